@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/stefrushxyz/prxy/clients/go/claude"
+)
+
+// batchRequest is a line of the input file. Lines may also be a bare Messages request.
+type batchRequest struct {
+	CustomID string                 `json:"custom_id"`
+	Params   *claude.MessageRequest `json:"params"`
+}
+
+// batchResult is a line of the output file
+type batchResult struct {
+	CustomID string       `json:"custom_id"`
+	Result   batchOutcome `json:"result"`
+}
+
+// batchOutcome is the response to a request, or the error that failed it
+type batchOutcome struct {
+	// Type is "succeeded" or "errored"
+	Type    string          `json:"type"`
+	Message *claude.Message `json:"message,omitempty"`
+	Error   *batchError     `json:"error,omitempty"`
+}
+
+// batchError describes a failed request
+type batchError struct {
+	Type       string `json:"type"`
+	Message    string `json:"message"`
+	StatusCode int    `json:"status_code,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+}
+
+// batchJob is a request to send, numbered by its position in the input
+type batchJob struct {
+	index    int
+	customID string
+	request  *claude.MessageRequest
+	// err is set if the input line could not be read as a request
+	err error
+}
+
+// batchDone is a finished job
+type batchDone struct {
+	index  int
+	result batchResult
+}
+
+// batchStats are the running totals shown in the progress line and summary
+type batchStats struct {
+	mu        sync.Mutex
+	skipped   int
+	succeeded int
+	errored   int
+	usage     claude.Usage
+	cost      float64
+}
+
+// runBatch sends the requests in a JSONL file and writes their results to a JSONL file in
+// input order. The output file is the checkpoint: running again with the same output file
+// resumes after the last result written.
+func runBatch(options []claude.Option, args []string) error {
+	fs := flag.NewFlagSet("batch", flag.ContinueOnError)
+	in := fs.String("in", "", "JSONL file of requests, each {\"custom_id\": ..., \"params\": {...}} or a bare request")
+	out := fs.String("out", "", "JSONL file to write results to, and resume from (default: <in>.results.jsonl)")
+	concurrency := fs.Int("concurrency", 4, "Requests to send at once")
+	retries := fs.Int("retries", 8, "Times to retry a request that is rate limited or fails temporarily")
+	model := fs.String("model", ClaudeModel, "Model for requests that do not name one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return errors.New("usage: batch -in requests.jsonl [-out results.jsonl]")
+	}
+	if *out == "" {
+		*out = *in + ".results.jsonl"
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	// Rate limited requests wait as long as the proxy's retry-after asks before retrying
+	client := claude.NewClient(append(options,
+		claude.WithMaxRetries(*retries), claude.WithModel(*model), claude.WithMaxTokens(MaxTokens))...)
+
+	input, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	done, err := resumeBatchOutput(*out)
+	if err != nil {
+		return err
+	}
+	output, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	if done > 0 {
+		fmt.Printf("Resuming after %d results already in %s\n", done, *out)
+	}
+
+	// Stop sending on Ctrl-C, keeping the results written so far for the next run
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stats := &batchStats{skipped: done}
+	jobs := make(chan batchJob)
+	results := make(chan batchDone)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		readErr <- readBatchInput(ctx, input, done, jobs)
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				result, ok := sendBatchJob(ctx, client, job, stats)
+				if !ok {
+					continue
+				}
+				results <- batchDone{index: job.index, result: result}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	writer := bufio.NewWriter(output)
+	pending := map[int]batchResult{}
+	next := done
+	var writeErr error
+	for finished := false; !finished; {
+		select {
+		case d, ok := <-results:
+			if !ok {
+				finished = true
+				break
+			}
+			pending[d.index] = d.result
+			// Write results in input order, so the output is always a prefix of the input
+			for result, ok := pending[next]; ok && writeErr == nil; result, ok = pending[next] {
+				delete(pending, next)
+				writeErr = writeBatchResult(writer, result)
+				next++
+			}
+			if writeErr != nil {
+				stop()
+			}
+		case <-ticker.C:
+			fmt.Fprintf(os.Stderr, "\r%s", stats.progress(time.Since(start)))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\r%s\n", stats.progress(time.Since(start)))
+
+	if writeErr != nil {
+		return fmt.Errorf("writing results: %w", writeErr)
+	}
+	if err := <-readErr; err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		fmt.Printf("Interrupted after %d results. Run again with the same -out to resume.\n", next)
+		return nil
+	}
+	fmt.Printf("Wrote %d results to %s\n", next, *out)
+	return nil
+}
+
+// resumeBatchOutput counts the complete results in an existing output file, dropping a
+// partly written last line
+func resumeBatchOutput(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if complete < len(data) {
+		if err := os.Truncate(path, int64(complete)); err != nil {
+			return 0, err
+		}
+	}
+	return bytes.Count(data[:complete], []byte("\n")), nil
+}
+
+// readBatchInput sends the requests in the input to jobs, skipping blank lines and the
+// first skip requests
+func readBatchInput(ctx context.Context, input io.Reader, skip int, jobs chan<- batchJob) error {
+	reader := bufio.NewReader(input)
+	index := 0
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if index >= skip {
+				job := parseBatchLine(line, lineNumber)
+				job.index = index
+				select {
+				case jobs <- job:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+			index++
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading requests: %w", err)
+		}
+	}
+}
+
+// parseBatchLine reads a request from a line of the input
+func parseBatchLine(line []byte, lineNumber int) batchJob {
+	job := batchJob{customID: fmt.Sprintf("line-%d", lineNumber)}
+	if !json.Valid(line) {
+		job.err = fmt.Errorf("line %d is not valid JSON", lineNumber)
+		return job
+	}
+	var wrapped batchRequest
+	if err := json.Unmarshal(line, &wrapped); err != nil {
+		job.err = fmt.Errorf("line %d is not a valid request: %w", lineNumber, err)
+		return job
+	}
+	if wrapped.CustomID != "" {
+		job.customID = wrapped.CustomID
+	}
+	job.request = wrapped.Params
+	if job.request == nil {
+		job.request = &claude.MessageRequest{}
+		if err := json.Unmarshal(line, job.request); err != nil {
+			job.err = fmt.Errorf("line %d is not a valid request: %w", lineNumber, err)
+		}
+	}
+	return job
+}
+
+// sendBatchJob sends a request and returns its result, or false if the batch was interrupted
+// before the request finished
+func sendBatchJob(ctx context.Context, client *claude.Client, job batchJob, stats *batchStats) (batchResult, bool) {
+	result := batchResult{CustomID: job.customID}
+	if job.err != nil {
+		result.Result = batchOutcome{Type: "errored", Error: &batchError{Type: claude.ErrInvalidRequest, Message: job.err.Error()}}
+		stats.record(nil)
+		return result, true
+	}
+
+	msg, err := client.CreateMessage(ctx, *job.request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return result, false
+		}
+		batchErr := &batchError{Type: claude.ErrAPI, Message: err.Error()}
+		var apiErr *claude.APIError
+		if errors.As(err, &apiErr) {
+			batchErr = &batchError{Type: apiErr.Type, Message: apiErr.Message, StatusCode: apiErr.StatusCode, RequestID: apiErr.RequestID}
+		}
+		result.Result = batchOutcome{Type: "errored", Error: batchErr}
+		stats.record(nil)
+		return result, true
+	}
+
+	result.Result = batchOutcome{Type: "succeeded", Message: msg}
+	stats.record(msg)
+	return result, true
+}
+
+// writeBatchResult writes a result as a line of the output and flushes it, so that an
+// interrupted batch only ever leaves complete lines behind
+func writeBatchResult(w *bufio.Writer, result batchResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	w.Write(data)
+	w.WriteByte('\n')
+	return w.Flush()
+}
+
+// record counts a finished request, with its message if it succeeded
+func (s *batchStats) record(msg *claude.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg == nil {
+		s.errored++
+		return
+	}
+	s.succeeded++
+	s.usage.Add(msg.Usage)
+	if dollars, ok := cost(msg.Model, msg.Usage); ok {
+		s.cost += dollars
+	}
+}
+
+// progress describes the batch so far
+func (s *batchStats) progress(elapsed time.Duration) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	line := fmt.Sprintf("%d succeeded, %d errored", s.succeeded, s.errored)
+	if s.skipped > 0 {
+		line += fmt.Sprintf(", %d resumed", s.skipped)
+	}
+	return line + fmt.Sprintf(" · %d input, %d output tokens · $%.4f · %s",
+		s.usage.InputTokens, s.usage.OutputTokens, s.cost, elapsed.Round(time.Second))
+}
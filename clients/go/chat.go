@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/stefrushxyz/prxy/clients/go/claude"
+)
+
+// modelPrice is the price of a model in US dollars per million tokens
+type modelPrice struct {
+	input  float64
+	output float64
+}
+
+// modelPrices are matched against model IDs by the longest prefix. Cache writes cost 1.25x
+// the input price and cache reads 0.1x.
+var modelPrices = map[string]modelPrice{
+	"claude-3-haiku":    {0.25, 1.25},
+	"claude-3-5-haiku":  {0.80, 4},
+	"claude-haiku-4-5":  {1, 5},
+	"claude-3-5-sonnet": {3, 15},
+	"claude-3-7-sonnet": {3, 15},
+	"claude-sonnet-4":   {3, 15},
+	"claude-3-opus":     {15, 75},
+	"claude-opus-4":     {15, 75},
+	"claude-opus-4-5":   {5, 25},
+}
+
+// cost estimates the price of a request in US dollars, or reports false if the model's price is unknown
+func cost(model string, usage claude.Usage) (float64, bool) {
+	var price modelPrice
+	longest := 0
+	for prefix, p := range modelPrices {
+		if strings.HasPrefix(model, prefix) && len(prefix) > longest {
+			price, longest = p, len(prefix)
+		}
+	}
+	if longest == 0 {
+		return 0, false
+	}
+
+	input := float64(usage.InputTokens) +
+		float64(usage.CacheCreationInputTokens)*1.25 +
+		float64(usage.CacheReadInputTokens)*0.1
+	return (input*price.input + float64(usage.OutputTokens)*price.output) / 1e6, true
+}
+
+// conversation is a chat, as saved to and loaded from a JSON file
+type conversation struct {
+	Model    string                `json:"model"`
+	System   string                `json:"system,omitempty"`
+	Messages []claude.MessageParam `json:"messages"`
+}
+
+// chat is the state of an interactive chat session
+type chat struct {
+	client *claude.Client
+	conversation
+	// Session totals across all turns
+	usage claude.Usage
+	cost  float64
+
+	bold   func(a ...interface{}) string
+	cyan   func(a ...interface{}) string
+	green  func(a ...interface{}) string
+	yellow func(a ...interface{}) string
+	faint  func(a ...interface{}) string
+}
+
+// runChat runs an interactive chat in the terminal until the user exits
+func runChat(client *claude.Client, args []string) error {
+	fs := flag.NewFlagSet("chat", flag.ContinueOnError)
+	model := fs.String("model", ClaudeModel, "Model to chat with")
+	system := fs.String("system", "", "System prompt")
+	load := fs.String("load", "", "Conversation file to continue")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c := &chat{
+		client:       client,
+		conversation: conversation{Model: *model, System: *system},
+		bold:         color.New(color.Bold).SprintFunc(),
+		cyan:         color.New(color.FgCyan).SprintFunc(),
+		green:        color.New(color.FgGreen).SprintFunc(),
+		yellow:       color.New(color.FgYellow).SprintFunc(),
+		faint:        color.New(color.Faint).SprintFunc(),
+	}
+	if *load != "" {
+		if err := c.load(*load); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Chatting with %s. Type /help for commands.\n", c.bold(c.Model))
+	fmt.Println()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		fmt.Print(c.green("You: "))
+		if !scanner.Scan() {
+			fmt.Println()
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "/") {
+			if c.command(line) {
+				return nil
+			}
+			continue
+		}
+		if err := c.turn(line); err != nil {
+			fmt.Printf("%s: %v\n", c.yellow("Error"), err)
+		}
+		fmt.Println()
+	}
+}
+
+// command runs a slash command, reporting whether the chat should exit
+func (c *chat) command(line string) bool {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch name {
+	case "/exit", "/quit":
+		return true
+	case "/help":
+		fmt.Println(`Commands:
+  /system [prompt]  Show or set the system prompt ("/system -" clears it)
+  /model [name]     Show or switch the model
+  /save <file>      Save the conversation to a JSON file
+  /load <file>      Load a conversation from a JSON file
+  /clear            Start a new conversation
+  /usage            Show the session's token usage and cost
+  /exit             Leave the chat`)
+	case "/system":
+		switch arg {
+		case "":
+			fmt.Printf("System prompt: %s\n", orNone(c.System))
+		case "-":
+			c.System = ""
+			fmt.Println("System prompt cleared")
+		default:
+			c.System = arg
+			fmt.Println("System prompt set")
+		}
+	case "/model":
+		if arg == "" {
+			fmt.Printf("Model: %s\n", c.Model)
+		} else {
+			c.Model = arg
+			fmt.Printf("Switched to %s\n", c.Model)
+		}
+	case "/save":
+		if arg == "" {
+			fmt.Println("Usage: /save <file>")
+		} else if err := c.save(arg); err != nil {
+			fmt.Printf("%s: %v\n", c.yellow("Error"), err)
+		} else {
+			fmt.Printf("Saved %d messages to %s\n", len(c.Messages), arg)
+		}
+	case "/load":
+		if arg == "" {
+			fmt.Println("Usage: /load <file>")
+		} else if err := c.load(arg); err != nil {
+			fmt.Printf("%s: %v\n", c.yellow("Error"), err)
+		} else {
+			fmt.Printf("Loaded %d messages from %s (model %s)\n", len(c.Messages), arg, c.Model)
+		}
+	case "/clear":
+		c.Messages = nil
+		fmt.Println("Started a new conversation")
+	case "/usage":
+		fmt.Println(c.usageLine(c.usage, c.cost, true))
+	default:
+		fmt.Printf("Unknown command %s. Type /help for commands.\n", name)
+	}
+	fmt.Println()
+	return false
+}
+
+// turn sends a user message with the conversation so far and streams the reply.
+// Ctrl-C stops the reply without leaving the chat.
+func (c *chat) turn(text string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// A copy, so that a failed turn leaves nothing behind in the history's backing array
+	messages := make([]claude.MessageParam, len(c.Messages), len(c.Messages)+2)
+	copy(messages, c.Messages)
+	req := claude.MessageRequest{
+		Model:     c.Model,
+		MaxTokens: MaxTokens,
+		Messages:  append(messages, claude.NewUserMessage(claude.TextBlock(text))),
+	}
+	if c.System != "" {
+		req.System = []claude.ContentBlock{claude.TextBlock(c.System)}
+	}
+
+	stream, err := c.client.StreamMessage(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	fmt.Print(c.cyan("Claude: "))
+	for stream.Next() {
+		event := stream.Event()
+		if event.Type == claude.EventContentBlockDelta && event.Delta != nil && event.Delta.Type == claude.DeltaText {
+			fmt.Print(event.Delta.Text)
+		}
+	}
+	fmt.Println()
+	if err := stream.Err(); err != nil {
+		if ctx.Err() != nil {
+			return errors.New("reply stopped, the turn was not added to the conversation")
+		}
+		return err
+	}
+
+	// Only completed turns become part of the history
+	msg := stream.Message()
+	c.Messages = append(req.Messages, msg.Param())
+
+	turnCost, priced := cost(msg.Model, msg.Usage)
+	c.cost += turnCost
+	c.usage.Add(msg.Usage)
+
+	fmt.Println(c.faint(c.usageLine(msg.Usage, turnCost, priced)))
+	return nil
+}
+
+// usageLine describes token usage and its cost
+func (c *chat) usageLine(usage claude.Usage, dollars float64, priced bool) string {
+	line := fmt.Sprintf("%d input, %d output tokens", usage.InputTokens, usage.OutputTokens)
+	if cached := usage.CacheCreationInputTokens + usage.CacheReadInputTokens; cached > 0 {
+		line += fmt.Sprintf(", %d cached", cached)
+	}
+	if priced {
+		line += fmt.Sprintf(" · $%.4f", dollars)
+	}
+	return line
+}
+
+// save writes the conversation to a JSON file
+func (c *chat) save(path string) error {
+	data, err := json.MarshalIndent(c.conversation, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// load replaces the conversation with one from a JSON file
+func (c *chat) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var loaded conversation
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	if loaded.Model == "" {
+		loaded.Model = c.Model
+	}
+	c.conversation = loaded
+	return nil
+}
+
+// orNone returns s, or "(none)" if it is empty
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
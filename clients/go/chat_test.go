@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stefrushxyz/prxy/clients/go/claude"
+)
+
+// newTestChat creates a chat with a stand-in API served by handler
+func newTestChat(t *testing.T, handler http.HandlerFunc) *chat {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	plain := func(a ...interface{}) string { return "" }
+	return &chat{
+		client:       claude.NewClient(claude.WithBaseURL(server.URL+"/"), claude.WithMaxRetries(0)),
+		conversation: conversation{Model: "claude-3-5-haiku-20241022"},
+		bold:         plain, cyan: plain, green: plain, yellow: plain, faint: plain,
+	}
+}
+
+func TestChatTurn(t *testing.T) {
+	fail := false
+	c := newTestChat(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"type":"error","error":{"type":"invalid_request_error","message":"bad"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range []string{
+			`{"type":"message_start","message":{"model":"claude-3-5-haiku-20241022","content":[],"usage":{"input_tokens":1000000}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			// A delta without its delta is skipped rather than crashing the chat
+			`{"type":"content_block_delta","index":0}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":1000000}}`,
+			`{"type":"message_stop"}`,
+		} {
+			io.WriteString(w, "data: "+event+"\n\n")
+		}
+	})
+
+	// History with room to grow, as after earlier turns
+	history := make([]claude.MessageParam, 1, 8)
+	history[0] = claude.NewUserMessage(claude.TextBlock("earlier"))
+	c.Messages = history
+
+	if err := c.turn("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Messages) != 3 || c.Messages[2].Role != claude.RoleAssistant {
+		t.Fatalf("history = %+v, want the earlier message, the prompt and the reply", c.Messages)
+	}
+	if math.Abs(c.cost-4.8) > 1e-9 || c.usage.OutputTokens != 1000000 {
+		t.Errorf("session cost $%v and usage %+v", c.cost, c.usage)
+	}
+
+	// A failed turn adds nothing to the history, even in the spare capacity of its backing array
+	fail = true
+	c.Messages = history
+	if err := c.turn("again"); err == nil {
+		t.Fatal("failed turn returned no error")
+	}
+	if len(c.Messages) != 1 || history[:2][1].Role != "" {
+		t.Errorf("failed turn changed the history: %+v", history[:2])
+	}
+}
+
+func TestCost(t *testing.T) {
+	usage := claude.Usage{InputTokens: 1000000, CacheReadInputTokens: 1000000, CacheCreationInputTokens: 1000000, OutputTokens: 1000000}
+	tests := []struct {
+		model  string
+		want   float64
+		priced bool
+	}{
+		{"claude-3-5-haiku-20241022", 0.80*2.35 + 4, true},
+		// The longest prefix wins over claude-opus-4
+		{"claude-opus-4-5-20251101", 5*2.35 + 25, true},
+		{"claude-opus-4-1-20250805", 15*2.35 + 75, true},
+		{"gpt-4o", 0, false},
+	}
+	for _, tt := range tests {
+		got, priced := cost(tt.model, usage)
+		if math.Abs(got-tt.want) > 1e-9 || priced != tt.priced {
+			t.Errorf("cost(%s) = %v, %v, want %v, %v", tt.model, got, priced, tt.want, tt.priced)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.json")
+	c := &chat{conversation: conversation{
+		Model:    "claude-x",
+		System:   "Be brief",
+		Messages: []claude.MessageParam{claude.NewUserMessage(claude.TextBlock("hi"))},
+	}}
+	if err := c.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &chat{conversation: conversation{Model: "default"}}
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Model != "claude-x" || loaded.System != "Be brief" || len(loaded.Messages) != 1 {
+		t.Errorf("loaded %+v", loaded.conversation)
+	}
+}
@@ -0,0 +1,220 @@
+// Package claude is a client for the Claude Messages API, served through PRXY or directly by Anthropic
+package claude
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default values if options are not set
+const (
+	DefaultBaseURL    = "http://localhost:3000"
+	DefaultMaxRetries = 2
+	DefaultMaxTokens  = 4096
+	anthropicVersion  = "2023-06-01"
+	maxRetryDelay     = 8 * time.Second
+	maxRetryAfter     = time.Minute
+)
+
+// Client sends requests to the Messages API. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	maxRetries int
+	header     http.Header
+	model      string
+	maxTokens  int
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithBaseURL sets the proxy or API base URL (default http://localhost:3000)
+func WithBaseURL(url string) Option {
+	return func(c *Client) { c.baseURL = strings.TrimSuffix(url, "/") }
+}
+
+// WithAPIKey sets the key sent in the x-api-key header
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithHTTPClient sets the HTTP client used to send requests (default http.DefaultClient)
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) { c.httpClient = client }
+}
+
+// WithMaxRetries sets how many times a failed request is retried (default 2). Connection
+// errors, rate limits, overloads and server errors are retried with exponential backoff, or
+// after the wait the response's Retry-After header asks for. Errors that ask for a wait of more
+// than a minute are returned instead.
+func WithMaxRetries(n int) Option {
+	return func(c *Client) { c.maxRetries = n }
+}
+
+// WithHeader adds a header to every request, e.g. anthropic-beta
+func WithHeader(name, value string) Option {
+	return func(c *Client) { c.header.Add(name, value) }
+}
+
+// WithModel sets the model used by requests that do not name one
+func WithModel(model string) Option {
+	return func(c *Client) { c.model = model }
+}
+
+// WithMaxTokens sets the max_tokens of requests that do not set it (default 4096)
+func WithMaxTokens(n int) Option {
+	return func(c *Client) { c.maxTokens = n }
+}
+
+// NewClient creates a client with the given options
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		baseURL:    DefaultBaseURL,
+		httpClient: http.DefaultClient,
+		maxRetries: DefaultMaxRetries,
+		header:     http.Header{},
+		maxTokens:  DefaultMaxTokens,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// CreateMessage sends a non-streaming Messages request and returns the model's response
+func (c *Client) CreateMessage(ctx context.Context, req MessageRequest) (*Message, error) {
+	req.Stream = false
+	c.applyDefaults(&req)
+	resp, err := c.post(ctx, "/v1/messages", req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	// A proxy that keeps the connection alive while waiting has already sent a 200 status
+	// when it reports a later failure
+	if msg.Type == "error" {
+		apiErr := decodeError(resp.StatusCode, resp.Header, data)
+		apiErr.StatusCode = streamErrorStatus(apiErr.Type, resp.StatusCode)
+		return nil, apiErr
+	}
+	return &msg, nil
+}
+
+// applyDefaults fills in the request's model and max_tokens from the client options
+func (c *Client) applyDefaults(req *MessageRequest) {
+	if req.Model == "" {
+		req.Model = c.model
+	}
+	if req.MaxTokens == 0 {
+		req.MaxTokens = c.maxTokens
+	}
+}
+
+// post sends a JSON request, retrying failures, and returns the successful response.
+// Error responses are returned as an *APIError.
+func (c *Client) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("encoding request: %w", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, path, payload)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		var retryAfter string
+		if err == nil {
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			retryAfter = resp.Header.Get("Retry-After")
+			apiErr := decodeError(resp.StatusCode, resp.Header, data)
+			if !apiErr.Retryable() {
+				return nil, apiErr
+			}
+			err = apiErr
+		} else if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt >= c.maxRetries {
+			return nil, err
+		}
+
+		// Waits asked for by Retry-After end early if the context is canceled, and the error is
+		// returned rather than waiting for longer than a minute
+		delay := retryDelay(attempt, retryAfter, time.Now())
+		if delay > maxRetryAfter {
+			return nil, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// send makes a single attempt at a request
+func (c *Client) send(ctx context.Context, path string, payload []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("anthropic-version", anthropicVersion)
+	if c.apiKey != "" {
+		req.Header.Set("x-api-key", c.apiKey)
+	}
+	return c.httpClient.Do(req)
+}
+
+// retryDelay is how long to wait before retrying, honoring a Retry-After header in seconds or
+// as an HTTP date
+func retryDelay(attempt int, retryAfter string, now time.Time) time.Duration {
+	if seconds, err := strconv.ParseInt(retryAfter, 10, 64); err == nil && seconds >= 0 {
+		if seconds > int64(math.MaxInt64/time.Second) {
+			return math.MaxInt64
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(retryAfter); err == nil {
+		if delay := at.Sub(now); delay > 0 {
+			return delay
+		}
+		return 0
+	}
+
+	delay := 500 * time.Millisecond << attempt
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	// Add up to 25% jitter so clients that failed together do not retry together
+	return delay + time.Duration(rand.Int63n(int64(delay)/4+1))
+}
@@ -0,0 +1,253 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient creates a client for a stand-in API served by handler
+func newTestClient(t *testing.T, handler http.HandlerFunc, opts ...Option) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return NewClient(append([]Option{WithBaseURL(server.URL + "/")}, opts...)...)
+}
+
+func TestCreateMessage(t *testing.T) {
+	var got MessageRequest
+	var header http.Header
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		io.WriteString(w, `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"Hello"},`+
+			`{"type":"tool_use","id":"t1","name":"lookup","input":{"q":"x"}},{"type":"text","text":" there"}],`+
+			`"stop_reason":"tool_use","usage":{"input_tokens":3,"output_tokens":4}}`)
+	}, WithAPIKey("client-key"), WithModel("claude-x"), WithHeader("anthropic-beta", "files-api"))
+
+	msg, err := client.CreateMessage(context.Background(), MessageRequest{
+		Messages: []MessageParam{NewUserMessage(TextBlock("hi"))},
+		Stream:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Model != "claude-x" || got.MaxTokens != DefaultMaxTokens || got.Stream {
+		t.Errorf("request = %+v, want the client's model and max_tokens, not streamed", got)
+	}
+	if header.Get("x-api-key") != "client-key" || header.Get("anthropic-version") != anthropicVersion || header.Get("anthropic-beta") != "files-api" {
+		t.Errorf("request headers = %v", header)
+	}
+	if msg.Text() != "Hello there" || msg.StopReason != StopToolUse || msg.Usage.OutputTokens != 4 {
+		t.Errorf("message = %+v", msg)
+	}
+	if uses := msg.ToolUses(); len(uses) != 1 || uses[0].Name != "lookup" || string(uses[0].Input) != `{"q":"x"}` {
+		t.Errorf("tool uses = %+v", uses)
+	}
+	if param := msg.Param(); param.Role != RoleAssistant || len(param.Content) != 3 {
+		t.Errorf("param = %+v", param)
+	}
+}
+
+func TestCreateMessageErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		errorType string
+		wantCode  int
+		requestID string
+		attempts  int32
+	}{
+		{
+			name:   "invalid request",
+			status: http.StatusBadRequest, body: `{"type":"error","error":{"type":"invalid_request_error","message":"bad"},"request_id":"req_body"}`,
+			errorType: ErrInvalidRequest, wantCode: http.StatusBadRequest, requestID: "req_body", attempts: 1,
+		},
+		{
+			name:   "not in the API format",
+			status: http.StatusBadGateway, body: `upstream connect error`,
+			errorType: ErrAPI, wantCode: http.StatusBadGateway, requestID: "req_header", attempts: 3,
+		},
+		{
+			name:   "overloaded",
+			status: 529, body: `{"type":"error","error":{"type":"overloaded_error","message":"busy"}}`,
+			errorType: ErrOverloaded, wantCode: 529, requestID: "req_header", attempts: 3,
+		},
+		{
+			// A proxy that sent keep-alives reports later failures with a 200 status
+			name:   "error after keep-alives",
+			status: http.StatusOK, body: "  \n" + `{"type":"error","error":{"type":"overloaded_error","message":"busy"}}`,
+			errorType: ErrOverloaded, wantCode: 529, requestID: "req_header", attempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				w.Header().Set("Request-Id", "req_header")
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			})
+			_, err := client.CreateMessage(context.Background(), MessageRequest{Model: "m", Messages: []MessageParam{NewUserMessage(TextBlock("hi"))}})
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("error = %v, want an *APIError", err)
+			}
+			if apiErr.Type != tt.errorType || apiErr.StatusCode != tt.wantCode || apiErr.RequestID != tt.requestID {
+				t.Errorf("error = %+v", apiErr)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestRetriesUntilSuccess(t *testing.T) {
+	var attempts int32
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, `{"type":"message","content":[{"type":"text","text":"ok"}]}`)
+	})
+	msg, err := client.CreateMessage(context.Background(), MessageRequest{Model: "m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text() != "ok" || attempts != 3 {
+		t.Errorf("text %q after %d attempts", msg.Text(), attempts)
+	}
+
+	// Without retries the first failure is returned
+	attempts = 0
+	client = newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, WithMaxRetries(0))
+	if _, err := client.CreateMessage(context.Background(), MessageRequest{Model: "m"}); err == nil || attempts != 1 {
+		t.Errorf("error %v after %d attempts, want one failed attempt", err, attempts)
+	}
+
+	// Errors that ask for a wait of more than a minute are returned without waiting
+	attempts = 0
+	client = newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	var apiErr *APIError
+	if _, err := client.CreateMessage(context.Background(), MessageRequest{Model: "m"}); !errors.As(err, &apiErr) || apiErr.StatusCode != 429 || attempts != 1 {
+		t.Errorf("error %v after %d attempts, want the rate limit error after one attempt", err, attempts)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		retryAfter string
+		attempt    int
+		min, max   time.Duration
+	}{
+		{"0", 0, 0, 0},
+		{"30", 0, 30 * time.Second, 30 * time.Second},
+		// Long waits are not replaced by the backoff, and the caller decides whether to wait
+		{"3600", 0, time.Hour, time.Hour},
+		{"99999999999999999", 0, math.MaxInt64, math.MaxInt64},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 0, 90 * time.Second, 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, 0, 0},
+		// Without a usable Retry-After the backoff doubles up to its limit, plus jitter
+		{"", 0, 500 * time.Millisecond, 625 * time.Millisecond},
+		{"-5", 2, 2 * time.Second, 2500 * time.Millisecond},
+		{"soon", 10, maxRetryDelay, maxRetryDelay * 5 / 4},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempt, tt.retryAfter, now); got < tt.min || got > tt.max {
+			t.Errorf("retryDelay(%d, %q) = %v, want %v to %v", tt.attempt, tt.retryAfter, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRetryWaitCanceled(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.CreateMessage(ctx, MessageRequest{Model: "m"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want the context's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("canceled request returned after %v", elapsed)
+	}
+}
+
+func TestAPIErrorRetryable(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusNotFound, false},
+		{http.StatusRequestTimeout, true},
+		{http.StatusConflict, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{529, true},
+	}
+	for _, tt := range tests {
+		if got := (&APIError{StatusCode: tt.status}).Retryable(); got != tt.want {
+			t.Errorf("Retryable() for %d = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestBlocksUnmarshal(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{`"hello"`, "hello"},
+		{`[{"type":"text","text":"a"},{"type":"text","text":"b"}]`, "ab"},
+	}
+	for _, tt := range tests {
+		var param MessageParam
+		if err := json.Unmarshal([]byte(`{"role":"user","content":`+tt.data+`}`), &param); err != nil {
+			t.Fatal(err)
+		}
+		msg := Message{Content: param.Content}
+		if msg.Text() != tt.want {
+			t.Errorf("content %s decoded to %+v", tt.data, param.Content)
+		}
+	}
+	var blocks Blocks
+	if err := json.Unmarshal([]byte(`42`), &blocks); err == nil {
+		t.Error("a number decoded as content blocks")
+	}
+
+	// Tool results encode their content as a JSON string
+	encoded, _ := json.Marshal(ToolResultBlock("t1", `say "hi"`, true))
+	if string(encoded) != `{"type":"tool_result","tool_use_id":"t1","content":"say \"hi\"","is_error":true}` {
+		t.Errorf("tool result = %s", encoded)
+	}
+}
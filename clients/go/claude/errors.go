@@ -0,0 +1,78 @@
+package claude
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Error types returned by the API
+const (
+	ErrInvalidRequest  = "invalid_request_error"
+	ErrAuthentication  = "authentication_error"
+	ErrPermission      = "permission_error"
+	ErrNotFound        = "not_found_error"
+	ErrRequestTooLarge = "request_too_large"
+	ErrRateLimit       = "rate_limit_error"
+	ErrAPI             = "api_error"
+	ErrOverloaded      = "overloaded_error"
+	ErrTimeout         = "timeout_error"
+)
+
+// APIError is an error response from the proxy or the Claude API
+type APIError struct {
+	StatusCode int
+	Type       string
+	Message    string
+	// RequestID identifies the request in the proxy and upstream logs
+	RequestID string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Type, e.StatusCode, e.Message)
+}
+
+// Retryable reports whether the request may succeed if sent again
+func (e *APIError) Retryable() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// errorResponse is the Anthropic API error body
+type errorResponse struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+	RequestID string `json:"request_id"`
+}
+
+// decodeError builds an APIError from an error response body, falling back to the raw
+// body for responses that are not in the Anthropic format
+func decodeError(status int, header http.Header, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: status, RequestID: header.Get("Request-Id")}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = header.Get("X-Request-Id")
+	}
+
+	var resp errorResponse
+	if err := json.Unmarshal(body, &resp); err == nil && resp.Error.Type != "" {
+		apiErr.Type = resp.Error.Type
+		apiErr.Message = resp.Error.Message
+		if resp.RequestID != "" {
+			apiErr.RequestID = resp.RequestID
+		}
+		return apiErr
+	}
+
+	apiErr.Type = ErrAPI
+	apiErr.Message = string(body)
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(status)
+	}
+	return apiErr
+}
@@ -0,0 +1,110 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Extraction defaults
+const (
+	DefaultExtractAttempts = 3
+	extractToolName        = "record_result"
+)
+
+// ValidationError is returned when the model's output still does not match the target
+// type's schema after every attempt
+type ValidationError struct {
+	// Problems are the mismatches in the last attempt
+	Problems []string
+	Attempts int
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("extracted data does not match the schema after %d attempts: %s",
+		e.Attempts, strings.Join(e.Problems, "; "))
+}
+
+// Extract asks the model to extract data from a prompt into target, which must be a pointer
+// to a struct or map. See ExtractMessage.
+func (c *Client) Extract(ctx context.Context, prompt string, target interface{}) error {
+	return c.ExtractMessage(ctx, MessageRequest{
+		Messages: []MessageParam{NewUserMessage(TextBlock(prompt))},
+	}, target)
+}
+
+// ExtractMessage sends a request that makes the model answer with data matching target's
+// type, and decodes the answer into target. The schema is derived from the type with
+// SchemaFor and the model is made to call a tool with it as the input schema. Input that
+// does not match the schema is sent back to the model with the problems found, up to
+// DefaultExtractAttempts attempts in all, after which a *ValidationError is returned.
+func (c *Client) ExtractMessage(ctx context.Context, req MessageRequest, target interface{}) error {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Pointer || value.IsNil() {
+		return errors.New("extract target must be a non-nil pointer")
+	}
+	schema := SchemaFor(target)
+	if schema["type"] != "object" {
+		return fmt.Errorf("extract target must be a struct or map, not %s", value.Elem().Type())
+	}
+
+	req.Tools = append(append([]Tool(nil), req.Tools...), Tool{
+		Name:        extractToolName,
+		Description: "Record the result. Call this exactly once, with input that matches the schema.",
+		InputSchema: schema,
+	})
+	req.ToolChoice = &ToolChoice{Type: "tool", Name: extractToolName}
+	req.Messages = append([]MessageParam(nil), req.Messages...)
+
+	var problems []string
+	for attempt := 1; attempt <= DefaultExtractAttempts; attempt++ {
+		msg, err := c.CreateMessage(ctx, req)
+		if err != nil {
+			return err
+		}
+		if msg.StopReason == StopMaxTokens {
+			return errors.New("extraction stopped at max_tokens before the result was complete")
+		}
+
+		var use *ContentBlock
+		for _, block := range msg.ToolUses() {
+			if block.Name == extractToolName {
+				use = &block
+				break
+			}
+		}
+		if use == nil {
+			return fmt.Errorf("model did not call the %s tool (stop reason %s)", extractToolName, msg.StopReason)
+		}
+
+		problems = checkExtracted(use.Input, schema, target)
+		if len(problems) == 0 {
+			return nil
+		}
+
+		// Send the problems back so the model can correct its input
+		req.Messages = append(req.Messages, msg.Param(), NewUserMessage(ToolResultBlock(use.ID,
+			"The input does not match the schema:\n- "+strings.Join(problems, "\n- ")+
+				"\nCall "+extractToolName+" again with corrected input.", true)))
+	}
+	return &ValidationError{Problems: problems, Attempts: DefaultExtractAttempts}
+}
+
+// checkExtracted validates the model's input against the schema and decodes it into target,
+// returning the problems found
+func checkExtracted(input json.RawMessage, schema map[string]interface{}, target interface{}) []string {
+	var decoded interface{}
+	if err := json.Unmarshal(input, &decoded); err != nil {
+		return []string{"input is not valid JSON: " + err.Error()}
+	}
+	if problems := validateSchema(decoded, schema, "input"); len(problems) > 0 {
+		return problems
+	}
+	if err := json.Unmarshal(input, target); err != nil {
+		return []string{err.Error()}
+	}
+	return nil
+}
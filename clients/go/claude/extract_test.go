@@ -0,0 +1,124 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type invoice struct {
+	Number string  `json:"number"`
+	Total  float64 `json:"total"`
+}
+
+// extractReply is a response that calls the extraction tool with input
+func extractReply(input string) string {
+	return toolUseReply([3]string{"call", extractToolName, input})
+}
+
+func TestExtract(t *testing.T) {
+	var requests []MessageRequest
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var req MessageRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+		if len(requests) == 1 {
+			io.WriteString(w, extractReply(`{"number":"A-1","total":"12.50"}`))
+			return
+		}
+		io.WriteString(w, extractReply(`{"number":"A-1","total":12.5}`))
+	})
+
+	var got invoice
+	if err := client.Extract(context.Background(), "Invoice A-1 for $12.50", &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != (invoice{Number: "A-1", Total: 12.5}) {
+		t.Errorf("extracted %+v", got)
+	}
+
+	req := requests[0]
+	if req.ToolChoice == nil || req.ToolChoice.Name != extractToolName || len(req.Tools) != 1 || req.Tools[0].Name != extractToolName {
+		t.Errorf("first request forces tools %+v with %+v", req.Tools, req.ToolChoice)
+	}
+	// The retry carries the rejected call and the problems found in it
+	retry := requests[1].Messages
+	if len(requests) != 2 || len(retry) != 3 {
+		t.Fatalf("%d requests, the retry with %d messages", len(requests), len(retry))
+	}
+	if result := retry[2].Content[0]; !result.IsError || result.ToolUseID != "call" || !strings.Contains(string(result.Content), "input.total must be a number") {
+		t.Errorf("retry result = %+v", result)
+	}
+}
+
+func TestExtractErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  string
+		target interface{}
+		want   string
+	}{
+		{
+			name:   "not a pointer",
+			target: invoice{},
+			want:   "non-nil pointer",
+		},
+		{
+			name:   "not an object",
+			target: new([]string),
+			want:   "must be a struct or map",
+		},
+		{
+			name:   "no tool call",
+			reply:  `{"type":"message","content":[{"type":"text","text":"No."}],"stop_reason":"end_turn"}`,
+			target: &invoice{},
+			want:   "did not call the record_result tool",
+		},
+		{
+			name:   "max tokens",
+			reply:  `{"type":"message","content":[],"stop_reason":"max_tokens"}`,
+			target: &invoice{},
+			want:   "max_tokens",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, tt.reply)
+			})
+			err := client.Extract(context.Background(), "prompt", tt.target)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractValidationError(t *testing.T) {
+	var requests int
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		io.WriteString(w, extractReply(`{"number":1}`))
+	})
+
+	var got invoice
+	err := client.Extract(context.Background(), "prompt", &got)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("error = %v, want a *ValidationError", err)
+	}
+	if requests != DefaultExtractAttempts || validationErr.Attempts != DefaultExtractAttempts {
+		t.Errorf("%d requests and %d attempts reported, want %d", requests, validationErr.Attempts, DefaultExtractAttempts)
+	}
+	want := []string{"input.total is required", "input.number must be a string"}
+	if strings.Join(validationErr.Problems, "\n") != strings.Join(want, "\n") {
+		t.Errorf("problems = %q, want %q", validationErr.Problems, want)
+	}
+	if got != (invoice{}) {
+		t.Errorf("target was filled in with invalid data: %+v", got)
+	}
+}
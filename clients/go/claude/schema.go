@@ -0,0 +1,233 @@
+package claude
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SchemaFor returns a JSON schema for the type of v, for use as a tool input schema.
+//
+// Struct fields are named by their json tags, and are required unless tagged omitempty or
+// pointers. A description tag describes a field to the model, and an enum tag lists its
+// allowed values separated by commas:
+//
+//	type WeatherInput struct {
+//		City  string `json:"city" description:"City name, e.g. Paris"`
+//		Units string `json:"units,omitempty" enum:"celsius,fahrenheit"`
+//	}
+func SchemaFor(v interface{}) map[string]interface{} {
+	return schemaForType(reflect.TypeOf(v), map[reflect.Type]bool{})
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaForType builds the schema of a type. Recursive types are described as plain objects
+// where they refer to themselves.
+func schemaForType(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// Byte slices are encoded as base64 strings
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaForType(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaForType(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		return structSchema(t, seen)
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema builds the object schema of a struct from its exported fields
+func structSchema(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		embedded := field.Type
+		if embedded.Kind() == reflect.Pointer {
+			embedded = embedded.Elem()
+		}
+		// Fields of embedded structs are encoded even if the struct type is unexported
+		if !field.IsExported() && !(field.Anonymous && embedded.Kind() == reflect.Struct) {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			// Embedded structs without a name have their fields promoted, as in encoding/json
+			if field.Anonymous && embedded.Kind() == reflect.Struct {
+				promoted := structSchema(embedded, seen)
+				for key, value := range promoted["properties"].(map[string]interface{}) {
+					properties[key] = value
+				}
+				required = append(required, promoted["required"].([]string)...)
+				continue
+			}
+			name = field.Name
+		}
+
+		schema := schemaForType(field.Type, seen)
+		if description := field.Tag.Get("description"); description != "" {
+			schema["description"] = description
+		}
+		if enum := field.Tag.Get("enum"); enum != "" {
+			var values []interface{}
+			for _, value := range strings.Split(enum, ",") {
+				values = append(values, strings.TrimSpace(value))
+			}
+			schema["enum"] = values
+		}
+		properties[name] = schema
+
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// validateSchema checks a decoded JSON value against a schema from SchemaFor and returns the
+// problems found, each naming the path of the value
+func validateSchema(value interface{}, schema map[string]interface{}, path string) []string {
+	if enum, ok := schema["enum"].([]interface{}); ok && !inEnum(value, enum) {
+		return []string{fmt.Sprintf("%s must be one of %v", path, enum)}
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s must be an object", path)}
+		}
+		return validateObject(object, schema, path)
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s must be an array", path)}
+		}
+		var problems []string
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range array {
+				problems = append(problems, validateSchema(item, items, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+		return problems
+	case "string":
+		if _, ok := value.(string); !ok {
+			return []string{fmt.Sprintf("%s must be a string", path)}
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			return []string{fmt.Sprintf("%s must be an integer", path)}
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return []string{fmt.Sprintf("%s must be a number", path)}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("%s must be a boolean", path)}
+		}
+	}
+	return nil
+}
+
+// validateObject checks the properties of an object
+func validateObject(object, schema map[string]interface{}, path string) []string {
+	var problems []string
+	properties, _ := schema["properties"].(map[string]interface{})
+	required := map[string]bool{}
+	if names, ok := schema["required"].([]string); ok {
+		for _, name := range names {
+			required[name] = true
+			if _, ok := object[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s is required", path, name))
+			}
+		}
+	}
+
+	// Check properties in a stable order so that repeated attempts report the same problems
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := object[name]
+		property, ok := properties[name].(map[string]interface{})
+		if !ok {
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					problems = append(problems, fmt.Sprintf("%s.%s is not allowed", path, name))
+				}
+			case map[string]interface{}:
+				problems = append(problems, validateSchema(value, additional, path+"."+name)...)
+			}
+			continue
+		}
+		// Optional properties may be null, which decodes as the zero value
+		if value == nil && !required[name] {
+			continue
+		}
+		problems = append(problems, validateSchema(value, property, path+"."+name)...)
+	}
+	return problems
+}
+
+// inEnum reports whether a value is one of the allowed values
+func inEnum(value interface{}, enum []interface{}) bool {
+	for _, allowed := range enum {
+		if fmt.Sprint(value) == fmt.Sprint(allowed) {
+			return true
+		}
+	}
+	return false
+}
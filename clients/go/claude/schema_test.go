@@ -0,0 +1,100 @@
+package claude
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type schemaAddress struct {
+	Street string `json:"street"`
+}
+
+type schemaNode struct {
+	Name     string        `json:"name"`
+	Children []*schemaNode `json:"children,omitempty"`
+}
+
+type schemaInput struct {
+	schemaAddress
+	City     string          `json:"city" description:"City name"`
+	Units    string          `json:"units,omitempty" enum:"celsius, fahrenheit"`
+	Days     int             `json:"days"`
+	Score    *float64        `json:"score"`
+	Tags     []string        `json:"tags"`
+	Labels   map[string]int  `json:"labels,omitempty"`
+	Data     []byte          `json:"data,omitempty"`
+	At       time.Time       `json:"at,omitempty"`
+	Extra    json.RawMessage `json:"extra,omitempty"`
+	Tree     schemaNode      `json:"tree,omitempty"`
+	Untagged bool
+	Skipped  string `json:"-"`
+	hidden   string
+}
+
+func TestSchemaFor(t *testing.T) {
+	got, _ := json.Marshal(SchemaFor(&schemaInput{}))
+	want := `{"additionalProperties":false,"properties":{` +
+		`"Untagged":{"type":"boolean"},` +
+		`"at":{"format":"date-time","type":"string"},` +
+		`"city":{"description":"City name","type":"string"},` +
+		`"data":{"contentEncoding":"base64","type":"string"},` +
+		`"days":{"type":"integer"},` +
+		`"extra":{},` +
+		`"labels":{"additionalProperties":{"type":"integer"},"type":"object"},` +
+		`"score":{"type":"number"},` +
+		`"street":{"type":"string"},` +
+		`"tags":{"items":{"type":"string"},"type":"array"},` +
+		`"tree":{"additionalProperties":false,"properties":{` +
+		`"children":{"items":{"type":"object"},"type":"array"},` +
+		`"name":{"type":"string"}},"required":["name"],"type":"object"},` +
+		`"units":{"enum":["celsius","fahrenheit"],"type":"string"}},` +
+		`"required":["street","city","days","tags","Untagged"],"type":"object"}`
+	if string(got) != want {
+		t.Errorf("SchemaFor() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	schema := SchemaFor(schemaInput{})
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{
+			input: `{"street":"Main","city":"Paris","days":3,"tags":[],"Untagged":true,"score":null,"units":"celsius"}`,
+		},
+		{
+			input: `{"city":"Paris","days":2.5,"tags":["a",1],"Untagged":"yes","units":"kelvin","labels":{"a":"b"},"unknown":1}`,
+			want: []string{
+				"input.street is required",
+				"input.Untagged must be a boolean",
+				"input.days must be an integer",
+				"input.labels.a must be an integer",
+				"input.tags[1] must be a string",
+				"input.units must be one of [celsius fahrenheit]",
+				"input.unknown is not allowed",
+			},
+		},
+		{
+			input: `{"street":"Main","city":"Paris","days":3,"tags":null,"Untagged":false,"tree":{"children":[{}]}}`,
+			want:  []string{"input.tags must be an array", "input.tree.name is required"},
+		},
+		{
+			input: `[]`,
+			want:  []string{"input must be an object"},
+		},
+	}
+	for _, tt := range tests {
+		var value interface{}
+		if err := json.Unmarshal([]byte(tt.input), &value); err != nil {
+			t.Fatal(err)
+		}
+		got := validateSchema(value, schema, "input")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("validateSchema(%s) =\n%s\nwant\n%s", tt.input, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package claude
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Stream event types
+const (
+	EventMessageStart      = "message_start"
+	EventMessageDelta      = "message_delta"
+	EventMessageStop       = "message_stop"
+	EventContentBlockStart = "content_block_start"
+	EventContentBlockDelta = "content_block_delta"
+	EventContentBlockStop  = "content_block_stop"
+	EventPing              = "ping"
+	EventError             = "error"
+)
+
+// Content block delta types
+const (
+	DeltaText      = "text_delta"
+	DeltaInputJSON = "input_json_delta"
+	DeltaThinking  = "thinking_delta"
+	DeltaSignature = "signature_delta"
+	DeltaCitations = "citations_delta"
+)
+
+// Event is a server-sent event from a streaming Messages request. Type decides which of the
+// other fields are set.
+type Event struct {
+	Type string `json:"type"`
+
+	// Message is the message so far, set for message_start
+	Message *Message `json:"message,omitempty"`
+
+	// Index is the content block the event applies to
+	Index int `json:"index"`
+	// ContentBlock is the new block, set for content_block_start
+	ContentBlock *ContentBlock `json:"content_block,omitempty"`
+
+	// Delta is set for content_block_delta and message_delta
+	Delta *Delta `json:"delta,omitempty"`
+	// Usage is the cumulative usage, set for message_delta
+	Usage *Usage `json:"usage,omitempty"`
+
+	// Error is set for error events
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// Delta is a change to a content block or to the message
+type Delta struct {
+	// Type is the content block delta type, or empty for message_delta
+	Type        string          `json:"type,omitempty"`
+	Text        string          `json:"text,omitempty"`
+	PartialJSON string          `json:"partial_json,omitempty"`
+	Thinking    string          `json:"thinking,omitempty"`
+	Signature   string          `json:"signature,omitempty"`
+	Citation    json.RawMessage `json:"citation,omitempty"`
+
+	// StopReason and StopSequence are set for message_delta
+	StopReason   StopReason `json:"stop_reason,omitempty"`
+	StopSequence *string    `json:"stop_sequence,omitempty"`
+}
+
+// Stream reads the events of a streaming Messages request and builds the final message from them
+type Stream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+	status int
+	// requestID is the response's request ID, reported on error events
+	requestID string
+	event     Event
+	message   Message
+	// partialJSON collects the input of tool use blocks by index until the block stops
+	partialJSON map[int]*strings.Builder
+	stopped     bool
+	err         error
+}
+
+// StreamMessage sends a streaming Messages request. Call Next to read events, and Close when done.
+//
+//	stream, err := client.StreamMessage(ctx, req)
+//	if err != nil { ... }
+//	defer stream.Close()
+//	for stream.Next() {
+//		event := stream.Event()
+//		...
+//	}
+//	if err := stream.Err(); err != nil { ... }
+//	msg := stream.Message()
+func (c *Client) StreamMessage(ctx context.Context, req MessageRequest) (*Stream, error) {
+	req.Stream = true
+	c.applyDefaults(&req)
+	resp, err := c.post(ctx, "/v1/messages", req)
+	if err != nil {
+		return nil, err
+	}
+	return newStream(resp), nil
+}
+
+// newStream reads events from a successful streaming response
+func newStream(resp *http.Response) *Stream {
+	return &Stream{
+		body:        resp.Body,
+		reader:      bufio.NewReader(resp.Body),
+		status:      resp.StatusCode,
+		requestID:   decodeError(resp.StatusCode, resp.Header, nil).RequestID,
+		partialJSON: map[int]*strings.Builder{},
+	}
+}
+
+// Next reads the next event and applies it to the message. It returns false at the end of
+// the stream or on an error, which Err then returns.
+func (s *Stream) Next() bool {
+	if s.err != nil || s.stopped {
+		return false
+	}
+
+	data, err := s.readEvent()
+	if err == io.EOF {
+		s.err = fmt.Errorf("stream ended before %s: %w", EventMessageStop, io.ErrUnexpectedEOF)
+		return false
+	}
+	if err != nil {
+		s.err = err
+		return false
+	}
+
+	s.event = Event{}
+	if err := json.Unmarshal(data, &s.event); err != nil {
+		s.err = fmt.Errorf("decoding event: %w", err)
+		return false
+	}
+	if err := s.apply(&s.event); err != nil {
+		s.err = err
+		return false
+	}
+	return true
+}
+
+// Event returns the event read by the last call to Next
+func (s *Stream) Event() Event {
+	return s.event
+}
+
+// Message returns the message built from the events read so far. After Next returns false
+// with no error, it is the complete message.
+func (s *Stream) Message() *Message {
+	return &s.message
+}
+
+// Err returns the error that ended the stream, or nil if it completed. Error events are
+// returned as an *APIError.
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// Close closes the response body. It is safe to call before the stream is finished.
+func (s *Stream) Close() error {
+	return s.body.Close()
+}
+
+// readEvent reads the data of the next server-sent event. Event names are not needed since
+// every payload carries its type, and comments and keep-alive lines are skipped.
+func (s *Stream) readEvent() ([]byte, error) {
+	var data []byte
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err == io.EOF && len(data) > 0 {
+				return data, nil
+			}
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" || strings.TrimSpace(line) == "" {
+			if len(data) > 0 {
+				return data, nil
+			}
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(value, " ")...)
+		}
+	}
+}
+
+// apply updates the message with an event
+func (s *Stream) apply(event *Event) error {
+	switch event.Type {
+	case EventMessageStart:
+		if event.Message != nil {
+			s.message = *event.Message
+		}
+
+	case EventContentBlockStart:
+		// Blocks start in order, so a start is for the next block or one already started
+		if event.Index < 0 || event.Index > len(s.message.Content) {
+			return fmt.Errorf("%s for block %d of a message with %d blocks", event.Type, event.Index, len(s.message.Content))
+		}
+		if event.ContentBlock == nil {
+			return nil
+		}
+		if event.Index == len(s.message.Content) {
+			s.message.Content = append(s.message.Content, ContentBlock{})
+		}
+		s.message.Content[event.Index] = *event.ContentBlock
+
+	case EventContentBlockDelta:
+		if event.Index < 0 || event.Index >= len(s.message.Content) {
+			return fmt.Errorf("%s for block %d of a message with %d blocks", event.Type, event.Index, len(s.message.Content))
+		}
+		if event.Delta == nil {
+			return nil
+		}
+		block := &s.message.Content[event.Index]
+		switch event.Delta.Type {
+		case DeltaText:
+			block.Text += event.Delta.Text
+		case DeltaThinking:
+			block.Thinking += event.Delta.Thinking
+		case DeltaSignature:
+			block.Signature = event.Delta.Signature
+		case DeltaCitations:
+			if len(event.Delta.Citation) > 0 {
+				block.Citations = append(block.Citations, event.Delta.Citation)
+			}
+		case DeltaInputJSON:
+			partial := s.partialJSON[event.Index]
+			if partial == nil {
+				partial = &strings.Builder{}
+				s.partialJSON[event.Index] = partial
+			}
+			partial.WriteString(event.Delta.PartialJSON)
+		}
+
+	case EventContentBlockStop:
+		// Tool input arrives as fragments of JSON that are only valid once the block is complete
+		if partial := s.partialJSON[event.Index]; partial != nil && event.Index < len(s.message.Content) {
+			if partial.Len() > 0 {
+				s.message.Content[event.Index].Input = json.RawMessage(partial.String())
+			}
+			delete(s.partialJSON, event.Index)
+		}
+
+	case EventMessageDelta:
+		if event.Delta != nil {
+			s.message.StopReason = event.Delta.StopReason
+			s.message.StopSequence = event.Delta.StopSequence
+		}
+		if event.Usage != nil {
+			s.message.Usage.merge(*event.Usage)
+		}
+
+	case EventMessageStop:
+		s.stopped = true
+
+	case EventError:
+		apiErr := &APIError{StatusCode: s.status, Type: ErrAPI, Message: "stream error", RequestID: s.requestID}
+		if event.Error != nil {
+			apiErr.Type, apiErr.Message = event.Error.Type, event.Error.Message
+			apiErr.StatusCode = streamErrorStatus(event.Error.Type, s.status)
+		}
+		return apiErr
+	}
+	return nil
+}
+
+// merge updates the usage with the non-zero counts of a later usage report
+func (u *Usage) merge(other Usage) {
+	if other.InputTokens != 0 {
+		u.InputTokens = other.InputTokens
+	}
+	if other.OutputTokens != 0 {
+		u.OutputTokens = other.OutputTokens
+	}
+	if other.CacheCreationInputTokens != 0 {
+		u.CacheCreationInputTokens = other.CacheCreationInputTokens
+	}
+	if other.CacheReadInputTokens != 0 {
+		u.CacheReadInputTokens = other.CacheReadInputTokens
+	}
+}
+
+// streamErrorStatus is the status an error event would have had as an error response, so that
+// APIError.Retryable works the same for errors that arrive after a stream has started
+func streamErrorStatus(errorType string, def int) int {
+	switch errorType {
+	case ErrRateLimit:
+		return http.StatusTooManyRequests
+	case ErrOverloaded:
+		return 529
+	case ErrAPI:
+		return http.StatusInternalServerError
+	case ErrTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return def
+}
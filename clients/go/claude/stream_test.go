@@ -0,0 +1,146 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// sse formats event payloads as a server-sent event stream
+func sse(events ...string) string {
+	var b strings.Builder
+	for _, event := range events {
+		b.WriteString("event: x\ndata: " + event + "\n\n")
+	}
+	return b.String()
+}
+
+// streamOf starts a stream of the given response body
+func streamOf(t *testing.T, body string) *Stream {
+	t.Helper()
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Request-Id", "req_stream")
+		io.WriteString(w, body)
+	})
+	stream, err := client.StreamMessage(context.Background(), MessageRequest{Model: "m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stream.Close() })
+	return stream
+}
+
+func TestStreamMessage(t *testing.T) {
+	stream := streamOf(t, ": keep-alive\n\n"+sse(
+		`{"type":"message_start","message":{"id":"msg_1","role":"assistant","content":[],"usage":{"input_tokens":10,"output_tokens":1}}}`,
+		`{"type":"ping"}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"lo"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"citations_delta","citation":{"type":"char_location","cited_text":"Hello","document_index":0}}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"t1","name":"lookup","input":{}}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"q\":"}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"x\"}"}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":25}}`,
+		`{"type":"message_stop"}`,
+	)+sse(`{"type":"ping"}`))
+
+	var types []string
+	for stream.Next() {
+		types = append(types, stream.Event().Type)
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// Events after message_stop are not read
+	if len(types) != 13 || types[len(types)-1] != EventMessageStop {
+		t.Errorf("events = %v", types)
+	}
+
+	msg := stream.Message()
+	if msg.ID != "msg_1" || msg.Text() != "Hello" || msg.StopReason != StopToolUse {
+		t.Errorf("message = %+v", msg)
+	}
+	if msg.Usage.InputTokens != 10 || msg.Usage.OutputTokens != 25 {
+		t.Errorf("usage = %+v, want the input tokens from the start and output tokens from the delta", msg.Usage)
+	}
+	if citations := msg.Content[0].Citations; len(citations) != 1 || !strings.Contains(string(citations[0]), `"cited_text":"Hello"`) {
+		t.Errorf("citations = %s", citations)
+	}
+	if uses := msg.ToolUses(); len(uses) != 1 || string(uses[0].Input) != `{"q":"x"}` {
+		t.Errorf("tool uses = %+v", uses)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	start := `{"type":"message_start","message":{"content":[]}}`
+	textStart := `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "ends before message_stop",
+			body: sse(start, textStart),
+			want: "stream ended before message_stop",
+		},
+		{
+			name: "not JSON",
+			body: sse(start, `{"type":`),
+			want: "decoding event",
+		},
+		{
+			name: "negative start index",
+			body: sse(start, `{"type":"content_block_start","index":-1,"content_block":{"type":"text","text":""}}`),
+			want: "content_block_start for block -1",
+		},
+		{
+			name: "start index past the next block",
+			body: sse(start, `{"type":"content_block_start","index":1000000000,"content_block":{"type":"text","text":""}}`),
+			want: "content_block_start for block 1000000000",
+		},
+		{
+			name: "negative delta index",
+			body: sse(start, textStart, `{"type":"content_block_delta","index":-1,"delta":{"type":"text_delta","text":"a"}}`),
+			want: "content_block_delta for block -1",
+		},
+		{
+			name: "delta for a block that has not started",
+			body: sse(start, textStart, `{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"a"}}`),
+			want: "content_block_delta for block 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := streamOf(t, tt.body)
+			for stream.Next() {
+			}
+			if err := stream.Err(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamErrorEvent(t *testing.T) {
+	stream := streamOf(t, sse(
+		`{"type":"message_start","message":{"content":[]}}`,
+		`{"type":"error","error":{"type":"overloaded_error","message":"busy"}}`,
+	))
+	for stream.Next() {
+	}
+	var apiErr *APIError
+	if !errors.As(stream.Err(), &apiErr) {
+		t.Fatalf("error = %v, want an *APIError", stream.Err())
+	}
+	if apiErr.Type != ErrOverloaded || apiErr.StatusCode != 529 || apiErr.RequestID != "req_stream" || !apiErr.Retryable() {
+		t.Errorf("error = %+v", apiErr)
+	}
+}
@@ -0,0 +1,168 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Default limits of a tool loop
+const (
+	DefaultMaxIterations = 10
+	DefaultMaxParallel   = 4
+)
+
+// ErrMaxIterations is returned when the model is still calling tools after the iteration limit
+var ErrMaxIterations = errors.New("tool loop reached the iteration limit")
+
+// ToolFunc is a Go function the model can call as a tool
+type ToolFunc struct {
+	// Tool is the definition sent to the model
+	Tool Tool
+	call func(ctx context.Context, input json.RawMessage) (string, error)
+}
+
+// NewToolFunc creates a tool from a Go function. The input schema is derived from the input
+// type with SchemaFor, and the model's input is decoded into it before fn is called. The
+// string fn returns is the tool result, and an error is reported to the model as a failed
+// tool call so that it can recover.
+func NewToolFunc[In any](name, description string, fn func(ctx context.Context, input In) (string, error)) ToolFunc {
+	var zero In
+	return ToolFunc{
+		Tool: Tool{Name: name, Description: description, InputSchema: SchemaFor(zero)},
+		call: func(ctx context.Context, raw json.RawMessage) (string, error) {
+			var input In
+			if len(raw) > 0 {
+				if err := json.Unmarshal(raw, &input); err != nil {
+					return "", fmt.Errorf("invalid input: %w", err)
+				}
+			}
+			return fn(ctx, input)
+		},
+	}
+}
+
+// Toolset is a set of tools and the limits of the loop that runs them
+type Toolset struct {
+	// MaxIterations limits how many requests a loop sends (default 10)
+	MaxIterations int
+	// MaxParallel limits how many tool calls from one response run at once (default 4)
+	MaxParallel int
+	// OnMessage, if set, is called with every response from the model
+	OnMessage func(*Message)
+
+	tools map[string]ToolFunc
+	order []string
+}
+
+// NewToolset creates a toolset from tools
+func NewToolset(tools ...ToolFunc) *Toolset {
+	t := &Toolset{tools: map[string]ToolFunc{}}
+	for _, tool := range tools {
+		t.Add(tool)
+	}
+	return t
+}
+
+// Add adds a tool, replacing any tool with the same name
+func (t *Toolset) Add(tool ToolFunc) {
+	if _, ok := t.tools[tool.Tool.Name]; !ok {
+		t.order = append(t.order, tool.Tool.Name)
+	}
+	t.tools[tool.Tool.Name] = tool
+}
+
+// Definitions returns the tool definitions to send to the model
+func (t *Toolset) Definitions() []Tool {
+	definitions := make([]Tool, 0, len(t.order))
+	for _, name := range t.order {
+		definitions = append(definitions, t.tools[name].Tool)
+	}
+	return definitions
+}
+
+// ToolRun is the outcome of a tool loop
+type ToolRun struct {
+	// Message is the model's last response
+	Message *Message
+	// Messages is the whole conversation, including tool calls, results and the last response
+	Messages []MessageParam
+	// Usage is the total usage of all requests
+	Usage Usage
+	// Iterations is the number of requests sent
+	Iterations int
+}
+
+// RunTools sends a request with the toolset's tools and runs the tool calls the model makes,
+// sending the results back until the model finishes its turn. The run so far is returned
+// along with any error, including ErrMaxIterations.
+func (c *Client) RunTools(ctx context.Context, req MessageRequest, tools *Toolset) (*ToolRun, error) {
+	maxIterations := tools.MaxIterations
+	if maxIterations <= 0 {
+		maxIterations = DefaultMaxIterations
+	}
+
+	req.Tools = append(append([]Tool(nil), req.Tools...), tools.Definitions()...)
+	run := &ToolRun{Messages: append([]MessageParam(nil), req.Messages...)}
+	for run.Iterations < maxIterations {
+		req.Messages = run.Messages
+		msg, err := c.CreateMessage(ctx, req)
+		if err != nil {
+			return run, err
+		}
+		run.Iterations++
+		run.Message = msg
+		run.Messages = append(run.Messages, msg.Param())
+		run.Usage.Add(msg.Usage)
+		if tools.OnMessage != nil {
+			tools.OnMessage(msg)
+		}
+
+		switch msg.StopReason {
+		case StopToolUse:
+			run.Messages = append(run.Messages, NewUserMessage(tools.call(ctx, msg.ToolUses())...))
+		case StopPauseTurn:
+			// A long-running server tool paused the turn, and sending the conversation back resumes it
+		default:
+			return run, nil
+		}
+	}
+	return run, ErrMaxIterations
+}
+
+// call runs tool calls concurrently, up to MaxParallel at a time, and returns their results in order
+func (t *Toolset) call(ctx context.Context, uses []ContentBlock) []ContentBlock {
+	maxParallel := t.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = DefaultMaxParallel
+	}
+
+	results := make([]ContentBlock, len(uses))
+	limit := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+	for i, use := range uses {
+		tool, ok := t.tools[use.Name]
+		if !ok {
+			results[i] = ToolResultBlock(use.ID, fmt.Sprintf("unknown tool %q", use.Name), true)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, use ContentBlock) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			output, err := tool.call(ctx, use.Input)
+			if err != nil {
+				results[i] = ToolResultBlock(use.ID, err.Error(), true)
+				return
+			}
+			results[i] = ToolResultBlock(use.ID, output, false)
+		}(i, use)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,157 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// toolUseReply is a response that calls the given tools, each as id:name:input
+func toolUseReply(uses ...[3]string) string {
+	var blocks []ContentBlock
+	for _, use := range uses {
+		blocks = append(blocks, ContentBlock{Type: "tool_use", ID: use[0], Name: use[1], Input: json.RawMessage(use[2])})
+	}
+	content, _ := json.Marshal(blocks)
+	return fmt.Sprintf(`{"type":"message","role":"assistant","content":%s,"stop_reason":"tool_use","usage":{"input_tokens":1,"output_tokens":2}}`, content)
+}
+
+type weatherInput struct {
+	City string `json:"city"`
+}
+
+func TestRunTools(t *testing.T) {
+	var requests []MessageRequest
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var req MessageRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+		if len(requests) == 1 {
+			io.WriteString(w, toolUseReply(
+				[3]string{"t1", "weather", `{"city":"Paris"}`},
+				[3]string{"t2", "weather", `{"city":"Oslo"}`},
+				[3]string{"t3", "missing", `{}`},
+				[3]string{"t4", "weather", `{"city":7}`},
+			))
+			return
+		}
+		io.WriteString(w, `{"type":"message","role":"assistant","content":[{"type":"text","text":"Done"}],"stop_reason":"end_turn","usage":{"input_tokens":3,"output_tokens":4}}`)
+	})
+
+	tools := NewToolset(NewToolFunc("weather", "Current weather", func(ctx context.Context, input weatherInput) (string, error) {
+		if input.City == "Oslo" {
+			return "", errors.New("no station")
+		}
+		return "Sunny in " + input.City, nil
+	}))
+	var seen int
+	tools.OnMessage = func(*Message) { seen++ }
+
+	run, err := client.RunTools(context.Background(), MessageRequest{
+		Model:    "m",
+		Messages: []MessageParam{NewUserMessage(TextBlock("weather?"))},
+	}, tools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Iterations != 2 || seen != 2 || run.Message.Text() != "Done" || len(run.Messages) != 4 {
+		t.Fatalf("run = %+v", run)
+	}
+	if run.Usage.InputTokens != 4 || run.Usage.OutputTokens != 6 {
+		t.Errorf("usage = %+v, want the total of both requests", run.Usage)
+	}
+	if len(requests[0].Tools) != 1 || requests[0].Tools[0].Name != "weather" || requests[0].Tools[0].InputSchema == nil {
+		t.Errorf("tools sent = %+v", requests[0].Tools)
+	}
+
+	// Results come back in the order of the calls, with failures marked as errors
+	results := requests[1].Messages[2].Content
+	want := []struct {
+		id      string
+		isError bool
+	}{{"t1", false}, {"t2", true}, {"t3", true}, {"t4", true}}
+	if len(results) != len(want) {
+		t.Fatalf("results = %+v", results)
+	}
+	for i, w := range want {
+		if results[i].Type != "tool_result" || results[i].ToolUseID != w.id || results[i].IsError != w.isError {
+			t.Errorf("result %d = %+v, want %s with is_error %v", i, results[i], w.id, w.isError)
+		}
+	}
+	if string(results[0].Content) != `"Sunny in Paris"` || string(results[1].Content) != `"no station"` {
+		t.Errorf("result content = %q, %q", results[0].Content, results[1].Content)
+	}
+}
+
+func TestRunToolsIterationLimit(t *testing.T) {
+	var requests int32
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		io.WriteString(w, toolUseReply([3]string{"t1", "noop", `{}`}))
+	})
+	tools := NewToolset(NewToolFunc("noop", "", func(ctx context.Context, input struct{}) (string, error) {
+		return "ok", nil
+	}))
+	tools.MaxIterations = 3
+
+	run, err := client.RunTools(context.Background(), MessageRequest{Model: "m"}, tools)
+	if !errors.Is(err, ErrMaxIterations) {
+		t.Fatalf("error = %v, want ErrMaxIterations", err)
+	}
+	if run.Iterations != 3 || requests != 3 {
+		t.Errorf("%d iterations and %d requests, want 3", run.Iterations, requests)
+	}
+}
+
+func TestToolsetMaxParallel(t *testing.T) {
+	var mu sync.Mutex
+	running, most := 0, 0
+	tools := NewToolset(NewToolFunc("slow", "", func(ctx context.Context, input struct{}) (string, error) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return "ok", nil
+	}))
+	tools.MaxParallel = 2
+
+	var uses []ContentBlock
+	for i := 0; i < 6; i++ {
+		uses = append(uses, ContentBlock{Type: "tool_use", ID: fmt.Sprint(i), Name: "slow"})
+	}
+	results := tools.call(context.Background(), uses)
+	if most > 2 {
+		t.Errorf("%d tools ran at once, want at most 2", most)
+	}
+	for i, result := range results {
+		if result.ToolUseID != fmt.Sprint(i) || result.IsError {
+			t.Errorf("result %d = %+v", i, result)
+		}
+	}
+}
+
+func TestToolsetAdd(t *testing.T) {
+	tool := func(name, description string) ToolFunc {
+		return NewToolFunc(name, description, func(ctx context.Context, input struct{}) (string, error) { return "", nil })
+	}
+	tools := NewToolset(tool("a", "first"), tool("b", ""))
+	tools.Add(tool("a", "second"))
+
+	definitions := tools.Definitions()
+	if len(definitions) != 2 || definitions[0].Name != "a" || definitions[0].Description != "second" || definitions[1].Name != "b" {
+		t.Errorf("definitions = %+v, want a replaced in place and b", definitions)
+	}
+}
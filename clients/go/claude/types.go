@@ -0,0 +1,239 @@
+package claude
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Message roles
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Content block types
+const (
+	BlockText                = "text"
+	BlockImage               = "image"
+	BlockDocument            = "document"
+	BlockToolUse             = "tool_use"
+	BlockToolResult          = "tool_result"
+	BlockServerToolUse       = "server_tool_use"
+	BlockWebSearchToolResult = "web_search_tool_result"
+	BlockThinking            = "thinking"
+	BlockRedactedThinking    = "redacted_thinking"
+)
+
+// StopReason is why the model stopped generating
+type StopReason string
+
+// Stop reasons
+const (
+	StopEndTurn      StopReason = "end_turn"
+	StopMaxTokens    StopReason = "max_tokens"
+	StopSequence     StopReason = "stop_sequence"
+	StopToolUse      StopReason = "tool_use"
+	StopPauseTurn    StopReason = "pause_turn"
+	StopRefusal      StopReason = "refusal"
+	StopContextLimit StopReason = "model_context_window_exceeded"
+)
+
+// MessageRequest is the body of a Messages API request
+type MessageRequest struct {
+	Model         string          `json:"model"`
+	MaxTokens     int             `json:"max_tokens"`
+	Messages      []MessageParam  `json:"messages"`
+	System        Blocks          `json:"system,omitempty"`
+	Metadata      *Metadata       `json:"metadata,omitempty"`
+	StopSequences []string        `json:"stop_sequences,omitempty"`
+	Stream        bool            `json:"stream,omitempty"`
+	Temperature   *float64        `json:"temperature,omitempty"`
+	TopP          *float64        `json:"top_p,omitempty"`
+	TopK          *int            `json:"top_k,omitempty"`
+	Tools         []Tool          `json:"tools,omitempty"`
+	ToolChoice    *ToolChoice     `json:"tool_choice,omitempty"`
+	Thinking      *ThinkingConfig `json:"thinking,omitempty"`
+}
+
+// MessageParam is a single turn of the conversation sent to the model
+type MessageParam struct {
+	Role    string `json:"role"`
+	Content Blocks `json:"content"`
+}
+
+// Blocks is a list of content blocks. It also decodes from a plain string, which the API
+// accepts as shorthand for a single text block.
+type Blocks []ContentBlock
+
+// UnmarshalJSON decodes a list of blocks or a string
+func (b *Blocks) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*b = Blocks{TextBlock(text)}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]ContentBlock)(b))
+}
+
+// NewUserMessage creates a user turn from content blocks
+func NewUserMessage(blocks ...ContentBlock) MessageParam {
+	return MessageParam{Role: RoleUser, Content: blocks}
+}
+
+// NewAssistantMessage creates an assistant turn from content blocks
+func NewAssistantMessage(blocks ...ContentBlock) MessageParam {
+	return MessageParam{Role: RoleAssistant, Content: blocks}
+}
+
+// ContentBlock is a block of message content. Type decides which of the other fields are used.
+type ContentBlock struct {
+	Type string `json:"type"`
+
+	// Text and Citations are set for text blocks. Each citation is kept as the API sent it.
+	Text      string            `json:"text,omitempty"`
+	Citations []json.RawMessage `json:"citations,omitempty"`
+
+	// Source is set for image and document blocks
+	Source *Source `json:"source,omitempty"`
+
+	// ID, Name and Input are set for tool_use and server_tool_use blocks
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// ToolUseID, Content and IsError are set for tool results. Content is a string or a list of blocks.
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+
+	// Thinking and Signature are set for thinking blocks, and Data for redacted_thinking blocks
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Data      string `json:"data,omitempty"`
+
+	// CacheControl marks the end of a cacheable prompt prefix
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+}
+
+// Source is the data of an image or document block
+type Source struct {
+	// Type is "base64" or "url"
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// CacheControl configures prompt caching for a block
+type CacheControl struct {
+	Type string `json:"type"`
+	// TTL is "5m" (the default) or "1h"
+	TTL string `json:"ttl,omitempty"`
+}
+
+// TextBlock creates a text block
+func TextBlock(text string) ContentBlock {
+	return ContentBlock{Type: BlockText, Text: text}
+}
+
+// ImageBlock creates an image block from base64-encoded data
+func ImageBlock(mediaType, base64Data string) ContentBlock {
+	return ContentBlock{Type: BlockImage, Source: &Source{Type: "base64", MediaType: mediaType, Data: base64Data}}
+}
+
+// ImageURLBlock creates an image block that the API fetches from a URL
+func ImageURLBlock(url string) ContentBlock {
+	return ContentBlock{Type: BlockImage, Source: &Source{Type: "url", URL: url}}
+}
+
+// ToolResultBlock creates a tool_result block answering a tool_use block
+func ToolResultBlock(toolUseID, content string, isError bool) ContentBlock {
+	encoded, _ := json.Marshal(content)
+	return ContentBlock{Type: BlockToolResult, ToolUseID: toolUseID, Content: encoded, IsError: isError}
+}
+
+// Metadata describes the request for abuse detection
+type Metadata struct {
+	// UserID is an opaque identifier for the end user, never an email or name
+	UserID string `json:"user_id,omitempty"`
+}
+
+// Tool is a client tool the model may call
+type Tool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// InputSchema is a JSON schema for the tool's input, as any JSON-encodable value
+	InputSchema  interface{}   `json:"input_schema"`
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+}
+
+// ToolChoice controls how the model uses tools
+type ToolChoice struct {
+	// Type is "auto", "any", "tool" or "none"
+	Type string `json:"type"`
+	// Name is the tool to use when Type is "tool"
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+// ThinkingConfig enables extended thinking
+type ThinkingConfig struct {
+	// Type is "enabled" or "disabled"
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// Message is a response from the model
+type Message struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Role         string         `json:"role"`
+	Content      []ContentBlock `json:"content"`
+	Model        string         `json:"model"`
+	StopReason   StopReason     `json:"stop_reason"`
+	StopSequence *string        `json:"stop_sequence"`
+	Usage        Usage          `json:"usage"`
+}
+
+// Text returns the text of all text blocks in the message
+func (m *Message) Text() string {
+	var b strings.Builder
+	for _, block := range m.Content {
+		if block.Type == BlockText {
+			b.WriteString(block.Text)
+		}
+	}
+	return b.String()
+}
+
+// ToolUses returns the tool_use blocks in the message
+func (m *Message) ToolUses() []ContentBlock {
+	var uses []ContentBlock
+	for _, block := range m.Content {
+		if block.Type == BlockToolUse {
+			uses = append(uses, block)
+		}
+	}
+	return uses
+}
+
+// Param returns the message as an assistant turn to continue the conversation with
+func (m *Message) Param() MessageParam {
+	return NewAssistantMessage(m.Content...)
+}
+
+// Usage is the token usage of a request
+type Usage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+}
+
+// Add adds the counts of other to the usage
+func (u *Usage) Add(other Usage) {
+	u.InputTokens += other.InputTokens
+	u.OutputTokens += other.OutputTokens
+	u.CacheCreationInputTokens += other.CacheCreationInputTokens
+	u.CacheReadInputTokens += other.CacheReadInputTokens
+}
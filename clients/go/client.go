@@ -1,20 +1,17 @@
-// Go client for Claude AI proxy server - PRXY
+// Go client for Claude AI proxy server - PRXY. Run with "chat" for an interactive chat,
+// or "batch" to send the requests in a JSONL file.
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/joho/godotenv"
+	"github.com/stefrushxyz/prxy/clients/go/claude"
 )
 
 const (
@@ -24,55 +21,6 @@ const (
 	MaxTokens = 1000
 )
 
-// ClaudeRequest represents the structure of a request to Claude API
-type ClaudeRequest struct {
-	Model     string    `json:"model"`
-	MaxTokens int       `json:"max_tokens"`
-	Stream    bool      `json:"stream"`
-	Messages  []Message `json:"messages"`
-}
-
-// Message represents a single message in the conversation
-type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
-
-// StreamingResponse represents a chunk of a streaming response
-type StreamingResponse struct {
-	Type         string       `json:"type"`
-	Index        int          `json:"index"`
-	Delta        Delta        `json:"delta,omitempty"`
-	ContentBlock ContentBlock `json:"content_block,omitempty"`
-}
-
-// Delta contains the actual content in a streaming response
-type Delta struct {
-	Text string `json:"text"`
-}
-
-// ContentBlock contains the content in a content block response
-type ContentBlock struct {
-	Text string `json:"text"`
-}
-
-// FullResponse represents the complete non-streaming response
-type FullResponse struct {
-	ID           string    `json:"id"`
-	Type         string    `json:"type"`
-	Role         string    `json:"role"`
-	Content      []Content `json:"content"`
-	Model        string    `json:"model"`
-	StopReason   string    `json:"stop_reason"`
-	StopSequence string    `json:"stop_sequence"`
-}
-
-// Content represents the content part of a response
-type Content struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
-}
-
 func main() {
 	err := godotenv.Load()
 	if err != nil {
@@ -101,21 +49,29 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Example 1: Non-streaming request
-	fmt.Println(bold("Non-streaming Example"))
-	nonStreamingRequest := ClaudeRequest{
-		Model:     ClaudeModel,
-		MaxTokens: MaxTokens,
-		Messages: []Message{
-			{
-				Role:    "user",
-				Content: "Give me one interesting fact about the moon.",
-			},
-		},
+	options := []claude.Option{claude.WithBaseURL(proxyURL), claude.WithAPIKey(apiKey)}
+	client := claude.NewClient(options...)
+
+	// Run the interactive chat or a batch instead of the examples if asked to
+	if len(os.Args) > 1 && (os.Args[1] == "chat" || os.Args[1] == "batch") {
+		if os.Args[1] == "chat" {
+			err = runChat(client, os.Args[2:])
+		} else {
+			err = runBatch(options, os.Args[2:])
+		}
+		if err != nil {
+			fmt.Printf("%s: %v\n", yellow("Error"), err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	// Send non-streaming request and process response
-	sendRequest(nonStreamingRequest, proxyURL, apiKey, bold, cyan, yellow, green)
+	// Example 1: Non-streaming request with the client library
+	fmt.Println(bold("Non-streaming Example"))
+	if err := sendMessage(client, "Give me one interesting fact about the moon.", bold, cyan, yellow, green); err != nil {
+		fmt.Printf("%s: %v\n", yellow("Error"), err)
+		os.Exit(1)
+	}
 
 	fmt.Println()
 	fmt.Println(cyan("===================="))
@@ -123,142 +79,77 @@ func main() {
 
 	// Example 2: Streaming request
 	fmt.Println(bold("Streaming Example"))
-	streamingRequest := ClaudeRequest{
-		Model:     ClaudeModel,
-		MaxTokens: MaxTokens,
-		Stream:    true,
-		Messages: []Message{
-			{
-				Role:    "user",
-				Content: "Write a haiku about computer science.",
-			},
-		},
-	}
-
-	// Send streaming request and process response
-	sendRequest(streamingRequest, proxyURL, apiKey, bold, cyan, yellow, green)
-}
-
-// sendRequest sends a request to the Claude API and processes the response
-func sendRequest(request ClaudeRequest, proxyURL string, apiKey string, bold, cyan, yellow, green func(a ...interface{}) string) {
-	// Convert request to JSON
-	requestBody, err := json.Marshal(request)
-	if err != nil {
-		fmt.Printf("%s: %v\n", yellow("Error marshalling request"), err)
+	if err := streamMessage(client, "Write a haiku about computer science.", bold, cyan, yellow, green); err != nil {
+		fmt.Printf("%s: %v\n", yellow("Error"), err)
 		os.Exit(1)
 	}
+}
 
+// sendMessage sends a single user message with the client library and prints the response
+func sendMessage(client *claude.Client, prompt string, bold, cyan, yellow, green func(a ...interface{}) string) error {
 	fmt.Println(bold("Sending request to Claude API..."))
 	fmt.Println()
 
-	// Create a new HTTP request
-	req, err := http.NewRequest("POST", proxyURL+"/v1/messages", bytes.NewBuffer(requestBody))
+	startTime := time.Now()
+	msg, err := client.CreateMessage(context.Background(), claude.MessageRequest{
+		Model:     ClaudeModel,
+		MaxTokens: MaxTokens,
+		Messages:  []claude.MessageParam{claude.NewUserMessage(claude.TextBlock(prompt))},
+	})
 	if err != nil {
-		fmt.Printf("%s: %v\n", yellow("Error creating request"), err)
-		os.Exit(1)
+		return err
 	}
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", apiKey)
+	fmt.Println(bold("Response from Claude:"))
+	fmt.Println(cyan("===================="))
+	responseText := msg.Text()
+	fmt.Println(responseText)
 
-	// Record start time before sending the request
-	startTime := time.Now()
+	// Print stats
+	elapsed := time.Since(startTime)
+	fmt.Println()
+	fmt.Println(cyan("===================="))
+	fmt.Printf("%s %s\n", bold("Time elapsed:"), green(fmt.Sprintf("%.2f seconds", elapsed.Seconds())))
+	fmt.Printf("%s %s\n", bold("Stop reason:"), green(string(msg.StopReason)))
+	fmt.Printf("%s %s\n", bold("Tokens:"), green(fmt.Sprintf("%d in, %d out", msg.Usage.InputTokens, msg.Usage.OutputTokens)))
+	fmt.Printf("%s %s\n", bold("Response length:"), green(fmt.Sprintf("%d characters", len(responseText))))
+	fmt.Println(cyan("===================="))
+	return nil
+}
 
-	// Send request to proxy server
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("%s: %v\n", yellow("Error sending request to proxy"), err)
-		os.Exit(1)
-	}
-	defer resp.Body.Close()
+// streamMessage streams the response to a single user message, printing text as it arrives
+func streamMessage(client *claude.Client, prompt string, bold, cyan, yellow, green func(a ...interface{}) string) error {
+	fmt.Println(bold("Sending request to Claude API..."))
+	fmt.Println()
 
-	// Check if response is successful
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("%s: %s\n", yellow("Error from server"), string(body))
-		os.Exit(1)
+	startTime := time.Now()
+	stream, err := client.StreamMessage(context.Background(), claude.MessageRequest{
+		Model:     ClaudeModel,
+		MaxTokens: MaxTokens,
+		Messages:  []claude.MessageParam{claude.NewUserMessage(claude.TextBlock(prompt))},
+	})
+	if err != nil {
+		return err
 	}
+	defer stream.Close()
 
 	fmt.Println(bold("Response from Claude:"))
 	fmt.Println(cyan("===================="))
 
-	// Variables for handling
-	responseText := ""
+	// Print the text deltas without newlines to make them appear as continuous text
 	eventCount := 0
-
-	if request.Stream {
-		// Handle streaming response
-		reader := bufio.NewReader(resp.Body)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				if err != io.EOF {
-					fmt.Printf("%s: %v\n", yellow("Error reading stream"), err)
-				}
-				break
-			}
-
-			// Skip empty lines
-			line = strings.TrimSpace(line)
-			if line == "" || !strings.HasPrefix(line, "data: ") {
-				continue
-			}
-
-			// Extract the JSON data
-			data := strings.TrimPrefix(line, "data: ")
-
-			// Check for [DONE] message
-			if data == "[DONE]" {
-				break
-			}
-
-			// Parse the streaming response
-			var streamResp StreamingResponse
-			if err := json.Unmarshal([]byte(data), &streamResp); err != nil {
-				fmt.Printf("%s: %v\n", yellow("Error parsing JSON"), err)
-				continue
-			}
-
-			// Process based on event type
-			if streamResp.Type == "content_block_delta" {
-				// Print the delta text without a newline to make it appear as continuous text
-				fmt.Print(streamResp.Delta.Text)
-				responseText += streamResp.Delta.Text
-				eventCount++
-			} else if streamResp.Type == "content_block_start" {
-				if streamResp.ContentBlock.Text != "" {
-					fmt.Print(streamResp.ContentBlock.Text)
-					responseText += streamResp.ContentBlock.Text
-				}
-				eventCount++
-			}
-		}
-	} else {
-		// Handle non-streaming response
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Printf("%s: %v\n", yellow("Error reading response"), err)
-			os.Exit(1)
-		}
-
-		var fullResp FullResponse
-		if err := json.Unmarshal(body, &fullResp); err != nil {
-			fmt.Printf("%s: %v\n", yellow("Error parsing JSON"), err)
-			// Print raw response if parsing fails
-			fmt.Println(string(body))
-			os.Exit(1)
-		}
-
-		// Extract and print the text content
-		for _, content := range fullResp.Content {
-			if content.Type == "text" {
-				fmt.Println(content.Text)
-				responseText = content.Text
-			}
+	for stream.Next() {
+		event := stream.Event()
+		if event.Type == claude.EventContentBlockDelta && event.Delta != nil && event.Delta.Type == claude.DeltaText {
+			fmt.Print(event.Delta.Text)
 		}
+		eventCount++
+	}
+	if err := stream.Err(); err != nil {
+		fmt.Println()
+		return err
 	}
+	msg := stream.Message()
 
 	// Print stats
 	elapsed := time.Since(startTime)
@@ -266,9 +157,10 @@ func sendRequest(request ClaudeRequest, proxyURL string, apiKey string, bold, cy
 	fmt.Println()
 	fmt.Println(cyan("===================="))
 	fmt.Printf("%s %s\n", bold("Time elapsed:"), green(fmt.Sprintf("%.2f seconds", elapsed.Seconds())))
-	if request.Stream {
-		fmt.Printf("%s %s\n", bold("Events received:"), green(fmt.Sprintf("%d", eventCount)))
-	}
-	fmt.Printf("%s %s\n", bold("Response length:"), green(fmt.Sprintf("%d characters", len(responseText))))
+	fmt.Printf("%s %s\n", bold("Events received:"), green(fmt.Sprintf("%d", eventCount)))
+	fmt.Printf("%s %s\n", bold("Stop reason:"), green(string(msg.StopReason)))
+	fmt.Printf("%s %s\n", bold("Tokens:"), green(fmt.Sprintf("%d in, %d out", msg.Usage.InputTokens, msg.Usage.OutputTokens)))
+	fmt.Printf("%s %s\n", bold("Response length:"), green(fmt.Sprintf("%d characters", len(msg.Text()))))
 	fmt.Println(cyan("===================="))
+	return nil
 }
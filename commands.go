@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/stefrushxyz/prxy/prxy"
+)
+
+// Default config file, loaded if it exists
+const defaultConfigFile = ".env"
+
+// settingFlags are the flags that override an environment variable, with their usage text
+var settingFlags = map[string]struct {
+	env   string
+	usage string
+}{
+	"port":         {"PORT", "Port to listen on"},
+	"upstream-url": {"CLAUDE_API_URL", "Claude API base URL"},
+	"key-store":    {"KEY_STORE_FILE", "Key store file"},
+	"usage-file":   {"USAGE_FILE", "Usage file"},
+}
+
+// newFlagSet creates the flags for a command: the config file flag and the named setting flags
+func newFlagSet(command string, settings ...string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("prxy "+command, flag.ContinueOnError)
+	configFile := fs.String("config", defaultConfigFile, "Config file of KEY=value settings")
+	for _, name := range settings {
+		setting := settingFlags[name]
+		fs.String(name, "", fmt.Sprintf("%s (overrides %s)", setting.usage, setting.env))
+	}
+	return fs, configFile
+}
+
+// loadSettings applies the command's settings so that flags take precedence over environment
+// variables, and environment variables over the config file
+func loadSettings(fs *flag.FlagSet, configFile string) error {
+	fs.Visit(func(f *flag.Flag) {
+		if setting, ok := settingFlags[f.Name]; ok {
+			os.Setenv(setting.env, f.Value.String())
+		}
+	})
+
+	// Variables that are already set are not overwritten by the config file
+	err := godotenv.Load(configFile)
+	if errors.Is(err, os.ErrNotExist) && configFile == defaultConfigFile {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading config file: %w", err)
+	}
+	return nil
+}
+
+// keysCommand manages the API keys in the key store file
+func keysCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: prxy keys create|list|revoke")
+	}
+	subcommand, args := args[0], args[1:]
+
+	fs, configFile := newFlagSet("keys "+subcommand, "key-store")
+	name := new(string)
+	origins := new(string)
+	if subcommand == "create" {
+		name = fs.String("name", "", "Name to identify the key by")
+		origins = fs.String("origins", "", "Comma-separated browser origins the key is bound to")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := loadSettings(fs, *configFile); err != nil {
+		return err
+	}
+	path := os.Getenv("KEY_STORE_FILE")
+	if path == "" {
+		return errors.New("no key store configured - set KEY_STORE_FILE or pass -key-store")
+	}
+	store := prxy.KeyFile{Path: path}
+
+	switch subcommand {
+	case "create":
+		var originList []string
+		for _, origin := range strings.Split(*origins, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				originList = append(originList, origin)
+			}
+		}
+		key, record, err := store.Create(*name, originList)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Key:         %s\n", key)
+		fmt.Printf("ID:          %s\n", record.ID)
+		fmt.Printf("Fingerprint: %s\n", record.Fingerprint)
+		fmt.Println()
+		fmt.Println("Give the key to the client. It is not stored and cannot be shown again.")
+
+	case "list":
+		records, err := store.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tFINGERPRINT\tORIGINS\tCREATED\tSTATUS")
+		for _, record := range records {
+			status := "active"
+			if record.RevokedAt != nil {
+				status = "revoked " + record.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", record.ID, orDash(record.Name), record.Fingerprint,
+				orDash(strings.Join(record.Origins, ",")), record.CreatedAt.Format(time.RFC3339), status)
+		}
+		return w.Flush()
+
+	case "revoke":
+		if fs.NArg() != 1 {
+			return errors.New("usage: prxy keys revoke <id>")
+		}
+		record, err := store.Revoke(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revoked %s (%s). Running servers stop accepting it within a few seconds.\n", record.ID, record.Fingerprint)
+
+	default:
+		return fmt.Errorf("unknown keys command %q", subcommand)
+	}
+	return nil
+}
+
+// checkConfigCommand parses a config file the way the server would and reports any problems.
+// Only the file's own settings are checked, not the environment it is run in. Only the TLS
+// certificates are read: key stores, file owners and provider credentials are left alone, and
+// nothing is contacted.
+func checkConfigCommand(args []string) error {
+	fs, configFile := newFlagSet("check-config")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		*configFile = fs.Arg(0)
+	}
+	values, err := godotenv.Read(*configFile)
+	if err != nil {
+		return fmt.Errorf("loading config file: %w", err)
+	}
+	getenv := func(name string) string { return values[name] }
+
+	cfg, err := prxy.ConfigFromLookup(getenv)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	warnings, err := cfg.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if _, err := loadServerSettings(getenv, func(entry prxy.LogEntry) {
+		if entry.Level == prxy.LogWarning || entry.Level == prxy.LogError {
+			warnings = append(warnings, entry.Message)
+		}
+	}); err != nil {
+		return err
+	}
+
+	for _, warning := range warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+	fmt.Printf("%s is valid\n", *configFile)
+	return nil
+}
+
+// usageTotal is the usage of one caller and model
+type usageTotal struct {
+	caller   string
+	model    string
+	requests int
+	input    int
+	cached   int
+	output   int
+}
+
+// usageCommand prints token usage from the usage file, totaled by caller and model
+func usageCommand(args []string) error {
+	fs, configFile := newFlagSet("usage", "usage-file", "key-store")
+	since := fs.Duration("since", 0, "Only count requests in this period, e.g. 24h (default: all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := loadSettings(fs, *configFile); err != nil {
+		return err
+	}
+	path := os.Getenv("USAGE_FILE")
+	if path == "" {
+		return errors.New("no usage file configured - set USAGE_FILE or pass -usage-file")
+	}
+
+	records, err := prxy.ReadUsage(path)
+	if err != nil {
+		return err
+	}
+
+	// Show key names from the key store where possible
+	names := map[string]string{}
+	if keyStore := os.Getenv("KEY_STORE_FILE"); keyStore != "" {
+		keys, err := prxy.KeyFile{Path: keyStore}.List()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if key.Name != "" {
+				names[key.ID] = key.Name
+			}
+		}
+	}
+
+	sorted, all := totalUsage(records, names, *since, time.Now())
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CALLER\tMODEL\tREQUESTS\tINPUT\tCACHED INPUT\tOUTPUT")
+	for _, t := range sorted {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", t.caller, t.model, t.requests, t.input, t.cached, t.output)
+	}
+	fmt.Fprintf(w, "TOTAL\t\t%d\t%d\t%d\t%d\n", all.requests, all.input, all.cached, all.output)
+	return w.Flush()
+}
+
+// totalUsage totals the records from the last since (or all records if since is zero) by
+// caller and model, sorted, along with the overall total. Requests with a key ID are totaled
+// by it, which tells keys with the same fingerprint apart and counts tokens under the key that
+// issued them, and are shown with the key's name if it has one. Other callers are totaled by
+// their caller ID.
+func totalUsage(records []prxy.UsageRecord, names map[string]string, since time.Duration, now time.Time) ([]*usageTotal, usageTotal) {
+	totals := map[[2]string]*usageTotal{}
+	var all usageTotal
+	for _, record := range records {
+		if since > 0 && now.Sub(record.Time) > since {
+			continue
+		}
+		caller := record.Caller
+		if record.KeyID != "" {
+			caller = record.KeyID
+			if name, ok := names[record.KeyID]; ok {
+				caller = name + " (" + record.KeyID + ")"
+			}
+		}
+		total := totals[[2]string{caller, record.Model}]
+		if total == nil {
+			total = &usageTotal{caller: caller, model: record.Model}
+			totals[[2]string{caller, record.Model}] = total
+		}
+		for _, t := range []*usageTotal{total, &all} {
+			t.requests++
+			t.input += record.InputTokens
+			t.cached += record.CacheCreationInputTokens + record.CacheReadInputTokens
+			t.output += record.OutputTokens
+		}
+	}
+
+	sorted := make([]*usageTotal, 0, len(totals))
+	for _, total := range totals {
+		sorted = append(sorted, total)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].caller != sorted[j].caller {
+			return sorted[i].caller < sorted[j].caller
+		}
+		return sorted[i].model < sorted[j].model
+	})
+	return sorted, all
+}
+
+// orDash returns s, or "-" if it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stefrushxyz/prxy/prxy"
+)
+
+func TestTotalUsage(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	records := []prxy.UsageRecord{
+		// Two keys with the same fingerprint
+		{Time: now, Caller: "prxy_…abcd", KeyID: "key_1", Model: "claude-x", InputTokens: 10, OutputTokens: 1},
+		{Time: now, Caller: "prxy_…abcd", KeyID: "key_2", Model: "claude-x", InputTokens: 20, OutputTokens: 2},
+		// A token issued by the first key
+		{Time: now, Caller: "token:0123abcd", KeyID: "key_1", Model: "claude-x", InputTokens: 5, CacheReadInputTokens: 7},
+		{Time: now, Caller: "mtls:billing", Model: "claude-y", OutputTokens: 3},
+		{Time: now.Add(-48 * time.Hour), Caller: "mtls:billing", Model: "claude-y", OutputTokens: 100},
+	}
+	names := map[string]string{"key_1": "backend"}
+
+	tests := []struct {
+		since    time.Duration
+		want     []string
+		requests int
+	}{
+		{
+			since:    0,
+			want:     []string{"backend (key_1) claude-x 2 15 7 1", "key_2 claude-x 1 20 0 2", "mtls:billing claude-y 2 0 0 103"},
+			requests: 5,
+		},
+		{
+			since:    24 * time.Hour,
+			want:     []string{"backend (key_1) claude-x 2 15 7 1", "key_2 claude-x 1 20 0 2", "mtls:billing claude-y 1 0 0 3"},
+			requests: 4,
+		},
+	}
+	for _, tt := range tests {
+		sorted, all := totalUsage(records, names, tt.since, now)
+		var got []string
+		for _, total := range sorted {
+			got = append(got, fmt.Sprintf("%s %s %d %d %d %d", total.caller, total.model, total.requests, total.input, total.cached, total.output))
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("since %v: totals =\n%s\nwant\n%s", tt.since, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+		if all.requests != tt.requests {
+			t.Errorf("since %v: %d requests in total, want %d", tt.since, all.requests, tt.requests)
+		}
+	}
+}
+
+func TestCheckConfigIsOffline(t *testing.T) {
+	dir := t.TempDir()
+	ownersFile := filepath.Join(dir, "files.jsonl")
+	configFile := filepath.Join(dir, "prod.env")
+	os.WriteFile(configFile, []byte(strings.Join([]string{
+		"KEY_STORE_FILE=" + filepath.Join(dir, "missing", "keys.json"),
+		"FILES_API=true",
+		"FILE_OWNERS_FILE=" + ownersFile,
+		"VERTEX_REGION=us-east5",
+		"VERTEX_PROJECT_ID=project",
+		"VERTEX_CREDENTIALS_FILE=" + filepath.Join(dir, "missing", "sa.json"),
+	}, "\n")), 0o600)
+
+	// Files that only the server opens are neither read nor created
+	if err := checkConfigCommand([]string{configFile}); err != nil {
+		t.Fatalf("check-config: %v", err)
+	}
+	if _, err := os.Stat(ownersFile); !os.IsNotExist(err) {
+		t.Errorf("check-config created the file owners file: %v", err)
+	}
+
+	os.WriteFile(configFile, []byte("UPSTREAM_PROVIDER=bedrock\n"), 0o600)
+	if err := checkConfigCommand([]string{configFile}); err == nil || !strings.Contains(err.Error(), "bedrock is not configured") {
+		t.Errorf("check-config error = %v, want the provider error", err)
+	}
+}
+
+func TestCheckConfigIgnoresEnvironment(t *testing.T) {
+	// The environment neither breaks a valid file nor fixes an invalid one
+	t.Setenv("PORT", "not-a-port")
+	t.Setenv("UPSTREAM_PROVIDER", "bedrock")
+	t.Setenv("BEDROCK_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	configFile := filepath.Join(t.TempDir(), "prod.env")
+
+	os.WriteFile(configFile, []byte("PORT=8080\n"), 0o600)
+	if err := checkConfigCommand([]string{configFile}); err != nil {
+		t.Errorf("check-config of a valid file: %v", err)
+	}
+	os.WriteFile(configFile, []byte("UPSTREAM_PROVIDER=bedrock\n"), 0o600)
+	if err := checkConfigCommand([]string{configFile}); err == nil || !strings.Contains(err.Error(), "bedrock is not configured") {
+		t.Errorf("check-config error = %v, want the provider error", err)
+	}
+	if os.Getenv("PORT") != "not-a-port" {
+		t.Errorf("check-config changed PORT to %q", os.Getenv("PORT"))
+	}
+}
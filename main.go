@@ -1,158 +1,180 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/hex"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
-	"github.com/rs/cors"
+	"github.com/stefrushxyz/prxy/prxy"
 )
 
 // Default values if environment variables are not set
 const (
-	name                    = "PRXY"
-	defaultPort             = "3000"
-	defaultClaudeURL        = "https://api.anthropic.com"
-	defaultAnthropicVersion = "2023-06-01"
-	timeout                 = 5 * time.Minute
-	shutdownTimeout         = 30 * time.Second
+	name            = "PRXY"
+	defaultPort     = "3000"
+	shutdownTimeout = 30 * time.Second
 )
 
-// Custom type for context keys to avoid collisions
-type contextKey string
-
-// Key for request ID in context
-const requestIDKey contextKey = "requestID"
-
-// Color codes for terminal output
-const (
-	colorReset  = "\033[0m"
-	colorRed    = "\033[31m"
-	colorGreen  = "\033[32m"
-	colorYellow = "\033[33m"
-	colorBlue   = "\033[34m"
-	colorPurple = "\033[35m"
-	colorCyan   = "\033[36m"
-)
-
-// Log type prefixes with colors
-const (
-	prefixError   = colorRed + "[ERROR]" + colorReset + " "
-	prefixWarning = colorYellow + "[WARN]" + colorReset + " "
-	prefixInfo    = colorGreen + "[INFO]" + colorReset + " "
-	prefixRequest = colorBlue + "[REQ]" + colorReset + " "
-	prefixSystem  = colorPurple + "[SYS]" + colorReset + " "
-)
+// version is the build version, set with -ldflags "-X main.version=..."
+var version = "dev"
 
 // logError logs error messages
 func logError(format string, v ...interface{}) {
-	log.Printf(prefixError+format, v...)
+	prxy.WriteLog(prxy.LogEntry{Level: prxy.LogError, Message: fmt.Sprintf(format, v...)})
 }
 
 // logWarning logs warning messages
 func logWarning(format string, v ...interface{}) {
-	log.Printf(prefixWarning+format, v...)
+	prxy.WriteLog(prxy.LogEntry{Level: prxy.LogWarning, Message: fmt.Sprintf(format, v...)})
 }
 
 // logInfo logs informational messages
 func logInfo(format string, v ...interface{}) {
-	log.Printf(prefixInfo+format, v...)
-}
-
-// logRequest logs request-related messages
-func logRequest(requestID, format string, v ...interface{}) {
-	log.Printf(prefixRequest+"%s[%s]%s "+format, append([]interface{}{colorCyan, requestID, colorReset}, v...)...)
+	prxy.WriteLog(prxy.LogEntry{Level: prxy.LogInfo, Message: fmt.Sprintf(format, v...)})
 }
 
 // logSystem logs system events
 func logSystem(format string, v ...interface{}) {
-	log.Printf(prefixSystem+format, v...)
+	prxy.WriteLog(prxy.LogEntry{Level: prxy.LogSystem, Message: fmt.Sprintf(format, v...)})
 }
 
-// main is the entry point for the proxy server
+// main runs the subcommand named by the first argument, or the server if there is none
 func main() {
-	// Configure logger with timestamp
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	logSystem("Starting %s...", name)
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
 
-	// Load environment variables from .env file
-	err := godotenv.Load()
+	var err error
+	switch command {
+	case "serve":
+		err = serveCommand(args)
+	case "keys":
+		err = keysCommand(args)
+	case "check-config":
+		err = checkConfigCommand(args)
+	case "usage":
+		err = usageCommand(args)
+	case "version":
+		fmt.Printf("prxy %s (%s %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	case "help":
+		printUsage()
+	default:
+		printUsage()
+		err = fmt.Errorf("unknown command %q", command)
+	}
 	if err != nil {
-		logWarning("No .env file found")
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
+}
 
-	// Check for allowed API keys configuration
-	allowedAPIKeysStr := os.Getenv("ALLOWED_API_KEYS")
-	if allowedAPIKeysStr != "" {
-		logInfo("API key validation is enabled")
-	} else {
-		logWarning("No ALLOWED_API_KEYS set - all API keys will be accepted")
+// printUsage lists the available commands
+func printUsage() {
+	fmt.Fprint(os.Stderr, `Usage: prxy <command> [flags]
+
+Commands:
+  serve                  Run the proxy server (the default)
+  keys create            Create an API key in the key store
+  keys list              List the keys in the key store
+  keys revoke <id>       Revoke a key in the key store
+  check-config [file]    Validate a config file without starting the server
+  usage                  Print token usage aggregated from the usage file
+  version                Print the version
+
+Settings come from flags, then environment variables, then the config file (.env by default).
+Run "prxy <command> -h" for the flags of a command.
+`)
+}
+
+// serveCommand runs the proxy server until it receives a termination signal
+func serveCommand(args []string) error {
+	fs, configFile := newFlagSet("serve", "port", "upstream-url", "key-store", "usage-file")
+	generateKey := fs.Bool("generate-key", false, "Generate a new API key and its hash, then exit")
+	if err := fs.Parse(args); err != nil {
+		return err
 	}
 
-	// Set up the router
-	r := mux.NewRouter()
-
-	// Health check endpoint
-	r.HandleFunc("/health", loggingMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		requestID := r.Context().Value(requestIDKey).(string)
-		logRequest(requestID, "Health check request from %s", r.RemoteAddr)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-	})).Methods("GET")
-
-	// Claude API proxy endpoint
-	r.HandleFunc("/v1/messages", loggingMiddleware(claudeProxyHandler)).Methods("POST")
-
-	// Set up CORS
-	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization", "x-api-key", "anthropic-version", "anthropic-beta"},
-		AllowCredentials: true,
-	})
-	handler := c.Handler(r)
+	if *generateKey {
+		if err := printNewAPIKey(); err != nil {
+			return fmt.Errorf("failed to generate API key: %w", err)
+		}
+		return nil
+	}
 
-	// Get port from environment variable or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = defaultPort
+	// Configure logger with timestamp
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	logSystem("Starting %s...", name)
+
+	// Load settings from flags and the config file
+	if err := loadSettings(fs, *configFile); err != nil {
+		return err
 	}
 
-	// Get Claude API URL for logging
-	claudeURL := os.Getenv("CLAUDE_API_URL")
-	if claudeURL == "" {
-		claudeURL = defaultClaudeURL
+	// Build the proxy and server from the environment
+	cfg, err := prxy.ConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	cfg.Version = version
+	proxy, err := prxy.New(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	settings, err := loadServerSettings(os.Getenv, cfg.Hooks.Log)
+	if err != nil {
+		return err
+	}
+	port, tlsConfig := settings.port, settings.tlsConfig
+
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+		logInfo("TLS is enabled (certificates reload on change)")
+		if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+			logInfo("Client certificate authentication is enabled (%s)", caFile)
+			if cfg.UpstreamAPIKey == "" {
+				logWarning("No UPSTREAM_API_KEY set - client certificates alone will not authorize requests")
+			}
+		}
 	}
-	logInfo("Using Claude API URL: %s", claudeURL)
 
 	// Create a new server
 	serverAddr := ":" + port
 	server := &http.Server{
-		Addr:    serverAddr,
-		Handler: handler,
+		Addr:      serverAddr,
+		Handler:   proxy,
+		TLSConfig: tlsConfig,
 	}
 
 	// Create a context that will be canceled on shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Run the upstream readiness probe and trace export in the background
+	proxy.Start()
+
 	// Start the server in a goroutine
 	go func() {
-		logSystem("%s server running at http://localhost:%s", name, port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logSystem("%s server running at %s://localhost:%s", name, scheme, port)
+		var err error
+		if tlsConfig != nil {
+			// Certificates come from the TLS config, so no files are passed here
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logError("Server error: %v", err)
 			cancel() // Cancel context to trigger shutdown
 		}
@@ -171,6 +193,13 @@ func main() {
 		logSystem("Shutting down server due to error...")
 	}
 
+	// Report not ready and give load balancers time to stop sending traffic
+	proxy.Drain()
+	if settings.drainDelay > 0 {
+		logSystem("Draining for %v before shutdown...", settings.drainDelay)
+		time.Sleep(settings.drainDelay)
+	}
+
 	// Create a deadline context for shutdown
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer shutdownCancel()
@@ -181,300 +210,63 @@ func main() {
 	} else {
 		logSystem("Server shutdown gracefully")
 	}
-}
-
-// loggingMiddleware is a middleware for logging requests
-func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Generate random request ID (7-character hex format)
-		randomBytes := make([]byte, 4)
-		_, err := rand.Read(randomBytes)
-		requestID := hex.EncodeToString(randomBytes)[:7]
-		if err != nil {
-			// Fallback to timestamp if random generation fails
-			requestID = fmt.Sprintf("%d", time.Now().UnixNano())
-		}
-
-		// Create a new context with the request ID
-		ctx := context.WithValue(r.Context(), requestIDKey, requestID)
-
-		// Create a new request with the updated context
-		r = r.WithContext(ctx)
 
-		startTime := time.Now()
-		logRequest(requestID, "%s→%s %s %s from %s", colorPurple, colorReset, r.Method, r.URL.Path, r.RemoteAddr)
-
-		next(w, r)
-
-		duration := time.Since(startTime)
-		logRequest(requestID, "%s←%s Completed in %v", colorGreen, colorReset, duration)
-	}
+	// Stop background work and flush any spans still queued for export
+	proxy.Close(shutdownCtx)
+	return nil
 }
 
-// validateAPIKey checks if the provided API key is in the list of allowed keys
-func validateAPIKey(key string) bool {
-	if key == "" {
-		return false
-	}
-
-	allowedAPIKeysStr := os.Getenv("ALLOWED_API_KEYS")
-	if allowedAPIKeysStr == "" {
-		// If no allowed keys are configured, accept all keys (with a warning already logged at startup)
-		return true
-	}
-
-	// Split the comma-separated list of allowed API keys
-	allowedAPIKeys := strings.Split(allowedAPIKeysStr, ",")
-
-	// Trim whitespace from each key
-	for i, k := range allowedAPIKeys {
-		allowedAPIKeys[i] = strings.TrimSpace(k)
-	}
-
-	// Check if the provided key is in the list of allowed keys
-	for _, allowedKey := range allowedAPIKeys {
-		if key == allowedKey {
-			return true
-		}
-	}
-
-	return false
+// serverSettings are the settings for the server around the proxy
+type serverSettings struct {
+	port       string
+	tlsConfig  *tls.Config
+	drainDelay time.Duration
 }
 
-// extractAPIKey gets the API key from either the Authorization header or x-api-key header
-func extractAPIKey(r *http.Request) string {
-	// Try to get the key from the x-api-key header first
-	apiKey := r.Header.Get("x-api-key")
-	if apiKey != "" {
-		return apiKey
-	}
-
-	// If not found, try to extract from the Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if strings.HasPrefix(authHeader, "Bearer ") {
-		return strings.TrimPrefix(authHeader, "Bearer ")
+// loadServerSettings reads the server settings with getenv, logging certificate reloads to log
+// like the proxy's own messages
+func loadServerSettings(getenv func(string) string, log func(prxy.LogEntry)) (serverSettings, error) {
+	// Get port from environment variable or use default
+	settings := serverSettings{port: getenv("PORT")}
+	if settings.port == "" {
+		settings.port = defaultPort
 	}
-
-	// No API key found
-	return ""
-}
-
-// claudeProxyHandler handles the proxy request to the Claude API
-func claudeProxyHandler(w http.ResponseWriter, r *http.Request) {
-	// Get request ID from context
-	requestID := r.Context().Value(requestIDKey).(string)
-	logRequest(requestID, "Processing Claude API request")
-
-	// Extract and validate API key
-	apiKey := extractAPIKey(r)
-	if !validateAPIKey(apiKey) {
-		logRequest(requestID, "Unauthorized: Invalid API key")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Unauthorized: Invalid API key",
-		})
-		return
+	if _, err := strconv.ParseUint(settings.port, 10, 16); err != nil {
+		return serverSettings{}, fmt.Errorf("invalid PORT %q", settings.port)
 	}
 
-	// Read the request body
-	body, err := io.ReadAll(r.Body)
+	// Load TLS configuration if certificates are configured
+	tlsConfig, err := prxy.TLSConfigFromLookup(getenv, log)
 	if err != nil {
-		logError("[%s] Error reading request body: %v", requestID, err)
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to read request body",
-		})
-		return
-	}
-	defer r.Body.Close()
-
-	// Add stream parameter to the request body if it's not already present
-	var requestData map[string]interface{}
-	if err := json.Unmarshal(body, &requestData); err != nil {
-		logError("[%s] Invalid JSON in request body: %v", requestID, err)
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Invalid JSON request body",
-		})
-		return
+		return serverSettings{}, fmt.Errorf("invalid TLS configuration: %w", err)
 	}
+	settings.tlsConfig = tlsConfig
 
-	// Log model being used if present
-	if model, ok := requestData["model"].(string); ok {
-		logRequest(requestID, "Using model: %s", model)
-	}
-
-	// Check if client wants streaming
-	streamRequested := false
-	if streamValue, exists := requestData["stream"]; exists {
-		if streamBool, ok := streamValue.(bool); ok {
-			streamRequested = streamBool
+	// Get how long to keep serving while draining before shutdown
+	if value := getenv("SHUTDOWN_DRAIN_DELAY"); value != "" {
+		settings.drainDelay, err = time.ParseDuration(value)
+		if err != nil {
+			return serverSettings{}, fmt.Errorf("invalid SHUTDOWN_DRAIN_DELAY: %w", err)
 		}
 	}
+	return settings, nil
+}
 
-	// For non-streaming requests, ensure stream is set to false
-	if !streamRequested {
-		requestData["stream"] = false
-	}
-
-	// Convert modified request back to JSON
-	modifiedBody, err := json.Marshal(requestData)
+// printNewAPIKey generates a new API key and prints it with its hash and fingerprint
+func printNewAPIKey() error {
+	key, err := prxy.GenerateAPIKey()
 	if err != nil {
-		logError("[%s] Failed to marshal modified request: %v", requestID, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to process request",
-		})
-		return
+		return err
 	}
-
-	// Get Claude API URL from environment variable or use default
-	claudeURL := os.Getenv("CLAUDE_API_URL")
-	if claudeURL == "" {
-		claudeURL = defaultClaudeURL
-	}
-
-	// Create a new request to the Claude API (always use /v1/messages endpoint)
-	claudeAPIURL := claudeURL + "/v1/messages"
-	logRequest(requestID, "Forwarding request to Claude API at %s", claudeAPIURL)
-
-	proxyReq, err := http.NewRequest("POST", claudeAPIURL, bytes.NewBuffer(modifiedBody))
+	hash, err := prxy.HashAPIKey(key)
 	if err != nil {
-		logError("[%s] Failed to create proxy request: %v", requestID, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to create proxy request",
-		})
-		return
+		return err
 	}
 
-	// Set the required headers
-	proxyReq.Header.Set("Content-Type", "application/json")
-	proxyReq.Header.Set("anthropic-version", defaultAnthropicVersion)
-
-	// Copy relevant headers from the original request
-	for header, values := range r.Header {
-		headerName := strings.ToLower(header)
-		if headerName == "authorization" ||
-			headerName == "x-api-key" ||
-			headerName == "anthropic-version" ||
-			headerName == "anthropic-beta" {
-			for _, value := range values {
-				proxyReq.Header.Set(header, value)
-				// Log headers being set (but hide actual auth values)
-				if headerName == "authorization" || headerName == "x-api-key" {
-					logRequest(requestID, "Forwarding header: %s: [REDACTED]", header)
-				} else {
-					logRequest(requestID, "Forwarding header: %s: %s", header, value)
-				}
-			}
-		}
-	}
-
-	// Send the request to Claude API
-	startTime := time.Now()
-	client := &http.Client{
-		Timeout: timeout,
-	}
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		logError("[%s] Failed to send request to Claude API: %v", requestID, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": fmt.Sprintf("Failed to send request to Claude API: %v", err),
-		})
-		return
-	}
-	defer resp.Body.Close()
-	logRequest(requestID, "Claude API responded with status: %d in %v", resp.StatusCode, time.Since(startTime))
-
-	// Copy response headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
-
-	// If not streaming or error occurred, just copy the response directly
-	if !streamRequested || resp.StatusCode != http.StatusOK {
-		responseBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			logError("[%s] Error reading Claude API response body: %v", requestID, err)
-			return
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			logError("[%s] Claude API error response: %s", requestID, string(responseBody))
-		} else {
-			logRequest(requestID, "Sending complete non-streaming response (%d bytes)", len(responseBody))
-		}
-
-		// For proper handling of non-streaming responses, verify the JSON is valid
-		// but pass it through without modification
-		if !streamRequested && resp.StatusCode == http.StatusOK {
-			// Just verify it's valid JSON
-			var jsonCheck interface{}
-			if err := json.Unmarshal(responseBody, &jsonCheck); err != nil {
-				logWarning("[%s] Invalid JSON in Claude API non-streaming response: %v", requestID, err)
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(map[string]string{
-					"error": "Invalid JSON in Claude API response",
-				})
-				return
-			}
-		}
-
-		// Set the appropriate content type for non-streaming responses
-		if !streamRequested && resp.StatusCode == http.StatusOK {
-			w.Header().Set("Content-Type", "application/json")
-		}
-
-		w.Write(responseBody)
-		return
-	}
-
-	// For streaming responses, flush each chunk as it arrives
-	logRequest(requestID, "Starting to stream response")
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		logError("[%s] Streaming not supported by server", requestID)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Streaming not supported by server",
-		})
-		return
-	}
-
-	// Stream the response
-	buffer := make([]byte, 1024)
-	bytesStreamed := 0
-	streamStart := time.Now()
-
-	// Set appropriate headers for Server-Sent Events (SSE)
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	for {
-		n, err := resp.Body.Read(buffer)
-		if n > 0 {
-			bytesStreamed += n
-			_, writeErr := w.Write(buffer[:n])
-			if writeErr != nil {
-				logError("[%s] Error writing to client: %v", requestID, writeErr)
-				return
-			}
-			flusher.Flush()
-		}
-		if err != nil {
-			if err != io.EOF {
-				logError("[%s] Error reading from Claude API: %v", requestID, err)
-			} else {
-				logRequest(requestID, "Finished streaming response: %d bytes in %v", bytesStreamed, time.Since(streamStart))
-			}
-			break
-		}
-	}
+	fmt.Printf("Key:         %s\n", key)
+	fmt.Printf("Hash:        %s\n", hash)
+	fmt.Printf("Fingerprint: %s\n", prxy.FingerprintAPIKey(key))
+	fmt.Println()
+	fmt.Println("Give the key to the client and add the hash to ALLOWED_API_KEYS.")
+	return nil
 }
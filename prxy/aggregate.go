@@ -0,0 +1,317 @@
+package prxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Default interval between keep-alive bytes while a non-streaming response is aggregated
+const defaultStreamKeepAlive = 15 * time.Second
+
+// upstreamResult is the outcome of an upstream request made for aggregation
+type upstreamResult struct {
+	// body is the complete message built from the stream, or the upstream error body
+	body   []byte
+	status int
+	err    error
+	// sendFailed is true if the request could not be sent
+	sendFailed bool
+}
+
+// serveAggregated streams a request upstream for a client that asked for a complete response,
+// and returns the message assembled from the stream. While waiting, it writes whitespace,
+// which JSON parsers ignore, so that idle connection timeouts do not fire. The status is sent
+// with the first keep-alive, after which failures are reported in the body.
+//
+// clientStream reports whether the client asked for a stream, and whether that is known yet,
+// which for request bodies streamed upstream is only once the body has been sent. If the
+// client did ask for a stream, the upstream response is returned for the caller to pass on.
+func (p *Proxy) serveAggregated(w http.ResponseWriter, r *http.Request, upstream provider, proxyReq *http.Request, upstreamSpan *span, clientStream func() (bool, bool)) *http.Response {
+	requestID := r.Context().Value(requestIDKey).(string)
+	flusher, canFlush := w.(http.Flusher)
+
+	responses := make(chan *http.Response)
+	results := make(chan upstreamResult, 1)
+	startTime := time.Now()
+	go func() {
+		resp, err := upstream.send(p.client, proxyReq)
+		if err != nil {
+			results <- upstreamResult{err: err, sendFailed: true}
+			return
+		}
+		select {
+		case responses <- resp:
+		case <-r.Context().Done():
+			resp.Body.Close()
+		}
+	}()
+
+	var keepAlive <-chan time.Time
+	if canFlush {
+		ticker := time.NewTicker(p.streamKeepAlive)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+	committed := false
+
+	for {
+		select {
+		case resp := <-responses:
+			p.upstreamResponded(r, resp, upstreamSpan, startTime)
+			if stream, _ := clientStream(); stream {
+				return resp
+			}
+			if !committed {
+				copyResponseHeaders(w.Header(), resp.Header, p.responseHeaders)
+				w.Header().Set("Content-Type", "application/json")
+			}
+			go func() {
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					body, err := io.ReadAll(resp.Body)
+					results <- upstreamResult{body: body, status: resp.StatusCode, err: err}
+					return
+				}
+				body, status, err := aggregateStream(resp.Body)
+				results <- upstreamResult{body: body, status: status, err: err}
+			}()
+
+		case result := <-results:
+			if result.sendFailed {
+				upstreamSpan.setError("%v", result.err)
+				p.writeSendFailure(w, requestID, result.err, committed)
+				return nil
+			}
+			if result.err != nil {
+				p.write(LogError, requestID, "Failed to aggregate Claude API stream: %v", result.err)
+				upstreamSpan.setError("%v", result.err)
+				writeFailure(w, committed, http.StatusBadGateway, errorTypeAPI, "Failed to get a complete response from Claude API")
+				return nil
+			}
+			if result.status == http.StatusOK {
+				p.logRequest(requestID, "Aggregated streamed response in %v", time.Since(startTime))
+			}
+			upstreamSpan.finish()
+			p.writeCompleteResponse(w, r, result.status, result.body, committed)
+			return nil
+
+		case <-keepAlive:
+			// Nothing can be sent until it is known that the client wants a complete response
+			if stream, known := clientStream(); stream || !known {
+				continue
+			}
+			if !committed {
+				p.logRequest(requestID, "Sending keep-alive while the response is aggregated")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				committed = true
+			}
+			if _, err := w.Write([]byte(" ")); err != nil {
+				p.write(LogError, requestID, "Error writing keep-alive to client: %v", err)
+				return nil
+			}
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			p.logRequest(requestID, "Client disconnected while the response was aggregated")
+			return nil
+		}
+	}
+}
+
+// aggregateStream reads a streamed Messages response and assembles the message it describes.
+// An error event becomes the error response it would have been without streaming.
+func aggregateStream(body io.Reader) ([]byte, int, error) {
+	reader := bufio.NewReader(body)
+	agg := &streamAggregator{message: map[string]json.RawMessage{}}
+	var data []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		line = bytes.TrimRight(line, "\r\n")
+		if value, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = append(data, bytes.TrimPrefix(value, []byte(" "))...)
+		} else if len(line) == 0 && len(data) > 0 {
+			errorBody, status, err := agg.event(data)
+			if err != nil {
+				return nil, 0, err
+			}
+			if errorBody != nil {
+				return errorBody, status, nil
+			}
+			data = data[:0]
+			if agg.stopped {
+				message, err := agg.result()
+				return message, http.StatusOK, err
+			}
+		}
+
+		if err == io.EOF {
+			return nil, 0, errors.New("stream ended before message_stop")
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// streamAggregator builds a message from stream events, keeping the fields it does not know
+type streamAggregator struct {
+	message map[string]json.RawMessage
+	blocks  []*aggregatedBlock
+	stopped bool
+}
+
+// aggregatedBlock is a content block and the deltas applied to it so far
+type aggregatedBlock struct {
+	fields map[string]json.RawMessage
+	// appended holds text and thinking deltas
+	appended    map[string]*strings.Builder
+	partialJSON *strings.Builder
+	citations   []json.RawMessage
+}
+
+// event applies an event to the message, returning the error response for error events. Events
+// for content blocks that are out of order are an error.
+func (a *streamAggregator) event(data []byte) ([]byte, int, error) {
+	var event struct {
+		Type         string                     `json:"type"`
+		Index        int                        `json:"index"`
+		Message      map[string]json.RawMessage `json:"message"`
+		ContentBlock map[string]json.RawMessage `json:"content_block"`
+		Delta        map[string]json.RawMessage `json:"delta"`
+		Usage        map[string]json.RawMessage `json:"usage"`
+		Error        apiError                   `json:"error"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, 0, nil
+	}
+
+	switch event.Type {
+	case "message_start":
+		if event.Message != nil {
+			a.message = event.Message
+		}
+
+	case "content_block_start":
+		// Blocks start in order, so a start is for the next block or one already started
+		if event.Index < 0 || event.Index > len(a.blocks) {
+			return nil, 0, fmt.Errorf("%s for block %d of a message with %d blocks", event.Type, event.Index, len(a.blocks))
+		}
+		if event.Index == len(a.blocks) {
+			a.blocks = append(a.blocks, &aggregatedBlock{fields: map[string]json.RawMessage{}, appended: map[string]*strings.Builder{}})
+		}
+		if event.ContentBlock != nil {
+			a.blocks[event.Index].fields = event.ContentBlock
+		}
+
+	case "content_block_delta":
+		if event.Index < 0 || event.Index >= len(a.blocks) {
+			return nil, 0, fmt.Errorf("%s for block %d of a message with %d blocks", event.Type, event.Index, len(a.blocks))
+		}
+		block := a.blocks[event.Index]
+		var deltaType string
+		json.Unmarshal(event.Delta["type"], &deltaType)
+		switch deltaType {
+		case "text_delta":
+			block.appendString("text", event.Delta["text"])
+		case "thinking_delta":
+			block.appendString("thinking", event.Delta["thinking"])
+		case "signature_delta":
+			block.fields["signature"] = event.Delta["signature"]
+		case "input_json_delta":
+			var partial string
+			json.Unmarshal(event.Delta["partial_json"], &partial)
+			if block.partialJSON == nil {
+				block.partialJSON = &strings.Builder{}
+			}
+			block.partialJSON.WriteString(partial)
+		case "citations_delta":
+			block.citations = append(block.citations, event.Delta["citation"])
+		}
+
+	case "message_delta":
+		// The delta carries the stop reason and sequence, and usage has running totals
+		for key, value := range event.Delta {
+			a.message[key] = value
+		}
+		if len(event.Usage) > 0 {
+			usage := map[string]json.RawMessage{}
+			json.Unmarshal(a.message["usage"], &usage)
+			for key, value := range event.Usage {
+				usage[key] = value
+			}
+			a.message["usage"], _ = json.Marshal(usage)
+		}
+
+	case "message_stop":
+		a.stopped = true
+
+	case "error":
+		body, _ := json.Marshal(apiErrorResponse{Type: "error", Error: event.Error})
+		return body, statusForErrorType(event.Error.Type), nil
+	}
+	return nil, 0, nil
+}
+
+// appendString appends a JSON string delta to a field
+func (b *aggregatedBlock) appendString(field string, value json.RawMessage) {
+	var s string
+	json.Unmarshal(value, &s)
+	builder := b.appended[field]
+	if builder == nil {
+		builder = &strings.Builder{}
+		b.appended[field] = builder
+	}
+	builder.WriteString(s)
+}
+
+// result encodes the complete message
+func (a *streamAggregator) result() ([]byte, error) {
+	content := make([]map[string]json.RawMessage, 0, len(a.blocks))
+	for _, block := range a.blocks {
+		// Apply appended fields in a fixed order so the output is deterministic
+		fields := make([]string, 0, len(block.appended))
+		for field := range block.appended {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			var start string
+			json.Unmarshal(block.fields[field], &start)
+			block.fields[field], _ = json.Marshal(start + block.appended[field].String())
+		}
+
+		// Tool input arrives as fragments of JSON that are only valid once the block is complete
+		if block.partialJSON != nil {
+			input := strings.TrimSpace(block.partialJSON.String())
+			if input == "" {
+				input = "{}"
+			}
+			if !json.Valid([]byte(input)) {
+				return nil, fmt.Errorf("invalid tool input JSON in content block")
+			}
+			block.fields["input"] = json.RawMessage(input)
+		}
+
+		if len(block.citations) > 0 {
+			var citations []json.RawMessage
+			json.Unmarshal(block.fields["citations"], &citations)
+			block.fields["citations"], _ = json.Marshal(append(citations, block.citations...))
+		}
+		content = append(content, block.fields)
+	}
+
+	var err error
+	if a.message["content"], err = json.Marshal(content); err != nil {
+		return nil, err
+	}
+	return json.Marshal(a.message)
+}
@@ -0,0 +1,168 @@
+package prxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvents formats event payloads as a server-sent event stream
+func sseEvents(events ...string) string {
+	var b strings.Builder
+	for _, event := range events {
+		var typed struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal([]byte(event), &typed)
+		b.WriteString("event: " + typed.Type + "\r\ndata: " + event + "\r\n\r\n")
+	}
+	return b.String()
+}
+
+func TestAggregateStream(t *testing.T) {
+	stream := sseEvents(
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"stop_reason":null,"usage":{"input_tokens":10,"output_tokens":1},"container":null}}`,
+		`{"type":"ping"}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"Hmm"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":"","citations":[]}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"Hello "}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"citations_delta","citation":{"cited_text":"x"}}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"\"world\""}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"t1","name":"lookup","input":{}}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"q\":"}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":" 1}"}}`,
+		`{"type":"content_block_stop","index":2}`,
+		`{"type":"content_block_start","index":3,"content_block":{"type":"tool_use","id":"t2","name":"now","input":{}}}`,
+		`{"type":"content_block_stop","index":3}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":42}}`,
+		`{"type":"message_stop"}`,
+	)
+
+	body, status, err := aggregateStream(strings.NewReader(stream))
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("aggregateStream() = %d, %v", status, err)
+	}
+	want := `{"container":null,"content":[` +
+		`{"signature":"sig","thinking":"Hmm","type":"thinking"},` +
+		`{"citations":[{"cited_text":"x"}],"text":"Hello \"world\"","type":"text"},` +
+		`{"id":"t1","input":{"q":1},"name":"lookup","type":"tool_use"},` +
+		`{"id":"t2","input":{},"name":"now","type":"tool_use"}],` +
+		`"id":"msg_1","role":"assistant","stop_reason":"tool_use","stop_sequence":null,"type":"message",` +
+		`"usage":{"input_tokens":10,"output_tokens":42}}`
+	if string(body) != want {
+		t.Errorf("message =\n%s\nwant\n%s", body, want)
+	}
+}
+
+func TestAggregateStreamErrors(t *testing.T) {
+	start := `{"type":"message_start","message":{"content":[]}}`
+	textStart := `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`
+	tests := []struct {
+		name   string
+		stream string
+		status int
+		want   string
+	}{
+		{
+			name:   "error event",
+			stream: sseEvents(start, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`),
+			status: 529,
+			want:   `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+		},
+		{
+			name:   "ends before message_stop",
+			stream: sseEvents(start, textStart),
+			want:   "stream ended before message_stop",
+		},
+		{
+			name: "invalid tool input",
+			stream: sseEvents(start,
+				`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"t1","name":"x","input":{}}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"q\""}}`,
+				`{"type":"message_stop"}`),
+			want: "invalid tool input JSON",
+		},
+		{
+			name:   "negative start index",
+			stream: sseEvents(start, `{"type":"content_block_start","index":-1,"content_block":{"type":"text","text":""}}`),
+			want:   "content_block_start for block -1",
+		},
+		{
+			name:   "start index past the next block",
+			stream: sseEvents(start, `{"type":"content_block_start","index":1000000000,"content_block":{"type":"text","text":""}}`),
+			want:   "content_block_start for block 1000000000",
+		},
+		{
+			name:   "negative delta index",
+			stream: sseEvents(start, textStart, `{"type":"content_block_delta","index":-1,"delta":{"type":"text_delta","text":"a"}}`),
+			want:   "content_block_delta for block -1",
+		},
+		{
+			name:   "delta for a block that has not started",
+			stream: sseEvents(start, textStart, `{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"a"}}`),
+			want:   "content_block_delta for block 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, status, err := aggregateStream(strings.NewReader(tt.stream))
+			if tt.status != 0 {
+				if err != nil || status != tt.status || string(body) != tt.want {
+					t.Errorf("aggregateStream() = %d %s, %v, want %d %s", status, body, err, tt.status, tt.want)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregatedRequest(t *testing.T) {
+	var upstreamStream interface{}
+	p := newTestProxy(t, Config{
+		AllowedAPIKeys:   []string{"client-key"},
+		AggregateStreams: true,
+		StreamKeepAlive:  5 * time.Millisecond,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		upstreamStream = req["stream"]
+		time.Sleep(50 * time.Millisecond)
+		if req["model"] == "broken" {
+			io.WriteString(w, sseEvents(`{"type":"message_start","message":{"content":[]}}`,
+				`{"type":"content_block_delta","index":-1,"delta":{"type":"text_delta","text":"a"}}`))
+			return
+		}
+		io.WriteString(w, sseEvents(
+			`{"type":"message_start","message":{"type":"message","content":[],"usage":{"input_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}`,
+			`{"type":"message_stop"}`,
+		))
+	})
+
+	body := `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`
+	w := serve(p, "POST", "/v1/messages", body, map[string]string{"x-api-key": "client-key"})
+	if w.Code != http.StatusOK || upstreamStream != true {
+		t.Fatalf("status %d with stream %v upstream", w.Code, upstreamStream)
+	}
+	// Keep-alive whitespace comes before the message
+	if !strings.HasPrefix(w.Body.String(), " ") || strings.TrimSpace(w.Body.String()) != `{"content":[{"text":"Hi","type":"text"}],"type":"message","usage":{"input_tokens":1}}` {
+		t.Errorf("body = %q", w.Body)
+	}
+
+	// After the keep-alives have sent the status, failures are reported in the body
+	w = serve(p, "POST", "/v1/messages", strings.Replace(body, "claude-x", "broken", 1), map[string]string{"x-api-key": "client-key"})
+	if got := decodeAPIError(t, strings.TrimSpace(w.Body.String())); got.Error.Type != errorTypeAPI {
+		t.Errorf("error = %+v", got)
+	}
+}
@@ -0,0 +1,102 @@
+package prxy
+
+import "net/http"
+
+// principal identifies the caller of an authenticated request
+type principal struct {
+	// fingerprint is a non-secret identifier for logs and response headers
+	fingerprint string
+	// claims is set when the caller used a short-lived token
+	claims *tokenClaims
+	// headers are static upstream headers configured for the caller's key
+	headers http.Header
+	// owner identifies the caller as the owner of uploaded files, or is empty if the caller
+	// cannot use files
+	owner string
+	// provider serves the caller's Messages requests, or is empty for the default provider
+	provider string
+	// keyID is the ID of the caller's API key, or of the key that issued its token
+	keyID string
+}
+
+// authenticateRequest checks the request with the Authenticate hook, then its API key,
+// short-lived token or client certificate
+func (p *Proxy) authenticateRequest(r *http.Request) (*principal, *Error) {
+	requestID := r.Context().Value(requestIDKey).(string)
+	origin := r.Header.Get("Origin")
+	apiKey := extractAPIKey(r)
+
+	// Callers accepted or rejected by the embedding application
+	if p.hooks.Authenticate != nil {
+		caller, err := p.hooks.Authenticate(r)
+		if err != nil {
+			p.logRequest(requestID, "Unauthorized: %v", err)
+			return nil, asError(err, http.StatusUnauthorized, errorTypeAuthentication)
+		}
+		if caller != nil {
+			p.logRequest(requestID, "Authorized caller %s", caller.ID)
+			return &principal{fingerprint: caller.ID, headers: caller.Headers, owner: "caller:" + caller.ID, provider: caller.Provider}, nil
+		}
+	}
+
+	// Short-lived tokens minted by the token endpoint
+	if isToken(apiKey) {
+		claims, err := validateToken(apiKey, origin, p.tokenKey)
+		if err != nil {
+			p.logRequest(requestID, "Unauthorized: Invalid token: %v", err)
+			return nil, &Error{http.StatusUnauthorized, errorTypeAuthentication, "Invalid token"}
+		}
+		caller := &principal{fingerprint: "token:" + claims.ID[:8], claims: claims, owner: claims.Owner, keyID: claims.KeyID}
+		if p.keys != nil || p.keyFile != nil {
+			// Tokens only last as long as the key that issued them
+			hash := p.keyByID(claims.KeyID)
+			if hash == nil {
+				p.logRequest(requestID, "Unauthorized: %s was issued to key %s, which is no longer allowed", caller.fingerprint, claims.Subject)
+				return nil, &Error{http.StatusUnauthorized, errorTypeAuthentication, "Invalid token"}
+			}
+			caller.headers = hash.headers
+			caller.provider = hash.provider
+		}
+		p.logRequest(requestID, "Authorized %s issued to key %s", caller.fingerprint, claims.Subject)
+		return caller, nil
+	}
+
+	// Verified client certificates identify the caller. Without an API key they stand in for one,
+	// which needs an upstream key to send instead.
+	identity := clientCertIdentity(r, p.clientIdentities)
+	if identity != "" && apiKey == "" {
+		if p.upstreamAPIKey == "" {
+			p.logRequest(requestID, "Unauthorized: Client certificate identity %s sent no API key, and there is no upstream key to use", identity)
+			return nil, &Error{http.StatusUnauthorized, errorTypeAuthentication, "Invalid API key"}
+		}
+		p.logRequest(requestID, "Authorized client certificate identity %s", identity)
+		return &principal{fingerprint: "mtls:" + identity, owner: "mtls:" + identity}, nil
+	}
+
+	// API keys
+	keyFingerprint := FingerprintAPIKey(apiKey)
+	hash, err := p.validateAPIKey(apiKey, origin)
+	if err == errOriginNotAllowed {
+		p.logRequest(requestID, "Forbidden: API key %s used from origin %q", keyFingerprint, origin)
+		return nil, &Error{http.StatusForbidden, errorTypePermission, "API key is not allowed from this origin"}
+	} else if err != nil {
+		p.logRequest(requestID, "Unauthorized: Invalid API key %s", keyFingerprint)
+		return nil, &Error{http.StatusUnauthorized, errorTypeAuthentication, "Invalid API key"}
+	}
+	caller := &principal{fingerprint: keyFingerprint, owner: keyOwner(apiKey)}
+	if hash != nil {
+		caller.headers = hash.headers
+		caller.provider = hash.provider
+		caller.keyID = hash.id
+	}
+	// A key sent with a client certificate must still be valid, and its settings apply, but the
+	// certificate identifies the caller
+	if identity != "" {
+		p.logRequest(requestID, "Authorized client certificate identity %s with API key %s", identity, keyFingerprint)
+		caller.fingerprint = "mtls:" + identity
+		caller.owner = "mtls:" + identity
+		return caller, nil
+	}
+	p.logRequest(requestID, "Authorized API key %s", keyFingerprint)
+	return caller, nil
+}
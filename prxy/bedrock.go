@@ -0,0 +1,213 @@
+package prxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Bedrock request constants
+const (
+	bedrockAnthropicVersion = "bedrock-2023-05-31"
+	bedrockService          = "bedrock"
+	bedrockStreamType       = "application/vnd.amazon.eventstream"
+	// Largest Bedrock error body that is read
+	maxBedrockErrorBytes = 1 << 20
+)
+
+// bedrockProvider sends Messages requests to the Bedrock InvokeModel and
+// InvokeModelWithResponseStream APIs, signed with the configured AWS credentials
+type bedrockProvider struct {
+	logger
+	endpoint    string
+	signer      *sigv4Signer
+	models      map[string]string
+	modelPrefix string
+}
+
+// newBedrockProvider checks the Bedrock configuration and fills in its defaults
+func newBedrockProvider(cfg BedrockConfig, l logger) (*bedrockProvider, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	endpoint := strings.TrimSuffix(cfg.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = "https://bedrock-runtime." + cfg.Region + ".amazonaws.com"
+	}
+	return &bedrockProvider{
+		logger:   l,
+		endpoint: endpoint,
+		signer: &sigv4Signer{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			sessionToken:    cfg.SessionToken,
+			region:          cfg.Region,
+			service:         bedrockService,
+		},
+		models:      cfg.Models,
+		modelPrefix: cfg.ModelPrefix,
+	}, nil
+}
+
+// validate checks that the Bedrock settings are complete
+func (cfg BedrockConfig) validate() error {
+	if cfg.Region == "" {
+		return fmt.Errorf("Bedrock needs a region")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return fmt.Errorf("Bedrock needs AWS credentials")
+	}
+	return nil
+}
+
+func (b *bedrockProvider) baseURL() string {
+	return b.endpoint
+}
+
+// modelID returns the Bedrock model ID for a Claude API model name. Names without a
+// configured mapping are assumed to be the Claude API name of an Anthropic model, unless
+// they are already Bedrock IDs or ARNs.
+func (b *bedrockProvider) modelID(model string) string {
+	if id, ok := b.models[model]; ok {
+		return id
+	}
+	if strings.HasPrefix(model, "claude-") {
+		return b.modelPrefix + "anthropic." + model + "-v1:0"
+	}
+	return model
+}
+
+// send rewrites a Messages request for Bedrock, which takes the model and streaming in the URL
+// and the API version and betas in the body. The body is read in full, since it is signed.
+func (b *bedrockProvider) send(client *http.Client, req *http.Request) (*http.Response, error) {
+	requestID := RequestIDFromContext(req.Context())
+	request, errResp, err := readProviderRequest(req)
+	if request == nil {
+		return errResp, err
+	}
+	stream := request.stream
+	modelID := b.modelID(request.model)
+
+	delete(request.fields, "model")
+	delete(request.fields, "stream")
+	request.setDefault("anthropic_version", bedrockAnthropicVersion)
+	if _, ok := request.fields["anthropic_beta"]; !ok {
+		var betas []string
+		for _, value := range req.Header.Values("anthropic-beta") {
+			for _, beta := range strings.Split(value, ",") {
+				if beta = strings.TrimSpace(beta); beta != "" {
+					betas = append(betas, beta)
+				}
+			}
+		}
+		if len(betas) > 0 {
+			request.setDefault("anthropic_beta", betas)
+		}
+	}
+	bedrockBody, err := json.Marshal(request.fields)
+	if err != nil {
+		return nil, err
+	}
+
+	action, accept := "invoke", "application/json"
+	if stream {
+		action, accept = "invoke-with-response-stream", bedrockStreamType
+	}
+	bedrockURL := b.endpoint + "/model/" + awsEscape(modelID) + "/" + action
+	b.logRequest(requestID, "Forwarding request to Bedrock model %s at %s", modelID, bedrockURL)
+
+	bedrockReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, bedrockURL, bytes.NewReader(bedrockBody))
+	if err != nil {
+		return nil, err
+	}
+	// Client credentials and Claude API headers are never sent to Bedrock, but Bedrock's own
+	// headers, such as guardrail settings, may be configured as static headers
+	bedrockReq.Header.Set("Content-Type", "application/json")
+	bedrockReq.Header.Set("Accept", accept)
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); lower == "traceparent" || strings.HasPrefix(lower, "x-amzn-bedrock-") {
+			bedrockReq.Header[name] = values
+		}
+	}
+	b.signer.sign(bedrockReq, bedrockBody, time.Now())
+
+	resp, err := client.Do(bedrockReq)
+	if err != nil {
+		return nil, err
+	}
+	if requestID := resp.Header.Get("X-Amzn-Requestid"); requestID != "" {
+		resp.Header.Set("request-id", requestID)
+	}
+
+	// Errors and streams are converted to the Claude API format
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxBedrockErrorBytes))
+		var bedrockErr struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &bedrockErr)
+		exception := resp.Header.Get("X-Amzn-Errortype")
+		errorType, status := bedrockErrorType(exception, resp.StatusCode)
+		if bedrockCredentialsRejected(exception) {
+			b.write(LogError, requestID, "Bedrock rejected the AWS credentials: %s", bedrockErr.Message)
+			bedrockErr.Message = "Bedrock rejected the proxy's credentials"
+		}
+		if bedrockErr.Message == "" {
+			bedrockErr.Message = http.StatusText(resp.StatusCode)
+		}
+		converted := errorResponse(req, status, errorType, bedrockErr.Message)
+		converted.Header.Set("request-id", resp.Header.Get("request-id"))
+		return converted, nil
+	}
+	if stream {
+		resp.Body = newEventStreamSSE(resp.Body)
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		resp.Header.Set("Content-Type", "text/event-stream")
+	}
+	return resp, nil
+}
+
+// bedrockErrorType returns the Claude API error type and status for a Bedrock exception, such as
+// "ThrottlingException" or "throttlingException" in streams, falling back to the Bedrock status
+func bedrockErrorType(exception string, status int) (string, int) {
+	name, _, _ := strings.Cut(exception, ":")
+	name = strings.TrimSuffix(strings.ToLower(name), "exception")
+	switch name {
+	case "validation":
+		return errorTypeInvalidRequest, http.StatusBadRequest
+	case "accessdenied":
+		return errorTypePermission, http.StatusForbidden
+	case "resourcenotfound":
+		return errorTypeNotFound, http.StatusNotFound
+	case "throttling", "servicequotaexceeded":
+		return errorTypeRateLimit, http.StatusTooManyRequests
+	case "serviceunavailable", "modelnotready":
+		return errorTypeOverloaded, statusForErrorType(errorTypeOverloaded)
+	case "modeltimeout":
+		return errorTypeAPI, http.StatusGatewayTimeout
+	case "modelerror", "modelstreamerror", "internalserver":
+		return errorTypeAPI, http.StatusInternalServerError
+	}
+	if bedrockCredentialsRejected(exception) {
+		return errorTypeAPI, http.StatusInternalServerError
+	}
+
+	return errorTypeForStatus(status)
+}
+
+// bedrockCredentialsRejected reports whether a Bedrock exception means the proxy's AWS
+// credentials or signature were rejected, which is not the client's fault
+func bedrockCredentialsRejected(exception string) bool {
+	name, _, _ := strings.Cut(exception, ":")
+	switch strings.TrimSuffix(strings.ToLower(name), "exception") {
+	case "unrecognizedclient", "invalidsignature", "incompletesignature", "expiredtoken", "missingauthenticationtoken":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package prxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newBedrockTestProxy returns a proxy that sends Messages requests to a stand-in for Bedrock
+func newBedrockTestProxy(t *testing.T, bedrock http.HandlerFunc) *Proxy {
+	t.Helper()
+	server := httptest.NewServer(bedrock)
+	t.Cleanup(server.Close)
+	return newTestProxy(t, Config{
+		AllowedAPIKeys:   []string{"client-key"},
+		UpstreamProvider: ProviderBedrock,
+		UpstreamHeaders:  http.Header{"X-Amzn-Bedrock-Guardrailidentifier": {"g1"}},
+		Bedrock: &BedrockConfig{
+			Region:          "us-west-2",
+			Endpoint:        server.URL + "/",
+			AccessKeyID:     "AKIDEXAMPLE",
+			SecretAccessKey: "secret",
+			SessionToken:    "session",
+			Models:          map[string]string{"claude-mapped": "arn:aws:bedrock:us-west-2:123:inference-profile/p1"},
+		},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Messages request sent to the Claude API: %s", r.URL)
+	})
+}
+
+func TestBedrockModelID(t *testing.T) {
+	b, err := newBedrockProvider(BedrockConfig{
+		Region: "us-east-1", AccessKeyID: "id", SecretAccessKey: "secret",
+		Models:      map[string]string{"claude-mapped": "us.anthropic.claude-mapped-v2:0"},
+		ModelPrefix: "eu.",
+	}, logger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.baseURL() != "https://bedrock-runtime.us-east-1.amazonaws.com" {
+		t.Errorf("baseURL() = %s", b.baseURL())
+	}
+	tests := map[string]string{
+		"claude-mapped":                   "us.anthropic.claude-mapped-v2:0",
+		"claude-sonnet-4-5-20250929":      "eu.anthropic.claude-sonnet-4-5-20250929-v1:0",
+		"anthropic.claude-x-v1:0":         "anthropic.claude-x-v1:0",
+		"arn:aws:bedrock:us-east-1:1:x/y": "arn:aws:bedrock:us-east-1:1:x/y",
+	}
+	for model, want := range tests {
+		if got := b.modelID(model); got != want {
+			t.Errorf("modelID(%s) = %s, want %s", model, got, want)
+		}
+	}
+
+	for _, cfg := range []BedrockConfig{{AccessKeyID: "id", SecretAccessKey: "secret"}, {Region: "us-east-1", AccessKeyID: "id"}} {
+		if _, err := newBedrockProvider(cfg, logger{}); err == nil {
+			t.Errorf("newBedrockProvider(%+v) succeeded", cfg)
+		}
+	}
+}
+
+func TestBedrockInvoke(t *testing.T) {
+	var got *http.Request
+	var gotBody map[string]interface{}
+	p := newBedrockTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Amzn-Requestid", "aws-request-1")
+		io.WriteString(w, `{"id":"msg_1","type":"message","usage":{"input_tokens":1,"output_tokens":1}}`)
+	})
+
+	w := serve(p, "POST", "/v1/messages", `{"model":"claude-x","max_tokens":10,"stream":false,"messages":[{"role":"user","content":"hi"}]}`, map[string]string{
+		"x-api-key":         "client-key",
+		"anthropic-version": "2023-06-01",
+		"anthropic-beta":    "beta-1, beta-2",
+		"traceparent":       "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	})
+	if w.Code != http.StatusOK || w.Header().Get("request-id") != "aws-request-1" {
+		t.Fatalf("status = %d with request-id %q: %s", w.Code, w.Header().Get("request-id"), w.Body)
+	}
+
+	if got.Method != "POST" || got.URL.EscapedPath() != "/model/anthropic.claude-x-v1%3A0/invoke" {
+		t.Errorf("request = %s %s", got.Method, got.URL.EscapedPath())
+	}
+	if !strings.HasPrefix(got.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+		got.Header.Get("X-Amz-Security-Token") != "session" || got.Header.Get("X-Amz-Date") == "" {
+		t.Errorf("request is not signed: %v", got.Header)
+	}
+	for _, name := range []string{"x-api-key", "anthropic-version", "anthropic-beta"} {
+		if got.Header.Get(name) != "" {
+			t.Errorf("%s header sent to Bedrock", name)
+		}
+	}
+	if got.Header.Get("traceparent") == "" || got.Header.Get("X-Amzn-Bedrock-GuardrailIdentifier") != "g1" || got.Header.Get("Accept") != "application/json" {
+		t.Errorf("headers = %v", got.Header)
+	}
+
+	body, _ := json.Marshal(gotBody)
+	if want := `{"anthropic_beta":["beta-1","beta-2"],"anthropic_version":"bedrock-2023-05-31","max_tokens":10,"messages":[{"content":"hi","role":"user"}]}`; string(body) != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+}
+
+func TestBedrockStream(t *testing.T) {
+	start := `{"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":1,"output_tokens":1}}}`
+	stop := `{"type":"message_stop"}`
+	var gotPath, gotAccept string
+	p := newBedrockTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotAccept = r.URL.EscapedPath(), r.Header.Get("Accept")
+		w.Header().Set("Content-Type", bedrockStreamType)
+		w.Write(bedrockChunk(start))
+		w.Write(bedrockChunk(stop))
+	})
+
+	w := serve(p, "POST", "/v1/messages", `{"model":"claude-mapped","max_tokens":10,"stream":true,"messages":[{"role":"user","content":"hi"}]}`, map[string]string{"x-api-key": "client-key"})
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("status = %d, Content-Type %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	if gotPath != "/model/arn%3Aaws%3Abedrock%3Aus-west-2%3A123%3Ainference-profile%2Fp1/invoke-with-response-stream" || gotAccept != bedrockStreamType {
+		t.Errorf("request = %s with Accept %q", gotPath, gotAccept)
+	}
+	if want := strings.ReplaceAll(sseEvents(start, stop), "\r\n", "\n"); w.Body.String() != want {
+		t.Errorf("events =\n%s\nwant\n%s", w.Body, want)
+	}
+}
+
+func TestBedrockErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		exception   string
+		body        string
+		wantStatus  int
+		wantType    string
+		wantMessage string
+	}{
+		{
+			name: "validation", status: http.StatusBadRequest, exception: "ValidationException:http://internal.amazon.com/coral/com.amazon.bedrock/",
+			body: `{"message":"max_tokens: Field required"}`, wantStatus: http.StatusBadRequest, wantType: errorTypeInvalidRequest, wantMessage: "max_tokens: Field required",
+		},
+		{
+			name: "throttling", status: http.StatusTooManyRequests, exception: "ThrottlingException",
+			body: `{"message":"Too many requests"}`, wantStatus: http.StatusTooManyRequests, wantType: errorTypeRateLimit, wantMessage: "Too many requests",
+		},
+		{
+			name: "model not ready", status: http.StatusTooManyRequests, exception: "ModelNotReadyException",
+			wantStatus: statusForErrorType(errorTypeOverloaded), wantType: errorTypeOverloaded, wantMessage: "Too Many Requests",
+		},
+		{
+			// The proxy's own credentials are not the client's problem, nor shown to it
+			name: "bad credentials", status: http.StatusForbidden, exception: "UnrecognizedClientException",
+			body: `{"message":"The security token included in the request is invalid."}`, wantStatus: http.StatusInternalServerError,
+			wantType: errorTypeAPI, wantMessage: "Bedrock rejected the proxy's credentials",
+		},
+		{
+			name: "access denied", status: http.StatusForbidden, exception: "AccessDeniedException",
+			body: `{"message":"No access to the model"}`, wantStatus: http.StatusForbidden, wantType: errorTypePermission, wantMessage: "No access to the model",
+		},
+		{
+			name: "unknown exception", status: http.StatusBadGateway, body: "<html>",
+			wantStatus: http.StatusInternalServerError, wantType: errorTypeAPI, wantMessage: "Bad Gateway",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newBedrockTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.exception != "" {
+					w.Header().Set("X-Amzn-Errortype", tt.exception)
+				}
+				w.Header().Set("X-Amzn-Requestid", "aws-request-1")
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			})
+			w := serve(p, "POST", "/v1/messages", `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`, map[string]string{"x-api-key": "client-key"})
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Header().Get("request-id") != "aws-request-1" {
+				t.Errorf("request-id = %q", w.Header().Get("request-id"))
+			}
+			resp := decodeAPIError(t, w.Body.String())
+			if resp.Error.Type != tt.wantType || resp.Error.Message != tt.wantMessage {
+				t.Errorf("error = %+v, want %s %q", resp.Error, tt.wantType, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestBedrockErrorType(t *testing.T) {
+	tests := []struct {
+		exception  string
+		status     int
+		wantType   string
+		wantStatus int
+	}{
+		{"validationException", 0, errorTypeInvalidRequest, http.StatusBadRequest},
+		{"ResourceNotFoundException", 404, errorTypeNotFound, http.StatusNotFound},
+		{"ServiceQuotaExceededException", 400, errorTypeRateLimit, http.StatusTooManyRequests},
+		{"serviceUnavailableException", 0, errorTypeOverloaded, statusForErrorType(errorTypeOverloaded)},
+		{"ModelTimeoutException", 408, errorTypeAPI, http.StatusGatewayTimeout},
+		{"modelStreamErrorException", 0, errorTypeAPI, http.StatusInternalServerError},
+		{"ExpiredTokenException", 403, errorTypeAPI, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		errorType, status := bedrockErrorType(tt.exception, tt.status)
+		if errorType != tt.wantType || status != tt.wantStatus {
+			t.Errorf("bedrockErrorType(%s) = %s %d, want %s %d", tt.exception, errorType, status, tt.wantType, tt.wantStatus)
+		}
+	}
+}
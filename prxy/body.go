@@ -0,0 +1,286 @@
+package prxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Longest top-level value that is captured for inspection
+const maxCapturedValue = 1024
+
+// bodyScanner passes a request body through unchanged apart from the top-level "stream" field,
+// reading the top-level model and stream values as the bytes go by. It never holds more than
+// one read's worth of the body, so large bodies can be forwarded as they arrive.
+type bodyScanner struct {
+	src io.Reader
+	// forceStream sets "stream" to true, adding it if it is missing
+	forceStream bool
+
+	// Lexer state
+	depth    int
+	inString bool
+	escaped  bool
+	state    int
+	key      []byte
+	members  int
+
+	// The top-level value being read, its key, and whether it is held back for replacement
+	valueKey  string
+	value     []byte
+	holding   bool
+	literal   bool
+	valueOpen bool
+
+	buf []byte
+	out []byte
+	err error
+
+	// streamSeen is true once the top-level stream field has been read
+	streamSeen bool
+
+	mu       sync.Mutex
+	result   bodyScanResult
+	finished bool
+}
+
+// bodyScanResult is what the scanner learned about the request
+type bodyScanResult struct {
+	Model string
+	// Stream is the client's own stream value, before any change
+	Stream bool
+	// Patched is true if the body was changed
+	Patched bool
+}
+
+// Top-level lexer states
+const (
+	scanStart = iota
+	scanKey
+	scanColon
+	scanValue
+	scanInValue
+	scanAfterValue
+	scanDone
+)
+
+// newBodyScanner wraps a request body
+func newBodyScanner(src io.Reader, forceStream bool) *bodyScanner {
+	return &bodyScanner{src: src, forceStream: forceStream}
+}
+
+// Read returns the next bytes of the (possibly patched) body
+func (s *bodyScanner) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.buf == nil {
+			s.buf = make([]byte, 32*1024)
+		}
+		n, err := s.src.Read(s.buf)
+		for _, c := range s.buf[:n] {
+			s.scan(c)
+		}
+		if err == io.EOF {
+			s.finish()
+		}
+		s.err = err
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// Result returns what the scanner found, and whether the whole body has been read
+func (s *bodyScanner) Result() (bodyScanResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result, s.finished
+}
+
+// emit outputs a byte, holding it back if it belongs to a value that may be replaced
+func (s *bodyScanner) emit(c byte) {
+	if s.valueOpen && (s.holding || len(s.value) < maxCapturedValue) {
+		s.value = append(s.value, c)
+	}
+	if !s.holding {
+		s.out = append(s.out, c)
+	}
+}
+
+// scan advances the lexer by one byte. Only the top-level object's keys and values are tracked;
+// nested values are skipped by depth.
+func (s *bodyScanner) scan(c byte) {
+	if s.inString {
+		closing := !s.escaped && c == '"'
+		if s.state == scanKey && s.depth == 1 && !closing && len(s.key) < maxCapturedValue {
+			s.key = append(s.key, c)
+		}
+		s.emit(c)
+		switch {
+		case s.escaped:
+			s.escaped = false
+		case c == '\\':
+			s.escaped = true
+		case closing:
+			s.inString = false
+			if s.depth == 1 {
+				switch s.state {
+				case scanKey:
+					s.state = scanColon
+				case scanInValue:
+					s.endValue()
+				}
+			}
+		}
+		return
+	}
+
+	// A literal value ends at the first delimiter after it
+	if s.state == scanInValue && s.literal && s.depth == 1 && isJSONDelimiter(c) {
+		s.endValue()
+	}
+
+	switch {
+	case c == '"':
+		if s.depth == 1 {
+			switch s.state {
+			case scanStart, scanKey:
+				s.state = scanKey
+				s.key = s.key[:0]
+			case scanValue:
+				s.startValue(false)
+			}
+		}
+		s.inString = true
+		s.emit(c)
+
+	case c == '{' || c == '[':
+		if s.depth == 0 && c == '{' {
+			s.state = scanStart
+		} else if s.depth == 1 && s.state == scanValue {
+			s.startValue(false)
+		}
+		s.depth++
+		s.emit(c)
+
+	case c == '}' || c == ']':
+		s.depth--
+		if s.depth == 0 {
+			// The end of the top-level object, where a missing stream field is added
+			if s.forceStream && !s.streamSeen {
+				field := `"stream":true`
+				if s.members > 0 {
+					field = "," + field
+				}
+				s.out = append(s.out, field...)
+				s.setPatched()
+			}
+			s.state = scanDone
+			s.emit(c)
+			return
+		}
+		s.emit(c)
+		if s.depth == 1 && s.state == scanInValue && !s.literal {
+			s.endValue()
+		}
+
+	case c == ':':
+		if s.depth == 1 && s.state == scanColon {
+			s.state = scanValue
+		}
+		s.emit(c)
+
+	case c == ',':
+		if s.depth == 1 && s.state == scanAfterValue {
+			s.state = scanKey
+		}
+		s.emit(c)
+
+	case isJSONDelimiter(c):
+		s.emit(c)
+
+	default:
+		if s.depth == 1 && s.state == scanValue {
+			s.startValue(true)
+		}
+		s.emit(c)
+	}
+}
+
+// startValue begins a top-level value, holding back the stream value so it can be replaced
+func (s *bodyScanner) startValue(literal bool) {
+	var key string
+	json.Unmarshal(append(append([]byte{'"'}, s.key...), '"'), &key)
+	s.valueKey = key
+	s.value = s.value[:0]
+	s.literal = literal
+	s.valueOpen = true
+	s.holding = key == "stream"
+	s.state = scanInValue
+}
+
+// endValue finishes a top-level value, recording the fields of interest
+func (s *bodyScanner) endValue() {
+	s.members++
+	s.state = scanAfterValue
+	s.valueOpen = false
+
+	switch s.valueKey {
+	case "model":
+		var model string
+		if json.Unmarshal(s.value, &model) == nil {
+			s.mu.Lock()
+			s.result.Model = model
+			s.mu.Unlock()
+		}
+	case "stream":
+		s.holding = false
+		stream := bytes.Equal(s.value, []byte("true"))
+		s.streamSeen = true
+		s.mu.Lock()
+		s.result.Stream = stream
+		s.mu.Unlock()
+		// Values that are not booleans are left for the Claude API to reject
+		if s.forceStream && (bytes.Equal(s.value, []byte("false")) || bytes.Equal(s.value, []byte("null"))) {
+			s.out = append(s.out, "true"...)
+			s.setPatched()
+		} else {
+			s.out = append(s.out, s.value...)
+		}
+	}
+}
+
+// setPatched records that the body was changed
+func (s *bodyScanner) setPatched() {
+	s.mu.Lock()
+	s.result.Patched = true
+	s.mu.Unlock()
+}
+
+// finish marks the whole body as read, ending a literal value at the end of the input
+func (s *bodyScanner) finish() {
+	if s.state == scanInValue && s.literal {
+		s.endValue()
+	}
+	s.mu.Lock()
+	s.finished = true
+	s.mu.Unlock()
+}
+
+// isJSONDelimiter reports whether c ends a JSON literal
+func isJSONDelimiter(c byte) bool {
+	switch c {
+	case ',', '}', ']', ' ', '\t', '\r', '\n':
+		return true
+	}
+	return false
+}
+
+// forceStreamField returns an in-memory body with stream set to true
+func forceStreamField(body []byte) []byte {
+	patched, _ := io.ReadAll(newBodyScanner(bytes.NewReader(body), true))
+	return patched
+}
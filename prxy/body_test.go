@@ -0,0 +1,143 @@
+package prxy
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// splitReader returns its data in two reads, split at the given offset
+type splitReader struct {
+	data  []byte
+	split int
+}
+
+func (r *splitReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := len(r.data)
+	if r.split > 0 && r.split < n {
+		n = r.split
+	}
+	n = copy(p, r.data[:n])
+	r.data = r.data[n:]
+	r.split -= n
+	return n, nil
+}
+
+func TestBodyScanner(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		forceStream bool
+		want        string
+		result      bodyScanResult
+	}{
+		{
+			name: "unchanged without forcing",
+			body: `{"stream":false,"model":"claude-x","max_tokens":1}`,
+			want: `{"stream":false,"model":"claude-x","max_tokens":1}`, result: bodyScanResult{Model: "claude-x"},
+		},
+		{
+			name: "stream absent", forceStream: true,
+			body:   `{"model":"claude-x","messages":[{"role":"user","content":"hi"}]}`,
+			want:   `{"model":"claude-x","messages":[{"role":"user","content":"hi"}],"stream":true}`,
+			result: bodyScanResult{Model: "claude-x", Patched: true},
+		},
+		{
+			name: "empty object", forceStream: true,
+			body: `{}`, want: `{"stream":true}`, result: bodyScanResult{Patched: true},
+		},
+		{
+			// Key order and whitespace are kept, and only the value is replaced
+			name: "stream false", forceStream: true,
+			body:   "{\n  \"stream\" : false ,\n  \"model\": \"claude-x\"\n}",
+			want:   "{\n  \"stream\" : true ,\n  \"model\": \"claude-x\"\n}",
+			result: bodyScanResult{Model: "claude-x", Patched: true},
+		},
+		{
+			name: "stream false at the end", forceStream: true,
+			body: `{"model":"claude-x","stream":false}`, want: `{"model":"claude-x","stream":true}`,
+			result: bodyScanResult{Model: "claude-x", Patched: true},
+		},
+		{
+			name: "stream null", forceStream: true,
+			body: `{"stream":null}`, want: `{"stream":true}`, result: bodyScanResult{Patched: true},
+		},
+		{
+			name: "stream true", forceStream: true,
+			body: `{"model":"claude-x","stream":true}`, want: `{"model":"claude-x","stream":true}`,
+			result: bodyScanResult{Model: "claude-x", Stream: true},
+		},
+		{
+			// The Claude API rejects the value, rather than the proxy quietly fixing it
+			name: "stream not a boolean", forceStream: true,
+			body: `{"stream":"yes","model":"claude-x"}`, want: `{"stream":"yes","model":"claude-x"}`,
+			result: bodyScanResult{Model: "claude-x"},
+		},
+		{
+			name: "stream object", forceStream: true,
+			body: `{"stream":{"a":[false]}}`, want: `{"stream":{"a":[false]}}`,
+		},
+		{
+			name: "escaped keys and values", forceStream: true,
+			body:   `{"stream":false,"model":"claude-\"x\"","say \"stream\"":false}`,
+			want:   `{"stream":true,"model":"claude-\"x\"","say \"stream\"":false}`,
+			result: bodyScanResult{Model: `claude-"x"`, Patched: true},
+		},
+		{
+			name: "unicode escape in the key", forceStream: true,
+			body: `{"str\u0065am":false}`, want: `{"str\u0065am":true}`, result: bodyScanResult{Patched: true},
+		},
+		{
+			name: "nested stream keys", forceStream: true,
+			body:   `{"metadata":{"stream":false},"messages":[{"stream":false,"content":"{\"stream\":false}"}],"tools":[]}`,
+			want:   `{"metadata":{"stream":false},"messages":[{"stream":false,"content":"{\"stream\":false}"}],"tools":[],"stream":true}`,
+			result: bodyScanResult{Patched: true},
+		},
+		{
+			name:   "model after nested values",
+			body:   `{"system":[{"type":"text","text":"} model"}],"temperature":0.5,"model":"claude-x"}`,
+			want:   `{"system":[{"type":"text","text":"} model"}],"temperature":0.5,"model":"claude-x"}`,
+			result: bodyScanResult{Model: "claude-x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Tokens split across reads at every possible point give the same result
+			for split := 0; split < len(tt.body); split++ {
+				scanner := newBodyScanner(&splitReader{data: []byte(tt.body), split: split}, tt.forceStream)
+				got, err := io.ReadAll(scanner)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != tt.want {
+					t.Fatalf("split at %d: body = %s, want %s", split, got, tt.want)
+				}
+				result, finished := scanner.Result()
+				if !finished || result != tt.result {
+					t.Fatalf("split at %d: result = %+v, %v, want %+v", split, result, finished, tt.result)
+				}
+			}
+		})
+	}
+}
+
+func TestBodyScannerLargeBody(t *testing.T) {
+	// A body many times the read buffer passes through, and a long model is not captured
+	large := `{"messages":[{"role":"user","content":"` + strings.Repeat("a", 200*1024) + `"}],` +
+		`"model":"` + strings.Repeat("m", maxCapturedValue+1) + `","stream":false}`
+	scanner := newBodyScanner(strings.NewReader(large), true)
+	got, err := io.ReadAll(scanner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Replace(large, `"stream":false`, `"stream":true`, 1); !bytes.Equal(got, []byte(want)) {
+		t.Errorf("large body was changed beyond the stream field")
+	}
+	if result, _ := scanner.Result(); result.Model != "" || !result.Patched {
+		t.Errorf("result = %+v", result)
+	}
+}
@@ -0,0 +1,490 @@
+package prxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/cors"
+)
+
+// Default values if configuration is not set
+const (
+	defaultClaudeURL        = "https://api.anthropic.com"
+	defaultAnthropicVersion = "2023-06-01"
+	defaultServiceName      = "prxy"
+	timeout                 = 5 * time.Minute
+)
+
+// Config configures a Proxy. The zero value proxies to the Claude API, accepts any API key
+// and forwards it upstream.
+type Config struct {
+	// UpstreamURL is the Claude API base URL (default https://api.anthropic.com)
+	UpstreamURL string
+	// UpstreamAPIKey replaces client credentials on upstream requests when set
+	UpstreamAPIKey string
+	// AllowedAPIKeys are the accepted API key hashes from HashAPIKey, each optionally followed by
+	// ";origins=...", ";headers=..." and ";provider=..." options. Nil accepts any key.
+	AllowedAPIKeys []string
+	// KeyStoreFile is a key store file managed with "prxy keys", used alongside AllowedAPIKeys.
+	// Changes to the file are picked up without a restart.
+	KeyStoreFile string
+	// UsageFile is a JSON lines file that a usage record is appended to for every proxied request
+	UsageFile string
+	// TokenSigningKey enables the short-lived token endpoint. It must be at least 32 characters,
+	// and tokens also need AllowedAPIKeys or KeyStoreFile, and UpstreamAPIKey.
+	TokenSigningKey string
+	// MaxRequestBodyBytes limits the size of request bodies (default 32 MiB)
+	MaxRequestBodyBytes int64
+	// PassthroughBodyBytes is the body size above which requests are streamed to the Claude API
+	// as they arrive instead of being read first (default 0, which reads every body in full).
+	// Requests with short-lived tokens, or when Hooks.TransformRequest, FilesAPI or Local is set,
+	// are always read in full.
+	//
+	// Passthrough bodies are NOT validated: only model and stream are read from them, and
+	// malformed or invalid requests reach the Claude API as sent, to be rejected by its own
+	// errors.
+	PassthroughBodyBytes int64
+	// FilesAPI proxies the Files API, recording which caller uploaded each file and keeping
+	// other callers from listing, reading, deleting or referencing it
+	FilesAPI bool
+	// FileOwnersFile is a JSON lines file that keeps file owners across restarts. Without it,
+	// files uploaded before a restart can no longer be used through the proxy.
+	FileOwnersFile string
+	// MaxFileBytes limits the size of file uploads (default 500 MiB)
+	MaxFileBytes int64
+	// UpstreamProvider serves Messages requests: ProviderAnthropic (default), ProviderBedrock or
+	// ProviderVertex. Keys can choose their own with the ";provider=" option.
+	UpstreamProvider string
+	// Bedrock configures the Amazon Bedrock provider, or is nil if it is not used
+	Bedrock *BedrockConfig
+	// Vertex configures the Google Vertex AI provider, or is nil if it is not used
+	Vertex *VertexConfig
+	// Local serves some model aliases from a local model server, or is nil if it is not used
+	Local *LocalModelsConfig
+	// Routes allow Claude API paths other than /v1/messages to be proxied
+	Routes []Route
+	// AggregateStreams streams non-streaming requests from the Claude API and returns the
+	// assembled message, so that long requests do not hit idle connection timeouts
+	AggregateStreams bool
+	// StreamKeepAlive is how often whitespace is sent while a response is aggregated (default 15s).
+	// The status is sent with the first keep-alive, so later failures have a 200 status.
+	StreamKeepAlive time.Duration
+
+	// CORS is the browser cross-origin policy, or nil to leave CORS to the embedding server
+	CORS *cors.Options
+
+	// ForwardRequestHeaders and BlockRequestHeaders decide which client headers are sent upstream.
+	// Names are case-insensitive and may end in "*" to match a prefix.
+	ForwardRequestHeaders []string
+	BlockRequestHeaders   []string
+	// ForwardResponseHeaders and BlockResponseHeaders decide which upstream headers are returned
+	ForwardResponseHeaders []string
+	BlockResponseHeaders   []string
+	// UpstreamHeaders are static headers added to every upstream request
+	UpstreamHeaders http.Header
+
+	// ClientIdentities maps verified client certificate common names to caller identities.
+	// Nil uses the common name itself.
+	ClientIdentities map[string]string
+
+	// TracesEndpoint is the OTLP/HTTP traces URL, or empty to disable span export
+	TracesEndpoint string
+	// TracesHeaders are extra headers sent with every span export
+	TracesHeaders map[string]string
+	// ServiceName is reported as service.name on exported spans (default "prxy")
+	ServiceName string
+
+	// Version is reported by /readyz?verbose and on exported spans
+	Version string
+	// HTTPClient sends upstream requests (default: a client with a 5 minute timeout)
+	HTTPClient *http.Client
+	// Hooks customize authentication, logging, metrics and request handling
+	Hooks Hooks
+}
+
+// Hooks let an embedding application customize the proxy. Every hook is optional.
+type Hooks struct {
+	// Authenticate runs before the built-in API key, token and client certificate checks.
+	// Return a Caller to accept the request, an error to reject it, or nil and nil to fall
+	// back to the built-in checks. Return an *Error to choose the status and error type.
+	Authenticate func(r *http.Request) (*Caller, error)
+	// TransformRequest can modify a validated Messages request body and the upstream request
+	// headers before they are sent. Returning an error rejects the request.
+	TransformRequest func(r *http.Request, body map[string]interface{}, header http.Header) error
+	// TransformResponse can replace the body of a complete (non-streaming) upstream response,
+	// including error responses. Returning an error fails the request with a 502.
+	TransformResponse func(r *http.Request, status int, header http.Header, body []byte) ([]byte, error)
+	// Log receives every log message instead of the standard logger
+	Log func(LogEntry)
+	// Metrics is called once for every completed request
+	Metrics func(RequestMetrics)
+}
+
+// BedrockConfig configures the Amazon Bedrock provider
+type BedrockConfig struct {
+	// Region is the AWS region, e.g. us-east-1
+	Region string
+	// Endpoint is the Bedrock runtime URL (default https://bedrock-runtime.<region>.amazonaws.com)
+	Endpoint string
+	// AccessKeyID, SecretAccessKey and SessionToken are the AWS credentials requests are signed with
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Models maps Claude API model names to Bedrock model IDs, inference profile IDs or ARNs.
+	// Other "claude-" names become "<ModelPrefix>anthropic.<name>-v1:0".
+	Models map[string]string
+	// ModelPrefix is added to model IDs derived from Claude API names, e.g. "us." for
+	// cross-region inference profiles
+	ModelPrefix string
+}
+
+// VertexConfig configures the Google Vertex AI provider
+type VertexConfig struct {
+	// Region is the Google Cloud region, e.g. us-east5, or "global"
+	Region string
+	// ProjectID is the Google Cloud project that the Claude models are enabled in
+	ProjectID string
+	// Endpoint is the Vertex AI URL (default https://<region>-aiplatform.googleapis.com)
+	Endpoint string
+	// CredentialsFile is a service account key file, whose signed JWTs are exchanged for access tokens
+	CredentialsFile string
+	// TokenURL replaces the token endpoint from the key file, e.g. for a local stand-in
+	TokenURL string
+	// Models maps Claude API model names to Vertex AI model IDs, e.g. "claude-sonnet-4-5@20250929".
+	// Other names are used as they are.
+	Models map[string]string
+}
+
+// LocalModelsConfig routes Messages requests for model aliases to a local server with an
+// OpenAI-compatible chat completions API, such as Ollama or the llama.cpp server
+type LocalModelsConfig struct {
+	// URL is the server's OpenAI-compatible API URL (default http://localhost:11434/v1, Ollama's)
+	URL string
+	// APIKey is sent as a bearer token, for servers that need one
+	APIKey string
+	// Models maps the model names clients use to local model names, e.g. "claude-local=llama3.2".
+	// Requests for these names go to the local server whatever provider the caller uses.
+	Models map[string]string
+}
+
+// Caller identifies the client of an authenticated request
+type Caller struct {
+	// ID identifies the caller in logs and the X-Prxy-Key-Fingerprint header. It must not be a secret.
+	ID string
+	// Headers are static headers added to the caller's upstream requests
+	Headers http.Header
+	// Provider serves the caller's Messages requests, or is empty for Config.UpstreamProvider
+	Provider string
+}
+
+// RequestMetrics describes a completed request
+type RequestMetrics struct {
+	RequestID string
+	Method    string
+	Path      string
+	Status    int
+	Duration  time.Duration
+	// Caller is the authenticated caller's ID, if the request got that far
+	Caller string
+	// KeyID is the ID of the caller's API key, or of the key that issued its token, if known
+	KeyID  string
+	Model  string
+	Stream bool
+	// UpstreamStatus is the Claude API response status, or 0 if no upstream request was made
+	UpstreamStatus int
+	// ResponseBytes is the size of the response body sent to the client
+	ResponseBytes int
+	// Token usage reported by the Claude API
+	InputTokens              int
+	OutputTokens             int
+	CacheCreationInputTokens int
+	CacheReadInputTokens     int
+}
+
+// Error is a failure reported to the client in the Anthropic API error format
+type Error struct {
+	Status  int
+	Type    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Validate checks the configuration without reading any files or contacting any service, and
+// returns warnings about settings that are accepted but probably not intended. New makes the
+// same checks before it loads key stores and credentials.
+func (cfg Config) Validate() ([]string, error) {
+	var warnings []string
+
+	configured := map[string]bool{ProviderAnthropic: true}
+	if cfg.Bedrock != nil {
+		if err := cfg.Bedrock.validate(); err != nil {
+			return nil, err
+		}
+		configured[ProviderBedrock] = true
+	}
+	if cfg.Vertex != nil {
+		if err := cfg.Vertex.validate(); err != nil {
+			return nil, err
+		}
+		configured[ProviderVertex] = true
+	}
+	if cfg.Local != nil {
+		if err := cfg.Local.validate(); err != nil {
+			return nil, err
+		}
+	}
+	provider := cfg.UpstreamProvider
+	if provider == "" {
+		provider = ProviderAnthropic
+	}
+	if err := checkProvider(provider); err != nil {
+		return nil, fmt.Errorf("invalid upstream provider: %w", err)
+	}
+	if !configured[provider] {
+		return nil, fmt.Errorf("upstream provider %s is not configured", provider)
+	}
+
+	if cfg.AllowedAPIKeys != nil {
+		store, plaintext, err := loadKeyStore(cfg.AllowedAPIKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed API keys: %w", err)
+		}
+		for _, hash := range store.hashes {
+			if hash.provider != "" && !configured[hash.provider] {
+				return nil, fmt.Errorf("an allowed API key uses provider %s, which is not configured", hash.provider)
+			}
+		}
+		if plaintext > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d plaintext keys in ALLOWED_API_KEYS - replace them with hashes from -generate-key", plaintext))
+		}
+	}
+	if cfg.AllowedAPIKeys == nil && cfg.KeyStoreFile == "" {
+		warnings = append(warnings, "No ALLOWED_API_KEYS or KEY_STORE_FILE set - all API keys will be accepted")
+	}
+	if cfg.FilesAPI && cfg.FileOwnersFile == "" {
+		warnings = append(warnings, "Files API is enabled without FILE_OWNERS_FILE - file owners are lost on restart")
+	}
+	if cfg.TokenSigningKey != "" && !cfg.tokensEnabled() {
+		warnings = append(warnings, fmt.Sprintf("TOKEN_SIGNING_KEY is set but tokens are disabled - they need a %d+ character key, ALLOWED_API_KEYS or KEY_STORE_FILE, and UPSTREAM_API_KEY", minTokenSigningKeyLen))
+	}
+
+	if _, err := cfg.normalizedRoutes(); err != nil {
+		return nil, err
+	}
+	return warnings, nil
+}
+
+// tokensEnabled reports whether the token endpoint can be served. Tokens also need key
+// validation and an upstream key, since a token is never forwarded upstream.
+func (cfg Config) tokensEnabled() bool {
+	return len(cfg.TokenSigningKey) >= minTokenSigningKeyLen && (cfg.AllowedAPIKeys != nil || cfg.KeyStoreFile != "") && cfg.UpstreamAPIKey != ""
+}
+
+// normalizedRoutes checks the configured routes and returns them with their defaults filled in
+func (cfg Config) normalizedRoutes() ([]Route, error) {
+	maxBodyBytes := cfg.MaxRequestBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = defaultMaxRequestBodyBytes
+	}
+	routes := make([]Route, len(cfg.Routes))
+	for i, route := range cfg.Routes {
+		if err := route.normalize(maxBodyBytes); err != nil {
+			return nil, err
+		}
+		if cfg.FilesAPI && routeCoversFiles(route) {
+			return nil, fmt.Errorf("route %s overlaps the Files API, which is served with file ownership checks", route.Pattern)
+		}
+		// Anyone who can reach the proxy could use the upstream key
+		if route.Auth == RouteAuthNone && cfg.UpstreamAPIKey != "" {
+			return nil, fmt.Errorf("route %s cannot use auth=%s with UPSTREAM_API_KEY, which it would be sent with", route.Pattern, RouteAuthNone)
+		}
+		routes[i] = route
+	}
+	return routes, nil
+}
+
+// ConfigFromEnv builds a Config from the environment variables documented in the README
+func ConfigFromEnv() (Config, error) {
+	return ConfigFromLookup(os.Getenv)
+}
+
+// ConfigFromLookup builds a Config from the variables documented in the README, read with getenv
+func ConfigFromLookup(getenv func(string) string) (Config, error) {
+	cfg := Config{
+		UpstreamURL:            getenv("CLAUDE_API_URL"),
+		UpstreamAPIKey:         getenv("UPSTREAM_API_KEY"),
+		AllowedAPIKeys:         envList(getenv, "ALLOWED_API_KEYS", nil),
+		KeyStoreFile:           getenv("KEY_STORE_FILE"),
+		UsageFile:              getenv("USAGE_FILE"),
+		TokenSigningKey:        getenv("TOKEN_SIGNING_KEY"),
+		ForwardRequestHeaders:  envList(getenv, "FORWARD_REQUEST_HEADERS", nil),
+		BlockRequestHeaders:    envList(getenv, "BLOCK_REQUEST_HEADERS", nil),
+		ForwardResponseHeaders: envList(getenv, "FORWARD_RESPONSE_HEADERS", nil),
+		BlockResponseHeaders:   envList(getenv, "BLOCK_RESPONSE_HEADERS", nil),
+		ServiceName:            getenv("OTEL_SERVICE_NAME"),
+	}
+
+	if value := getenv("MAX_REQUEST_BODY_BYTES"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return Config{}, fmt.Errorf("MAX_REQUEST_BODY_BYTES must be a positive number of bytes")
+		}
+		cfg.MaxRequestBodyBytes = n
+	}
+	if value := getenv("PASSTHROUGH_BODY_BYTES"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return Config{}, fmt.Errorf("PASSTHROUGH_BODY_BYTES must be a positive number of bytes")
+		}
+		cfg.PassthroughBodyBytes = n
+	}
+
+	if value := getenv("FILES_API"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return Config{}, fmt.Errorf("FILES_API must be true or false")
+		}
+		cfg.FilesAPI = enabled
+	}
+	cfg.FileOwnersFile = getenv("FILE_OWNERS_FILE")
+	if value := getenv("MAX_FILE_BYTES"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return Config{}, fmt.Errorf("MAX_FILE_BYTES must be a positive number of bytes")
+		}
+		cfg.MaxFileBytes = n
+	}
+
+	if value := getenv("AGGREGATE_STREAMS"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return Config{}, fmt.Errorf("AGGREGATE_STREAMS must be true or false")
+		}
+		cfg.AggregateStreams = enabled
+	}
+	if value := getenv("STREAM_KEEPALIVE_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return Config{}, fmt.Errorf("STREAM_KEEPALIVE_INTERVAL must be a positive duration, e.g. 15s")
+		}
+		cfg.StreamKeepAlive = interval
+	}
+
+	corsOptions, err := corsOptionsFromEnv(getenv)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.CORS = &corsOptions
+
+	if cfg.UpstreamHeaders, err = parseStaticHeaders(getenv("UPSTREAM_HEADERS")); err != nil {
+		return Config{}, fmt.Errorf("UPSTREAM_HEADERS: %w", err)
+	}
+
+	cfg.UpstreamProvider = getenv("UPSTREAM_PROVIDER")
+	if region := getenv("BEDROCK_REGION"); region != "" {
+		cfg.Bedrock = &BedrockConfig{
+			Region:          region,
+			Endpoint:        getenv("BEDROCK_ENDPOINT"),
+			AccessKeyID:     getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    getenv("AWS_SESSION_TOKEN"),
+			ModelPrefix:     getenv("BEDROCK_MODEL_PREFIX"),
+		}
+		if cfg.Bedrock.Models, err = envModelMap(getenv, "BEDROCK_MODELS"); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if region := getenv("VERTEX_REGION"); region != "" {
+		cfg.Vertex = &VertexConfig{
+			Region:          region,
+			ProjectID:       getenv("VERTEX_PROJECT_ID"),
+			Endpoint:        getenv("VERTEX_ENDPOINT"),
+			CredentialsFile: getenv("VERTEX_CREDENTIALS_FILE"),
+			TokenURL:        getenv("VERTEX_TOKEN_URL"),
+		}
+		if cfg.Vertex.CredentialsFile == "" {
+			cfg.Vertex.CredentialsFile = getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		}
+		if cfg.Vertex.Models, err = envModelMap(getenv, "VERTEX_MODELS"); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if getenv("LOCAL_MODELS") != "" {
+		cfg.Local = &LocalModelsConfig{
+			URL:    getenv("LOCAL_MODEL_URL"),
+			APIKey: getenv("LOCAL_MODEL_API_KEY"),
+		}
+		if cfg.Local.Models, err = envModelMap(getenv, "LOCAL_MODELS"); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if cfg.Routes, err = parseRoutes(envList(getenv, "PROXY_ROUTES", nil)); err != nil {
+		return Config{}, fmt.Errorf("PROXY_ROUTES: %w", err)
+	}
+
+	if cfg.ClientIdentities, err = parseClientIdentities(getenv("TLS_CLIENT_IDENTITIES")); err != nil {
+		return Config{}, err
+	}
+
+	cfg.TracesEndpoint = getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if cfg.TracesEndpoint == "" {
+		if base := getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			cfg.TracesEndpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	for _, pair := range envList(getenv, "OTEL_EXPORTER_OTLP_HEADERS", nil) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return Config{}, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q", pair)
+		}
+		if cfg.TracesHeaders == nil {
+			cfg.TracesHeaders = map[string]string{}
+		}
+		cfg.TracesHeaders[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return cfg, nil
+}
+
+// envModelMap reads comma-separated "name=id" pairs that map Claude API model names to a
+// provider's model IDs
+func envModelMap(getenv func(string) string, name string) (map[string]string, error) {
+	var models map[string]string
+	for _, pair := range envList(getenv, name, nil) {
+		model, id, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(model) == "" || strings.TrimSpace(id) == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected name=id", name, pair)
+		}
+		if models == nil {
+			models = map[string]string{}
+		}
+		models[strings.TrimSpace(model)] = strings.TrimSpace(id)
+	}
+	return models, nil
+}
+
+// envList reads a comma-separated list from an environment variable, falling back to a default
+func envList(getenv func(string) string, name string, def []string) []string {
+	value := getenv(name)
+	if value == "" {
+		return def
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,228 @@
+package prxy
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configEnv lists every variable ConfigFromEnv reads
+var configEnv = []string{
+	"AGGREGATE_STREAMS", "ALLOWED_API_KEYS", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+	"BEDROCK_ENDPOINT", "BEDROCK_MODELS", "BEDROCK_MODEL_PREFIX", "BEDROCK_REGION", "BLOCK_REQUEST_HEADERS",
+	"BLOCK_RESPONSE_HEADERS", "CLAUDE_API_URL", "CORS_ALLOWED_HEADERS", "CORS_ALLOWED_ORIGINS",
+	"CORS_ALLOW_CREDENTIALS", "CORS_EXPOSED_HEADERS", "CORS_MAX_AGE", "FILES_API", "FILE_OWNERS_FILE",
+	"FORWARD_REQUEST_HEADERS", "FORWARD_RESPONSE_HEADERS", "GOOGLE_APPLICATION_CREDENTIALS", "KEY_STORE_FILE",
+	"LOCAL_MODELS", "LOCAL_MODEL_API_KEY", "LOCAL_MODEL_URL", "MAX_FILE_BYTES", "MAX_REQUEST_BODY_BYTES",
+	"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+	"OTEL_SERVICE_NAME", "PASSTHROUGH_BODY_BYTES", "PROXY_ROUTES", "STREAM_KEEPALIVE_INTERVAL",
+	"TLS_CLIENT_IDENTITIES", "TOKEN_SIGNING_KEY", "UPSTREAM_API_KEY", "UPSTREAM_HEADERS", "UPSTREAM_PROVIDER",
+	"USAGE_FILE", "VERTEX_CREDENTIALS_FILE", "VERTEX_ENDPOINT", "VERTEX_MODELS", "VERTEX_PROJECT_ID",
+	"VERTEX_REGION", "VERTEX_TOKEN_URL",
+}
+
+// setConfigEnv clears the configuration environment and then sets env
+func setConfigEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, name := range configEnv {
+		t.Setenv(name, env[name])
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	setConfigEnv(t, map[string]string{
+		"CLAUDE_API_URL":                 "https://claude.example",
+		"UPSTREAM_API_KEY":               "upstream-key",
+		"ALLOWED_API_KEYS":               "k1, k2,,",
+		"MAX_REQUEST_BODY_BYTES":         "1024",
+		"PASSTHROUGH_BODY_BYTES":         "512",
+		"FILES_API":                      "true",
+		"AGGREGATE_STREAMS":              "1",
+		"STREAM_KEEPALIVE_INTERVAL":      "15s",
+		"UPSTREAM_HEADERS":               "X-Team:platform",
+		"BEDROCK_REGION":                 "us-east-1",
+		"BEDROCK_MODELS":                 "claude-x=anthropic.claude-x-v1:0",
+		"VERTEX_REGION":                  "us-east5",
+		"GOOGLE_APPLICATION_CREDENTIALS": "/etc/gcp.json",
+		"OTEL_EXPORTER_OTLP_ENDPOINT":    "http://collector:4318/",
+		"OTEL_EXPORTER_OTLP_HEADERS":     "Authorization=Bearer t, X-Tenant = a=b",
+	})
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.UpstreamURL != "https://claude.example" || cfg.UpstreamAPIKey != "upstream-key" || strings.Join(cfg.AllowedAPIKeys, " ") != "k1 k2" {
+		t.Errorf("upstream and keys = %q, %q, %v", cfg.UpstreamURL, cfg.UpstreamAPIKey, cfg.AllowedAPIKeys)
+	}
+	if cfg.MaxRequestBodyBytes != 1024 || cfg.PassthroughBodyBytes != 512 || !cfg.FilesAPI || !cfg.AggregateStreams || cfg.StreamKeepAlive != 15*time.Second {
+		t.Errorf("limits and switches = %+v", cfg)
+	}
+	if cfg.UpstreamHeaders.Get("X-Team") != "platform" {
+		t.Errorf("upstream headers = %v", cfg.UpstreamHeaders)
+	}
+	if cfg.Bedrock == nil || cfg.Bedrock.Region != "us-east-1" || cfg.Bedrock.Models["claude-x"] != "anthropic.claude-x-v1:0" {
+		t.Errorf("Bedrock = %+v", cfg.Bedrock)
+	}
+	if cfg.Vertex == nil || cfg.Vertex.CredentialsFile != "/etc/gcp.json" {
+		t.Errorf("Vertex = %+v, want the application default credentials file", cfg.Vertex)
+	}
+	if cfg.Local != nil {
+		t.Errorf("local models configured without LOCAL_MODELS: %+v", cfg.Local)
+	}
+	if cfg.TracesEndpoint != "http://collector:4318/v1/traces" || cfg.TracesHeaders["Authorization"] != "Bearer t" || cfg.TracesHeaders["X-Tenant"] != "a=b" {
+		t.Errorf("traces = %q %v", cfg.TracesEndpoint, cfg.TracesHeaders)
+	}
+	if cfg.CORS == nil || strings.Join(cfg.CORS.AllowedOrigins, " ") != "*" {
+		t.Errorf("CORS = %+v", cfg.CORS)
+	}
+}
+
+func TestConfigFromEnvTracesEndpoint(t *testing.T) {
+	setConfigEnv(t, map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT":        "http://collector:4318",
+		"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://traces:4318/custom",
+	})
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TracesEndpoint != "http://traces:4318/custom" {
+		t.Errorf("traces endpoint = %q, want the traces-specific one", cfg.TracesEndpoint)
+	}
+}
+
+func TestConfigFromEnvErrors(t *testing.T) {
+	tests := []struct {
+		env     map[string]string
+		wantErr string
+	}{
+		{map[string]string{"MAX_REQUEST_BODY_BYTES": "0"}, "MAX_REQUEST_BODY_BYTES"},
+		{map[string]string{"MAX_REQUEST_BODY_BYTES": "32MB"}, "MAX_REQUEST_BODY_BYTES"},
+		{map[string]string{"PASSTHROUGH_BODY_BYTES": "-1"}, "PASSTHROUGH_BODY_BYTES"},
+		{map[string]string{"FILES_API": "yes"}, "FILES_API"},
+		{map[string]string{"MAX_FILE_BYTES": "x"}, "MAX_FILE_BYTES"},
+		{map[string]string{"AGGREGATE_STREAMS": "on"}, "AGGREGATE_STREAMS"},
+		{map[string]string{"STREAM_KEEPALIVE_INTERVAL": "15"}, "STREAM_KEEPALIVE_INTERVAL"},
+		{map[string]string{"STREAM_KEEPALIVE_INTERVAL": "-1s"}, "STREAM_KEEPALIVE_INTERVAL"},
+		{map[string]string{"UPSTREAM_HEADERS": "X-Team"}, "UPSTREAM_HEADERS"},
+		{map[string]string{"BEDROCK_REGION": "us-east-1", "BEDROCK_MODELS": "claude-x"}, "BEDROCK_MODELS"},
+		{map[string]string{"VERTEX_REGION": "us-east5", "VERTEX_MODELS": "=id"}, "VERTEX_MODELS"},
+		{map[string]string{"LOCAL_MODELS": "llama="}, "LOCAL_MODELS"},
+		{map[string]string{"OTEL_EXPORTER_OTLP_HEADERS": "Authorization"}, "OTEL_EXPORTER_OTLP_HEADERS"},
+		{map[string]string{"TLS_CLIENT_IDENTITIES": "cn"}, "TLS_CLIENT_IDENTITIES"},
+		{map[string]string{"CORS_MAX_AGE": "x"}, "CORS_MAX_AGE"},
+	}
+	for _, tt := range tests {
+		setConfigEnv(t, tt.env)
+		if _, err := ConfigFromEnv(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%v: error = %v, want one naming %s", tt.env, err, tt.wantErr)
+		}
+	}
+}
+
+func TestEnvModelMap(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "claude-x=model-a", want: map[string]string{"claude-x": "model-a"}},
+		{value: " claude-x = model-a , claude-y=arn:aws:bedrock:x=y ", want: map[string]string{"claude-x": "model-a", "claude-y": "arn:aws:bedrock:x=y"}},
+		{value: "claude-x", wantErr: true},
+		{value: "claude-x=", wantErr: true},
+		{value: " =model-a", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_MODELS", tt.value)
+		got, err := envModelMap(os.Getenv, "TEST_MODELS")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("envModelMap(%q) error = %v", tt.value, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("envModelMap(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+		for model, id := range tt.want {
+			if got[model] != id {
+				t.Errorf("envModelMap(%q)[%s] = %q, want %q", tt.value, model, got[model], id)
+			}
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	hashed, err := HashAPIKey("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bedrock := &BedrockConfig{Region: "us-east-1", AccessKeyID: "id", SecretAccessKey: "secret"}
+	tests := []struct {
+		name     string
+		cfg      Config
+		wantErr  string
+		warnings []string
+	}{
+		{name: "hashed keys", cfg: Config{AllowedAPIKeys: []string{hashed}}},
+		{name: "no keys", cfg: Config{}, warnings: []string{"all API keys will be accepted"}},
+		{name: "plaintext keys", cfg: Config{AllowedAPIKeys: []string{"a", "b"}}, warnings: []string{"2 plaintext keys"}},
+		{name: "bad key option", cfg: Config{AllowedAPIKeys: []string{hashed + ";color=red"}}, wantErr: "invalid allowed API keys"},
+		{name: "key provider not configured", cfg: Config{AllowedAPIKeys: []string{hashed + ";provider=bedrock"}}, wantErr: "provider bedrock, which is not configured"},
+		{name: "key provider configured", cfg: Config{AllowedAPIKeys: []string{hashed + ";provider=bedrock"}, Bedrock: bedrock}},
+		{name: "unknown provider", cfg: Config{KeyStoreFile: "keys.json", UpstreamProvider: "azure"}, wantErr: "invalid upstream provider"},
+		{name: "provider not configured", cfg: Config{KeyStoreFile: "keys.json", UpstreamProvider: ProviderVertex}, wantErr: "vertex is not configured"},
+		{name: "Bedrock without credentials", cfg: Config{KeyStoreFile: "keys.json", Bedrock: &BedrockConfig{Region: "us-east-1"}}, wantErr: "AWS credentials"},
+		{name: "Vertex without project", cfg: Config{KeyStoreFile: "keys.json", Vertex: &VertexConfig{Region: "us-east5", CredentialsFile: "sa.json"}}, wantErr: "project ID"},
+		// The credentials file is only read by New
+		{name: "Vertex with a missing key file", cfg: Config{KeyStoreFile: "/nonexistent/keys.json", Vertex: &VertexConfig{Region: "us-east5", ProjectID: "p", CredentialsFile: "/nonexistent/sa.json"}}},
+		{name: "local without models", cfg: Config{KeyStoreFile: "keys.json", Local: &LocalModelsConfig{}}, wantErr: "at least one model alias"},
+		{name: "files without owners file", cfg: Config{KeyStoreFile: "keys.json", FilesAPI: true}, warnings: []string{"FILE_OWNERS_FILE"}},
+		{name: "short signing key", cfg: Config{KeyStoreFile: "keys.json", UpstreamAPIKey: "u", TokenSigningKey: "short"}, warnings: []string{"tokens are disabled"}},
+		{name: "tokens without upstream key", cfg: Config{KeyStoreFile: "keys.json", TokenSigningKey: testSigningKey}, warnings: []string{"tokens are disabled"}},
+		{name: "tokens", cfg: Config{KeyStoreFile: "keys.json", UpstreamAPIKey: "u", TokenSigningKey: testSigningKey}},
+		{name: "bad route", cfg: Config{KeyStoreFile: "keys.json", Routes: []Route{{Pattern: "v1/models"}}}, wantErr: "must be a path"},
+		{name: "route over files", cfg: Config{KeyStoreFile: "keys.json", FileOwnersFile: "files.jsonl", FilesAPI: true, Routes: []Route{{Pattern: "/v1/files*"}}}, wantErr: "overlaps the Files API"},
+		{name: "route over messages", cfg: Config{KeyStoreFile: "keys.json", Routes: []Route{{Pattern: "/v1/*"}}}},
+		{name: "public route over messages", cfg: Config{KeyStoreFile: "keys.json", Routes: []Route{{Pattern: "/v1/*", Auth: RouteAuthNone}}}, wantErr: "paths under /v1/messages/"},
+		{name: "public route", cfg: Config{KeyStoreFile: "keys.json", Routes: []Route{{Pattern: "/v1/models*", Auth: RouteAuthNone}}}},
+		{name: "public route with upstream key", cfg: Config{KeyStoreFile: "keys.json", UpstreamAPIKey: "u", Routes: []Route{{Pattern: "/v1/models*", Auth: RouteAuthNone}}}, wantErr: "auth=none with UPSTREAM_API_KEY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings, err := tt.cfg.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(warnings) != len(tt.warnings) {
+				t.Fatalf("warnings = %q, want %q", warnings, tt.warnings)
+			}
+			for i, want := range tt.warnings {
+				if !strings.Contains(warnings[i], want) {
+					t.Errorf("warning %d = %q, want %q", i, warnings[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewLogsValidationWarnings(t *testing.T) {
+	var warnings []string
+	cfg := Config{AllowedAPIKeys: []string{"plain-key"}}
+	cfg.Hooks.Log = func(entry LogEntry) {
+		if entry.Level == LogWarning {
+			warnings = append(warnings, entry.Message)
+		}
+	}
+	newTestProxy(t, cfg, nil)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "1 plaintext keys") {
+		t.Errorf("warnings = %q", warnings)
+	}
+}
@@ -0,0 +1,58 @@
+package prxy
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/rs/cors"
+)
+
+// Response headers set by the proxy itself
+const (
+	headerKeyFingerprint = "X-Prxy-Key-Fingerprint"
+	headerRequestID      = "X-Request-ID"
+)
+
+// Default CORS policy values if environment variables are not set
+var (
+	defaultCORSAllowedOrigins = []string{"*"}
+	defaultCORSAllowedHeaders = []string{"Content-Type", "Authorization", "x-api-key", "anthropic-version", "anthropic-beta", headerRequestID}
+	defaultCORSExposedHeaders = []string{headerKeyFingerprint, headerRequestID, "request-id"}
+)
+
+// corsOptionsFromEnv builds the CORS policy from CORS_* environment variables
+func corsOptionsFromEnv(getenv func(string) string) (cors.Options, error) {
+	options := cors.Options{
+		AllowedOrigins: envList(getenv, "CORS_ALLOWED_ORIGINS", defaultCORSAllowedOrigins),
+		AllowedMethods: []string{"GET", "POST", "DELETE", "OPTIONS"},
+		AllowedHeaders: envList(getenv, "CORS_ALLOWED_HEADERS", defaultCORSAllowedHeaders),
+		ExposedHeaders: envList(getenv, "CORS_EXPOSED_HEADERS", defaultCORSExposedHeaders),
+	}
+
+	if maxAge := getenv("CORS_MAX_AGE"); maxAge != "" {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil || seconds < 0 {
+			return cors.Options{}, fmt.Errorf("CORS_MAX_AGE must be a non-negative number of seconds")
+		}
+		options.MaxAge = seconds
+	}
+
+	if credentials := getenv("CORS_ALLOW_CREDENTIALS"); credentials != "" {
+		allow, err := strconv.ParseBool(credentials)
+		if err != nil {
+			return cors.Options{}, fmt.Errorf("CORS_ALLOW_CREDENTIALS must be true or false")
+		}
+		options.AllowCredentials = allow
+	}
+
+	// Credentials with a wildcard origin would let any site make credentialed requests
+	if options.AllowCredentials {
+		for _, origin := range options.AllowedOrigins {
+			if origin == "*" {
+				return cors.Options{}, fmt.Errorf("CORS_ALLOW_CREDENTIALS cannot be used with a wildcard origin")
+			}
+		}
+	}
+
+	return options, nil
+}
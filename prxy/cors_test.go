@@ -0,0 +1,114 @@
+package prxy
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCORSOptionsFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		origins     string
+		maxAge      int
+		credentials bool
+		wantErr     string
+	}{
+		{name: "defaults", origins: "*"},
+		{
+			name:    "listed origins",
+			env:     map[string]string{"CORS_ALLOWED_ORIGINS": "https://a.example, https://b.example", "CORS_MAX_AGE": "600"},
+			origins: "https://a.example https://b.example", maxAge: 600,
+		},
+		{
+			name:    "credentials",
+			env:     map[string]string{"CORS_ALLOWED_ORIGINS": "https://a.example", "CORS_ALLOW_CREDENTIALS": "true"},
+			origins: "https://a.example", credentials: true,
+		},
+		{name: "credentials with wildcard", env: map[string]string{"CORS_ALLOW_CREDENTIALS": "true"}, wantErr: "wildcard"},
+		{name: "bad credentials", env: map[string]string{"CORS_ALLOW_CREDENTIALS": "maybe"}, wantErr: "true or false"},
+		{name: "negative max age", env: map[string]string{"CORS_MAX_AGE": "-1"}, wantErr: "non-negative"},
+		{name: "bad max age", env: map[string]string{"CORS_MAX_AGE": "10m"}, wantErr: "non-negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"CORS_ALLOWED_ORIGINS", "CORS_MAX_AGE", "CORS_ALLOW_CREDENTIALS"} {
+				t.Setenv(name, tt.env[name])
+			}
+			options, err := corsOptionsFromEnv(os.Getenv)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(options.AllowedOrigins, " "); got != tt.origins {
+				t.Errorf("origins = %q, want %q", got, tt.origins)
+			}
+			if options.MaxAge != tt.maxAge || options.AllowCredentials != tt.credentials {
+				t.Errorf("max age %d, credentials %v, want %d and %v", options.MaxAge, options.AllowCredentials, tt.maxAge, tt.credentials)
+			}
+		})
+	}
+}
+
+func TestKeyOriginBinding(t *testing.T) {
+	p := newTestProxy(t, Config{AllowedAPIKeys: []string{"web-key;origins=https://app.example"}, UpstreamAPIKey: "upstream-key"},
+		func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"type":"message"}`)) })
+
+	tests := []struct {
+		origin string
+		status int
+	}{
+		{"https://app.example", http.StatusOK},
+		{"https://evil.example", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		header := map[string]string{"x-api-key": "web-key"}
+		if tt.origin != "" {
+			header["Origin"] = tt.origin
+		}
+		w := serve(p, "POST", "/v1/messages", `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`, header)
+		if w.Code != tt.status {
+			t.Errorf("origin %q: status = %d, want %d", tt.origin, w.Code, tt.status)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example")
+	options, err := corsOptionsFromEnv(os.Getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, Config{CORS: &options}, nil)
+
+	tests := []struct {
+		origin string
+		method string
+		path   string
+		allow  string
+	}{
+		{"https://app.example", "POST", "/v1/messages", "https://app.example"},
+		{"https://evil.example", "POST", "/v1/messages", ""},
+		// Browsers can delete their files through the Files API
+		{"https://app.example", "DELETE", "/v1/files/file_1", "https://app.example"},
+		{"https://app.example", "PUT", "/v1/files/file_1", ""},
+	}
+	for _, tt := range tests {
+		w := serve(p, "OPTIONS", tt.path, "", map[string]string{
+			"Origin":                         tt.origin,
+			"Access-Control-Request-Method":  tt.method,
+			"Access-Control-Request-Headers": "x-api-key,content-type",
+		})
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allow {
+			t.Errorf("%s %s from %s: Access-Control-Allow-Origin = %q, want %q", tt.method, tt.path, tt.origin, got, tt.allow)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package prxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Anthropic API error types
+const (
+	errorTypeInvalidRequest  = "invalid_request_error"
+	errorTypeAuthentication  = "authentication_error"
+	errorTypePermission      = "permission_error"
+	errorTypeNotFound        = "not_found_error"
+	errorTypeRequestTooLarge = "request_too_large"
+	errorTypeRateLimit       = "rate_limit_error"
+	errorTypeAPI             = "api_error"
+	errorTypeOverloaded      = "overloaded_error"
+)
+
+// apiErrorResponse is an error body in the Anthropic API format
+type apiErrorResponse struct {
+	Type  string   `json:"type"`
+	Error apiError `json:"error"`
+}
+
+// apiError describes the error in an apiErrorResponse
+type apiError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// writeAPIError writes an error response in the Anthropic API format
+func writeAPIError(w http.ResponseWriter, status int, errorType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiErrorResponse{
+		Type:  "error",
+		Error: apiError{Type: errorType, Message: message},
+	})
+}
+
+// writeAPIErrorBody writes an error body in the Anthropic API format after the status has been sent
+func writeAPIErrorBody(w http.ResponseWriter, errorType, message string) {
+	json.NewEncoder(w).Encode(apiErrorResponse{
+		Type:  "error",
+		Error: apiError{Type: errorType, Message: message},
+	})
+}
+
+// writeFailure writes an error response, or only its body if the status was already sent
+func writeFailure(w http.ResponseWriter, committed bool, status int, errorType, message string) {
+	if committed {
+		writeAPIErrorBody(w, errorType, message)
+		return
+	}
+	writeAPIError(w, status, errorType, message)
+}
+
+// statusForErrorType returns the HTTP status the Claude API uses for an error type
+func statusForErrorType(errorType string) int {
+	switch errorType {
+	case errorTypeInvalidRequest:
+		return http.StatusBadRequest
+	case errorTypeAuthentication:
+		return http.StatusUnauthorized
+	case errorTypePermission:
+		return http.StatusForbidden
+	case errorTypeNotFound:
+		return http.StatusNotFound
+	case errorTypeRequestTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errorTypeRateLimit:
+		return http.StatusTooManyRequests
+	case errorTypeOverloaded:
+		return 529
+	}
+	return http.StatusInternalServerError
+}
+
+// errorTypeForStatus returns the error type for an upstream error status, and the status the
+// Claude API would use for it
+func errorTypeForStatus(status int) (string, int) {
+	switch status {
+	case http.StatusBadRequest:
+		return errorTypeInvalidRequest, status
+	case http.StatusUnauthorized:
+		return errorTypeAuthentication, status
+	case http.StatusForbidden:
+		return errorTypePermission, status
+	case http.StatusNotFound:
+		return errorTypeNotFound, status
+	case http.StatusRequestEntityTooLarge:
+		return errorTypeRequestTooLarge, status
+	case http.StatusTooManyRequests:
+		return errorTypeRateLimit, status
+	case http.StatusServiceUnavailable, statusForErrorType(errorTypeOverloaded):
+		return errorTypeOverloaded, statusForErrorType(errorTypeOverloaded)
+	}
+	if status >= http.StatusBadRequest && status < http.StatusInternalServerError {
+		return errorTypeInvalidRequest, status
+	}
+	return errorTypeAPI, http.StatusInternalServerError
+}
+
+// writeSSEError writes an error event to a stream that has already started
+func writeSSEError(w http.ResponseWriter, errorType, message string) {
+	data, _ := json.Marshal(apiErrorResponse{
+		Type:  "error",
+		Error: apiError{Type: errorType, Message: message},
+	})
+	fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+}
+
+// asError returns err as an *Error, or wraps its message with the given status and error type
+func asError(err error, status int, errorType string) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return &Error{Status: status, Type: errorType, Message: err.Error()}
+}
@@ -0,0 +1,141 @@
+package prxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorTypeForStatus(t *testing.T) {
+	tests := []struct {
+		status     int
+		errorType  string
+		wantStatus int
+	}{
+		{http.StatusBadRequest, errorTypeInvalidRequest, http.StatusBadRequest},
+		{http.StatusUnauthorized, errorTypeAuthentication, http.StatusUnauthorized},
+		{http.StatusForbidden, errorTypePermission, http.StatusForbidden},
+		{http.StatusNotFound, errorTypeNotFound, http.StatusNotFound},
+		{http.StatusRequestEntityTooLarge, errorTypeRequestTooLarge, http.StatusRequestEntityTooLarge},
+		{http.StatusTooManyRequests, errorTypeRateLimit, http.StatusTooManyRequests},
+		{http.StatusServiceUnavailable, errorTypeOverloaded, 529},
+		{529, errorTypeOverloaded, 529},
+		{http.StatusConflict, errorTypeInvalidRequest, http.StatusConflict},
+		{http.StatusInternalServerError, errorTypeAPI, http.StatusInternalServerError},
+		{http.StatusBadGateway, errorTypeAPI, http.StatusInternalServerError},
+		{http.StatusGatewayTimeout, errorTypeAPI, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		errorType, status := errorTypeForStatus(tt.status)
+		if errorType != tt.errorType || status != tt.wantStatus {
+			t.Errorf("errorTypeForStatus(%d) = %s, %d, want %s, %d", tt.status, errorType, status, tt.errorType, tt.wantStatus)
+		}
+	}
+
+	// Each error type maps back to the status it came from
+	for _, errorType := range []string{
+		errorTypeInvalidRequest, errorTypeAuthentication, errorTypePermission, errorTypeNotFound,
+		errorTypeRequestTooLarge, errorTypeRateLimit, errorTypeOverloaded,
+	} {
+		if got, _ := errorTypeForStatus(statusForErrorType(errorType)); got != errorType {
+			t.Errorf("errorTypeForStatus(statusForErrorType(%s)) = %s", errorType, got)
+		}
+	}
+	if status := statusForErrorType(errorTypeAPI); status != http.StatusInternalServerError {
+		t.Errorf("statusForErrorType(api_error) = %d", status)
+	}
+}
+
+// decodeAPIError decodes an Anthropic-format error body
+func decodeAPIError(t *testing.T, body string) apiErrorResponse {
+	t.Helper()
+	var response apiErrorResponse
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatalf("error body is not JSON: %v: %s", err, body)
+	}
+	if response.Type != "error" {
+		t.Errorf("body type = %q, want error", response.Type)
+	}
+	return response
+}
+
+func TestWriteFailure(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeFailure(w, false, http.StatusForbidden, errorTypePermission, `Model "x" is not allowed`)
+	if w.Code != http.StatusForbidden || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("status %d and content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if response := decodeAPIError(t, w.Body.String()); response.Error.Type != errorTypePermission || response.Error.Message != `Model "x" is not allowed` {
+		t.Errorf("error = %+v", response.Error)
+	}
+
+	// After the status is sent only the body is written
+	w = httptest.NewRecorder()
+	w.WriteHeader(http.StatusOK)
+	writeFailure(w, true, http.StatusBadGateway, errorTypeAPI, "Failed")
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want the one already sent", w.Code)
+	}
+	if response := decodeAPIError(t, w.Body.String()); response.Error.Type != errorTypeAPI {
+		t.Errorf("error = %+v", response.Error)
+	}
+
+	w = httptest.NewRecorder()
+	writeSSEError(w, errorTypeOverloaded, "Overloaded")
+	data, ok := strings.CutPrefix(w.Body.String(), "event: error\ndata: ")
+	if !ok || !strings.HasSuffix(data, "\n\n") {
+		t.Fatalf("SSE error = %q", w.Body)
+	}
+	if response := decodeAPIError(t, data); response.Error.Type != errorTypeOverloaded || response.Error.Message != "Overloaded" {
+		t.Errorf("error = %+v", response.Error)
+	}
+}
+
+func TestAsError(t *testing.T) {
+	wrapped := fmt.Errorf("checking: %w", &Error{Status: http.StatusTooManyRequests, Type: errorTypeRateLimit, Message: "slow down"})
+	if err := asError(wrapped, http.StatusBadRequest, errorTypeInvalidRequest); err.Status != http.StatusTooManyRequests || err.Type != errorTypeRateLimit {
+		t.Errorf("asError(wrapped *Error) = %+v", err)
+	}
+	if err := asError(errors.New("bad"), http.StatusBadRequest, errorTypeInvalidRequest); err.Status != http.StatusBadRequest || err.Type != errorTypeInvalidRequest || err.Message != "bad" {
+		t.Errorf("asError(plain error) = %+v", err)
+	}
+}
+
+func TestProxyErrorsUseAPIFormat(t *testing.T) {
+	// Nothing listens on the upstream address
+	p := newTestProxy(t, Config{AllowedAPIKeys: []string{"client-key"}, UpstreamAPIKey: "upstream-key", UpstreamURL: "http://127.0.0.1:1"}, nil)
+	header := map[string]string{"x-api-key": "client-key"}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		header    map[string]string
+		status    int
+		errorType string
+	}{
+		{"unknown route", "GET", "/v2/other", "", nil, http.StatusNotFound, errorTypeNotFound},
+		{"wrong method", "GET", "/v1/messages", "", header, http.StatusMethodNotAllowed, errorTypeInvalidRequest},
+		{"no key", "POST", "/v1/messages", `{}`, nil, http.StatusUnauthorized, errorTypeAuthentication},
+		{"invalid JSON", "POST", "/v1/messages", `{`, header, http.StatusBadRequest, errorTypeInvalidRequest},
+		{"invalid request", "POST", "/v1/messages", `{"model":"m"}`, header, http.StatusBadRequest, errorTypeInvalidRequest},
+		{"tokens disabled", "POST", "/v1/tokens", `{}`, header, http.StatusNotFound, errorTypeNotFound},
+		{"upstream unreachable", "POST", "/v1/messages", `{"model":"m","max_tokens":1,"messages":[{"role":"user","content":"hi"}]}`, header, http.StatusBadGateway, errorTypeAPI},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(p, tt.method, tt.path, tt.body, tt.header)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if response := decodeAPIError(t, w.Body.String()); response.Error.Type != tt.errorType || response.Error.Message == "" {
+				t.Errorf("error = %+v, want type %s", response.Error, tt.errorType)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package prxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// AWS event stream framing limits
+const (
+	eventStreamPreludeBytes = 12
+	eventStreamMaxMessage   = 16 << 20
+)
+
+// Sizes of the event stream header value types, or -1 for the byte array and string types,
+// which have a 2-byte length prefix
+var eventStreamValueSizes = map[byte]int{0: 0, 1: 0, 2: 1, 3: 2, 4: 4, 5: 8, 6: -1, 7: -1, 8: 8, 9: 16}
+
+// eventStreamMessage is a decoded AWS event stream message
+type eventStreamMessage struct {
+	headers map[string]string
+	payload []byte
+}
+
+// readEventStreamMessage reads one message in the AWS event stream framing: a prelude with the
+// total and header lengths and its CRC, the headers, the payload and a CRC of the whole message.
+// Only string header values are kept.
+func readEventStreamMessage(r io.Reader) (*eventStreamMessage, error) {
+	prelude := make([]byte, eventStreamPreludeBytes)
+	if _, err := io.ReadFull(r, prelude); err != nil {
+		return nil, err
+	}
+	totalLength := binary.BigEndian.Uint32(prelude[0:4])
+	headersLength := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return nil, errors.New("event stream prelude checksum mismatch")
+	}
+	if totalLength > eventStreamMaxMessage || totalLength < eventStreamPreludeBytes+headersLength+4 {
+		return nil, fmt.Errorf("invalid event stream message length %d", totalLength)
+	}
+
+	message := make([]byte, totalLength)
+	copy(message, prelude)
+	if _, err := io.ReadFull(r, message[eventStreamPreludeBytes:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(message[:totalLength-4]) != binary.BigEndian.Uint32(message[totalLength-4:]) {
+		return nil, errors.New("event stream message checksum mismatch")
+	}
+
+	headers, err := parseEventStreamHeaders(message[eventStreamPreludeBytes : eventStreamPreludeBytes+headersLength])
+	if err != nil {
+		return nil, err
+	}
+	return &eventStreamMessage{headers: headers, payload: message[eventStreamPreludeBytes+headersLength : totalLength-4]}, nil
+}
+
+// parseEventStreamHeaders decodes message headers, each a name, a value type and a value
+func parseEventStreamHeaders(data []byte) (map[string]string, error) {
+	headers := map[string]string{}
+	for len(data) > 0 {
+		nameLength := int(data[0])
+		if len(data) < 1+nameLength+1 {
+			return nil, errors.New("truncated event stream header")
+		}
+		name := string(data[1 : 1+nameLength])
+		valueType := data[1+nameLength]
+		data = data[2+nameLength:]
+
+		size, ok := eventStreamValueSizes[valueType]
+		if !ok {
+			return nil, fmt.Errorf("unknown event stream header type %d", valueType)
+		}
+		if size < 0 {
+			if len(data) < 2 {
+				return nil, errors.New("truncated event stream header")
+			}
+			size = int(binary.BigEndian.Uint16(data))
+			data = data[2:]
+		}
+		if len(data) < size {
+			return nil, errors.New("truncated event stream header")
+		}
+		if valueType == 7 {
+			headers[name] = string(data[:size])
+		}
+		data = data[size:]
+	}
+	return headers, nil
+}
+
+// eventStreamSSE turns a Bedrock response stream into the server-sent events the Claude API
+// sends. Each chunk carries one Messages stream event, and exceptions become error events.
+type eventStreamSSE struct {
+	src  io.ReadCloser
+	out  bytes.Buffer
+	done bool
+}
+
+// newEventStreamSSE wraps a Bedrock response stream body
+func newEventStreamSSE(src io.ReadCloser) *eventStreamSSE {
+	return &eventStreamSSE{src: src}
+}
+
+func (e *eventStreamSSE) Read(p []byte) (int, error) {
+	for e.out.Len() == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		message, err := readEventStreamMessage(e.src)
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		e.convert(message)
+	}
+	return e.out.Read(p)
+}
+
+func (e *eventStreamSSE) Close() error {
+	return e.src.Close()
+}
+
+// convert writes the events for one message
+func (e *eventStreamSSE) convert(message *eventStreamMessage) {
+	switch message.headers[":message-type"] {
+	case "event":
+		if message.headers[":event-type"] != "chunk" {
+			return
+		}
+		var chunk struct {
+			Bytes string `json:"bytes"`
+		}
+		var event struct {
+			Type string `json:"type"`
+		}
+		err := json.Unmarshal(message.payload, &chunk)
+		data, decodeErr := base64.StdEncoding.DecodeString(chunk.Bytes)
+		if err != nil || decodeErr != nil || json.Unmarshal(data, &event) != nil || event.Type == "" {
+			e.writeError(errorTypeAPI, "Invalid event from Bedrock")
+			return
+		}
+		fmt.Fprintf(&e.out, "event: %s\ndata: %s\n\n", event.Type, data)
+
+	case "exception":
+		var exception struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(message.payload, &exception)
+		errorType, _ := bedrockErrorType(message.headers[":exception-type"], 0)
+		e.writeError(errorType, exception.Message)
+
+	case "error":
+		e.writeError(errorTypeAPI, strings.TrimSpace(message.headers[":error-code"]+" "+message.headers[":error-message"]))
+	}
+}
+
+// writeError writes an error event, which ends the stream
+func (e *eventStreamSSE) writeError(errorType, message string) {
+	if message == "" {
+		message = "Bedrock stream failed"
+	}
+	data, _ := json.Marshal(apiErrorResponse{Type: "error", Error: apiError{Type: errorType, Message: message}})
+	fmt.Fprintf(&e.out, "event: error\ndata: %s\n\n", data)
+	e.done = true
+}
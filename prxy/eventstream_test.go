@@ -0,0 +1,185 @@
+package prxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+)
+
+// eventStreamFrame encodes a message in the AWS event stream framing, with string headers
+// given as name and value pairs
+func eventStreamFrame(payload string, headers ...string) []byte {
+	var encoded bytes.Buffer
+	for i := 0; i+1 < len(headers); i += 2 {
+		encoded.WriteByte(byte(len(headers[i])))
+		encoded.WriteString(headers[i])
+		encoded.WriteByte(7)
+		binary.Write(&encoded, binary.BigEndian, uint16(len(headers[i+1])))
+		encoded.WriteString(headers[i+1])
+	}
+	return eventStreamFrameRaw(encoded.Bytes(), payload)
+}
+
+// eventStreamFrameRaw encodes a message with already encoded headers
+func eventStreamFrameRaw(headers []byte, payload string) []byte {
+	var frame bytes.Buffer
+	binary.Write(&frame, binary.BigEndian, uint32(eventStreamPreludeBytes+len(headers)+len(payload)+4))
+	binary.Write(&frame, binary.BigEndian, uint32(len(headers)))
+	binary.Write(&frame, binary.BigEndian, crc32.ChecksumIEEE(frame.Bytes()))
+	frame.Write(headers)
+	frame.WriteString(payload)
+	binary.Write(&frame, binary.BigEndian, crc32.ChecksumIEEE(frame.Bytes()))
+	return frame.Bytes()
+}
+
+// bedrockChunk encodes a Messages stream event as a Bedrock chunk message
+func bedrockChunk(event string) []byte {
+	payload := `{"bytes":"` + base64.StdEncoding.EncodeToString([]byte(event)) + `"}`
+	return eventStreamFrame(payload, ":message-type", "event", ":event-type", "chunk", ":content-type", "application/json")
+}
+
+func TestReadEventStreamMessage(t *testing.T) {
+	// Header values of every type, of which only strings are kept
+	var headers bytes.Buffer
+	for _, header := range [][]byte{
+		{4, 't', 'r', 'u', 'e', 0},
+		{4, 'b', 'y', 't', 'e', 2, 1},
+		{3, 'i', 'n', 't', 4, 0, 0, 0, 1},
+		{5, 'b', 'y', 't', 'e', 's', 6, 0, 2, 'a', 'b'},
+		{4, 'n', 'a', 'm', 'e', 7, 0, 2, 'o', 'k'},
+		append([]byte{4, 'u', 'u', 'i', 'd', 9}, make([]byte, 16)...),
+	} {
+		headers.Write(header)
+	}
+	message, err := readEventStreamMessage(bytes.NewReader(eventStreamFrameRaw(headers.Bytes(), "payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(message.headers) != 1 || message.headers["name"] != "ok" || string(message.payload) != "payload" {
+		t.Errorf("message = %v %q", message.headers, message.payload)
+	}
+
+	// Consecutive messages are read one at a time, then the end of the stream
+	r := bytes.NewReader(append(eventStreamFrame("1"), eventStreamFrame("", "a", "b")...))
+	for _, want := range []string{"1", ""} {
+		if message, err := readEventStreamMessage(r); err != nil || string(message.payload) != want {
+			t.Fatalf("message = %v, %v, want payload %q", message, err, want)
+		}
+	}
+	if _, err := readEventStreamMessage(r); err != io.EOF {
+		t.Errorf("error at the end = %v, want EOF", err)
+	}
+}
+
+func TestReadEventStreamMessageErrors(t *testing.T) {
+	frame := eventStreamFrame(`{"a":1}`, "name", "value")
+	corrupt := func(at int) []byte {
+		data := append([]byte(nil), frame...)
+		data[at] ^= 0xff
+		return data
+	}
+	tooLong := eventStreamFrameRaw(nil, "")
+	binary.BigEndian.PutUint32(tooLong, eventStreamMaxMessage+1)
+	binary.BigEndian.PutUint32(tooLong[8:], crc32.ChecksumIEEE(tooLong[:8]))
+	tooShort := eventStreamFrameRaw(nil, "")
+	binary.BigEndian.PutUint32(tooShort[4:], 8)
+	binary.BigEndian.PutUint32(tooShort[8:], crc32.ChecksumIEEE(tooShort[:8]))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "truncated prelude", data: frame[:8], wantErr: "unexpected EOF"},
+		{name: "truncated message", data: frame[:len(frame)-1], wantErr: "unexpected EOF"},
+		{name: "prelude checksum", data: corrupt(8), wantErr: "prelude checksum mismatch"},
+		{name: "message checksum", data: corrupt(len(frame) - 1), wantErr: "message checksum mismatch"},
+		{name: "corrupt payload", data: corrupt(len(frame) - 6), wantErr: "message checksum mismatch"},
+		{name: "message too long", data: tooLong, wantErr: "invalid event stream message length"},
+		{name: "headers longer than the message", data: tooShort, wantErr: "invalid event stream message length"},
+		{name: "truncated header name", data: eventStreamFrameRaw([]byte{5, 'a'}, ""), wantErr: "truncated event stream header"},
+		{name: "truncated string length", data: eventStreamFrameRaw([]byte{1, 'a', 7, 0}, ""), wantErr: "truncated event stream header"},
+		{name: "truncated string", data: eventStreamFrameRaw([]byte{1, 'a', 7, 0, 5, 'x'}, ""), wantErr: "truncated event stream header"},
+		{name: "truncated integer", data: eventStreamFrameRaw([]byte{1, 'a', 4, 0, 0}, ""), wantErr: "truncated event stream header"},
+		{name: "unknown header type", data: eventStreamFrameRaw([]byte{1, 'a', 10}, ""), wantErr: "unknown event stream header type 10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readEventStreamMessage(bytes.NewReader(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("readEventStreamMessage() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEventStreamSSE(t *testing.T) {
+	start := `{"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":1}}}`
+	stop := `{"type":"message_stop"}`
+	tests := []struct {
+		name string
+		data [][]byte
+		want string
+	}{
+		{
+			name: "chunks",
+			data: [][]byte{
+				bedrockChunk(start),
+				eventStreamFrame("{}", ":message-type", "event", ":event-type", "metadata"),
+				bedrockChunk(stop),
+			},
+			want: sseEvents(start, stop),
+		},
+		{
+			name: "exception",
+			data: [][]byte{
+				bedrockChunk(start),
+				eventStreamFrame(`{"message":"Too many requests"}`, ":message-type", "exception", ":exception-type", "throttlingException"),
+				bedrockChunk(stop),
+			},
+			want: sseEvents(start, `{"type":"error","error":{"type":"rate_limit_error","message":"Too many requests"}}`),
+		},
+		{
+			name: "error",
+			data: [][]byte{eventStreamFrame("", ":message-type", "error", ":error-code", "InternalFailure", ":error-message", "It broke")},
+			want: sseEvents(`{"type":"error","error":{"type":"api_error","message":"InternalFailure It broke"}}`),
+		},
+		{
+			name: "error without a message",
+			data: [][]byte{eventStreamFrame("", ":message-type", "error")},
+			want: sseEvents(`{"type":"error","error":{"type":"api_error","message":"Bedrock stream failed"}}`),
+		},
+		{
+			name: "invalid chunk",
+			data: [][]byte{bedrockChunk(`{"no_type":true}`), bedrockChunk(stop)},
+			want: sseEvents(`{"type":"error","error":{"type":"api_error","message":"Invalid event from Bedrock"}}`),
+		},
+		{
+			name: "chunk that is not base64",
+			data: [][]byte{eventStreamFrame(`{"bytes":"!"}`, ":message-type", "event", ":event-type", "chunk")},
+			want: sseEvents(`{"type":"error","error":{"type":"api_error","message":"Invalid event from Bedrock"}}`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(newEventStreamSSE(io.NopCloser(bytes.NewReader(bytes.Join(tt.data, nil)))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.ReplaceAll(tt.want, "\r\n", "\n"); string(got) != want {
+				t.Errorf("events =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+
+	// A corrupt message fails the stream after the events before it
+	data := append(bedrockChunk(start), 0, 0, 0, 0)
+	got, err := io.ReadAll(newEventStreamSSE(io.NopCloser(bytes.NewReader(data))))
+	if err == nil || string(got) != strings.ReplaceAll(sseEvents(start), "\r\n", "\n") {
+		t.Errorf("corrupt stream = %q, %v, want the first event and an error", got, err)
+	}
+}
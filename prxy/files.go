@@ -0,0 +1,373 @@
+package prxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Files API defaults
+const (
+	filesPath           = "/v1/files"
+	defaultMaxFileBytes = 500 << 20
+)
+
+// fileRecord is a line of the file owners file. Deleted files get a second record.
+type fileRecord struct {
+	Time    time.Time `json:"time"`
+	FileID  string    `json:"file_id"`
+	Owner   string    `json:"owner"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+// fileOwners records the caller that uploaded each file, in memory and optionally in a JSON lines file
+type fileOwners struct {
+	logger
+	path string
+
+	mu     sync.RWMutex
+	owners map[string]string
+	file   *os.File
+}
+
+// loadFileOwners replays the owners file, if one is configured
+func loadFileOwners(path string, l logger) (*fileOwners, error) {
+	f := &fileOwners{logger: l, path: path, owners: map[string]string{}}
+	if path == "" {
+		return f, nil
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		if record.Deleted {
+			delete(f.owners, record.FileID)
+		} else {
+			f.owners[record.FileID] = record.Owner
+		}
+	}
+	return f, scanner.Err()
+}
+
+// allows reports whether the caller owns the file. Files uploaded without the proxy have no owner.
+func (f *fileOwners) allows(fileID, owner string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	recorded, ok := f.owners[fileID]
+	return ok && owner != "" && recorded == owner
+}
+
+// add records the owner of an uploaded file
+func (f *fileOwners) add(fileID, owner string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.owners[fileID] = owner
+	f.append(fileRecord{Time: time.Now().UTC(), FileID: fileID, Owner: owner})
+}
+
+// remove forgets a deleted file
+func (f *fileOwners) remove(fileID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	owner := f.owners[fileID]
+	delete(f.owners, fileID)
+	f.append(fileRecord{Time: time.Now().UTC(), FileID: fileID, Owner: owner, Deleted: true})
+}
+
+// append writes a record to the owners file, opening it on first use. The caller holds the lock.
+func (f *fileOwners) append(record fileRecord) {
+	if f.path == "" {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		f.logError("Failed to encode file owner record: %v", err)
+		return
+	}
+	if f.file == nil {
+		f.file, err = os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			f.logError("Failed to open file owners file %s: %v", f.path, err)
+			return
+		}
+	}
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		f.logError("Failed to write file owner record: %v", err)
+	}
+}
+
+// close closes the owners file if it was opened
+func (f *fileOwners) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+}
+
+// findForeignFile returns the first file the caller does not own that a request body's content
+// blocks refer to, and its JSON path. Files are referred to by source.file_id in document and
+// image blocks and by file_id in container_upload blocks, and other fields named file_id, such
+// as in tool inputs or metadata, are not references. Message batches are checked request by
+// request.
+func (f *fileOwners) findForeignFile(body map[string]interface{}, owner string) (string, string) {
+	messages, _ := body["messages"].([]interface{})
+	for i, message := range messages {
+		message, _ := message.(map[string]interface{})
+		content, _ := message["content"].([]interface{})
+		if id, at := f.findForeignFileInBlocks(content, owner, fmt.Sprintf("messages.%d.content", i)); id != "" {
+			return id, at
+		}
+	}
+	requests, _ := body["requests"].([]interface{})
+	for i, request := range requests {
+		request, _ := request.(map[string]interface{})
+		params, _ := request["params"].(map[string]interface{})
+		if id, at := f.findForeignFile(params, owner); id != "" {
+			return id, fmt.Sprintf("requests.%d.params.%s", i, at)
+		}
+	}
+	return "", ""
+}
+
+// findForeignFileInBlocks checks a list of content blocks, including the blocks nested in tool
+// results and in documents with content sources
+func (f *fileOwners) findForeignFileInBlocks(blocks []interface{}, owner, path string) (string, string) {
+	for i, block := range blocks {
+		block, ok := block.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		at := joinPath(path, fmt.Sprint(i))
+		if block["type"] == "container_upload" {
+			if id, ok := block["file_id"].(string); ok && !f.allows(id, owner) {
+				return id, joinPath(at, "file_id")
+			}
+		}
+		if source, ok := block["source"].(map[string]interface{}); ok {
+			if id, ok := source["file_id"].(string); ok && !f.allows(id, owner) {
+				return id, joinPath(at, "source.file_id")
+			}
+			if nested, ok := source["content"].([]interface{}); ok {
+				if id, at := f.findForeignFileInBlocks(nested, owner, joinPath(at, "source.content")); id != "" {
+					return id, at
+				}
+			}
+		}
+		if nested, ok := block["content"].([]interface{}); ok {
+			if id, at := f.findForeignFileInBlocks(nested, owner, joinPath(at, "content")); id != "" {
+				return id, at
+			}
+		}
+	}
+	return "", ""
+}
+
+// joinPath appends a key to a JSON path such as "messages.0.content"
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// allowFileReferences refuses a route request whose JSON body refers to a file the caller does
+// not own, writing the error. Bodies that are not JSON objects refer to no files.
+func (p *Proxy) allowFileReferences(w http.ResponseWriter, r *http.Request, caller *principal, body []byte) bool {
+	if p.files == nil {
+		return true
+	}
+	var data map[string]interface{}
+	if json.Unmarshal(body, &data) != nil {
+		return true
+	}
+	if fileID, at := p.files.findForeignFile(data, caller.owner); fileID != "" {
+		requestID := r.Context().Value(requestIDKey).(string)
+		p.logRequest(requestID, "File %s is not owned by %s", fileID, caller.fingerprint)
+		writeAPIError(w, http.StatusNotFound, errorTypeNotFound, fmt.Sprintf("%s: File not found: %s", at, fileID))
+		return false
+	}
+	return true
+}
+
+// filesCaller authenticates a Files API request, rejecting callers that cannot own files
+func (p *Proxy) filesCaller(w http.ResponseWriter, r *http.Request) (*principal, bool) {
+	caller, ok := p.authenticate(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !p.requireAnthropic(w, r, caller) {
+		return nil, false
+	}
+	if caller.owner == "" {
+		requestID := r.Context().Value(requestIDKey).(string)
+		p.logRequest(requestID, "Forbidden: %s cannot use files", caller.fingerprint)
+		writeAPIError(w, http.StatusForbidden, errorTypePermission, "These credentials cannot be used for files")
+		return nil, false
+	}
+	return caller, true
+}
+
+// fileUploadHandler streams a multipart upload to the Claude API and records the caller as
+// the owner of the new file
+func (p *Proxy) fileUploadHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Context().Value(requestIDKey).(string)
+	caller, ok := p.filesCaller(w, r)
+	if !ok {
+		return
+	}
+
+	// The upload is never held in memory, only passed on as it arrives
+	defer r.Body.Close()
+	body := http.MaxBytesReader(w, r.Body, p.maxFileBytes)
+	resp, upstreamSpan := p.forwardUpstream(w, r, caller, filesPath, body, r.ContentLength)
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+	defer upstreamSpan.finish()
+	if resp.StatusCode != http.StatusOK {
+		p.passResponse(w, r, resp, upstreamSpan)
+		return
+	}
+
+	responseBody, err := io.ReadAll(resp.Body)
+	var file struct {
+		ID string `json:"id"`
+	}
+	if err == nil {
+		err = json.Unmarshal(responseBody, &file)
+	}
+	if err != nil || file.ID == "" {
+		p.write(LogError, requestID, "Invalid file upload response from Claude API: %v", err)
+		upstreamSpan.setError("invalid upload response")
+		writeAPIError(w, http.StatusBadGateway, errorTypeAPI, "Invalid response from Claude API")
+		return
+	}
+	p.files.add(file.ID, caller.owner)
+	p.logRequest(requestID, "Uploaded file %s for %s", file.ID, caller.fingerprint)
+	p.writeUpstreamJSON(w, resp, responseBody)
+}
+
+// fileListHandler lists the caller's files. The Claude API lists every file in the
+// organization, so other callers' files are removed from each page, which can leave pages
+// shorter than the limit. The upstream first_id, last_id and has_more are kept for paging.
+func (p *Proxy) fileListHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Context().Value(requestIDKey).(string)
+	caller, ok := p.filesCaller(w, r)
+	if !ok {
+		return
+	}
+
+	resp, upstreamSpan := p.forwardUpstream(w, r, caller, filesPath, nil, 0)
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+	defer upstreamSpan.finish()
+	if resp.StatusCode != http.StatusOK {
+		p.passResponse(w, r, resp, upstreamSpan)
+		return
+	}
+
+	responseBody, err := io.ReadAll(resp.Body)
+	var page map[string]json.RawMessage
+	var files []json.RawMessage
+	if err == nil {
+		if err = json.Unmarshal(responseBody, &page); err == nil {
+			err = json.Unmarshal(page["data"], &files)
+		}
+	}
+	if err != nil {
+		p.write(LogError, requestID, "Invalid file list response from Claude API: %v", err)
+		upstreamSpan.setError("invalid list response")
+		writeAPIError(w, http.StatusBadGateway, errorTypeAPI, "Invalid response from Claude API")
+		return
+	}
+
+	owned := make([]json.RawMessage, 0, len(files))
+	for _, file := range files {
+		var metadata struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(file, &metadata) == nil && p.files.allows(metadata.ID, caller.owner) {
+			owned = append(owned, file)
+		}
+	}
+	p.logRequest(requestID, "Listing %d of %d files for %s", len(owned), len(files), caller.fingerprint)
+	page["data"], _ = json.Marshal(owned)
+	filtered, _ := json.Marshal(page)
+	p.writeUpstreamJSON(w, resp, filtered)
+}
+
+// fileHandler gets, downloads or deletes a file the caller owns. Files the caller does not
+// own are reported as not found, so their IDs reveal nothing.
+func (p *Proxy) fileHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Context().Value(requestIDKey).(string)
+	caller, ok := p.filesCaller(w, r)
+	if !ok {
+		return
+	}
+
+	fileID := mux.Vars(r)["file_id"]
+	if !p.files.allows(fileID, caller.owner) {
+		p.logRequest(requestID, "File %s is not owned by %s", fileID, caller.fingerprint)
+		writeAPIError(w, http.StatusNotFound, errorTypeNotFound, "File not found: "+fileID)
+		return
+	}
+
+	resp, upstreamSpan := p.forwardUpstream(w, r, caller, filesPath+"/{file_id}", nil, 0)
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+	defer upstreamSpan.finish()
+	if r.Method == http.MethodDelete && resp.StatusCode == http.StatusOK {
+		p.files.remove(fileID)
+		p.logRequest(requestID, "Deleted file %s", fileID)
+	}
+	p.passResponse(w, r, resp, upstreamSpan)
+}
+
+// writeUpstreamJSON sends a JSON body in place of an upstream response's own
+func (p *Proxy) writeUpstreamJSON(w http.ResponseWriter, resp *http.Response, body []byte) {
+	copyResponseHeaders(w.Header(), resp.Header, p.responseHeaders)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
+
+// routeCoversFiles reports whether a route would forward Files API paths
+func routeCoversFiles(route Route) bool {
+	prefix, isPrefix := strings.CutSuffix(route.Pattern, "*")
+	if isPrefix {
+		return strings.HasPrefix(filesPath, prefix) || strings.HasPrefix(prefix, filesPath)
+	}
+	return route.Pattern == filesPath || strings.HasPrefix(route.Pattern, filesPath+"/")
+}
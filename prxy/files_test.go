@@ -0,0 +1,243 @@
+package prxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileOwners(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "files.jsonl")
+	owners, err := loadFileOwners(path, logger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners.add("file_1", "alice")
+	owners.add("file_2", "bob")
+	owners.remove("file_2")
+	owners.close()
+
+	// Owners are replayed from the file after a restart
+	owners, err = loadFileOwners(path, logger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		fileID, owner string
+		want          bool
+	}{
+		{"file_1", "alice", true},
+		{"file_1", "bob", false},
+		{"file_1", "", false},
+		{"file_2", "bob", false},
+		{"file_3", "alice", false},
+	}
+	for _, tt := range tests {
+		if got := owners.allows(tt.fileID, tt.owner); got != tt.want {
+			t.Errorf("allows(%s, %q) = %v, want %v", tt.fileID, tt.owner, got, tt.want)
+		}
+	}
+
+	os.WriteFile(path, []byte(`{"file_id":"file_1","owner":"alice"}`+"\nnot json\n"), 0o600)
+	if _, err := loadFileOwners(path, logger{}); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("loadFileOwners() of a broken file error = %v, want the line number", err)
+	}
+}
+
+func TestFindForeignFile(t *testing.T) {
+	owners, _ := loadFileOwners("", logger{})
+	owners.add("file_mine", "alice")
+	owners.add("file_theirs", "bob")
+
+	tests := []struct {
+		name   string
+		body   string
+		wantID string
+		wantAt string
+	}{
+		{
+			name: "own files",
+			body: `{"messages":[{"role":"user","content":[{"type":"document","source":{"type":"file","file_id":"file_mine"}},` +
+				`{"type":"container_upload","file_id":"file_mine"}]}]}`,
+		},
+		{
+			name:   "document source",
+			body:   `{"messages":[{"role":"user","content":"hi"},{"role":"user","content":[{"type":"text","text":"x"},{"type":"document","source":{"type":"file","file_id":"file_theirs"}}]}]}`,
+			wantID: "file_theirs", wantAt: "messages.1.content.1.source.file_id",
+		},
+		{
+			name:   "image source",
+			body:   `{"messages":[{"role":"user","content":[{"type":"image","source":{"type":"file","file_id":"file_unknown"}}]}]}`,
+			wantID: "file_unknown", wantAt: "messages.0.content.0.source.file_id",
+		},
+		{
+			name:   "container upload",
+			body:   `{"messages":[{"role":"user","content":[{"type":"container_upload","file_id":"file_theirs"}]}]}`,
+			wantID: "file_theirs", wantAt: "messages.0.content.0.file_id",
+		},
+		{
+			name: "tool result content",
+			body: `{"messages":[{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":[` +
+				`{"type":"image","source":{"type":"file","file_id":"file_theirs"}}]}]}]}`,
+			wantID: "file_theirs", wantAt: "messages.0.content.0.content.0.source.file_id",
+		},
+		{
+			name: "document with a content source",
+			body: `{"messages":[{"role":"user","content":[{"type":"document","source":{"type":"content","content":[` +
+				`{"type":"image","source":{"type":"file","file_id":"file_theirs"}}]}}]}]}`,
+			wantID: "file_theirs", wantAt: "messages.0.content.0.source.content.0.source.file_id",
+		},
+		{
+			name: "message batch",
+			body: `{"requests":[{"custom_id":"a","params":{"messages":[{"role":"user","content":"hi"}]}},` +
+				`{"custom_id":"b","params":{"messages":[{"role":"user","content":[{"type":"document","source":{"type":"file","file_id":"file_theirs"}}]}]}}]}`,
+			wantID: "file_theirs", wantAt: "requests.1.params.messages.0.content.0.source.file_id",
+		},
+		{
+			// Fields that happen to be named file_id are not references
+			name: "not references",
+			body: `{"metadata":{"file_id":"file_theirs"},"messages":[{"role":"assistant","content":[` +
+				`{"type":"tool_use","id":"t1","name":"open","input":{"file_id":"file_theirs","source":{"file_id":"file_theirs"}}},` +
+				`{"type":"text","text":"x","file_id":"file_theirs"}]}],` +
+				`"tools":[{"name":"open","input_schema":{"type":"object","properties":{"file_id":{"type":"string"}}}}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.body), &body); err != nil {
+				t.Fatal(err)
+			}
+			id, at := owners.findForeignFile(body, "alice")
+			if id != tt.wantID || at != tt.wantAt {
+				t.Errorf("findForeignFile() = %q at %q, want %q at %q", id, at, tt.wantID, tt.wantAt)
+			}
+		})
+	}
+}
+
+// testFilesAPI is a stand-in for the Claude API's Files API and Messages endpoint
+type testFilesAPI struct {
+	mu       sync.Mutex
+	files    []string
+	next     int
+	requests []string
+}
+
+func (api *testFilesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.requests = append(api.requests, r.Method+" "+r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == "POST" && r.URL.Path == filesPath:
+		io.Copy(io.Discard, r.Body)
+		api.next++
+		id := "file_" + string(rune('a'+api.next-1))
+		api.files = append(api.files, id)
+		io.WriteString(w, `{"id":"`+id+`","type":"file"}`)
+	case r.Method == "GET" && r.URL.Path == filesPath:
+		var data []string
+		for _, id := range append([]string{"file_outside"}, api.files...) {
+			data = append(data, `{"id":"`+id+`"}`)
+		}
+		io.WriteString(w, `{"data":[`+strings.Join(data, ",")+`],"has_more":false}`)
+	case r.Method == "POST" && r.URL.Path == "/v1/messages":
+		io.WriteString(w, `{"type":"message","usage":{"input_tokens":1,"output_tokens":1}}`)
+	default:
+		io.WriteString(w, `{"id":"`+strings.TrimPrefix(r.URL.Path, filesPath+"/")+`"}`)
+	}
+}
+
+func TestFilesAPI(t *testing.T) {
+	api := &testFilesAPI{}
+	p := newTestProxy(t, Config{
+		AllowedAPIKeys: []string{"alice-key", "bob-key"},
+		UpstreamAPIKey: "upstream-key",
+		FilesAPI:       true,
+		Routes: []Route{
+			{Pattern: "/v1/skills*", Methods: []string{"POST"}, Body: RouteBodyStream},
+			{Pattern: "/v1/messages/batches", Methods: []string{"POST"}},
+		},
+	}, api.ServeHTTP)
+	alice := map[string]string{"x-api-key": "alice-key"}
+	bob := map[string]string{"x-api-key": "bob-key"}
+
+	upload := func(header map[string]string) string {
+		t.Helper()
+		w := serve(p, "POST", filesPath, "file contents", header)
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+		}
+		var file struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &file)
+		return file.ID
+	}
+	aliceFile, bobFile := upload(alice), upload(bob)
+
+	w := serve(p, "GET", filesPath, "", alice)
+	if w.Code != http.StatusOK || w.Body.String() != `{"data":[{"id":"`+aliceFile+`"}],"has_more":false}` {
+		t.Errorf("list = %d %s, want only Alice's file", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header map[string]string
+		status int
+	}{
+		{name: "get own file", method: "GET", path: filesPath + "/" + aliceFile, header: alice, status: http.StatusOK},
+		{name: "download another caller's file", method: "GET", path: filesPath + "/" + bobFile + "/content", header: alice, status: http.StatusNotFound},
+		{name: "get a file from outside the proxy", method: "GET", path: filesPath + "/file_outside", header: alice, status: http.StatusNotFound},
+		{name: "delete another caller's file", method: "DELETE", path: filesPath + "/" + bobFile, header: alice, status: http.StatusNotFound},
+		{
+			name: "message with own file", method: "POST", path: "/v1/messages", header: alice, status: http.StatusOK,
+			body: `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":[{"type":"document","source":{"type":"file","file_id":"` + aliceFile + `"}}]}]}`,
+		},
+		{
+			name: "message with another caller's file", method: "POST", path: "/v1/messages", header: alice, status: http.StatusNotFound,
+			body: `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":[{"type":"document","source":{"type":"file","file_id":"` + bobFile + `"}}]}]}`,
+		},
+		{
+			// Route bodies are read in full and checked even on streamed routes
+			name: "route with another caller's file", method: "POST", path: "/v1/skills", header: alice, status: http.StatusNotFound,
+			body: `{"messages":[{"role":"user","content":[{"type":"container_upload","file_id":"` + bobFile + `"}]}]}`,
+		},
+		{
+			name: "batch with another caller's file", method: "POST", path: "/v1/messages/batches", header: alice, status: http.StatusNotFound,
+			body: `{"requests":[{"custom_id":"a","params":{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":[` +
+				`{"type":"document","source":{"type":"file","file_id":"` + bobFile + `"}}]}]}}]}`,
+		},
+		{name: "route with a body that is not JSON", method: "POST", path: "/v1/skills", body: "name=x", header: alice, status: http.StatusOK},
+		{name: "delete own file", method: "DELETE", path: filesPath + "/" + aliceFile, header: alice, status: http.StatusOK},
+		{name: "get a deleted file", method: "GET", path: filesPath + "/" + aliceFile, header: alice, status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api.mu.Lock()
+			api.requests = nil
+			api.mu.Unlock()
+			w := serve(p, tt.method, tt.path, tt.body, tt.header)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			api.mu.Lock()
+			defer api.mu.Unlock()
+			if tt.status == http.StatusNotFound {
+				if len(api.requests) > 0 {
+					t.Errorf("refused request was forwarded: %v", api.requests)
+				}
+				decodeAPIError(t, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package prxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// Hop-by-hop headers apply to a single connection and are never forwarded (RFC 9110 section 7.6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Default header forwarding rules if environment variables are not set
+var (
+	defaultForwardRequestHeaders  = []string{"authorization", "x-api-key", "anthropic-version", "anthropic-beta"}
+	defaultForwardResponseHeaders = []string{"*"}
+	// Upstream response headers that are always passed back unless explicitly blocked
+	preservedResponseHeaders = []string{"request-id", "anthropic-ratelimit-*", "retry-after"}
+)
+
+// headerPolicy decides which headers are forwarded. Patterns are case-insensitive
+// header names, optionally ending in "*" to match a prefix. Deny rules win over allow rules.
+type headerPolicy struct {
+	allow []string
+	deny  []string
+}
+
+// newHeaderPolicy builds a policy from allow and deny patterns, using def when allow is empty
+func newHeaderPolicy(allow, def, deny []string) headerPolicy {
+	if len(allow) == 0 {
+		allow = def
+	}
+	return headerPolicy{allow: lowerAll(allow), deny: lowerAll(deny)}
+}
+
+// allows reports whether the policy lets the header through
+func (p headerPolicy) allows(name string) bool {
+	name = strings.ToLower(name)
+	return !matchHeaderPattern(p.deny, name) && matchHeaderPattern(p.allow, name)
+}
+
+// matchHeaderPattern reports whether a lowercase header name matches any of the patterns
+func matchHeaderPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isHopByHop reports whether a header only applies to a single connection, including
+// any headers the sender listed in its Connection header
+func isHopByHop(header http.Header, name string) bool {
+	canonical := textproto.CanonicalMIMEHeaderKey(name)
+	for _, h := range hopByHopHeaders {
+		if canonical == h {
+			return true
+		}
+	}
+	for _, value := range header.Values("Connection") {
+		for _, listed := range strings.Split(value, ",") {
+			if textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(listed)) == canonical {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copyRequestHeaders copies the client headers allowed by the request policy to the upstream request
+func copyRequestHeaders(dst, src http.Header, policy headerPolicy, skip func(name string) bool) []string {
+	var copied []string
+	for name, values := range src {
+		if isHopByHop(src, name) || !policy.allows(name) || skip(name) {
+			continue
+		}
+		dst.Del(name)
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+		copied = append(copied, name)
+	}
+	return copied
+}
+
+// copyResponseHeaders copies the upstream headers allowed by the response policy to the client response.
+// Headers already set by the proxy and Content-Length, which the proxy's own writes determine, are kept as they are.
+func copyResponseHeaders(dst, src http.Header, policy headerPolicy) {
+	for name, values := range src {
+		if isHopByHop(src, name) || name == "Content-Length" || !policy.allows(name) {
+			continue
+		}
+		if _, exists := dst[name]; exists {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// parseStaticHeaders parses "Name:Value" pairs separated by "|"; repeated names add multiple values
+func parseStaticHeaders(spec string) (http.Header, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	headers := http.Header{}
+	for _, pair := range strings.Split(spec, "|") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q, expected Name:Value", pair)
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// addStaticHeaders sets the given static headers on the request, replacing any forwarded values
+func addStaticHeaders(dst, headers http.Header) {
+	for name, values := range headers {
+		dst.Del(name)
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// lowerAll lowercases every string in the list
+func lowerAll(list []string) []string {
+	lowered := make([]string, len(list))
+	for i, s := range list {
+		lowered[i] = strings.ToLower(s)
+	}
+	return lowered
+}
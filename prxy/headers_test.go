@@ -0,0 +1,171 @@
+package prxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestHeaderPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  []string
+		deny   []string
+		header string
+		want   bool
+	}{
+		{name: "default allows listed", header: "Anthropic-Beta", want: true},
+		{name: "default blocks others", header: "Cookie"},
+		{name: "exact", allow: []string{"X-Team"}, header: "x-team", want: true},
+		{name: "exact is not a prefix", allow: []string{"x-team"}, header: "x-team-id"},
+		{name: "prefix", allow: []string{"x-trace-*"}, header: "X-Trace-Parent", want: true},
+		{name: "prefix does not match others", allow: []string{"x-trace-*"}, header: "X-Tracer"},
+		{name: "wildcard", allow: []string{"*"}, header: "Anything", want: true},
+		{name: "deny wins", allow: []string{"*"}, deny: []string{"cookie"}, header: "Cookie"},
+		{name: "deny prefix wins", allow: []string{"x-*"}, deny: []string{"X-Internal-*"}, header: "x-internal-user"},
+	}
+	for _, tt := range tests {
+		policy := newHeaderPolicy(tt.allow, defaultForwardRequestHeaders, tt.deny)
+		if got := policy.allows(tt.header); got != tt.want {
+			t.Errorf("%s: allows(%q) = %v, want %v", tt.name, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestIsHopByHop(t *testing.T) {
+	header := http.Header{"Connection": {"keep-alive, X-Session"}}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Transfer-Encoding", true},
+		{"proxy-authorization", true},
+		{"te", true},
+		{"x-session", true},
+		{"X-Other", false},
+		{"Anthropic-Version", false},
+	}
+	for _, tt := range tests {
+		if got := isHopByHop(header, tt.name); got != tt.want {
+			t.Errorf("isHopByHop(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCopyHeaders(t *testing.T) {
+	src := http.Header{
+		"Connection":        {"X-Session"},
+		"X-Session":         {"s1"},
+		"Transfer-Encoding": {"chunked"},
+		"Anthropic-Beta":    {"a", "b"},
+		"X-Team":            {"t"},
+		"Cookie":            {"c"},
+	}
+	dst := http.Header{"Anthropic-Beta": {"old"}}
+	policy := newHeaderPolicy([]string{"*"}, nil, []string{"cookie"})
+	copied := copyRequestHeaders(dst, src, policy, func(name string) bool { return name == "X-Team" })
+	sort.Strings(copied)
+	if strings.Join(copied, ",") != "Anthropic-Beta" {
+		t.Errorf("copied %v, want only Anthropic-Beta", copied)
+	}
+	if got := strings.Join(dst.Values("Anthropic-Beta"), ","); got != "a,b" {
+		t.Errorf("Anthropic-Beta = %q, want the client's values to replace the old one", got)
+	}
+
+	response := http.Header{"Content-Type": {"text/event-stream"}}
+	copyResponseHeaders(response, http.Header{
+		"Content-Type":      {"application/json"},
+		"Content-Length":    {"10"},
+		"Transfer-Encoding": {"chunked"},
+		"Request-Id":        {"req_1"},
+	}, newHeaderPolicy(nil, defaultForwardResponseHeaders, nil))
+	if response.Get("Content-Type") != "text/event-stream" || response.Get("Content-Length") != "" || response.Get("Transfer-Encoding") != "" || response.Get("Request-Id") != "req_1" {
+		t.Errorf("response headers = %v", response)
+	}
+}
+
+func TestParseStaticHeaders(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    http.Header
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "  ", want: nil},
+		{spec: "X-Team: billing", want: http.Header{"X-Team": {"billing"}}},
+		{spec: "X-Team:billing | X-Env:prod|", want: http.Header{"X-Team": {"billing"}, "X-Env": {"prod"}}},
+		{spec: "X-Tag:a|X-Tag:b", want: http.Header{"X-Tag": {"a", "b"}}},
+		{spec: "X-Url:https://example.com", want: http.Header{"X-Url": {"https://example.com"}}},
+		{spec: "X-Empty:", want: http.Header{"X-Empty": {""}}},
+		{spec: "X-Team", wantErr: true},
+		{spec: ":billing", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseStaticHeaders(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseStaticHeaders(%q) error = %v", tt.spec, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseStaticHeaders(%q) = %v, want %v", tt.spec, got, tt.want)
+			continue
+		}
+		for name, values := range tt.want {
+			if strings.Join(got.Values(name), ",") != strings.Join(values, ",") {
+				t.Errorf("parseStaticHeaders(%q)[%s] = %v, want %v", tt.spec, name, got.Values(name), values)
+			}
+		}
+	}
+}
+
+func TestHeaderForwarding(t *testing.T) {
+	var upstream http.Header
+	p := newTestProxy(t, Config{
+		AllowedAPIKeys:        []string{"client-key"},
+		UpstreamAPIKey:        "upstream-key",
+		ForwardRequestHeaders: []string{"anthropic-*", "x-api-key", "x-team"},
+		BlockRequestHeaders:   []string{"anthropic-internal"},
+		BlockResponseHeaders:  []string{"x-upstream-secret"},
+		UpstreamHeaders:       http.Header{"X-Team": {"platform"}},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+		w.Header().Set("X-Upstream-Secret", "s")
+		w.Header().Set("X-Upstream-Other", "o")
+		w.Header().Set("Anthropic-Ratelimit-Requests-Remaining", "9")
+		io.WriteString(w, `{"type":"message"}`)
+	})
+
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model":"m","max_tokens":1,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("x-api-key", "client-key")
+	req.Header.Set("Anthropic-Beta", "files-api")
+	req.Header.Set("Anthropic-Internal", "1")
+	req.Header.Set("X-Team", "spoofed")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	want := map[string]string{
+		"X-Api-Key":          "upstream-key",
+		"Anthropic-Beta":     "files-api",
+		"Anthropic-Internal": "",
+		"X-Team":             "platform",
+		"Cookie":             "",
+		"X-Hop":              "",
+	}
+	for name, value := range want {
+		if got := upstream.Get(name); got != value {
+			t.Errorf("upstream %s = %q, want %q", name, got, value)
+		}
+	}
+	if w.Header().Get("X-Upstream-Secret") != "" || w.Header().Get("X-Upstream-Other") != "o" || w.Header().Get("Anthropic-Ratelimit-Requests-Remaining") != "9" {
+		t.Errorf("response headers = %v", w.Header())
+	}
+}
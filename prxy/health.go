@@ -0,0 +1,183 @@
+package prxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Upstream probe timing
+const (
+	upstreamProbeInterval = 30 * time.Second
+	upstreamProbeTimeout  = 5 * time.Second
+)
+
+// healthCheck is the result of a single readiness check
+type healthCheck struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+	CheckedAt string `json:"checked_at,omitempty"`
+}
+
+// healthResponse is returned by the liveness and readiness endpoints
+type healthResponse struct {
+	Status  string        `json:"status"`
+	Version string        `json:"version,omitempty"`
+	Checks  []healthCheck `json:"checks,omitempty"`
+}
+
+// readinessState tracks everything the readiness endpoint reports on
+type readinessState struct {
+	mu                sync.RWMutex
+	configLoaded      bool
+	draining          bool
+	upstreamErr       error
+	upstreamCheckedAt time.Time
+	// keysConfigured is set when API keys are validated against a key store
+	keysConfigured bool
+	// keyFile is set when keys are loaded from a key store file
+	keyFile *keyFileWatcher
+}
+
+// setConfigLoaded marks the configuration as successfully loaded
+func (s *readinessState) setConfigLoaded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configLoaded = true
+}
+
+// setDraining marks the server as shutting down so load balancers stop sending traffic
+func (s *readinessState) setDraining() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+}
+
+// setUpstreamResult records the outcome of an upstream probe
+func (s *readinessState) setUpstreamResult(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upstreamErr = err
+	s.upstreamCheckedAt = time.Now()
+}
+
+// checks returns the current result of every readiness check
+func (s *readinessState) checks() []healthCheck {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	config := healthCheck{Name: "config", Status: "ok"}
+	if !s.configLoaded {
+		config.Status = "fail"
+		config.Message = "configuration not loaded"
+	}
+
+	upstream := healthCheck{Name: "upstream", Status: "ok"}
+	switch {
+	case s.upstreamCheckedAt.IsZero():
+		upstream.Status = "fail"
+		upstream.Message = "not probed yet"
+	case s.upstreamErr != nil:
+		upstream.Status = "fail"
+		upstream.Message = s.upstreamErr.Error()
+	}
+	if !s.upstreamCheckedAt.IsZero() {
+		upstream.CheckedAt = s.upstreamCheckedAt.UTC().Format(time.RFC3339)
+	}
+
+	storage := healthCheck{Name: "storage", Status: "ok", Message: "in-memory key store"}
+	switch {
+	case s.keyFile != nil && s.keyFile.lastError() != nil:
+		storage.Status = "fail"
+		storage.Message = s.keyFile.lastError().Error()
+	case s.keyFile != nil:
+		storage.Message = "key store file " + s.keyFile.file.Path
+	case !s.keysConfigured:
+		storage.Message = "no key store configured"
+	}
+
+	draining := healthCheck{Name: "draining", Status: "ok"}
+	if s.draining {
+		draining.Status = "fail"
+		draining.Message = "server is shutting down"
+	}
+
+	return []healthCheck{config, upstream, storage, draining}
+}
+
+// runUpstreamProbe periodically checks that the default provider can be reached until the context is canceled
+func (p *Proxy) runUpstreamProbe(ctx context.Context) {
+	client := &http.Client{Timeout: upstreamProbeTimeout}
+	ticker := time.NewTicker(upstreamProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		err := probeUpstream(ctx, client, p.providers[p.defaultProvider].baseURL())
+		if err != nil && ctx.Err() == nil {
+			p.logWarning("Upstream probe failed: %v", err)
+		}
+		p.readiness.setUpstreamResult(err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeUpstream makes a request to the Claude API base URL; any HTTP response means it is reachable
+func probeUpstream(ctx context.Context, client *http.Client, claudeURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, claudeURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upstream unreachable: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("upstream returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// livenessHandler reports that the process is up and serving requests
+func (p *Proxy) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, r, http.StatusOK, healthResponse{Status: "ok"}, p.version)
+}
+
+// readinessHandler reports whether the server should receive traffic.
+// Add ?verbose to list each check and the build version.
+func (p *Proxy) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Context().Value(requestIDKey).(string)
+
+	checks := p.readiness.checks()
+	response := healthResponse{Status: "ok"}
+	status := http.StatusOK
+	for _, check := range checks {
+		if check.Status != "ok" {
+			response.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			p.logRequest(requestID, "Readiness check %s failed: %s", check.Name, check.Message)
+		}
+	}
+
+	writeHealth(w, r, status, response, p.version, checks...)
+}
+
+// writeHealth writes a health response, adding checks and the version in verbose mode
+func writeHealth(w http.ResponseWriter, r *http.Request, status int, response healthResponse, version string, checks ...healthCheck) {
+	if _, verbose := r.URL.Query()["verbose"]; verbose {
+		response.Version = version
+		response.Checks = checks
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,103 @@
+package prxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	tests := []struct {
+		name     string
+		prepare  func(p *Proxy)
+		status   int
+		failing  string
+		contains string
+	}{
+		{name: "not probed", prepare: func(p *Proxy) {}, status: http.StatusServiceUnavailable, failing: "upstream", contains: "not probed yet"},
+		{name: "ready", prepare: func(p *Proxy) { p.readiness.setUpstreamResult(nil) }, status: http.StatusOK},
+		{
+			name:    "upstream down",
+			prepare: func(p *Proxy) { p.readiness.setUpstreamResult(errors.New("upstream unreachable")) },
+			status:  http.StatusServiceUnavailable, failing: "upstream", contains: "upstream unreachable",
+		},
+		{
+			name:    "draining",
+			prepare: func(p *Proxy) { p.readiness.setUpstreamResult(nil); p.Drain() },
+			status:  http.StatusServiceUnavailable, failing: "draining", contains: "shutting down",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, Config{Version: "1.2.3"}, nil)
+			tt.prepare(p)
+
+			w := serve(p, "GET", "/readyz?verbose", "", nil)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var response healthResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Version != "1.2.3" || len(response.Checks) != 4 {
+				t.Errorf("verbose response = %+v, want the version and 4 checks", response)
+			}
+			for _, check := range response.Checks {
+				failing := check.Status != "ok"
+				if failing != (check.Name == tt.failing) {
+					t.Errorf("check %s is %s: %s", check.Name, check.Status, check.Message)
+				}
+				if check.Name == tt.failing && !strings.Contains(check.Message, tt.contains) {
+					t.Errorf("check %s message = %q, want %q", check.Name, check.Message, tt.contains)
+				}
+			}
+
+			// Without verbose, only the status is reported
+			if w := serve(p, "GET", "/readyz", "", nil); strings.Contains(w.Body.String(), "checks") {
+				t.Errorf("non-verbose body = %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestLivenessIgnoresReadiness(t *testing.T) {
+	p := newTestProxy(t, Config{}, nil)
+	p.Drain()
+	for _, path := range []string{"/livez", "/health"} {
+		if w := serve(p, "GET", path, "", nil); w.Code != http.StatusOK {
+			t.Errorf("%s status = %d, want 200", path, w.Code)
+		}
+	}
+}
+
+func TestProbeUpstream(t *testing.T) {
+	tests := []struct {
+		status  int
+		wantErr bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNotFound, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusBadGateway, true},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(tt.status) }))
+		err := probeUpstream(context.Background(), &http.Client{Timeout: time.Second}, server.URL)
+		server.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("status %d: probe error = %v", tt.status, err)
+		}
+	}
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	if err := probeUpstream(context.Background(), &http.Client{Timeout: time.Second}, server.URL); err == nil {
+		t.Error("probe of a closed server succeeded")
+	}
+}
@@ -0,0 +1,228 @@
+package prxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the key store file is checked for changes
+const keyFileReloadInterval = 10 * time.Second
+
+// KeyRecord is an API key in a key store file. Only the key's salted hash is stored.
+type KeyRecord struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name,omitempty"`
+	Hash        string     `json:"hash"`
+	Fingerprint string     `json:"fingerprint"`
+	Origins     []string   `json:"origins,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+// keyFileContents is the JSON layout of a key store file
+type keyFileContents struct {
+	Keys []KeyRecord `json:"keys"`
+}
+
+// KeyFile is a JSON file of API keys that the server picks up without a restart
+type KeyFile struct {
+	Path string
+}
+
+// List returns every key in the file, including revoked keys. A missing file has no keys.
+func (f KeyFile) List() ([]KeyRecord, error) {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var contents keyFileContents
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("parsing key store %s: %w", f.Path, err)
+	}
+	return contents.Keys, nil
+}
+
+// Create generates a new API key, stores its hash and returns the key with its record.
+// The key itself is not stored and cannot be shown again.
+func (f KeyFile) Create(name string, origins []string) (string, KeyRecord, error) {
+	records, err := f.List()
+	if err != nil {
+		return "", KeyRecord{}, err
+	}
+
+	key, err := GenerateAPIKey()
+	if err != nil {
+		return "", KeyRecord{}, err
+	}
+	hash, err := HashAPIKey(key)
+	if err != nil {
+		return "", KeyRecord{}, err
+	}
+	id, err := randomBytes(6)
+	if err != nil {
+		return "", KeyRecord{}, err
+	}
+
+	record := KeyRecord{
+		ID:          "key_" + hex.EncodeToString(id),
+		Name:        name,
+		Hash:        hash,
+		Fingerprint: FingerprintAPIKey(key),
+		Origins:     origins,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := f.save(append(records, record)); err != nil {
+		return "", KeyRecord{}, err
+	}
+	return key, record, nil
+}
+
+// Revoke marks the key with the given ID as revoked and returns its record
+func (f KeyFile) Revoke(id string) (KeyRecord, error) {
+	records, err := f.List()
+	if err != nil {
+		return KeyRecord{}, err
+	}
+
+	for i := range records {
+		if records[i].ID != id {
+			continue
+		}
+		if records[i].RevokedAt != nil {
+			return records[i], fmt.Errorf("key %s is already revoked", id)
+		}
+		now := time.Now().UTC()
+		records[i].RevokedAt = &now
+		return records[i], f.save(records)
+	}
+	return KeyRecord{}, fmt.Errorf("no key with ID %s", id)
+}
+
+// save replaces the file atomically, so the server never reads a partial write
+func (f KeyFile) save(records []KeyRecord) error {
+	data, err := json.MarshalIndent(keyFileContents{Keys: records}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), ".keys-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// keyStoreFromRecords builds a key store from the keys that are not revoked
+func keyStoreFromRecords(records []KeyRecord) (*keyStore, error) {
+	store := &keyStore{}
+	for _, record := range records {
+		if record.RevokedAt != nil {
+			continue
+		}
+		hash, err := parseAPIKeyHash(record.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", record.ID, err)
+		}
+		hash.id = record.ID
+		for _, origin := range record.Origins {
+			if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+				hash.origins = append(hash.origins, origin)
+			}
+		}
+		store.hashes = append(store.hashes, hash)
+	}
+	return store, nil
+}
+
+// keyFileWatcher serves the keys in a key store file, reloading them when the file changes
+type keyFileWatcher struct {
+	logger
+	file KeyFile
+
+	mu        sync.Mutex
+	store     *keyStore
+	err       error
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// newKeyFileWatcher loads the key store file once so configuration errors stop startup
+func newKeyFileWatcher(path string, log logger) (*keyFileWatcher, error) {
+	w := &keyFileWatcher{logger: log, file: KeyFile{Path: path}}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// load reads the key store file
+func (w *keyFileWatcher) load() error {
+	w.checkedAt = time.Now()
+	var modTime time.Time
+	if info, err := os.Stat(w.file.Path); err == nil {
+		modTime = info.ModTime()
+	}
+
+	records, err := w.file.List()
+	if err != nil {
+		return err
+	}
+	store, err := keyStoreFromRecords(records)
+	if err != nil {
+		return err
+	}
+	w.store = store
+	w.modTime = modTime
+	return nil
+}
+
+// current returns the latest keys, reloading the file if it changed.
+// The previous keys are kept if the file cannot be loaded.
+func (w *keyFileWatcher) current() *keyStore {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if time.Since(w.checkedAt) >= keyFileReloadInterval {
+		w.checkedAt = time.Now()
+		var modTime time.Time
+		if info, err := os.Stat(w.file.Path); err == nil {
+			modTime = info.ModTime()
+		}
+		if !modTime.Equal(w.modTime) {
+			if err := w.load(); err != nil {
+				w.err = err
+				w.logError("Failed to reload key store %s: %v", w.file.Path, err)
+			} else {
+				w.err = nil
+				w.logSystem("Reloaded key store %s (%d keys)", w.file.Path, len(w.store.hashes))
+			}
+		}
+	}
+	return w.store
+}
+
+// lastError returns the error from the most recent failed reload, if any
+func (w *keyFileWatcher) lastError() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
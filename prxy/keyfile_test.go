@@ -0,0 +1,137 @@
+package prxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyFile(t *testing.T) {
+	keyFile := KeyFile{Path: filepath.Join(t.TempDir(), "keys.json")}
+	if records, err := keyFile.List(); err != nil || len(records) != 0 {
+		t.Fatalf("List() of a missing file = %v, %v", records, err)
+	}
+
+	key, record, err := keyFile.Create("billing", []string{"https://app.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(record.ID, "key_") || record.Name != "billing" || record.Fingerprint != FingerprintAPIKey(key) {
+		t.Errorf("record = %+v", record)
+	}
+	other, otherRecord, err := keyFile.Create("reports", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherRecord.ID == record.ID {
+		t.Error("two keys share an ID")
+	}
+
+	data, err := os.ReadFile(keyFile.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), key) {
+		t.Error("the key file contains the plaintext key")
+	}
+
+	if _, err := keyFile.Revoke(record.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyFile.Revoke(record.ID); err == nil || !strings.Contains(err.Error(), "already revoked") {
+		t.Errorf("second Revoke() error = %v", err)
+	}
+	if _, err := keyFile.Revoke("key_missing"); err == nil {
+		t.Error("Revoke() of an unknown ID succeeded")
+	}
+
+	records, err := keyFile.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].RevokedAt == nil || records[1].RevokedAt != nil {
+		t.Fatalf("records = %+v, want the first revoked", records)
+	}
+
+	// Only keys that are not revoked are served, under their record IDs
+	store, err := keyStoreFromRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.lookup(key) != nil {
+		t.Error("the revoked key is still accepted")
+	}
+	if hash := store.lookup(other); hash == nil || hash.id != otherRecord.ID {
+		t.Errorf("lookup(other) = %+v, want ID %s", hash, otherRecord.ID)
+	}
+	if store.byID(otherRecord.ID) == nil || store.byID(record.ID) != nil || store.byID("") != nil {
+		t.Error("byID does not match the served keys")
+	}
+}
+
+func TestKeyFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{"invalid JSON", "{", "parsing key store"},
+		{"invalid hash", `{"keys":[{"id":"key_1","hash":"sha256:zz:zz"}]}`, "key key_1"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "_")+".json")
+		os.WriteFile(path, []byte(tt.contents), 0o600)
+		if _, err := newKeyFileWatcher(path, logger{hook: func(LogEntry) {}}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestKeyFileWatcherReload(t *testing.T) {
+	keyFile := KeyFile{Path: filepath.Join(t.TempDir(), "keys.json")}
+	first, _, err := keyFile.Create("first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []LogEntry
+	watcher, err := newKeyFileWatcher(keyFile.Path, logger{hook: func(entry LogEntry) { entries = append(entries, entry) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload := func() {
+		future := time.Now().Add(time.Minute)
+		os.Chtimes(keyFile.Path, future, future)
+		watcher.mu.Lock()
+		watcher.checkedAt = time.Time{}
+		watcher.mu.Unlock()
+	}
+
+	// Keys added to the file are picked up once it changes
+	second, _, err := keyFile.Create("second", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if watcher.current().lookup(second) != nil {
+		t.Error("the new key was accepted before the reload interval passed")
+	}
+	reload()
+	if watcher.current().lookup(first) == nil || watcher.current().lookup(second) == nil {
+		t.Fatal("reloaded store is missing a key")
+	}
+
+	// A broken file keeps the previous keys and is reported
+	os.WriteFile(keyFile.Path, []byte("{"), 0o600)
+	reload()
+	if watcher.current().lookup(second) == nil {
+		t.Error("the previous keys were dropped after a failed reload")
+	}
+	if watcher.lastError() == nil {
+		t.Error("lastError() = nil after a failed reload")
+	}
+	if last := entries[len(entries)-1]; last.Level != LogError || !strings.Contains(last.Message, "Failed to reload key store") {
+		t.Errorf("last log entry = %+v", last)
+	}
+}
@@ -0,0 +1,265 @@
+package prxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// API key format and hashing parameters
+const (
+	apiKeyPrefix      = "prxy_"
+	apiKeyRandomBytes = 32
+	keyHashScheme     = "sha256"
+	keySaltBytes      = 16
+	keyOriginsOption  = "origins="
+	keyHeadersOption  = "headers="
+	keyProviderOption = "provider="
+	// keyIDLabel derives stable IDs for plaintext keys, whose salts change on every start
+	keyIDLabel = "prxy key id"
+)
+
+// Errors returned by API key validation
+var (
+	errInvalidAPIKey    = errors.New("invalid API key")
+	errOriginNotAllowed = errors.New("API key is not allowed from this origin")
+)
+
+// apiKeyHash is a single allowed API key, stored only as a salted hash
+type apiKeyHash struct {
+	// id identifies the key in the tokens it issues, so they stop working when it is removed
+	id      string
+	salt    []byte
+	digest  []byte
+	origins []string
+	// headers are static headers added to upstream requests made with this key
+	headers http.Header
+	// provider serves Messages requests made with this key, or is empty for the default provider
+	provider string
+}
+
+// keyStore holds the salted hashes of all allowed API keys
+type keyStore struct {
+	hashes []apiKeyHash
+}
+
+// loadKeyStore parses a list of hashed or plaintext API keys.
+// Each entry may bind the key to browser origins with ";origins=https://a.example|https://b.example"
+// add static upstream headers with ";headers=Name:Value|Name:Value", and choose the provider
+// of its Messages requests with ";provider=bedrock".
+// Plaintext entries are hashed in memory and counted so the caller can warn about them.
+func loadKeyStore(entries []string) (*keyStore, int, error) {
+	store := &keyStore{}
+	plaintext := 0
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// Split off per-key options
+		options := strings.Split(entry, ";")
+		key := strings.TrimSpace(options[0])
+
+		var hash apiKeyHash
+		if strings.HasPrefix(key, keyHashScheme+":") {
+			// Entries in "sha256:<salt>:<digest>" form are already hashed
+			parsed, err := parseAPIKeyHash(key)
+			if err != nil {
+				return nil, 0, err
+			}
+			hash = parsed
+		} else {
+			// Legacy plaintext entry, hash it so the plaintext is not kept around
+			salt, err := randomBytes(keySaltBytes)
+			if err != nil {
+				return nil, 0, err
+			}
+			hash = apiKeyHash{salt: salt, digest: digestAPIKey(salt, key), id: plaintextKeyID(key)}
+			plaintext++
+		}
+
+		if err := parseKeyOptions(options[1:], &hash); err != nil {
+			return nil, 0, err
+		}
+		if hash.id == "" {
+			hash.id = "env_" + hex.EncodeToString(hash.digest[:6])
+		}
+		store.hashes = append(store.hashes, hash)
+	}
+
+	return store, plaintext, nil
+}
+
+// parseKeyOptions parses the per-key "origins=a|b", "headers=Name:Value|Name:Value" and
+// "provider=name" options
+func parseKeyOptions(options []string, hash *apiKeyHash) error {
+	for _, option := range options {
+		option = strings.TrimSpace(option)
+		switch {
+		case option == "":
+		case strings.HasPrefix(option, keyOriginsOption):
+			for _, origin := range strings.Split(strings.TrimPrefix(option, keyOriginsOption), "|") {
+				origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+				if origin != "" {
+					hash.origins = append(hash.origins, origin)
+				}
+			}
+			if len(hash.origins) == 0 {
+				return errors.New("empty API key origins option")
+			}
+		case strings.HasPrefix(option, keyHeadersOption):
+			headers, err := parseStaticHeaders(strings.TrimPrefix(option, keyHeadersOption))
+			if err != nil {
+				return fmt.Errorf("API key headers option: %w", err)
+			}
+			hash.headers = headers
+		case strings.HasPrefix(option, keyProviderOption):
+			hash.provider = strings.TrimPrefix(option, keyProviderOption)
+			if err := checkProvider(hash.provider); err != nil {
+				return fmt.Errorf("API key provider option: %w", err)
+			}
+		default:
+			return fmt.Errorf("unknown API key option %q", option)
+		}
+	}
+	return nil
+}
+
+// lookup returns the stored hash matching the key, checking every entry in constant time
+func (s *keyStore) lookup(key string) *apiKeyHash {
+	if s == nil {
+		return nil
+	}
+	match := -1
+	for i, hash := range s.hashes {
+		eq := subtle.ConstantTimeCompare(digestAPIKey(hash.salt, key), hash.digest)
+		match = subtle.ConstantTimeSelect(eq, i, match)
+	}
+	if match < 0 {
+		return nil
+	}
+	return &s.hashes[match]
+}
+
+// byID returns the stored hash with the given key ID
+func (s *keyStore) byID(id string) *apiKeyHash {
+	if s == nil || id == "" {
+		return nil
+	}
+	for i := range s.hashes {
+		if s.hashes[i].id == id {
+			return &s.hashes[i]
+		}
+	}
+	return nil
+}
+
+// allowsOrigin reports whether the key may be used from the given request origin.
+// Keys without an origin binding may be used from anywhere.
+func (h *apiKeyHash) allowsOrigin(origin string) bool {
+	if len(h.origins) == 0 {
+		return true
+	}
+	for _, o := range h.origins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// plaintextKeyID derives the ID of a plaintext key from the key itself, so that its tokens and
+// usage records keep working across restarts
+func plaintextKeyID(key string) string {
+	mac := hmac.New(sha256.New, []byte(keyIDLabel))
+	mac.Write([]byte(key))
+	return "env_" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// digestAPIKey computes the salted SHA-256 digest of an API key
+func digestAPIKey(salt []byte, key string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(key))
+	return h.Sum(nil)
+}
+
+// parseAPIKeyHash parses a hash in "sha256:<salt-hex>:<digest-hex>" form
+func parseAPIKeyHash(s string) (apiKeyHash, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 || parts[0] != keyHashScheme {
+		return apiKeyHash{}, fmt.Errorf("invalid API key hash format")
+	}
+
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil || len(salt) == 0 {
+		return apiKeyHash{}, fmt.Errorf("invalid API key hash salt")
+	}
+
+	digest, err := hex.DecodeString(parts[2])
+	if err != nil || len(digest) != sha256.Size {
+		return apiKeyHash{}, fmt.Errorf("invalid API key hash digest")
+	}
+
+	return apiKeyHash{salt: salt, digest: digest}, nil
+}
+
+// HashAPIKey returns a salted hash of the key in "sha256:<salt-hex>:<digest-hex>" form
+func HashAPIKey(key string) (string, error) {
+	salt, err := randomBytes(keySaltBytes)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s:%s", keyHashScheme, hex.EncodeToString(salt), hex.EncodeToString(digestAPIKey(salt, key))), nil
+}
+
+// GenerateAPIKey creates a new random API key with the recognizable "prxy_" prefix
+func GenerateAPIKey() (string, error) {
+	b, err := randomBytes(apiKeyRandomBytes)
+	if err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(b), nil
+}
+
+// FingerprintAPIKey returns a short, non-secret identifier for a key (e.g. "prxy_…a1b2")
+func FingerprintAPIKey(key string) string {
+	if key == "" {
+		return "none"
+	}
+
+	prefix := ""
+	if strings.HasPrefix(key, apiKeyPrefix) {
+		prefix = apiKeyPrefix
+	}
+
+	// Avoid revealing a meaningful share of short keys
+	if len(key) < 16 {
+		return prefix + "…"
+	}
+	return prefix + "…" + key[len(key)-4:]
+}
+
+// keyOwner returns the owner ID of files uploaded with an API key. Unlike the fingerprint,
+// it is unique to the key, and it stays the same however the key is stored.
+func keyOwner(key string) string {
+	digest := sha256.Sum256([]byte("prxy file owner\x00" + key))
+	return "key:" + hex.EncodeToString(digest[:12])
+}
+
+// randomBytes returns n cryptographically random bytes
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,187 @@
+package prxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashAPIKeyRoundTrip(t *testing.T) {
+	key, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(key) != len(apiKeyPrefix)+2*apiKeyRandomBytes {
+		t.Fatalf("GenerateAPIKey() = %q, want %s and %d hex characters", key, apiKeyPrefix, 2*apiKeyRandomBytes)
+	}
+
+	first, err := HashAPIKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := HashAPIKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Error("hashes of the same key share a salt")
+	}
+
+	store, plaintext, err := loadKeyStore([]string{first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != 0 {
+		t.Errorf("plaintext = %d, want 0", plaintext)
+	}
+	if store.lookup(key) == nil {
+		t.Error("lookup of the hashed key failed")
+	}
+	if store.lookup(key+"x") != nil || store.lookup("") != nil {
+		t.Error("lookup matched a different key")
+	}
+}
+
+func TestLoadKeyStore(t *testing.T) {
+	hashed, err := HashAPIKey("hashed-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		entries   []string
+		plaintext int
+		key       string
+		origins   []string
+		headers   map[string]string
+		provider  string
+		wantErr   string
+	}{
+		{name: "plaintext", entries: []string{"plain-key"}, plaintext: 1, key: "plain-key"},
+		{name: "hashed", entries: []string{hashed}, key: "hashed-key"},
+		{name: "blank entries", entries: []string{"", "  ", " plain-key "}, plaintext: 1, key: "plain-key"},
+		{
+			name:    "origins",
+			entries: []string{"plain-key;origins=https://a.example/| https://b.example"},
+			key:     "plain-key", plaintext: 1,
+			origins: []string{"https://a.example", "https://b.example"},
+		},
+		{
+			name:    "headers",
+			entries: []string{hashed + ";headers=X-Team: web|X-Env:prod"},
+			key:     "hashed-key",
+			headers: map[string]string{"X-Team": "web", "X-Env": "prod"},
+		},
+		{name: "provider", entries: []string{hashed + ";provider=bedrock"}, key: "hashed-key", provider: ProviderBedrock},
+		{name: "unknown provider", entries: []string{"k;provider=openai"}, wantErr: "unknown provider"},
+		{name: "unknown option", entries: []string{"k;colour=blue"}, wantErr: "unknown API key option"},
+		{name: "empty origins", entries: []string{"k;origins=|"}, wantErr: "empty API key origins"},
+		{name: "bad header", entries: []string{"k;headers=NoValue"}, wantErr: "invalid header"},
+		{name: "bad hash format", entries: []string{"sha256:abcd"}, wantErr: "invalid API key hash format"},
+		{name: "bad salt", entries: []string{"sha256:zz:" + strings.Repeat("00", 32)}, wantErr: "invalid API key hash salt"},
+		{name: "short digest", entries: []string{"sha256:00:0000"}, wantErr: "invalid API key hash digest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, plaintext, err := loadKeyStore(tt.entries)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plaintext != tt.plaintext {
+				t.Errorf("plaintext = %d, want %d", plaintext, tt.plaintext)
+			}
+			hash := store.lookup(tt.key)
+			if hash == nil {
+				t.Fatalf("lookup(%q) found no key", tt.key)
+			}
+			if strings.Join(hash.origins, " ") != strings.Join(tt.origins, " ") {
+				t.Errorf("origins = %v, want %v", hash.origins, tt.origins)
+			}
+			for name, value := range tt.headers {
+				if got := hash.headers.Get(name); got != value {
+					t.Errorf("header %s = %q, want %q", name, got, value)
+				}
+			}
+			if hash.provider != tt.provider {
+				t.Errorf("provider = %q, want %q", hash.provider, tt.provider)
+			}
+		})
+	}
+}
+
+func TestKeyStoreLookupPicksMatchingEntry(t *testing.T) {
+	store, _, err := loadKeyStore([]string{"first;origins=https://one.example", "second;origins=https://two.example", "third"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, origin := range map[string]string{"first": "https://one.example", "second": "https://two.example"} {
+		hash := store.lookup(key)
+		if hash == nil || len(hash.origins) != 1 || hash.origins[0] != origin {
+			t.Errorf("lookup(%q) = %+v, want the entry bound to %s", key, hash, origin)
+		}
+	}
+	var nilStore *keyStore
+	if nilStore.lookup("first") != nil {
+		t.Error("lookup on a nil store found a key")
+	}
+}
+
+func TestKeyIDsAreStable(t *testing.T) {
+	hashed, _ := HashAPIKey("hashed-key")
+	entries := []string{"plain-key", "other-key", hashed}
+	first, _, _ := loadKeyStore(entries)
+	second, _, _ := loadKeyStore(entries)
+	// Tokens and usage records refer to keys by ID, so IDs must survive a restart
+	for _, key := range []string{"plain-key", "other-key", "hashed-key"} {
+		if a, b := first.lookup(key).id, second.lookup(key).id; a != b || !strings.HasPrefix(a, "env_") {
+			t.Errorf("IDs of %s = %s and %s, want the same", key, a, b)
+		}
+	}
+	if first.lookup("plain-key").id == first.lookup("other-key").id {
+		t.Error("different keys have the same ID")
+	}
+}
+
+func TestAllowsOrigin(t *testing.T) {
+	tests := []struct {
+		origins []string
+		origin  string
+		want    bool
+	}{
+		{nil, "", true},
+		{nil, "https://any.example", true},
+		{[]string{"https://a.example"}, "https://a.example", true},
+		{[]string{"https://a.example"}, "https://b.example", false},
+		{[]string{"https://a.example"}, "", false},
+	}
+	for _, tt := range tests {
+		hash := apiKeyHash{origins: tt.origins}
+		if got := hash.allowsOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowsOrigin(%q) with %v = %v, want %v", tt.origin, tt.origins, got, tt.want)
+		}
+	}
+}
+
+func TestFingerprintAPIKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"", "none"},
+		{"short", "…"},
+		{"prxy_short", "prxy_…"},
+		{"sk-ant-api03-abcdefgh1234", "…1234"},
+		{"prxy_0123456789abcdef", "prxy_…cdef"},
+	}
+	for _, tt := range tests {
+		if got := FingerprintAPIKey(tt.key); got != tt.want {
+			t.Errorf("FingerprintAPIKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,703 @@
+package prxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Local model defaults
+const (
+	defaultLocalModelURL = "http://localhost:11434/v1"
+	// Largest local server error or response body that is read
+	maxLocalResponseBytes = 32 << 20
+)
+
+// localProvider serves Messages requests for model aliases from a local server with an
+// OpenAI-compatible chat completions API, such as Ollama or the llama.cpp server. Requests and
+// responses, including streams, are translated so clients only see the Claude API format.
+type localProvider struct {
+	logger
+	url    string
+	apiKey string
+	models map[string]string
+}
+
+// newLocalProvider checks the local model configuration and fills in its defaults
+func newLocalProvider(cfg LocalModelsConfig, l logger) (*localProvider, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	url := strings.TrimSuffix(cfg.URL, "/")
+	if url == "" {
+		url = defaultLocalModelURL
+	}
+	return &localProvider{logger: l, url: url, apiKey: cfg.APIKey, models: cfg.Models}, nil
+}
+
+// validate checks that at least one model alias is served locally
+func (cfg LocalModelsConfig) validate() error {
+	if len(cfg.Models) == 0 {
+		return fmt.Errorf("local models need at least one model alias")
+	}
+	return nil
+}
+
+func (l *localProvider) baseURL() string {
+	return l.url
+}
+
+// serves reports whether a model name is an alias for a local model
+func (l *localProvider) serves(model string) bool {
+	_, ok := l.models[model]
+	return ok
+}
+
+// send translates a Messages request into a chat completion request, and the response back
+func (l *localProvider) send(client *http.Client, req *http.Request) (*http.Response, error) {
+	requestID := RequestIDFromContext(req.Context())
+	request, errResp, err := readProviderRequest(req)
+	if request == nil {
+		return errResp, err
+	}
+	chat, err := newChatRequest(request.body, l.models[request.model], request.stream)
+	if err != nil {
+		return errorResponse(req, http.StatusBadRequest, errorTypeInvalidRequest, err.Error()), nil
+	}
+	chatBody, err := json.Marshal(chat)
+	if err != nil {
+		return nil, err
+	}
+
+	chatURL := l.url + "/chat/completions"
+	l.logRequest(requestID, "Forwarding request to local model %s at %s", chat.Model, chatURL)
+	chatReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, chatURL, bytes.NewReader(chatBody))
+	if err != nil {
+		return nil, err
+	}
+	chatReq.Header.Set("Content-Type", "application/json")
+	if l.apiKey != "" {
+		chatReq.Header.Set("Authorization", "Bearer "+l.apiKey)
+	}
+
+	resp, err := client.Do(chatReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxLocalResponseBytes))
+		errorType, status := errorTypeForStatus(resp.StatusCode)
+		message := chatErrorMessage(data)
+		if message == "" {
+			message = http.StatusText(resp.StatusCode)
+		}
+		return errorResponse(req, status, errorType, message), nil
+	}
+
+	resp.Header.Del("Content-Length")
+	if request.stream {
+		resp.Body = newChatStreamSSE(resp.Body, request.model)
+		resp.ContentLength = -1
+		resp.Header.Set("Content-Type", "text/event-stream")
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxLocalResponseBytes))
+	if err != nil {
+		return nil, err
+	}
+	message, err := newLocalMessage(data, request.model)
+	if err != nil {
+		l.write(LogError, requestID, "Invalid response from local model: %v", err)
+		return errorResponse(req, http.StatusBadGateway, errorTypeAPI, "Invalid response from local model"), nil
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(message))
+	resp.ContentLength = int64(len(message))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(message)))
+	resp.Header.Set("Content-Type", "application/json")
+	return resp, nil
+}
+
+// messagesRequest is the part of a Messages request that local models understand. Other fields,
+// such as top_k, metadata and cache_control, are ignored.
+type messagesRequest struct {
+	System        json.RawMessage `json:"system"`
+	Messages      []inputMessage  `json:"messages"`
+	MaxTokens     int             `json:"max_tokens"`
+	Temperature   *float64        `json:"temperature"`
+	TopP          *float64        `json:"top_p"`
+	StopSequences []string        `json:"stop_sequences"`
+	Tools         []struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		InputSchema json.RawMessage `json:"input_schema"`
+	} `json:"tools"`
+	ToolChoice *struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	} `json:"tool_choice"`
+}
+
+// inputMessage is a message of a Messages request, whose content is a string or blocks
+type inputMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// inputBlock is a content block of a Messages request
+type inputBlock struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Source *struct {
+		Type      string `json:"type"`
+		MediaType string `json:"media_type"`
+		Data      string `json:"data"`
+		URL       string `json:"url"`
+	} `json:"source"`
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content"`
+	IsError   bool            `json:"is_error"`
+}
+
+// chatRequest is an OpenAI-compatible chat completion request
+type chatRequest struct {
+	Model         string          `json:"model"`
+	Messages      []chatMessage   `json:"messages"`
+	MaxTokens     int             `json:"max_tokens,omitempty"`
+	Temperature   *float64        `json:"temperature,omitempty"`
+	TopP          *float64        `json:"top_p,omitempty"`
+	Stop          []string        `json:"stop,omitempty"`
+	Stream        bool            `json:"stream,omitempty"`
+	StreamOptions *chatStreamOpts `json:"stream_options,omitempty"`
+	Tools         []chatTool      `json:"tools,omitempty"`
+	ToolChoice    interface{}     `json:"tool_choice,omitempty"`
+}
+
+// chatStreamOpts asks for usage at the end of a stream
+type chatStreamOpts struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// chatMessage is a chat completion message. Content is a string, content parts, or nil for
+// assistant messages that only call tools.
+type chatMessage struct {
+	Role       string         `json:"role"`
+	Content    interface{}    `json:"content"`
+	ToolCalls  []chatToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+}
+
+// chatPart is a text or image content part
+type chatPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+// chatToolCall is a tool call in a message, or part of one in a stream
+type chatToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// chatTool is a function the model may call
+type chatTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+// chatUsage is the token usage of a chat completion
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// newChatRequest translates a Messages request body for a local model
+func newChatRequest(body []byte, model string, stream bool) (*chatRequest, error) {
+	var request messagesRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, fmt.Errorf("invalid request: %v", err)
+	}
+	chat := &chatRequest{
+		Model:       model,
+		MaxTokens:   request.MaxTokens,
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		Stop:        request.StopSequences,
+		Stream:      stream,
+	}
+	if stream {
+		chat.StreamOptions = &chatStreamOpts{IncludeUsage: true}
+	}
+
+	if len(request.System) > 0 {
+		blocks, err := parseContent(request.System)
+		if err != nil {
+			return nil, fmt.Errorf("system: %v", err)
+		}
+		var texts []string
+		for _, block := range blocks {
+			texts = append(texts, block.Text)
+		}
+		chat.Messages = append(chat.Messages, chatMessage{Role: "system", Content: strings.Join(texts, "\n\n")})
+	}
+
+	for i, message := range request.Messages {
+		blocks, err := parseContent(message.Content)
+		if err != nil {
+			return nil, fmt.Errorf("messages.%d.content: %v", i, err)
+		}
+		out := chatMessage{Role: message.Role}
+		var parts []chatPart
+		textOnly := true
+		for j, block := range blocks {
+			switch block.Type {
+			case "text":
+				parts = append(parts, chatPart{Type: "text", Text: block.Text})
+			case "image":
+				part := chatPart{Type: "image_url", ImageURL: &struct {
+					URL string `json:"url"`
+				}{}}
+				if block.Source != nil && block.Source.Type == "base64" {
+					part.ImageURL.URL = "data:" + block.Source.MediaType + ";base64," + block.Source.Data
+				} else if block.Source != nil {
+					part.ImageURL.URL = block.Source.URL
+				}
+				parts = append(parts, part)
+				textOnly = false
+			case "tool_use":
+				call := chatToolCall{ID: block.ID, Type: "function"}
+				call.Function.Name = block.Name
+				call.Function.Arguments = string(block.Input)
+				if len(block.Input) == 0 {
+					call.Function.Arguments = "{}"
+				}
+				out.ToolCalls = append(out.ToolCalls, call)
+			case "tool_result":
+				// Tool results are messages of their own, which come before any text
+				result, err := toolResultText(block)
+				if err != nil {
+					return nil, fmt.Errorf("messages.%d.content.%d: %v", i, j, err)
+				}
+				chat.Messages = append(chat.Messages, chatMessage{Role: "tool", ToolCallID: block.ToolUseID, Content: result})
+			case "thinking", "redacted_thinking":
+			default:
+				return nil, fmt.Errorf("messages.%d.content.%d: %s blocks are not supported by local models", i, j, block.Type)
+			}
+		}
+		if len(parts) == 0 && len(out.ToolCalls) == 0 {
+			continue
+		}
+		if textOnly && len(parts) > 0 {
+			var texts []string
+			for _, part := range parts {
+				texts = append(texts, part.Text)
+			}
+			out.Content = strings.Join(texts, "\n\n")
+		} else if len(parts) > 0 {
+			out.Content = parts
+		}
+		chat.Messages = append(chat.Messages, out)
+	}
+
+	for _, tool := range request.Tools {
+		out := chatTool{Type: "function"}
+		out.Function.Name = tool.Name
+		out.Function.Description = tool.Description
+		out.Function.Parameters = tool.InputSchema
+		chat.Tools = append(chat.Tools, out)
+	}
+	if request.ToolChoice != nil {
+		switch request.ToolChoice.Type {
+		case "auto", "none":
+			chat.ToolChoice = request.ToolChoice.Type
+		case "any":
+			chat.ToolChoice = "required"
+		case "tool":
+			chat.ToolChoice = map[string]interface{}{"type": "function", "function": map[string]string{"name": request.ToolChoice.Name}}
+		}
+	}
+	return chat, nil
+}
+
+// parseContent reads message content, which is a string or an array of blocks
+func parseContent(content json.RawMessage) ([]inputBlock, error) {
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return []inputBlock{{Type: "text", Text: text}}, nil
+	}
+	var blocks []inputBlock
+	if err := json.Unmarshal(content, &blocks); err != nil {
+		return nil, fmt.Errorf("must be a string or an array of content blocks")
+	}
+	return blocks, nil
+}
+
+// toolResultText returns the text of a tool result, marking errors as such
+func toolResultText(block inputBlock) (string, error) {
+	var texts []string
+	if len(block.Content) > 0 {
+		blocks, err := parseContent(block.Content)
+		if err != nil {
+			return "", err
+		}
+		for _, content := range blocks {
+			if content.Type != "text" {
+				return "", fmt.Errorf("%s blocks in tool results are not supported by local models", content.Type)
+			}
+			texts = append(texts, content.Text)
+		}
+	}
+	text := strings.Join(texts, "\n\n")
+	if block.IsError {
+		text = "Error: " + text
+	}
+	return text, nil
+}
+
+// outputBlock is a content block of a Messages response or stream
+type outputBlock struct {
+	Type  string          `json:"type"`
+	Text  *string         `json:"text,omitempty"`
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+// outputMessage is a Messages response
+type outputMessage struct {
+	ID           string        `json:"id"`
+	Type         string        `json:"type"`
+	Role         string        `json:"role"`
+	Model        string        `json:"model"`
+	Content      []outputBlock `json:"content"`
+	StopReason   *string       `json:"stop_reason"`
+	StopSequence *string       `json:"stop_sequence"`
+	Usage        messageUsage  `json:"usage"`
+}
+
+// newLocalMessage translates a chat completion into a Messages response for the model alias
+// the client asked for
+func newLocalMessage(data []byte, model string) ([]byte, error) {
+	var completion struct {
+		ID      string `json:"id"`
+		Choices []struct {
+			Message struct {
+				Content   string         `json:"content"`
+				ToolCalls []chatToolCall `json:"tool_calls"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage chatUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &completion); err != nil {
+		return nil, err
+	}
+	if len(completion.Choices) == 0 {
+		return nil, fmt.Errorf("no choices in chat completion")
+	}
+	choice := completion.Choices[0]
+
+	message := outputMessage{
+		ID:      localMessageID(completion.ID),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   model,
+		Content: []outputBlock{},
+		Usage:   messageUsage{InputTokens: completion.Usage.PromptTokens, OutputTokens: completion.Usage.CompletionTokens},
+	}
+	if text := choice.Message.Content; text != "" {
+		message.Content = append(message.Content, outputBlock{Type: "text", Text: &text})
+	}
+	for i, call := range choice.Message.ToolCalls {
+		input := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(input) {
+			input = json.RawMessage("{}")
+		}
+		message.Content = append(message.Content, outputBlock{Type: "tool_use", ID: localToolUseID(call.ID, i), Name: call.Function.Name, Input: input})
+	}
+	stopReason := localStopReason(choice.FinishReason, len(choice.Message.ToolCalls) > 0)
+	message.StopReason = &stopReason
+	return json.Marshal(message)
+}
+
+// localMessageID makes a message ID from a chat completion ID
+func localMessageID(id string) string {
+	if id == "" {
+		return "msg_local"
+	}
+	return "msg_" + id
+}
+
+// localToolUseID returns a tool call's ID, or makes one for servers that do not send any
+func localToolUseID(id string, index int) string {
+	if id == "" {
+		return fmt.Sprintf("toolu_local_%d", index)
+	}
+	return id
+}
+
+// localStopReason translates a chat completion finish reason
+func localStopReason(finishReason string, calledTools bool) string {
+	switch {
+	case finishReason == "length":
+		return "max_tokens"
+	case finishReason == "tool_calls" || calledTools:
+		return "tool_use"
+	}
+	return "end_turn"
+}
+
+// chatErrorMessage reads the message of an OpenAI-compatible error body, where the error is an
+// object or, for Ollama, a string
+func chatErrorMessage(data []byte) string {
+	var body struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(data, &body) != nil {
+		return ""
+	}
+	var message string
+	if json.Unmarshal(body.Error, &message) == nil {
+		return message
+	}
+	var object struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(body.Error, &object)
+	return object.Message
+}
+
+// chatStreamSSE turns a chat completion stream into the server-sent events of a Messages stream.
+// Input tokens are only known at the end, so they are sent with message_delta.
+type chatStreamSSE struct {
+	src    io.ReadCloser
+	reader *bufio.Reader
+	model  string
+	out    bytes.Buffer
+	err    error
+
+	started bool
+	done    bool
+	// block is the index of the open content block, or -1, and blocks is the number started
+	block     int
+	blockType string
+	blocks    int
+	// tools maps tool call indexes to the calls, in the order of toolOrder. Servers may
+	// interleave the argument deltas of several calls and text, so calls are buffered and sent
+	// as whole blocks at the end.
+	tools        map[int]*localToolCall
+	toolOrder    []int
+	finishReason string
+	usage        chatUsage
+}
+
+// localToolCall is a tool call read from a chat completion stream
+type localToolCall struct {
+	id        string
+	name      string
+	arguments strings.Builder
+}
+
+// newChatStreamSSE wraps a chat completion stream body
+func newChatStreamSSE(src io.ReadCloser, model string) *chatStreamSSE {
+	return &chatStreamSSE{src: src, reader: bufio.NewReader(src), model: model, block: -1, tools: map[int]*localToolCall{}}
+}
+
+func (c *chatStreamSSE) Read(p []byte) (int, error) {
+	for c.out.Len() == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+		line, err := c.reader.ReadBytes('\n')
+		c.convert(bytes.TrimSpace(line))
+		if err == io.EOF {
+			c.finish()
+		} else if err != nil {
+			c.err = err
+		}
+	}
+	return c.out.Read(p)
+}
+
+func (c *chatStreamSSE) Close() error {
+	return c.src.Close()
+}
+
+// convert writes the events for one line of the chat completion stream
+func (c *chatStreamSSE) convert(line []byte) {
+	data, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok || c.done {
+		return
+	}
+	data = bytes.TrimSpace(data)
+	if string(data) == "[DONE]" {
+		c.finish()
+		return
+	}
+
+	var chunk struct {
+		ID      string `json:"id"`
+		Choices []struct {
+			Delta struct {
+				Content   string         `json:"content"`
+				ToolCalls []chatToolCall `json:"tool_calls"`
+			} `json:"delta"`
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage *chatUsage      `json:"usage"`
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		c.writeError("Invalid event from local model")
+		return
+	}
+	if len(chunk.Error) > 0 {
+		c.writeError(chatErrorMessage(data))
+		return
+	}
+	c.start(chunk.ID)
+	if chunk.Usage != nil {
+		c.usage = *chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return
+	}
+	choice := chunk.Choices[0]
+	if text := choice.Delta.Content; text != "" {
+		if c.blockType != "text" {
+			empty := ""
+			c.startBlock(outputBlock{Type: "text", Text: &empty})
+		}
+		c.writeEvent("content_block_delta", map[string]interface{}{"index": c.block, "delta": map[string]string{"type": "text_delta", "text": text}})
+	}
+	for _, call := range choice.Delta.ToolCalls {
+		index := 0
+		if call.Index != nil {
+			index = *call.Index
+		}
+		tool, ok := c.tools[index]
+		if !ok {
+			tool = &localToolCall{}
+			c.tools[index] = tool
+			c.toolOrder = append(c.toolOrder, index)
+		}
+		if tool.id == "" {
+			tool.id = call.ID
+		}
+		if tool.name == "" {
+			tool.name = call.Function.Name
+		}
+		tool.arguments.WriteString(call.Function.Arguments)
+	}
+	if choice.FinishReason != nil && *choice.FinishReason != "" {
+		c.finishReason = *choice.FinishReason
+	}
+}
+
+// start writes message_start before the first event
+func (c *chatStreamSSE) start(id string) {
+	if c.started {
+		return
+	}
+	c.started = true
+	c.writeEvent("message_start", map[string]interface{}{"message": outputMessage{
+		ID:      localMessageID(id),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   c.model,
+		Content: []outputBlock{},
+	}})
+}
+
+// startBlock closes the open content block and starts another
+func (c *chatStreamSSE) startBlock(block outputBlock) {
+	c.stopBlock()
+	c.block = c.blocks
+	c.blockType = block.Type
+	c.blocks++
+	c.writeEvent("content_block_start", map[string]interface{}{"index": c.block, "content_block": block})
+}
+
+// stopBlock closes the open content block, if any
+func (c *chatStreamSSE) stopBlock() {
+	if c.block < 0 {
+		return
+	}
+	c.writeEvent("content_block_stop", map[string]interface{}{"index": c.block})
+	c.block = -1
+	c.blockType = ""
+}
+
+// finish ends the message with its stop reason and usage
+func (c *chatStreamSSE) finish() {
+	if c.done {
+		return
+	}
+	c.start("")
+	c.stopBlock()
+	c.writeToolCalls()
+	c.writeEvent("message_delta", map[string]interface{}{
+		"delta": map[string]interface{}{"stop_reason": localStopReason(c.finishReason, len(c.tools) > 0), "stop_sequence": nil},
+		"usage": messageUsage{InputTokens: c.usage.PromptTokens, OutputTokens: c.usage.CompletionTokens},
+	})
+	c.writeEvent("message_stop", map[string]interface{}{})
+	c.done = true
+}
+
+// writeToolCalls writes a tool_use block for each buffered tool call. Arguments that are not
+// valid JSON leave the input empty, as in responses that are not streamed.
+func (c *chatStreamSSE) writeToolCalls() {
+	for _, index := range c.toolOrder {
+		tool := c.tools[index]
+		c.startBlock(outputBlock{Type: "tool_use", ID: localToolUseID(tool.id, index), Name: tool.name, Input: json.RawMessage("{}")})
+		if arguments := tool.arguments.String(); arguments != "" && json.Valid([]byte(arguments)) {
+			c.writeEvent("content_block_delta", map[string]interface{}{"index": c.block, "delta": map[string]string{"type": "input_json_delta", "partial_json": arguments}})
+		}
+		c.stopBlock()
+	}
+}
+
+// writeEvent writes an event whose data is its type followed by the given fields
+func (c *chatStreamSSE) writeEvent(eventType string, fields map[string]interface{}) {
+	data, _ := json.Marshal(fields)
+	if len(fields) > 0 {
+		data[0] = ','
+	} else {
+		data = []byte("}")
+	}
+	fmt.Fprintf(&c.out, "event: %s\ndata: {\"type\":%q%s\n\n", eventType, eventType, data)
+}
+
+// writeError writes an error event, which ends the stream
+func (c *chatStreamSSE) writeError(message string) {
+	if message == "" {
+		message = "Local model stream failed"
+	}
+	data, _ := json.Marshal(apiErrorResponse{Type: "error", Error: apiError{Type: errorTypeAPI, Message: message}})
+	fmt.Fprintf(&c.out, "event: error\ndata: %s\n\n", data)
+	c.done = true
+}
@@ -0,0 +1,350 @@
+package prxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// chatStream encodes chat completion chunks as a stream that ends with [DONE]
+func chatStream(chunks ...string) string {
+	var b strings.Builder
+	for _, chunk := range chunks {
+		b.WriteString("data: " + chunk + "\n\n")
+	}
+	b.WriteString("data: [DONE]\n\n")
+	return b.String()
+}
+
+func TestNewChatRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		stream bool
+		want   string
+	}{
+		{
+			name: "text",
+			body: `{"model":"claude-local","max_tokens":100,"temperature":0.5,"top_p":0.9,"top_k":5,"stop_sequences":["END"],` +
+				`"system":"Be brief.","messages":[{"role":"user","content":"Hi"}]}`,
+			want: `{"model":"llama","messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hi"}],` +
+				`"max_tokens":100,"temperature":0.5,"top_p":0.9,"stop":["END"]}`,
+		},
+		{
+			name:   "stream with system blocks",
+			body:   `{"system":[{"type":"text","text":"One."},{"type":"text","text":"Two.","cache_control":{"type":"ephemeral"}}],"messages":[]}`,
+			stream: true,
+			want:   `{"model":"llama","messages":[{"role":"system","content":"One.\n\nTwo."}],"stream":true,"stream_options":{"include_usage":true}}`,
+		},
+		{
+			name: "images",
+			body: `{"messages":[{"role":"user","content":[{"type":"text","text":"What is this?"},` +
+				`{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBO"}},` +
+				`{"type":"image","source":{"type":"url","url":"https://example.com/a.png"}}]}]}`,
+			want: `{"model":"llama","messages":[{"role":"user","content":[{"type":"text","text":"What is this?"},` +
+				`{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBO"}},` +
+				`{"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]}]}`,
+		},
+		{
+			// Tool results become tool messages before the rest of the message, and thinking is dropped
+			name: "tools",
+			body: `{"messages":[` +
+				`{"role":"user","content":"Weather?"},` +
+				`{"role":"assistant","content":[{"type":"thinking","thinking":"Hmm","signature":"s"},{"type":"text","text":"Checking."},` +
+				`{"type":"tool_use","id":"t1","name":"weather","input":{"city":"Paris"}},{"type":"tool_use","id":"t2","name":"now"}]},` +
+				`{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":"Sunny"},` +
+				`{"type":"tool_result","tool_use_id":"t2","is_error":true,"content":[{"type":"text","text":"No clock"}]},{"type":"text","text":"Thanks"}]}],` +
+				`"tools":[{"name":"weather","description":"Gets the weather","input_schema":{"type":"object"}}],"tool_choice":{"type":"tool","name":"weather"}}`,
+			want: `{"model":"llama","messages":[{"role":"user","content":"Weather?"},` +
+				`{"role":"assistant","content":"Checking.","tool_calls":[` +
+				`{"id":"t1","type":"function","function":{"name":"weather","arguments":"{\"city\":\"Paris\"}"}},` +
+				`{"id":"t2","type":"function","function":{"name":"now","arguments":"{}"}}]},` +
+				`{"role":"tool","content":"Sunny","tool_call_id":"t1"},{"role":"tool","content":"Error: No clock","tool_call_id":"t2"},` +
+				`{"role":"user","content":"Thanks"}],` +
+				`"tools":[{"type":"function","function":{"name":"weather","description":"Gets the weather","parameters":{"type":"object"}}}],` +
+				`"tool_choice":{"function":{"name":"weather"},"type":"function"}}`,
+		},
+		{
+			name: "assistant message with only tool calls",
+			body: `{"messages":[{"role":"assistant","content":[{"type":"tool_use","id":"t1","name":"now","input":{}}]}],"tool_choice":{"type":"any"}}`,
+			want: `{"model":"llama","messages":[{"role":"assistant","content":null,"tool_calls":[{"id":"t1","type":"function","function":{"name":"now","arguments":"{}"}}]}],` +
+				`"tool_choice":"required"}`,
+		},
+		{
+			name: "tool choice none",
+			body: `{"messages":[],"tool_choice":{"type":"none"}}`,
+			want: `{"model":"llama","messages":null,"tool_choice":"none"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat, err := newChatRequest([]byte(tt.body), "llama", tt.stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(chat)
+			if string(got) != tt.want {
+				t.Errorf("request =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewChatRequestErrors(t *testing.T) {
+	tests := []struct {
+		body    string
+		wantErr string
+	}{
+		{`{"messages":{}}`, "invalid request"},
+		{`{"system":1,"messages":[]}`, "system: must be a string or an array of content blocks"},
+		{`{"messages":[{"role":"user","content":5}]}`, "messages.0.content: must be a string"},
+		{`{"messages":[{"role":"user","content":[{"type":"text","text":"a"},{"type":"document","source":{}}]}]}`, "messages.0.content.1: document blocks are not supported"},
+		{`{"messages":[{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":[{"type":"image"}]}]}]}`, "messages.0.content.0: image blocks in tool results are not supported"},
+	}
+	for _, tt := range tests {
+		if _, err := newChatRequest([]byte(tt.body), "llama", false); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("newChatRequest(%s) error = %v, want %q", tt.body, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNewLocalMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		completion string
+		want       string
+	}{
+		{
+			name:       "text",
+			completion: `{"id":"chatcmpl-1","choices":[{"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":2}}`,
+			want: `{"id":"msg_chatcmpl-1","type":"message","role":"assistant","model":"claude-local","content":[{"type":"text","text":"Hello"}],` +
+				`"stop_reason":"end_turn","stop_sequence":null,"usage":{"input_tokens":5,"output_tokens":2,"cache_creation_input_tokens":0,"cache_read_input_tokens":0}}`,
+		},
+		{
+			name: "tool calls",
+			completion: `{"choices":[{"message":{"content":"Checking.","tool_calls":[` +
+				`{"id":"call_1","type":"function","function":{"name":"weather","arguments":"{\"city\":\"Paris\"}"}},` +
+				`{"type":"function","function":{"name":"now","arguments":"not json"}}]},"finish_reason":"stop"}]}`,
+			want: `{"id":"msg_local","type":"message","role":"assistant","model":"claude-local","content":[{"type":"text","text":"Checking."},` +
+				`{"type":"tool_use","id":"call_1","name":"weather","input":{"city":"Paris"}},{"type":"tool_use","id":"toolu_local_1","name":"now","input":{}}],` +
+				`"stop_reason":"tool_use","stop_sequence":null,"usage":{"input_tokens":0,"output_tokens":0,"cache_creation_input_tokens":0,"cache_read_input_tokens":0}}`,
+		},
+		{
+			name:       "length",
+			completion: `{"id":"x","choices":[{"message":{"content":""},"finish_reason":"length"}]}`,
+			want: `{"id":"msg_x","type":"message","role":"assistant","model":"claude-local","content":[],` +
+				`"stop_reason":"max_tokens","stop_sequence":null,"usage":{"input_tokens":0,"output_tokens":0,"cache_creation_input_tokens":0,"cache_read_input_tokens":0}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newLocalMessage([]byte(tt.completion), "claude-local")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("message =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	for _, completion := range []string{`{"choices":[]}`, `<html>`} {
+		if _, err := newLocalMessage([]byte(completion), "claude-local"); err == nil {
+			t.Errorf("newLocalMessage(%s) succeeded", completion)
+		}
+	}
+}
+
+func TestChatErrorMessage(t *testing.T) {
+	tests := map[string]string{
+		`{"error":{"message":"model not found","type":"invalid_request_error"}}`: "model not found",
+		`{"error":"model \"llama\" not found, try pulling it first"}`:            `model "llama" not found, try pulling it first`,
+		`{"detail":"x"}`: "",
+		`<html>`:         "",
+	}
+	for data, want := range tests {
+		if got := chatErrorMessage([]byte(data)); got != want {
+			t.Errorf("chatErrorMessage(%s) = %q, want %q", data, got, want)
+		}
+	}
+}
+
+func TestChatStreamSSE(t *testing.T) {
+	stream := chatStream(
+		`{"id":"chatcmpl-1","choices":[{"delta":{"role":"assistant","content":""}}]}`,
+		`{"id":"chatcmpl-1","choices":[{"delta":{"content":"Hel"}}]}`,
+		`{"id":"chatcmpl-1","choices":[{"delta":{"content":"lo"},"finish_reason":"stop"}]}`,
+		`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":5,"completion_tokens":2}}`,
+	)
+	got, err := io.ReadAll(newChatStreamSSE(io.NopCloser(strings.NewReader(stream)), "claude-local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sseEvents(
+		`{"type":"message_start","message":{"id":"msg_chatcmpl-1","type":"message","role":"assistant","model":"claude-local","content":[],"stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":0,"output_tokens":0,"cache_creation_input_tokens":0,"cache_read_input_tokens":0}}}`,
+		`{"type":"content_block_start","content_block":{"type":"text","text":""},"index":0}`,
+		`{"type":"content_block_delta","delta":{"text":"Hel","type":"text_delta"},"index":0}`,
+		`{"type":"content_block_delta","delta":{"text":"lo","type":"text_delta"},"index":0}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"input_tokens":5,"output_tokens":2,"cache_creation_input_tokens":0,"cache_read_input_tokens":0}}`,
+		`{"type":"message_stop"}`,
+	)
+	if want = strings.ReplaceAll(want, "\r\n", "\n"); string(got) != want {
+		t.Errorf("events =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestChatStreamSSEToolCalls(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   string
+	}{
+		{
+			name: "one call",
+			stream: chatStream(
+				`{"id":"c","choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"weather","arguments":""}}]}}]}`,
+				`{"id":"c","choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+				`{"id":"c","choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]},"finish_reason":"tool_calls"}]}`,
+			),
+			want: `[{"id":"call_1","input":{"city":"Paris"},"name":"weather","type":"tool_use"}]`,
+		},
+		{
+			// Argument deltas for calls whose block another call or text would have closed
+			name: "interleaved calls and text",
+			stream: chatStream(
+				`{"id":"c","choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"weather","arguments":"{\"city\":"}}]}}]}`,
+				`{"id":"c","choices":[{"delta":{"tool_calls":[{"index":1,"id":"call_2","function":{"name":"now","arguments":"{"}}]}}]}`,
+				`{"id":"c","choices":[{"delta":{"content":"Checking."}}]}`,
+				`{"id":"c","choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}},{"index":1,"function":{"arguments":"}"}}]}}]}`,
+			),
+			want: `[{"text":"Checking.","type":"text"},{"id":"call_1","input":{"city":"Paris"},"name":"weather","type":"tool_use"},` +
+				`{"id":"call_2","input":{},"name":"now","type":"tool_use"}]`,
+		},
+		{
+			// Servers that send whole calls without IDs or indexes, and arguments that are not JSON
+			name: "whole calls",
+			stream: chatStream(
+				`{"choices":[{"delta":{"tool_calls":[{"function":{"name":"now","arguments":"{\"tz\":\"UTC\"}"}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":1,"function":{"name":"broken","arguments":"{\"a\":"}}]}}]}`,
+			),
+			want: `[{"id":"toolu_local_0","input":{"tz":"UTC"},"name":"now","type":"tool_use"},{"id":"toolu_local_1","input":{},"name":"broken","type":"tool_use"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The events must make a consistent Messages stream
+			body, status, err := aggregateStream(newChatStreamSSE(io.NopCloser(strings.NewReader(tt.stream)), "claude-local"))
+			if err != nil || status != http.StatusOK {
+				t.Fatalf("aggregateStream() = %d, %v: %s", status, err, body)
+			}
+			var message struct {
+				Content    json.RawMessage `json:"content"`
+				StopReason string          `json:"stop_reason"`
+			}
+			json.Unmarshal(body, &message)
+			if string(message.Content) != tt.want || message.StopReason != "tool_use" {
+				t.Errorf("content = %s, stop reason %s, want\n%s", message.Content, message.StopReason, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatStreamSSEErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   string
+	}{
+		{
+			name:   "error chunk",
+			stream: chatStream(`{"choices":[{"delta":{"content":"Hi"}}]}`, `{"error":{"message":"out of memory"}}`),
+			want:   `{"type":"error","error":{"type":"api_error","message":"out of memory"}}`,
+		},
+		{
+			name:   "invalid chunk",
+			stream: chatStream(`{"choices":[{"delta":{"content":"Hi"}}]}`, `{not json`),
+			want:   `{"type":"error","error":{"type":"api_error","message":"Invalid event from local model"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(newChatStreamSSE(io.NopCloser(strings.NewReader(tt.stream)), "claude-local"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "event: error\ndata: " + tt.want + "\n\n"; !strings.HasSuffix(string(got), want) {
+				t.Errorf("events =\n%s\nwant them to end with\n%s", got, want)
+			}
+		})
+	}
+
+	// A stream that ends without [DONE] is still finished
+	got, _ := io.ReadAll(newChatStreamSSE(io.NopCloser(strings.NewReader(`data: {"choices":[{"delta":{"content":"Hi"}}]}`)), "claude-local"))
+	if !strings.HasSuffix(string(got), "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n") {
+		t.Errorf("events =\n%s\nwant them to end with message_stop", got)
+	}
+}
+
+func TestLocalModels(t *testing.T) {
+	var gotPath, gotAuth string
+	var gotBody map[string]interface{}
+	p := newTestProxy(t, Config{
+		AllowedAPIKeys: []string{"client-key"},
+		UpstreamAPIKey: "upstream-key",
+		Local:          &LocalModelsConfig{APIKey: "local-key", Models: map[string]string{"claude-local": "llama3.2", "claude-missing": "missing"}},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/messages" {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"type":"message","model":"claude-x","usage":{"input_tokens":1,"output_tokens":1}}`)
+			return
+		}
+		gotPath, gotAuth = r.URL.Path, r.Header.Get("Authorization")
+		gotBody = nil
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		switch gotBody["model"] {
+		case "llama3.2":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"id":"c1","choices":[{"message":{"content":"Hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error":"model not found"}`)
+		}
+	})
+	// The local server stands in on the same test server, under /local
+	p.local.url = p.upstreamURL + "/local"
+	header := map[string]string{"x-api-key": "client-key"}
+
+	w := serve(p, "POST", "/v1/messages", `{"model":"claude-local","max_tokens":10,"messages":[{"role":"user","content":"Hi"}]}`, header)
+	if w.Code != http.StatusOK || gotPath != "/local/chat/completions" || gotAuth != "Bearer local-key" {
+		t.Fatalf("status = %d from %s with %q: %s", w.Code, gotPath, gotAuth, w.Body)
+	}
+	var message struct {
+		Model   string `json:"model"`
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &message)
+	if message.Model != "claude-local" || len(message.Content) != 1 || message.Content[0].Text != "Hi" {
+		t.Errorf("message = %s", w.Body)
+	}
+
+	// Other models go to the Claude API
+	gotPath = ""
+	if w := serve(p, "POST", "/v1/messages", `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":"Hi"}]}`, header); w.Code != http.StatusOK || gotPath != "" {
+		t.Errorf("status = %d, local server got %q", w.Code, gotPath)
+	}
+
+	w = serve(p, "POST", "/v1/messages", `{"model":"claude-missing","max_tokens":10,"messages":[{"role":"user","content":"Hi"}]}`, header)
+	if resp := decodeAPIError(t, w.Body.String()); w.Code != http.StatusNotFound || resp.Error.Type != errorTypeNotFound || resp.Error.Message != "model not found" {
+		t.Errorf("status = %d: %s", w.Code, w.Body)
+	}
+
+	w = serve(p, "POST", "/v1/messages", `{"model":"claude-local","max_tokens":10,"messages":[{"role":"user","content":[{"type":"document","source":{}}]}]}`, header)
+	if resp := decodeAPIError(t, w.Body.String()); w.Code != http.StatusBadRequest || resp.Error.Type != errorTypeInvalidRequest {
+		t.Errorf("status = %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,96 @@
+package prxy
+
+import (
+	"fmt"
+	"log"
+)
+
+// LogLevel is the kind of a log message
+type LogLevel string
+
+// Log levels, from most to least severe
+const (
+	LogError   LogLevel = "error"
+	LogWarning LogLevel = "warn"
+	LogInfo    LogLevel = "info"
+	LogRequest LogLevel = "request"
+	LogSystem  LogLevel = "system"
+)
+
+// LogEntry is a single log message passed to the Log hook
+type LogEntry struct {
+	Level LogLevel
+	// RequestID is set for messages about a single request
+	RequestID string
+	Message   string
+}
+
+// Color codes for terminal output
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorBlue   = "\033[34m"
+	colorPurple = "\033[35m"
+	colorCyan   = "\033[36m"
+)
+
+// Log type prefixes with colors
+var logPrefixes = map[LogLevel]string{
+	LogError:   colorRed + "[ERROR]" + colorReset + " ",
+	LogWarning: colorYellow + "[WARN]" + colorReset + " ",
+	LogInfo:    colorGreen + "[INFO]" + colorReset + " ",
+	LogRequest: colorBlue + "[REQ]" + colorReset + " ",
+	LogSystem:  colorPurple + "[SYS]" + colorReset + " ",
+}
+
+// WriteLog writes a log entry to the standard logger in PRXY's colored format.
+// It is the default when no Log hook is configured.
+func WriteLog(entry LogEntry) {
+	if entry.RequestID != "" {
+		log.Printf("%s%s[%s]%s %s", logPrefixes[entry.Level], colorCyan, entry.RequestID, colorReset, entry.Message)
+		return
+	}
+	log.Printf("%s%s", logPrefixes[entry.Level], entry.Message)
+}
+
+// logger sends log messages to a Log hook, or to WriteLog if there is none
+type logger struct {
+	hook func(LogEntry)
+}
+
+// write formats and sends a single log message
+func (l logger) write(level LogLevel, requestID, format string, v ...interface{}) {
+	entry := LogEntry{Level: level, RequestID: requestID, Message: fmt.Sprintf(format, v...)}
+	if l.hook != nil {
+		l.hook(entry)
+		return
+	}
+	WriteLog(entry)
+}
+
+// logError logs error messages
+func (l logger) logError(format string, v ...interface{}) {
+	l.write(LogError, "", format, v...)
+}
+
+// logWarning logs warning messages
+func (l logger) logWarning(format string, v ...interface{}) {
+	l.write(LogWarning, "", format, v...)
+}
+
+// logInfo logs informational messages
+func (l logger) logInfo(format string, v ...interface{}) {
+	l.write(LogInfo, "", format, v...)
+}
+
+// logRequest logs request-related messages
+func (l logger) logRequest(requestID, format string, v ...interface{}) {
+	l.write(LogRequest, requestID, format, v...)
+}
+
+// logSystem logs system events
+func (l logger) logSystem(format string, v ...interface{}) {
+	l.write(LogSystem, "", format, v...)
+}
@@ -0,0 +1,145 @@
+package prxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Upstream providers of the Messages API
+const (
+	// ProviderAnthropic sends Messages requests to the Claude API
+	ProviderAnthropic = "anthropic"
+	// ProviderBedrock sends Messages requests to Amazon Bedrock
+	ProviderBedrock = "bedrock"
+	// ProviderVertex sends Messages requests to Google Vertex AI
+	ProviderVertex = "vertex"
+	// ProviderLocal serves requests for local model aliases from an OpenAI-compatible server.
+	// It is chosen by model, not by key.
+	ProviderLocal = "local"
+)
+
+// provider sends Messages requests to a service that serves Claude. Requests are prepared for
+// the Claude API, and responses are returned in its format, so the rest of the proxy does not
+// depend on where a request went.
+type provider interface {
+	// send sends a Messages request and returns the response in the Claude API format
+	send(client *http.Client, req *http.Request) (*http.Response, error)
+	// baseURL is the URL the readiness probe checks
+	baseURL() string
+}
+
+// anthropicProvider sends requests to the Claude API as they are
+type anthropicProvider struct {
+	url string
+}
+
+func (a anthropicProvider) send(client *http.Client, req *http.Request) (*http.Response, error) {
+	return client.Do(req)
+}
+
+func (a anthropicProvider) baseURL() string {
+	return a.url
+}
+
+// checkProvider checks a provider name, where empty means the default provider
+func checkProvider(name string) error {
+	switch name {
+	case "", ProviderAnthropic, ProviderBedrock, ProviderVertex:
+		return nil
+	}
+	return fmt.Errorf("unknown provider %q, must be %s, %s or %s", name, ProviderAnthropic, ProviderBedrock, ProviderVertex)
+}
+
+// providerName returns the name of the provider that serves a caller's Messages requests
+func (p *Proxy) providerName(caller *principal) string {
+	if caller != nil && caller.provider != "" {
+		return caller.provider
+	}
+	return p.defaultProvider
+}
+
+// providerFor returns the provider that serves a caller's Messages request for a model, and its
+// name. Local model aliases are served locally for every caller. Providers that are not
+// configured were rejected by New, except for callers from the Authenticate hook.
+func (p *Proxy) providerFor(caller *principal, model string) (provider, string, error) {
+	if p.local != nil && p.local.serves(model) {
+		return p.local, ProviderLocal, nil
+	}
+	name := p.providerName(caller)
+	if upstream, ok := p.providers[name]; ok {
+		return upstream, name, nil
+	}
+	return nil, name, &Error{http.StatusInternalServerError, errorTypeAPI, fmt.Sprintf("Provider %s is not configured", name)}
+}
+
+// requireAnthropic rejects callers whose requests go to another provider on endpoints that only
+// the Claude API serves, such as the Files API and routes
+func (p *Proxy) requireAnthropic(w http.ResponseWriter, r *http.Request, caller *principal) bool {
+	name := p.providerName(caller)
+	if name == ProviderAnthropic {
+		return true
+	}
+	requestID := r.Context().Value(requestIDKey).(string)
+	p.logRequest(requestID, "Not found: %s is served by %s", r.URL.Path, name)
+	writeAPIError(w, http.StatusNotFound, errorTypeNotFound, fmt.Sprintf("%s is not available with %s", r.URL.Path, name))
+	return false
+}
+
+// providerRequest is a Messages request body split into its top-level fields, for providers
+// that move some of them elsewhere
+type providerRequest struct {
+	body   []byte
+	fields map[string]json.RawMessage
+	model  string
+	stream bool
+}
+
+// readProviderRequest reads a Messages request body. Bodies a provider cannot use, which
+// passthrough requests are not validated for, get an error response.
+func readProviderRequest(req *http.Request) (*providerRequest, *http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	request := &providerRequest{body: body}
+	if err := json.Unmarshal(body, &request.fields); err != nil {
+		return nil, errorResponse(req, http.StatusBadRequest, errorTypeInvalidRequest, "Invalid JSON request body"), nil
+	}
+	json.Unmarshal(request.fields["model"], &request.model)
+	json.Unmarshal(request.fields["stream"], &request.stream)
+	if request.model == "" {
+		return nil, errorResponse(req, http.StatusBadRequest, errorTypeInvalidRequest, "model: Field required"), nil
+	}
+	return request, nil, nil
+}
+
+// setDefault sets a field that the client did not send
+func (r *providerRequest) setDefault(name string, value interface{}) {
+	if _, ok := r.fields[name]; !ok {
+		r.fields[name], _ = json.Marshal(value)
+	}
+}
+
+// errorResponse makes a response with an error in the Claude API format, for providers to return
+func errorResponse(req *http.Request, status int, errorType, message string) *http.Response {
+	body, _ := json.Marshal(apiErrorResponse{Type: "error", Error: apiError{Type: errorType, Message: message}})
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,885 @@
+// Package prxy is a Claude API proxy that can run as the prxy server or be mounted in another Go HTTP server.
+package prxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/cors"
+)
+
+// Maximum length of a client-supplied request ID
+const maxRequestIDLength = 128
+
+// Custom type for context keys to avoid collisions
+type contextKey string
+
+// Keys for request-scoped values in context
+const (
+	requestIDKey contextKey = "requestID"
+	metricsKey   contextKey = "metrics"
+)
+
+// Proxy is an http.Handler that serves the PRXY endpoints
+type Proxy struct {
+	logger
+	hooks            Hooks
+	upstreamURL      string
+	upstreamAPIKey   string
+	providers        map[string]provider
+	defaultProvider  string
+	local            *localProvider
+	keys             *keyStore
+	keyFile          *keyFileWatcher
+	usage            *usageLog
+	files            *fileOwners
+	tokenKey         []byte
+	maxBodyBytes     int64
+	passthroughBytes int64
+	maxFileBytes     int64
+	aggregateStreams bool
+	streamKeepAlive  time.Duration
+	requestHeaders   headerPolicy
+	responseHeaders  headerPolicy
+	upstreamHeaders  http.Header
+	clientIdentities map[string]string
+	version          string
+	client           *http.Client
+	tracer           *spanExporter
+	readiness        *readinessState
+	handler          http.Handler
+
+	// stop ends the background work started by Start
+	stop context.CancelFunc
+}
+
+// New creates a Proxy from the configuration. Call Start to begin the upstream
+// readiness probe and span export, and Close when done.
+func New(cfg Config) (*Proxy, error) {
+	if cfg.Version == "" {
+		cfg.Version = "dev"
+	}
+	warnings, err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	routes, err := cfg.normalizedRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		logger:           logger{hook: cfg.Hooks.Log},
+		hooks:            cfg.Hooks,
+		upstreamURL:      strings.TrimSuffix(cfg.UpstreamURL, "/"),
+		upstreamAPIKey:   cfg.UpstreamAPIKey,
+		defaultProvider:  cfg.UpstreamProvider,
+		maxBodyBytes:     cfg.MaxRequestBodyBytes,
+		passthroughBytes: cfg.PassthroughBodyBytes,
+		maxFileBytes:     cfg.MaxFileBytes,
+		aggregateStreams: cfg.AggregateStreams,
+		streamKeepAlive:  cfg.StreamKeepAlive,
+		clientIdentities: cfg.ClientIdentities,
+		version:          cfg.Version,
+		client:           cfg.HTTPClient,
+		readiness:        &readinessState{},
+	}
+	if p.upstreamURL == "" {
+		p.upstreamURL = defaultClaudeURL
+	}
+	if p.maxBodyBytes <= 0 {
+		p.maxBodyBytes = defaultMaxRequestBodyBytes
+	}
+	// Streaming bodies upstream is opt-in, because they are not validated
+	if p.passthroughBytes <= 0 || p.passthroughBytes > p.maxBodyBytes {
+		p.passthroughBytes = p.maxBodyBytes
+	}
+	if p.maxFileBytes <= 0 {
+		p.maxFileBytes = defaultMaxFileBytes
+	}
+	if p.client == nil {
+		p.client = &http.Client{Timeout: timeout}
+	}
+	if p.streamKeepAlive <= 0 {
+		p.streamKeepAlive = defaultStreamKeepAlive
+	}
+	p.logInfo("Using Claude API URL: %s", p.upstreamURL)
+
+	// Providers that serve Messages requests, chosen per key or for everyone
+	p.providers = map[string]provider{ProviderAnthropic: anthropicProvider{url: p.upstreamURL}}
+	if cfg.Bedrock != nil {
+		bedrock, err := newBedrockProvider(*cfg.Bedrock, p.logger)
+		if err != nil {
+			return nil, err
+		}
+		p.providers[ProviderBedrock] = bedrock
+		p.logInfo("Using Bedrock in %s at %s", cfg.Bedrock.Region, bedrock.endpoint)
+	}
+	if cfg.Vertex != nil {
+		vertex, err := newVertexProvider(*cfg.Vertex, p.logger)
+		if err != nil {
+			return nil, err
+		}
+		p.providers[ProviderVertex] = vertex
+		p.logInfo("Using Vertex AI project %s in %s at %s as %s", cfg.Vertex.ProjectID, cfg.Vertex.Region, vertex.endpoint, vertex.tokens.email)
+	}
+	if cfg.Local != nil {
+		local, err := newLocalProvider(*cfg.Local, p.logger)
+		if err != nil {
+			return nil, err
+		}
+		p.local = local
+		p.logInfo("Serving %d model aliases from local models at %s", len(local.models), local.url)
+	}
+	if p.defaultProvider == "" {
+		p.defaultProvider = ProviderAnthropic
+	}
+	if p.defaultProvider != ProviderAnthropic {
+		p.logInfo("Messages requests are sent to %s unless a key chooses another provider", p.defaultProvider)
+	}
+	if p.aggregateStreams {
+		p.logInfo("Non-streaming requests are streamed from Claude API, with keep-alives every %v", p.streamKeepAlive)
+	}
+
+	// Check for allowed API keys configuration
+	if cfg.AllowedAPIKeys != nil {
+		store, _, err := loadKeyStore(cfg.AllowedAPIKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed API keys: %w", err)
+		}
+		p.keys = store
+		p.logInfo("API key validation is enabled (%d keys)", len(store.hashes))
+	}
+	if cfg.KeyStoreFile != "" {
+		keyFile, err := newKeyFileWatcher(cfg.KeyStoreFile, p.logger)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key store: %w", err)
+		}
+		p.keyFile = keyFile
+		p.logInfo("API key validation is enabled (%d keys in key store %s)", len(keyFile.store.hashes), cfg.KeyStoreFile)
+	}
+	p.readiness.keysConfigured = p.keys != nil || p.keyFile != nil
+	p.readiness.keyFile = p.keyFile
+
+	// Record usage for every proxied request
+	if cfg.UsageFile != "" {
+		p.usage = &usageLog{logger: p.logger, path: cfg.UsageFile}
+		p.logInfo("Recording usage to %s", cfg.UsageFile)
+	}
+
+	// Proxy the Files API, keeping each caller's files to itself
+	if cfg.FilesAPI {
+		files, err := loadFileOwners(cfg.FileOwnersFile, p.logger)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file owners file: %w", err)
+		}
+		p.files = files
+		if cfg.FileOwnersFile != "" {
+			p.logInfo("Files API is enabled (%d files in %s)", len(files.owners), cfg.FileOwnersFile)
+		} else {
+			p.logInfo("Files API is enabled")
+		}
+	}
+
+	// Check for an upstream API key to use instead of the client's key
+	if p.upstreamAPIKey != "" {
+		p.logInfo("Using UPSTREAM_API_KEY for Claude API requests")
+	}
+
+	if cfg.tokensEnabled() {
+		p.tokenKey = []byte(cfg.TokenSigningKey)
+		p.logInfo("Short-lived token endpoint is enabled")
+	}
+
+	// Header forwarding rules
+	p.requestHeaders = newHeaderPolicy(cfg.ForwardRequestHeaders, defaultForwardRequestHeaders, cfg.BlockRequestHeaders)
+	p.responseHeaders = newHeaderPolicy(cfg.ForwardResponseHeaders, defaultForwardResponseHeaders, cfg.BlockResponseHeaders)
+	p.responseHeaders.allow = append(p.responseHeaders.allow, preservedResponseHeaders...)
+	p.upstreamHeaders = cfg.UpstreamHeaders
+
+	// Trace export, if an OTLP endpoint is configured
+	if cfg.TracesEndpoint != "" {
+		p.tracer = newSpanExporter(cfg, p.logger)
+		p.logInfo("Exporting traces to %s", p.tracer.endpoint)
+	}
+
+	// Set up the router
+	r := mux.NewRouter()
+
+	// Health check endpoints (/health is kept as an alias for liveness)
+	r.HandleFunc("/health", p.loggingMiddleware(p.livenessHandler)).Methods("GET")
+	r.HandleFunc("/livez", p.loggingMiddleware(p.livenessHandler)).Methods("GET")
+	r.HandleFunc("/readyz", p.loggingMiddleware(p.readinessHandler)).Methods("GET")
+
+	// Short-lived token endpoint for trusted backends
+	r.HandleFunc("/v1/tokens", p.loggingMiddleware(p.tokenHandler)).Methods("POST")
+
+	// Claude API proxy endpoint
+	r.HandleFunc("/v1/messages", p.loggingMiddleware(p.claudeProxyHandler)).Methods("POST")
+
+	// Files API endpoints, which check the caller owns the file
+	if p.files != nil {
+		r.HandleFunc(filesPath, p.loggingMiddleware(p.fileUploadHandler)).Methods("POST")
+		r.HandleFunc(filesPath, p.loggingMiddleware(p.fileListHandler)).Methods("GET")
+		r.HandleFunc(filesPath+"/{file_id}", p.loggingMiddleware(p.fileHandler)).Methods("GET", "DELETE")
+		r.HandleFunc(filesPath+"/{file_id}/content", p.loggingMiddleware(p.fileHandler)).Methods("GET")
+	}
+
+	// Other Claude API paths allowed by the configured routes
+	for _, route := range routes {
+		muxRoute := r.Path(route.Pattern)
+		if prefix, ok := strings.CutSuffix(route.Pattern, "*"); ok {
+			muxRoute = r.PathPrefix(prefix)
+		}
+		muxRoute.Methods(route.Methods...).HandlerFunc(p.loggingMiddleware(p.routeHandler(route)))
+		p.logInfo("Proxying %s %s (auth: %s, body: %s)", strings.Join(route.Methods, "|"), route.Pattern, route.Auth, route.Body)
+	}
+
+	for _, warning := range warnings {
+		p.logWarning("%s", warning)
+	}
+
+	// Unknown routes and methods get Anthropic-style errors too
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, errorTypeNotFound, fmt.Sprintf("Not found: %s %s", r.Method, r.URL.Path))
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, errorTypeInvalidRequest, fmt.Sprintf("Method %s not allowed for %s", r.Method, r.URL.Path))
+	})
+	p.handler = r
+
+	// Set up CORS
+	if cfg.CORS != nil {
+		p.logInfo("CORS allowed origins: %s", strings.Join(cfg.CORS.AllowedOrigins, ", "))
+		p.handler = cors.New(*cfg.CORS).Handler(r)
+	}
+
+	p.readiness.setConfigLoaded()
+	return p, nil
+}
+
+// ServeHTTP serves the PRXY endpoints
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handler.ServeHTTP(w, r)
+}
+
+// Start runs the upstream readiness probe and span export in the background until Close is called
+func (p *Proxy) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.stop = cancel
+
+	// Keep the cached upstream reachability up to date for readiness checks
+	go p.runUpstreamProbe(ctx)
+
+	// Export trace spans in the background
+	if p.tracer != nil {
+		go p.tracer.run(ctx)
+	}
+}
+
+// Drain makes the readiness endpoint fail so load balancers stop sending traffic before shutdown
+func (p *Proxy) Drain() {
+	p.readiness.setDraining()
+}
+
+// Close stops the background work, flushes any spans still queued for export
+// (waiting at most until the context is done) and closes the usage and file owners files
+func (p *Proxy) Close(ctx context.Context) {
+	if p.stop != nil {
+		p.stop()
+		if p.tracer != nil {
+			p.tracer.wait(ctx)
+		}
+	}
+	if p.usage != nil {
+		p.usage.close()
+	}
+	if p.files != nil {
+		p.files.close()
+	}
+}
+
+// RequestIDFromContext returns the ID of the request being handled, for use in hooks
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// loggingMiddleware is a middleware for logging requests
+func (p *Proxy) loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Use the client's request ID if it is valid, otherwise generate a random one (7-character hex format)
+		requestID := r.Header.Get(headerRequestID)
+		if !validRequestID(requestID) {
+			randomBytes := make([]byte, 4)
+			_, err := rand.Read(randomBytes)
+			requestID = hex.EncodeToString(randomBytes)[:7]
+			if err != nil {
+				// Fallback to timestamp if random generation fails
+				requestID = fmt.Sprintf("%d", time.Now().UnixNano())
+			}
+		}
+
+		// Return the request ID on every response
+		w.Header().Set(headerRequestID, requestID)
+
+		// Start the request span, continuing the caller's trace if it sent a traceparent
+		ctx, requestSpan := startServerSpan(r, r.Method+" "+r.URL.Path, p.tracer)
+		requestSpan.setAttribute("prxy.request_id", requestID)
+		requestSpan.setAttribute("http.request.method", r.Method)
+		requestSpan.setAttribute("url.path", r.URL.Path)
+		requestSpan.setAttribute("client.address", r.RemoteAddr)
+
+		// Create a new context with the request ID and the metrics the handler fills in
+		metrics := &RequestMetrics{RequestID: requestID, Method: r.Method, Path: r.URL.Path}
+		ctx = context.WithValue(ctx, requestIDKey, requestID)
+		ctx = context.WithValue(ctx, metricsKey, metrics)
+
+		// Create a new request with the updated context
+		r = r.WithContext(ctx)
+
+		startTime := time.Now()
+		p.logRequest(requestID, "%s→%s %s %s from %s (trace %s)", colorPurple, colorReset, r.Method, r.URL.Path, r.RemoteAddr, requestSpan.traceIDString())
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		requestSpan.setAttribute("http.response.status_code", recorder.status)
+		if recorder.status >= http.StatusInternalServerError {
+			requestSpan.setError("HTTP %d", recorder.status)
+		}
+		requestSpan.finish()
+
+		duration := time.Since(startTime)
+		p.logRequest(requestID, "%s←%s Completed in %v", colorGreen, colorReset, duration)
+
+		metrics.Status = recorder.status
+		metrics.Duration = duration
+		metrics.ResponseBytes = recorder.bytes
+		if p.usage != nil && metrics.UpstreamStatus != 0 {
+			p.usage.record(*metrics)
+		}
+		if p.hooks.Metrics != nil {
+			p.hooks.Metrics(*metrics)
+		}
+	}
+}
+
+// metricsFromContext returns the metrics being collected for the request
+func metricsFromContext(ctx context.Context) *RequestMetrics {
+	if metrics, ok := ctx.Value(metricsKey).(*RequestMetrics); ok {
+		return metrics
+	}
+	return &RequestMetrics{}
+}
+
+// validRequestID reports whether a client-supplied request ID is safe to log and forward
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateAPIKey checks if the provided API key matches one of the allowed key hashes
+// and, for keys bound to origins, that the request comes from one of them.
+// It returns the matching entry, or nil if key validation is disabled.
+func (p *Proxy) validateAPIKey(key, origin string) (*apiKeyHash, error) {
+	if key == "" {
+		return nil, errInvalidAPIKey
+	}
+
+	if p.keys == nil && p.keyFile == nil {
+		// If no allowed keys are configured, accept all keys (with a warning already logged at startup)
+		return nil, nil
+	}
+
+	hash := p.keys.lookup(key)
+	if hash == nil && p.keyFile != nil {
+		hash = p.keyFile.current().lookup(key)
+	}
+	if hash == nil {
+		return nil, errInvalidAPIKey
+	}
+	if !hash.allowsOrigin(origin) {
+		return nil, errOriginNotAllowed
+	}
+	return hash, nil
+}
+
+// keyByID returns the allowed key with the given ID, or nil if it was removed or revoked
+func (p *Proxy) keyByID(id string) *apiKeyHash {
+	if hash := p.keys.byID(id); hash != nil {
+		return hash
+	}
+	if p.keyFile != nil {
+		return p.keyFile.current().byID(id)
+	}
+	return nil
+}
+
+// extractAPIKey gets the API key from either the Authorization header or x-api-key header
+func extractAPIKey(r *http.Request) string {
+	// Try to get the key from the x-api-key header first
+	apiKey := r.Header.Get("x-api-key")
+	if apiKey != "" {
+		return apiKey
+	}
+
+	// If not found, try to extract from the Authorization header
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+
+	// No API key found
+	return ""
+}
+
+// authenticate checks the caller of a proxied request, writing the error if it is rejected
+func (p *Proxy) authenticate(w http.ResponseWriter, r *http.Request) (*principal, bool) {
+	_, authSpan := startSpan(r.Context(), "authenticate", spanKindInternal)
+	caller, authErr := p.authenticateRequest(r)
+	if authErr != nil {
+		authSpan.setError("%s", authErr.Message)
+	}
+	authSpan.finish()
+	if authErr != nil {
+		writeAPIError(w, authErr.Status, authErr.Type, authErr.Message)
+		return nil, false
+	}
+	metrics := metricsFromContext(r.Context())
+	metrics.Caller = caller.fingerprint
+	metrics.KeyID = caller.keyID
+	w.Header().Set(headerKeyFingerprint, caller.fingerprint)
+	spanFromContext(r.Context()).setAttribute("prxy.key_fingerprint", caller.fingerprint)
+	return caller, true
+}
+
+// upstreamRequestHeader builds the headers of an upstream request: the required headers, then
+// the client headers allowed by the request header policy, then the static headers. Client
+// credentials are dropped when the proxy uses its own upstream key.
+func (p *Proxy) upstreamRequestHeader(r *http.Request, caller *principal, contentType string) http.Header {
+	requestID := r.Context().Value(requestIDKey).(string)
+	upstreamHeader := http.Header{}
+	if contentType != "" {
+		upstreamHeader.Set("Content-Type", contentType)
+	}
+	upstreamHeader.Set("anthropic-version", defaultAnthropicVersion)
+	upstreamHeader.Set(headerRequestID, requestID)
+	forwarded := copyRequestHeaders(upstreamHeader, r.Header, p.requestHeaders, func(name string) bool {
+		name = strings.ToLower(name)
+		return p.upstreamAPIKey != "" && (name == "authorization" || name == "x-api-key")
+	})
+	for _, header := range forwarded {
+		// Log headers being set (but only show key fingerprints)
+		headerName := strings.ToLower(header)
+		if headerName == "authorization" || headerName == "x-api-key" {
+			p.logRequest(requestID, "Forwarding header: %s: %s", header, caller.fingerprint)
+		} else {
+			p.logRequest(requestID, "Forwarding header: %s: %s", header, strings.Join(r.Header.Values(header), ", "))
+		}
+	}
+
+	// Use the upstream API key when configured
+	if p.upstreamAPIKey != "" {
+		upstreamHeader.Set("x-api-key", p.upstreamAPIKey)
+	}
+
+	// Add static headers configured for the upstream and for the caller's key
+	addStaticHeaders(upstreamHeader, p.upstreamHeaders)
+	addStaticHeaders(upstreamHeader, caller.headers)
+	return upstreamHeader
+}
+
+// claudeProxyHandler handles the proxy request to the Claude API
+func (p *Proxy) claudeProxyHandler(w http.ResponseWriter, r *http.Request) {
+	// Get request ID from context
+	requestID := r.Context().Value(requestIDKey).(string)
+	metrics := metricsFromContext(r.Context())
+	p.logRequest(requestID, "Processing Claude API request")
+
+	// Authenticate with an API key, short-lived token or client certificate
+	caller, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	claims := caller.claims
+
+	// Read the request body, up to the configured size limit. Bodies over the passthrough size are
+	// streamed upstream as they arrive, unless the request has to be inspected before it is sent.
+	_, parseSpan := startSpan(r.Context(), "parse request", spanKindInternal)
+	defer parseSpan.finish()
+	defer r.Body.Close()
+	limitedBody := http.MaxBytesReader(w, r.Body, p.maxBodyBytes)
+	body, err := io.ReadAll(io.LimitReader(limitedBody, p.passthroughBytes+1))
+	passthrough := err == nil && int64(len(body)) > p.passthroughBytes
+	if passthrough && (claims != nil || p.hooks.TransformRequest != nil || p.files != nil || p.local != nil) {
+		passthrough = false
+		buffer := bytes.NewBuffer(body)
+		_, err = buffer.ReadFrom(limitedBody)
+		body = buffer.Bytes()
+	}
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			p.writeBodyTooLarge(w, requestID, maxBytesErr.Limit, false)
+			return
+		}
+		p.write(LogError, requestID, "Error reading request body: %v", err)
+		writeAPIError(w, http.StatusBadRequest, errorTypeInvalidRequest, "Failed to read request body")
+		return
+	}
+
+	// The body is parsed to check it, but forwarded as sent
+	var requestData map[string]interface{}
+	if passthrough {
+		p.logRequest(requestID, "Streaming request body over %d bytes to Claude API without validation", p.passthroughBytes)
+		parseSpan.setAttribute("prxy.passthrough", true)
+	} else {
+		if err := json.Unmarshal(body, &requestData); err != nil {
+			p.write(LogError, requestID, "Invalid JSON in request body: %v", err)
+			writeAPIError(w, http.StatusBadRequest, errorTypeInvalidRequest, "Invalid JSON request body")
+			return
+		}
+
+		// Check the request structure before forwarding it
+		if err := validateMessagesRequest(requestData); err != nil {
+			p.logRequest(requestID, "Invalid request: %v", err)
+			parseSpan.setError("%v", err)
+			writeAPIError(w, http.StatusBadRequest, errorTypeInvalidRequest, err.Error())
+			return
+		}
+		parseSpan.setAttribute("prxy.request_bytes", len(body))
+	}
+	parseSpan.finish()
+
+	// Log model being used if present
+	if model, ok := requestData["model"].(string); ok {
+		p.logRequest(requestID, "Using model: %s", model)
+		metrics.Model = model
+	}
+
+	// Keep token requests within the token's scope
+	if claims != nil {
+		_, scopeSpan := startSpan(r.Context(), "check token scope", spanKindInternal)
+		err := claims.checkScope(requestData)
+		if err != nil {
+			scopeSpan.setError("%v", err)
+		}
+		scopeSpan.finish()
+		if err != nil {
+			p.logRequest(requestID, "Forbidden: %v", err)
+			writeAPIError(w, http.StatusForbidden, errorTypePermission, err.Error())
+			return
+		}
+	}
+
+	// Only files the caller uploaded may be referenced
+	if p.files != nil {
+		if fileID, at := p.files.findForeignFile(requestData, caller.owner); fileID != "" {
+			p.logRequest(requestID, "File %s is not owned by %s", fileID, caller.fingerprint)
+			writeAPIError(w, http.StatusNotFound, errorTypeNotFound, fmt.Sprintf("%s: File not found: %s", at, fileID))
+			return
+		}
+	}
+
+	upstreamHeader := p.upstreamRequestHeader(r, caller, "application/json")
+
+	// Let the embedding application adjust the request
+	if p.hooks.TransformRequest != nil {
+		if err := p.hooks.TransformRequest(r, requestData, upstreamHeader); err != nil {
+			apiErr := asError(err, http.StatusBadRequest, errorTypeInvalidRequest)
+			p.logRequest(requestID, "Request rejected by transform: %v", err)
+			writeAPIError(w, apiErr.Status, apiErr.Type, apiErr.Message)
+			return
+		}
+	}
+
+	// The provider is chosen once the hook has had its say on the model
+	model, _ := requestData["model"].(string)
+	upstream, providerName, err := p.providerFor(caller, model)
+	if err != nil {
+		apiErr := asError(err, http.StatusInternalServerError, errorTypeAPI)
+		p.write(LogError, requestID, "%s", apiErr.Message)
+		writeAPIError(w, apiErr.Status, apiErr.Type, apiErr.Message)
+		return
+	}
+
+	// Check if client wants streaming
+	streamRequested := false
+	if streamValue, exists := requestData["stream"]; exists {
+		if streamBool, ok := streamValue.(bool); ok {
+			streamRequested = streamBool
+		}
+	}
+	metrics.Stream = streamRequested
+
+	// Non-streaming requests are streamed upstream and aggregated when configured, so that
+	// long requests do not look idle to intermediaries
+	aggregate := !passthrough && !streamRequested && p.aggregateStreams
+
+	// Forward the client's body as sent where possible, keeping its key order and number
+	// formatting. Only the stream field is changed, for aggregation.
+	var upstreamBody io.Reader
+	var scanner *bodyScanner
+	switch {
+	case passthrough:
+		// Whether the client asked for a stream is only known once the body has been sent
+		scanner = newBodyScanner(io.MultiReader(bytes.NewReader(body), limitedBody), p.aggregateStreams)
+		upstreamBody = scanner
+	case p.hooks.TransformRequest != nil:
+		// The hook may have changed the request, so it is encoded again
+		if !streamRequested {
+			requestData["stream"] = aggregate
+		}
+		modifiedBody, err := json.Marshal(requestData)
+		if err != nil {
+			p.write(LogError, requestID, "Failed to marshal modified request: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, errorTypeAPI, "Failed to process request")
+			return
+		}
+		upstreamBody = bytes.NewReader(modifiedBody)
+	case aggregate:
+		upstreamBody = bytes.NewReader(forceStreamField(body))
+	default:
+		upstreamBody = bytes.NewReader(body)
+	}
+
+	// Create a new request to the Claude API (always use /v1/messages endpoint)
+	// Other providers rewrite the request for their own API
+	claudeAPIURL := p.upstreamURL + "/v1/messages"
+	if providerName == ProviderAnthropic {
+		p.logRequest(requestID, "Forwarding request to Claude API at %s", claudeAPIURL)
+	}
+
+	upstreamCtx, upstreamSpan := startSpan(r.Context(), "POST /v1/messages upstream", spanKindClient)
+	defer upstreamSpan.finish()
+	upstreamSpan.setAttribute("server.address", upstream.baseURL())
+	upstreamSpan.setAttribute("prxy.provider", providerName)
+	upstreamSpan.setAttribute("prxy.stream", streamRequested)
+	upstreamSpan.setAttribute("prxy.aggregated", aggregate)
+
+	proxyReq, err := http.NewRequestWithContext(upstreamCtx, "POST", claudeAPIURL, upstreamBody)
+	if err != nil {
+		p.write(LogError, requestID, "Failed to create proxy request: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, errorTypeAPI, "Failed to create proxy request")
+		return
+	}
+	if passthrough && !p.aggregateStreams && r.ContentLength > 0 {
+		// The body is forwarded unchanged, so its length is known
+		proxyReq.ContentLength = r.ContentLength
+	}
+	proxyReq.Header = upstreamHeader
+	proxyReq.Header.Set("traceparent", upstreamSpan.traceparent())
+
+	// Send the request to Claude API
+	var resp *http.Response
+	if aggregate || passthrough && p.aggregateStreams {
+		if aggregate {
+			p.logRequest(requestID, "Streaming from Claude API to aggregate a non-streaming response")
+		}
+		clientStream := func() (bool, bool) {
+			if scanner == nil {
+				return streamRequested, true
+			}
+			result, done := scanner.Result()
+			return result.Stream, done
+		}
+		if resp = p.serveAggregated(w, r, upstream, proxyReq, upstreamSpan, clientStream); resp == nil {
+			if scanner != nil {
+				p.recordStreamedBody(r, scanner, upstreamSpan, nil)
+			}
+			return
+		}
+	} else {
+		startTime := time.Now()
+		resp, err = upstream.send(p.client, proxyReq)
+		if err != nil {
+			upstreamSpan.setError("%v", err)
+			p.writeSendFailure(w, requestID, err, false)
+			return
+		}
+		p.upstreamResponded(r, resp, upstreamSpan, startTime)
+	}
+	defer resp.Body.Close()
+
+	if scanner != nil {
+		streamRequested = p.recordStreamedBody(r, scanner, upstreamSpan, resp)
+	}
+
+	// Copy the upstream response headers allowed by the response header policy
+	copyResponseHeaders(w.Header(), resp.Header, p.responseHeaders)
+
+	// If not streaming or error occurred, send the complete response
+	if !streamRequested || resp.StatusCode != http.StatusOK {
+		responseBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			p.write(LogError, requestID, "Error reading Claude API response body: %v", err)
+			writeAPIError(w, http.StatusBadGateway, errorTypeAPI, "Failed to read Claude API response")
+			return
+		}
+
+		p.writeCompleteResponse(w, r, resp.StatusCode, responseBody, false)
+		return
+	}
+
+	// For streaming responses, flush each chunk as it arrives
+	p.logRequest(requestID, "Starting to stream response")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		p.write(LogError, requestID, "Streaming not supported by server")
+		writeAPIError(w, http.StatusInternalServerError, errorTypeAPI, "Streaming not supported by server")
+		return
+	}
+
+	// Stream the response
+	upstreamSpan.finish()
+	_, streamSpan := startSpan(r.Context(), "stream response", spanKindInternal)
+	defer streamSpan.finish()
+	buffer := make([]byte, 1024)
+	bytesStreamed := 0
+	streamStart := time.Now()
+	var usage streamUsage
+	defer func() { usage.usage.setMetrics(metrics) }()
+
+	// Set appropriate headers for Server-Sent Events (SSE)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(resp.StatusCode)
+
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			bytesStreamed += n
+			usage.write(buffer[:n])
+			_, writeErr := w.Write(buffer[:n])
+			if writeErr != nil {
+				p.write(LogError, requestID, "Error writing to client: %v", writeErr)
+				streamSpan.setError("writing to client: %v", writeErr)
+				return
+			}
+			flusher.Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				p.write(LogError, requestID, "Error reading from Claude API: %v", err)
+				streamSpan.setError("reading from Claude API: %v", err)
+				// Headers are already sent, so report the failure in-band as an SSE error event
+				writeSSEError(w, errorTypeAPI, "Stream from Claude API was interrupted")
+				flusher.Flush()
+			} else {
+				p.logRequest(requestID, "Finished streaming response: %d bytes in %v", bytesStreamed, time.Since(streamStart))
+			}
+			break
+		}
+	}
+	streamSpan.setAttribute("prxy.bytes_streamed", bytesStreamed)
+}
+
+// recordStreamedBody records the model and stream values of a request body streamed upstream,
+// and returns whether the client asked for a stream. The body has been read by the time
+// Claude API responds, unless the response came early, when the response type is used instead.
+func (p *Proxy) recordStreamedBody(r *http.Request, scanner *bodyScanner, upstreamSpan *span, resp *http.Response) bool {
+	requestID := r.Context().Value(requestIDKey).(string)
+	metrics := metricsFromContext(r.Context())
+	result, done := scanner.Result()
+	stream := result.Stream
+	if !done && resp != nil {
+		stream = strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+	}
+	if result.Model != "" {
+		p.logRequest(requestID, "Using model: %s", result.Model)
+		metrics.Model = result.Model
+	}
+	metrics.Stream = stream
+	upstreamSpan.setAttribute("prxy.stream", stream)
+	return stream
+}
+
+// upstreamResponded records the status of a Claude API response
+func (p *Proxy) upstreamResponded(r *http.Request, resp *http.Response, upstreamSpan *span, startTime time.Time) {
+	requestID := r.Context().Value(requestIDKey).(string)
+	metricsFromContext(r.Context()).UpstreamStatus = resp.StatusCode
+	upstreamRequestID := resp.Header.Get("request-id")
+	p.logRequest(requestID, "Claude API responded with status: %d in %v (upstream request-id: %s)", resp.StatusCode, time.Since(startTime), upstreamRequestID)
+	upstreamSpan.setAttribute("http.response.status_code", resp.StatusCode)
+	upstreamSpan.setAttribute("prxy.upstream_request_id", upstreamRequestID)
+	if resp.StatusCode != http.StatusOK {
+		upstreamSpan.setError("HTTP %d", resp.StatusCode)
+	}
+}
+
+// writeSendFailure reports a request that could not be sent to Claude API. A streamed request
+// body fails the upstream request when it goes over the size limit.
+func (p *Proxy) writeSendFailure(w http.ResponseWriter, requestID string, err error, committed bool) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		p.writeBodyTooLarge(w, requestID, maxBytesErr.Limit, committed)
+		return
+	}
+	p.write(LogError, requestID, "Failed to send request to Claude API: %v", err)
+	writeFailure(w, committed, http.StatusBadGateway, errorTypeAPI, "Failed to send request to Claude API")
+}
+
+// writeBodyTooLarge rejects a request body over the size limit
+func (p *Proxy) writeBodyTooLarge(w http.ResponseWriter, requestID string, limit int64, committed bool) {
+	p.logRequest(requestID, "Request body exceeds %d bytes", limit)
+	writeFailure(w, committed, http.StatusRequestEntityTooLarge, errorTypeRequestTooLarge,
+		fmt.Sprintf("Request body exceeds the maximum size of %d bytes", limit))
+}
+
+// writeCompleteResponse sends a complete upstream response, a message or an error, to the client.
+// If the status was already sent, only the body is written.
+func (p *Proxy) writeCompleteResponse(w http.ResponseWriter, r *http.Request, status int, responseBody []byte, committed bool) {
+	requestID := r.Context().Value(requestIDKey).(string)
+	metrics := metricsFromContext(r.Context())
+	if status != http.StatusOK {
+		p.write(LogError, requestID, "Claude API error response: %s", string(responseBody))
+	} else {
+		p.logRequest(requestID, "Sending complete non-streaming response (%d bytes)", len(responseBody))
+
+		// Verify the JSON is valid but pass it through without modification
+		var jsonCheck struct {
+			Usage messageUsage `json:"usage"`
+		}
+		if err := json.Unmarshal(responseBody, &jsonCheck); err != nil {
+			p.write(LogWarning, requestID, "Invalid JSON in Claude API non-streaming response: %v", err)
+			writeFailure(w, committed, http.StatusBadGateway, errorTypeAPI, "Invalid JSON in Claude API response")
+			return
+		}
+		jsonCheck.Usage.setMetrics(metrics)
+	}
+
+	// Let the embedding application adjust the response
+	if p.hooks.TransformResponse != nil {
+		var err error
+		responseBody, err = p.hooks.TransformResponse(r, status, w.Header(), responseBody)
+		if err != nil {
+			apiErr := asError(err, http.StatusBadGateway, errorTypeAPI)
+			p.write(LogError, requestID, "Response transform failed: %v", err)
+			writeFailure(w, committed, apiErr.Status, apiErr.Type, apiErr.Message)
+			return
+		}
+	}
+
+	if !committed {
+		w.WriteHeader(status)
+	}
+	w.Write(responseBody)
+}
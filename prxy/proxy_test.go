@@ -0,0 +1,189 @@
+package prxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestProxy creates a proxy in front of a stand-in Claude API served by upstream, if set
+func newTestProxy(t *testing.T, cfg Config, upstream http.HandlerFunc) *Proxy {
+	t.Helper()
+	if upstream != nil {
+		server := httptest.NewServer(upstream)
+		t.Cleanup(server.Close)
+		cfg.UpstreamURL = server.URL
+	}
+	if cfg.Hooks.Log == nil {
+		cfg.Hooks.Log = func(LogEntry) {}
+	}
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close(context.Background()) })
+	return p
+}
+
+// serve sends a request through the proxy and returns the response
+func serve(p *Proxy, method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	return w
+}
+
+func TestMessagesUseUpstreamKey(t *testing.T) {
+	var gotKey string
+	p := newTestProxy(t, Config{AllowedAPIKeys: []string{"client-key"}, UpstreamAPIKey: "upstream-key"}, func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.Header.Get("x-api-key")
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"type":"message","usage":{"input_tokens":1,"output_tokens":1}}`)
+	})
+
+	tests := []struct {
+		name   string
+		key    string
+		status int
+	}{
+		{"allowed key", "client-key", http.StatusOK},
+		{"unknown key", "other-key", http.StatusUnauthorized},
+		{"no key", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotKey = ""
+			w := serve(p, "POST", "/v1/messages", `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`, map[string]string{"x-api-key": tt.key})
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusOK && gotKey != "upstream-key" {
+				t.Errorf("upstream key = %q, want the configured upstream key", gotKey)
+			}
+		})
+	}
+}
+
+func TestPassthroughIsOptIn(t *testing.T) {
+	// A large body without max_tokens
+	body := `{"model":"claude-x","messages":[{"role":"user","content":"` + strings.Repeat("a", 64<<10) + `"}]}`
+	tests := []struct {
+		name        string
+		passthrough int64
+		status      int
+		forwarded   bool
+	}{
+		{"validated by default", 0, http.StatusBadRequest, false},
+		{"validated under the passthrough size", 1 << 20, http.StatusBadRequest, false},
+		{"streamed over the passthrough size", 1024, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []byte
+			p := newTestProxy(t, Config{AllowedAPIKeys: []string{"client-key"}, PassthroughBodyBytes: tt.passthrough}, func(w http.ResponseWriter, r *http.Request) {
+				got, _ = io.ReadAll(r.Body)
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{"type":"message","usage":{"input_tokens":1,"output_tokens":1}}`)
+			})
+			w := serve(p, "POST", "/v1/messages", body, map[string]string{"x-api-key": "client-key"})
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if forwarded := string(got) == body; forwarded != tt.forwarded {
+				t.Errorf("body forwarded = %v, want %v", forwarded, tt.forwarded)
+			}
+		})
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"req-123", true},
+		{"0b5e7c1a:retry.2_final", true},
+		{strings.Repeat("a", maxRequestIDLength), true},
+		{"", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+		{"has space", false},
+		{"line\nbreak", false},
+		{"quote\"", false},
+		{"ünïcode", false},
+	}
+	for _, tt := range tests {
+		if got := validRequestID(tt.id); got != tt.want {
+			t.Errorf("validRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	var upstreamID string
+	var entries []LogEntry
+	var metrics []RequestMetrics
+	cfg := Config{AllowedAPIKeys: []string{"client-key"}, UpstreamAPIKey: "upstream-key"}
+	cfg.Hooks.Log = func(entry LogEntry) { entries = append(entries, entry) }
+	cfg.Hooks.Metrics = func(m RequestMetrics) { metrics = append(metrics, m) }
+	p := newTestProxy(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get(headerRequestID)
+		io.WriteString(w, `{"type":"message"}`)
+	})
+
+	tests := []struct {
+		name string
+		sent string
+		// kept is whether the client's ID is used rather than a generated one
+		kept bool
+	}{
+		{name: "client ID", sent: "client-req-1", kept: true},
+		{name: "no ID"},
+		{name: "unsafe ID", sent: "bad id\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamID, entries, metrics = "", nil, nil
+			header := map[string]string{"x-api-key": "client-key"}
+			if tt.sent != "" {
+				header[headerRequestID] = tt.sent
+			}
+			w := serve(p, "POST", "/v1/messages", `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`, header)
+
+			id := w.Header().Get(headerRequestID)
+			if tt.kept && id != tt.sent || !tt.kept && (id == tt.sent || !validRequestID(id)) {
+				t.Fatalf("response request ID = %q, sent %q", id, tt.sent)
+			}
+			if upstreamID != id {
+				t.Errorf("upstream request ID = %q, want %q", upstreamID, id)
+			}
+			if len(metrics) != 1 || metrics[0].RequestID != id {
+				t.Errorf("metrics = %+v, want request ID %q", metrics, id)
+			}
+			for _, entry := range entries {
+				if entry.RequestID != "" && entry.RequestID != id {
+					t.Errorf("log entry %q has request ID %q, want %q", entry.Message, entry.RequestID, id)
+				}
+			}
+		})
+	}
+
+	// Generated IDs differ between requests
+	first := serve(p, "GET", "/health", "", nil).Header().Get(headerRequestID)
+	second := serve(p, "GET", "/health", "", nil).Header().Get(headerRequestID)
+	if first == second {
+		t.Errorf("two requests both got request ID %q", first)
+	}
+}
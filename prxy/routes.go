@@ -0,0 +1,285 @@
+package prxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Route body handling
+const (
+	// RouteBodyBuffered reads request bodies in full before sending them upstream
+	RouteBodyBuffered = "buffered"
+	// RouteBodyStream sends request bodies upstream as they arrive
+	RouteBodyStream = "stream"
+)
+
+// Route authentication policies
+const (
+	// RouteAuthKey accepts API keys, client certificates and callers from the Authenticate hook.
+	// Short-lived tokens are refused, since their scope only covers Messages requests.
+	RouteAuthKey = "key"
+	// RouteAuthNone accepts every request. It cannot be used with an upstream API key.
+	RouteAuthNone = "none"
+)
+
+// Route entry options
+const (
+	routeMethodsOption = "methods="
+	routeBodyOption    = "body="
+	routeMaxBodyOption = "max_body="
+	routeAuthOption    = "auth="
+)
+
+// Paths the proxy serves itself, which are matched before any route
+var reservedRoutePaths = []string{"/v1/messages", "/v1/tokens", "/health", "/livez", "/readyz"}
+
+// Paths under messagesPath, such as count_tokens and batches, take Messages request bodies, so
+// routes that cover them must authenticate callers
+const messagesPath = "/v1/messages"
+
+// Route allows requests to a Claude API path other than /v1/messages, which are forwarded to
+// the same path and query upstream. Request and response bodies are passed through as they
+// are, and the request and response hooks are not called.
+type Route struct {
+	// Pattern is the request path, or a path prefix ending in "*", e.g. "/v1/models*"
+	Pattern string
+	// Methods are the allowed HTTP methods (default GET)
+	Methods []string
+	// Body is RouteBodyBuffered (default) or RouteBodyStream. With the Files API, bodies are
+	// always buffered so that references to other callers' files can be refused.
+	Body string
+	// MaxBodyBytes limits request bodies (default Config.MaxRequestBodyBytes)
+	MaxBodyBytes int64
+	// Auth is RouteAuthKey (default) or RouteAuthNone
+	Auth string
+}
+
+// parseRoutes parses route entries of the form "/v1/models*;methods=GET|HEAD;body=stream;
+// max_body=1048576;auth=none", where every option is optional
+func parseRoutes(entries []string) ([]Route, error) {
+	var routes []Route
+	for _, entry := range entries {
+		options := strings.Split(entry, ";")
+		route := Route{Pattern: strings.TrimSpace(options[0])}
+		for _, option := range options[1:] {
+			option = strings.TrimSpace(option)
+			switch {
+			case option == "":
+			case strings.HasPrefix(option, routeMethodsOption):
+				for _, method := range strings.Split(strings.TrimPrefix(option, routeMethodsOption), "|") {
+					if method = strings.TrimSpace(method); method != "" {
+						route.Methods = append(route.Methods, method)
+					}
+				}
+			case strings.HasPrefix(option, routeBodyOption):
+				route.Body = strings.TrimPrefix(option, routeBodyOption)
+			case strings.HasPrefix(option, routeMaxBodyOption):
+				n, err := strconv.ParseInt(strings.TrimPrefix(option, routeMaxBodyOption), 10, 64)
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("route %s: max_body must be a positive number of bytes", route.Pattern)
+				}
+				route.MaxBodyBytes = n
+			case strings.HasPrefix(option, routeAuthOption):
+				route.Auth = strings.TrimPrefix(option, routeAuthOption)
+			default:
+				return nil, fmt.Errorf("route %s: unknown option %q", route.Pattern, option)
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// normalize checks a route and fills in its defaults
+func (route *Route) normalize(maxBodyBytes int64) error {
+	prefix, _ := strings.CutSuffix(route.Pattern, "*")
+	if !strings.HasPrefix(route.Pattern, "/") || strings.Contains(prefix, "*") {
+		return fmt.Errorf("route %q must be a path starting with / with at most a trailing *", route.Pattern)
+	}
+	// Prefixes may cover the proxy's own paths, which are matched first
+	for _, reserved := range reservedRoutePaths {
+		if route.Pattern == reserved {
+			return fmt.Errorf("route %s is served by the proxy itself", route.Pattern)
+		}
+	}
+
+	methods := []string{http.MethodGet}
+	if len(route.Methods) > 0 {
+		methods = make([]string, len(route.Methods))
+		for i, method := range route.Methods {
+			methods[i] = strings.ToUpper(method)
+		}
+	}
+	route.Methods = methods
+	switch route.Body {
+	case "":
+		route.Body = RouteBodyBuffered
+	case RouteBodyBuffered, RouteBodyStream:
+	default:
+		return fmt.Errorf("route %s: body must be %s or %s", route.Pattern, RouteBodyBuffered, RouteBodyStream)
+	}
+	if route.MaxBodyBytes <= 0 {
+		route.MaxBodyBytes = maxBodyBytes
+	}
+	switch route.Auth {
+	case "":
+		route.Auth = RouteAuthKey
+	case RouteAuthKey, RouteAuthNone:
+	default:
+		return fmt.Errorf("route %s: auth must be %s or %s", route.Pattern, RouteAuthKey, RouteAuthNone)
+	}
+	if route.Auth == RouteAuthNone && routeCoversMessages(route.Pattern) {
+		return fmt.Errorf("route %s covers paths under %s/, which take Messages requests, so it cannot use auth=%s", route.Pattern, messagesPath, RouteAuthNone)
+	}
+	return nil
+}
+
+// routeCoversMessages reports whether a route pattern matches any path under /v1/messages/
+func routeCoversMessages(pattern string) bool {
+	prefix, isPrefix := strings.CutSuffix(pattern, "*")
+	if isPrefix && strings.HasPrefix(messagesPath+"/", prefix) {
+		return true
+	}
+	return strings.HasPrefix(prefix, messagesPath+"/")
+}
+
+// routeHandler forwards requests on an allowed route to the same path upstream
+func (p *Proxy) routeHandler(route Route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Context().Value(requestIDKey).(string)
+		p.logRequest(requestID, "Processing request for route %s", route.Pattern)
+
+		// Authenticate as the route's policy asks. Tokens are scoped to Messages requests, so
+		// they are never accepted here.
+		caller := &principal{fingerprint: "public"}
+		if route.Auth != RouteAuthNone {
+			var ok bool
+			if caller, ok = p.authenticate(w, r); !ok {
+				return
+			}
+			if caller.claims != nil {
+				p.logRequest(requestID, "Forbidden: %s used for route %s", caller.fingerprint, route.Pattern)
+				writeAPIError(w, http.StatusForbidden, errorTypePermission, "Short-lived tokens cannot be used for this endpoint")
+				return
+			}
+		}
+		if !p.requireAnthropic(w, r, caller) {
+			return
+		}
+
+		// Read or stream the request body, up to the route's size limit
+		defer r.Body.Close()
+		var body io.Reader
+		if r.ContentLength != 0 {
+			limitedBody := http.MaxBytesReader(w, r.Body, route.MaxBodyBytes)
+			body = limitedBody
+			if route.Body == RouteBodyBuffered || p.files != nil {
+				data, err := io.ReadAll(limitedBody)
+				if err != nil {
+					var maxBytesErr *http.MaxBytesError
+					if errors.As(err, &maxBytesErr) {
+						p.writeBodyTooLarge(w, requestID, maxBytesErr.Limit, false)
+						return
+					}
+					p.write(LogError, requestID, "Error reading request body: %v", err)
+					writeAPIError(w, http.StatusBadRequest, errorTypeInvalidRequest, "Failed to read request body")
+					return
+				}
+				if !p.allowFileReferences(w, r, caller, data) {
+					return
+				}
+				body = bytes.NewReader(data)
+			}
+		}
+
+		contentLength := int64(0)
+		if route.Body == RouteBodyStream && p.files == nil {
+			contentLength = r.ContentLength
+		}
+		resp, upstreamSpan := p.forwardUpstream(w, r, caller, route.Pattern, body, contentLength)
+		if resp == nil {
+			return
+		}
+		defer resp.Body.Close()
+		defer upstreamSpan.finish()
+		p.passResponse(w, r, resp, upstreamSpan)
+	}
+}
+
+// forwardUpstream sends a request to the same path and query upstream, with the body given and
+// its length if known. It writes the error and returns nil if the request could not be sent.
+func (p *Proxy) forwardUpstream(w http.ResponseWriter, r *http.Request, caller *principal, name string, body io.Reader, contentLength int64) (*http.Response, *span) {
+	requestID := r.Context().Value(requestIDKey).(string)
+	upstreamURL := p.upstreamURL + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		upstreamURL += "?" + r.URL.RawQuery
+	}
+	p.logRequest(requestID, "Forwarding request to Claude API at %s", upstreamURL)
+
+	upstreamCtx, upstreamSpan := startSpan(r.Context(), r.Method+" "+name+" upstream", spanKindClient)
+	upstreamSpan.setAttribute("server.address", p.upstreamURL)
+	upstreamSpan.setAttribute("url.path", r.URL.Path)
+
+	proxyReq, err := http.NewRequestWithContext(upstreamCtx, r.Method, upstreamURL, body)
+	if err != nil {
+		p.write(LogError, requestID, "Failed to create proxy request: %v", err)
+		upstreamSpan.finish()
+		writeAPIError(w, http.StatusInternalServerError, errorTypeAPI, "Failed to create proxy request")
+		return nil, nil
+	}
+	if contentLength > 0 {
+		proxyReq.ContentLength = contentLength
+	}
+	proxyReq.Header = p.upstreamRequestHeader(r, caller, r.Header.Get("Content-Type"))
+	proxyReq.Header.Set("traceparent", upstreamSpan.traceparent())
+
+	startTime := time.Now()
+	resp, err := p.client.Do(proxyReq)
+	if err != nil {
+		upstreamSpan.setError("%v", err)
+		upstreamSpan.finish()
+		p.writeSendFailure(w, requestID, err, false)
+		return nil, nil
+	}
+	p.upstreamResponded(r, resp, upstreamSpan, startTime)
+	return resp, upstreamSpan
+}
+
+// passResponse passes an upstream response to the client as it arrives, which suits JSON,
+// event streams and file downloads
+func (p *Proxy) passResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, upstreamSpan *span) {
+	requestID := r.Context().Value(requestIDKey).(string)
+	copyResponseHeaders(w.Header(), resp.Header, p.responseHeaders)
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	flusher, canFlush := w.(http.Flusher)
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
+				p.write(LogError, requestID, "Error writing to client: %v", writeErr)
+				return
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			p.write(LogError, requestID, "Error reading from Claude API: %v", err)
+			upstreamSpan.setError("reading from Claude API: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package prxy
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := parseRoutes([]string{
+		"/v1/models*",
+		" /v1/files* ; methods=get|POST| ; body=stream ; max_body=1024 ; auth=none ;",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Route{
+		{Pattern: "/v1/models*"},
+		{Pattern: "/v1/files*", Methods: []string{"get", "POST"}, Body: RouteBodyStream, MaxBodyBytes: 1024, Auth: RouteAuthNone},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("parseRoutes() = %+v, want %+v", routes, want)
+	}
+
+	for _, entry := range []string{"/v1/models;max_body=0", "/v1/models;max_body=big", "/v1/models;cache=true"} {
+		if _, err := parseRoutes([]string{entry}); err == nil {
+			t.Errorf("parseRoutes(%q) succeeded", entry)
+		}
+	}
+}
+
+func TestRouteNormalize(t *testing.T) {
+	tests := []struct {
+		route   Route
+		want    Route
+		wantErr string
+	}{
+		{
+			route: Route{Pattern: "/v1/models*", Methods: []string{"get", "head"}},
+			want:  Route{Pattern: "/v1/models*", Methods: []string{"GET", "HEAD"}, Body: RouteBodyBuffered, MaxBodyBytes: 100, Auth: RouteAuthKey},
+		},
+		{
+			route: Route{Pattern: "/v1/organizations/usage_report/messages", MaxBodyBytes: 5, Auth: RouteAuthNone},
+			want:  Route{Pattern: "/v1/organizations/usage_report/messages", Methods: []string{"GET"}, Body: RouteBodyBuffered, MaxBodyBytes: 5, Auth: RouteAuthNone},
+		},
+		// Prefixes over the proxy's own paths are allowed, since those are matched first
+		{
+			route: Route{Pattern: "/v1/tok*"},
+			want:  Route{Pattern: "/v1/tok*", Methods: []string{"GET"}, Body: RouteBodyBuffered, MaxBodyBytes: 100, Auth: RouteAuthKey},
+		},
+		{
+			route: Route{Pattern: "/v1/messages*"},
+			want:  Route{Pattern: "/v1/messages*", Methods: []string{"GET"}, Body: RouteBodyBuffered, MaxBodyBytes: 100, Auth: RouteAuthKey},
+		},
+		{
+			route: Route{Pattern: "/v1/messages/count_tokens", Methods: []string{"POST"}},
+			want:  Route{Pattern: "/v1/messages/count_tokens", Methods: []string{"POST"}, Body: RouteBodyBuffered, MaxBodyBytes: 100, Auth: RouteAuthKey},
+		},
+		{
+			route: Route{Pattern: "/v1/messagesx*"},
+			want:  Route{Pattern: "/v1/messagesx*", Methods: []string{"GET"}, Body: RouteBodyBuffered, MaxBodyBytes: 100, Auth: RouteAuthKey},
+		},
+		{route: Route{Pattern: "v1/models"}, wantErr: "must be a path"},
+		{route: Route{Pattern: "/v1/*/models"}, wantErr: "must be a path"},
+		{route: Route{Pattern: "/health"}, wantErr: "served by the proxy itself"},
+		{route: Route{Pattern: "/v1/messages"}, wantErr: "served by the proxy itself"},
+		// Paths under /v1/messages/ take Messages requests, so they must authenticate callers
+		{route: Route{Pattern: "/*", Auth: RouteAuthNone}, wantErr: "paths under /v1/messages/"},
+		{route: Route{Pattern: "/v1/*", Auth: RouteAuthNone}, wantErr: "paths under /v1/messages/"},
+		{route: Route{Pattern: "/v1/messages*", Auth: RouteAuthNone}, wantErr: "paths under /v1/messages/"},
+		{route: Route{Pattern: "/v1/messages/batches*", Auth: RouteAuthNone}, wantErr: "cannot use auth=none"},
+		{route: Route{Pattern: "/v1/messages/count_tokens", Auth: RouteAuthNone}, wantErr: "cannot use auth=none"},
+		{route: Route{Pattern: "/v1/models", Body: "chunked"}, wantErr: "body must be"},
+		{route: Route{Pattern: "/v1/models", Auth: "token"}, wantErr: "auth must be key or none"},
+	}
+	for _, tt := range tests {
+		route := tt.route
+		err := route.normalize(100)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("normalize(%s) error = %v, want %q", tt.route.Pattern, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalize(%s) error = %v", tt.route.Pattern, err)
+			continue
+		}
+		if !reflect.DeepEqual(route, tt.want) {
+			t.Errorf("normalize(%s) = %+v, want %+v", tt.route.Pattern, route, tt.want)
+		}
+	}
+}
+
+func TestRouteForwarding(t *testing.T) {
+	var gotURL, gotKey, gotBody string
+	p := newTestProxy(t, Config{
+		AllowedAPIKeys:  []string{"client-key"},
+		UpstreamAPIKey:  "upstream-key",
+		TokenSigningKey: testSigningKey,
+		Routes: []Route{
+			{Pattern: "/v1/models*"},
+			{Pattern: "/v1/organizations/*", Methods: []string{"GET", "POST"}, MaxBodyBytes: 16},
+			{Pattern: "/v1/messages/count_tokens", Methods: []string{"POST"}},
+		},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		gotURL, gotKey = r.URL.String(), r.Header.Get("x-api-key")
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, `{"data":[]}`)
+	})
+	token := mintToken(t, p, "client-key", `{"models":["claude-x"]}`)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		key    string
+		status int
+	}{
+		{name: "allowed", method: "GET", path: "/v1/models/claude-x?limit=2", key: "client-key", status: http.StatusAccepted},
+		{name: "no key", method: "GET", path: "/v1/models", status: http.StatusUnauthorized},
+		{name: "token", method: "GET", path: "/v1/models", key: token, status: http.StatusForbidden},
+		{name: "method not allowed", method: "DELETE", path: "/v1/models/claude-x", key: "client-key", status: http.StatusMethodNotAllowed},
+		{name: "not a route", method: "GET", path: "/v1/messages/batches", key: "client-key", status: http.StatusNotFound},
+		{name: "count tokens", method: "POST", path: "/v1/messages/count_tokens", body: `{"model":"claude-x","messages":[]}`, key: "client-key", status: http.StatusAccepted},
+		{name: "count tokens with a token", method: "POST", path: "/v1/messages/count_tokens", body: `{"model":"claude-x","messages":[]}`, key: token, status: http.StatusForbidden},
+		{name: "body", method: "POST", path: "/v1/organizations/invites", body: `{"a":1}`, key: "client-key", status: http.StatusAccepted},
+		{name: "body too large", method: "POST", path: "/v1/organizations/invites", body: `{"email":"someone@example.com"}`, key: "client-key", status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotURL, gotKey, gotBody = "", "", ""
+			w := serve(p, tt.method, tt.path, tt.body, map[string]string{"x-api-key": tt.key})
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusAccepted {
+				if gotURL != "" {
+					t.Errorf("refused request was forwarded to %s", gotURL)
+				}
+				decodeAPIError(t, w.Body.String())
+				return
+			}
+			if gotURL != tt.path || gotKey != "upstream-key" || gotBody != tt.body || w.Body.String() != `{"data":[]}` {
+				t.Errorf("forwarded %s with key %q and body %q, responded %s", gotURL, gotKey, gotBody, w.Body)
+			}
+		})
+	}
+}
+
+func TestPublicRoute(t *testing.T) {
+	var gotKey string
+	p := newTestProxy(t, Config{
+		AllowedAPIKeys: []string{"client-key"},
+		Routes:         []Route{{Pattern: "/v1/models", Auth: RouteAuthNone}},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.Header.Get("x-api-key")
+		io.WriteString(w, `{"data":[]}`)
+	})
+
+	// Without an upstream key, the caller's own key is what reaches the Claude API
+	for _, key := range []string{"", "caller-upstream-key"} {
+		if w := serve(p, "GET", "/v1/models", "", map[string]string{"x-api-key": key}); w.Code != http.StatusOK || gotKey != key {
+			t.Errorf("status %d with upstream key %q, want 200 with %q", w.Code, gotKey, key)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package prxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Service account token settings
+const (
+	serviceAccountScope    = "https://www.googleapis.com/auth/cloud-platform"
+	serviceAccountTokenURL = "https://oauth2.googleapis.com/token"
+	serviceAccountGrant    = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	serviceAccountJWTTTL   = time.Hour
+	// Access tokens are replaced this long before they expire
+	accessTokenRefreshMargin = 5 * time.Minute
+	maxTokenResponseBytes    = 64 << 10
+)
+
+// serviceAccountKey is the part of a Google service account key file that is used
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// serviceAccountTokens exchanges signed JWTs for OAuth access tokens, and caches each token
+// until shortly before it expires. Requests that need a token while it is refreshed wait for
+// the one refresh instead of making their own.
+type serviceAccountTokens struct {
+	email    string
+	keyID    string
+	key      *rsa.PrivateKey
+	tokenURL string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// loadServiceAccount reads a service account key file. tokenURL replaces the file's token URI
+// when set.
+func loadServiceAccount(path, tokenURL string) (*serviceAccountTokens, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var account serviceAccountKey
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if account.Type != "service_account" || account.ClientEmail == "" {
+		return nil, fmt.Errorf("%s is not a service account key file", path)
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: invalid private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("%s: private key must be an RSA key", path)
+	}
+
+	if tokenURL == "" {
+		tokenURL = account.TokenURI
+	}
+	if tokenURL == "" {
+		tokenURL = serviceAccountTokenURL
+	}
+	return &serviceAccountTokens{email: account.ClientEmail, keyID: account.PrivateKeyID, key: key, tokenURL: tokenURL}, nil
+}
+
+// accessToken returns a cached access token, or gets a new one if it is about to expire
+func (s *serviceAccountTokens) accessToken(ctx context.Context, client *http.Client) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Add(accessTokenRefreshMargin).Before(s.expiry) {
+		return s.token, nil
+	}
+
+	assertion, err := s.assertion(time.Now())
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": {serviceAccountGrant}, "assertion": {assertion}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token endpoint unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponseBytes))
+	if err != nil {
+		return "", err
+	}
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	json.Unmarshal(body, &token)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, strings.TrimSpace(token.Error+" "+token.ErrorDescription))
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("token endpoint returned no access token")
+	}
+	if token.ExpiresIn <= 0 {
+		token.ExpiresIn = int(serviceAccountJWTTTL.Seconds())
+	}
+	s.token = token.AccessToken
+	s.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// invalidate drops a cached token that the upstream rejected, so the next request gets a new one
+func (s *serviceAccountTokens) invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+// assertion signs the JWT that is exchanged for an access token
+func (s *serviceAccountTokens) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   s.email,
+		"scope": serviceAccountScope,
+		"aud":   s.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(serviceAccountJWTTTL).Unix(),
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", errors.New("failed to sign service account assertion")
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
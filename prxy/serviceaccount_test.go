@@ -0,0 +1,263 @@
+package prxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	testServiceAccountKeyOnce sync.Once
+	testServiceAccountKey     *rsa.PrivateKey
+)
+
+// writeServiceAccountKey writes a service account key file with a shared test key, encoded as
+// PKCS #8 or PKCS #1
+func writeServiceAccountKey(t *testing.T, tokenURI string, pkcs1 bool) (string, *rsa.PrivateKey) {
+	t.Helper()
+	testServiceAccountKeyOnce.Do(func() {
+		testServiceAccountKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testServiceAccountKey)}
+	if !pkcs1 {
+		der, _ := x509.MarshalPKCS8PrivateKey(testServiceAccountKey)
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	data, _ := json.Marshal(serviceAccountKey{
+		Type:         "service_account",
+		ClientEmail:  "prxy@project.iam.gserviceaccount.com",
+		PrivateKeyID: "key-1",
+		PrivateKey:   string(pem.EncodeToMemory(block)),
+		TokenURI:     tokenURI,
+	})
+	path := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, testServiceAccountKey
+}
+
+// verifyAssertion checks the signature of a service account JWT and returns its header and claims
+func verifyAssertion(key *rsa.PublicKey, assertion string) (map[string]interface{}, map[string]interface{}, error) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return nil, nil, fmt.Errorf("assertion has %d parts", len(parts))
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, nil, err
+	}
+	var header, claims map[string]interface{}
+	for i, v := range []*map[string]interface{}{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			return nil, nil, err
+		}
+	}
+	return header, claims, nil
+}
+
+// testTokenEndpoint is a stand-in for Google's OAuth token endpoint
+type testTokenEndpoint struct {
+	key       *rsa.PublicKey
+	expiresIn int
+	exchanges int32
+	release   chan struct{}
+	reject    bool
+}
+
+func (e *testTokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&e.exchanges, 1)
+	if e.release != nil {
+		<-e.release
+	}
+	w.Header().Set("Content-Type", "application/json")
+	r.ParseForm()
+	header, claims, err := verifyAssertion(e.key, r.PostForm.Get("assertion"))
+	if err != nil || r.PostForm.Get("grant_type") != serviceAccountGrant || e.reject {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"invalid_grant","error_description":"Invalid JWT Signature."}`)
+		return
+	}
+	if header["alg"] != "RS256" || header["kid"] != "key-1" || claims["iss"] != "prxy@project.iam.gserviceaccount.com" ||
+		claims["scope"] != serviceAccountScope || claims["aud"] != "http://"+r.Host+r.URL.Path ||
+		claims["exp"].(float64)-claims["iat"].(float64) != serviceAccountJWTTTL.Seconds() {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error":"invalid_grant","error_description":"unexpected JWT %v %v"}`, header, claims)
+		return
+	}
+	fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":%d,"token_type":"Bearer"}`, n, e.expiresIn)
+}
+
+func TestServiceAccountTokens(t *testing.T) {
+	endpoint := &testTokenEndpoint{expiresIn: 3600}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	for _, pkcs1 := range []bool{false, true} {
+		path, key := writeServiceAccountKey(t, server.URL+"/token", pkcs1)
+		endpoint.key = &key.PublicKey
+		tokens, err := loadServiceAccount(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt32(&endpoint.exchanges, 0)
+
+		// The token is cached until it is invalidated
+		for i := 0; i < 2; i++ {
+			if token, err := tokens.accessToken(context.Background(), server.Client()); err != nil || token != "token-1" {
+				t.Fatalf("accessToken() = %q, %v, want token-1", token, err)
+			}
+		}
+		tokens.invalidate("token-other")
+		if token, _ := tokens.accessToken(context.Background(), server.Client()); token != "token-1" {
+			t.Errorf("token after invalidating another = %q, want token-1", token)
+		}
+		tokens.invalidate("token-1")
+		if token, _ := tokens.accessToken(context.Background(), server.Client()); token != "token-2" {
+			t.Errorf("token after invalidating = %q, want token-2", token)
+		}
+	}
+
+	// Tokens about to expire are replaced
+	endpoint.expiresIn = int(accessTokenRefreshMargin.Seconds())
+	path, _ := writeServiceAccountKey(t, "https://oauth2.example.com/token", false)
+	tokens, err := loadServiceAccount(path, server.URL+"/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&endpoint.exchanges, 0)
+	for _, want := range []string{"token-1", "token-2"} {
+		if token, err := tokens.accessToken(context.Background(), server.Client()); err != nil || token != want {
+			t.Errorf("accessToken() = %q, %v, want %s", token, err, want)
+		}
+	}
+}
+
+func TestServiceAccountTokensRefreshOnce(t *testing.T) {
+	path, key := writeServiceAccountKey(t, "", false)
+	endpoint := &testTokenEndpoint{key: &key.PublicKey, expiresIn: 3600, release: make(chan struct{})}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+	tokens, err := loadServiceAccount(path, server.URL+"/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests that arrive during a refresh wait for it
+	var wg sync.WaitGroup
+	got := make([]string, 5)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got[i], _ = tokens.accessToken(context.Background(), server.Client())
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(endpoint.release)
+	wg.Wait()
+	for _, token := range got {
+		if token != "token-1" {
+			t.Errorf("tokens = %v, want one exchange", got)
+			break
+		}
+	}
+	if n := atomic.LoadInt32(&endpoint.exchanges); n != 1 {
+		t.Errorf("%d exchanges, want 1", n)
+	}
+}
+
+func TestServiceAccountTokenErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{
+			name: "rejected", status: http.StatusBadRequest, body: `{"error":"invalid_grant","error_description":"Invalid JWT Signature."}`,
+			wantErr: "token endpoint returned status 400: invalid_grant Invalid JWT Signature.",
+		},
+		{name: "no token", status: http.StatusOK, body: `{"token_type":"Bearer"}`, wantErr: "no access token"},
+		{name: "not JSON", status: http.StatusBadGateway, body: "<html>", wantErr: "status 502"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer server.Close()
+			path, _ := writeServiceAccountKey(t, server.URL+"/token", false)
+			tokens, err := loadServiceAccount(path, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tokens.accessToken(context.Background(), server.Client()); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("accessToken() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadServiceAccount(t *testing.T) {
+	path, _ := writeServiceAccountKey(t, "", false)
+	tokens, err := loadServiceAccount(path, "")
+	if err != nil || tokens.tokenURL != serviceAccountTokenURL || tokens.email != "prxy@project.iam.gserviceaccount.com" {
+		t.Errorf("loadServiceAccount() = %+v, %v", tokens, err)
+	}
+
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecdsaDER, _ := x509.MarshalPKCS8PrivateKey(ecdsaKey)
+	ecdsaPEM, _ := json.Marshal(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecdsaDER})))
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "not JSON", data: "key", wantErr: "invalid character"},
+		{name: "not a service account", data: `{"type":"authorized_user","client_email":"a@b"}`, wantErr: "not a service account key file"},
+		{name: "no email", data: `{"type":"service_account"}`, wantErr: "not a service account key file"},
+		{name: "no key", data: `{"type":"service_account","client_email":"a@b"}`, wantErr: "invalid private key"},
+		{name: "not RSA", data: `{"type":"service_account","client_email":"a@b","private_key":` + string(ecdsaPEM) + `}`, wantErr: "must be an RSA key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "key.json")
+			os.WriteFile(path, []byte(tt.data), 0o600)
+			if _, err := loadServiceAccount(path, ""); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadServiceAccount() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+	if _, err := loadServiceAccount(filepath.Join(t.TempDir(), "missing.json"), ""); err == nil {
+		t.Error("loadServiceAccount() of a missing file succeeded")
+	}
+}
@@ -0,0 +1,89 @@
+package prxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigV4Sign(t *testing.T) {
+	// Vectors from the AWS Signature Version 4 test suite
+	signer := &sigv4Signer{
+		accessKeyID:     "AKIDEXAMPLE",
+		secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		region:          "us-east-1",
+		service:         "service",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{
+			name: "get-vanilla",
+			url:  "https://example.amazonaws.com/",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, " +
+				"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name: "get-vanilla-query-order-key-case",
+			url:  "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, " +
+				"Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tt.url, nil)
+			signer.sign(req, nil, now)
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("Authorization =\n%s\nwant\n%s", got, tt.want)
+			}
+			if req.Header.Get("X-Amz-Date") != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %q", req.Header.Get("X-Amz-Date"))
+			}
+		})
+	}
+}
+
+func TestSigV4SignedHeaders(t *testing.T) {
+	signer := &sigv4Signer{accessKeyID: "id", secretAccessKey: "secret", sessionToken: "session", region: "us-west-2", service: "bedrock"}
+	req, _ := http.NewRequest("POST", "https://bedrock-runtime.us-west-2.amazonaws.com/model/a%3Ab/invoke", nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Amzn-Bedrock-GuardrailIdentifier", "g1")
+	signer.sign(req, []byte(`{}`), time.Now())
+
+	if req.Header.Get("X-Amz-Security-Token") != "session" {
+		t.Error("session token not sent")
+	}
+	// Accept is not signed, and neither are headers that are not x-amz-*
+	auth := req.Header.Get("Authorization")
+	if !strings.Contains(auth, "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("Authorization = %s", auth)
+	}
+
+	// A different body gives a different signature
+	other := req.Clone(req.Context())
+	signer.sign(other, []byte(`{"a":1}`), time.Now())
+	if other.Header.Get("Authorization") == auth && req.Header.Get("X-Amz-Date") == other.Header.Get("X-Amz-Date") {
+		t.Error("signature does not cover the body")
+	}
+}
+
+func TestSigV4Canonical(t *testing.T) {
+	if got := sigv4CanonicalURI("/model/anthropic.claude-x-v1%3A0/invoke"); got != "/model/anthropic.claude-x-v1%253A0/invoke" {
+		t.Errorf("canonical URI = %s, want each segment escaped again", got)
+	}
+	if got := sigv4CanonicalURI(""); got != "/" {
+		t.Errorf("canonical URI of an empty path = %q", got)
+	}
+	if got := sigv4CanonicalQuery("b=2&a&a=1"); got != "a=&a=1&b=2" {
+		t.Errorf("canonical query = %s", got)
+	}
+	if got := awsEscape("a-b_c.d~e f/g:h"); got != "a-b_c.d~e%20f%2Fg%3Ah" {
+		t.Errorf("awsEscape() = %s", got)
+	}
+}
@@ -0,0 +1,222 @@
+package prxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often certificate files are checked for changes
+const tlsReloadInterval = 10 * time.Second
+
+// tlsReloader serves the current certificate and client CA pool, reloading them when the files change
+type tlsReloader struct {
+	logger
+	certFile string
+	keyFile  string
+	caFile   string
+	// clientAuth is the client certificate policy used when a CA bundle is configured
+	clientAuth tls.ClientAuthType
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	checkedAt time.Time
+}
+
+// TLSConfigFromEnv builds a server TLS config from TLS_* environment variables. Certificates and
+// the client CA bundle are reloaded when their files change, and reloads are logged to log, or
+// with WriteLog if it is nil. It returns nil if TLS is not configured.
+func TLSConfigFromEnv(log func(LogEntry)) (*tls.Config, error) {
+	return TLSConfigFromLookup(os.Getenv, log)
+}
+
+// TLSConfigFromLookup is TLSConfigFromEnv with the TLS_* variables read with getenv
+func TLSConfigFromLookup(getenv func(string) string, log func(LogEntry)) (*tls.Config, error) {
+	reloader, err := tlsReloaderFromEnv(getenv, log)
+	if reloader == nil || err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     reloader.getCertificate,
+		GetConfigForClient: reloader.getConfigForClient,
+	}, nil
+}
+
+// tlsReloaderFromEnv loads the certificate files from TLS_* environment variables, or returns nil
+// if TLS is not configured
+func tlsReloaderFromEnv(getenv func(string) string, log func(LogEntry)) (*tlsReloader, error) {
+	certFile := getenv("TLS_CERT_FILE")
+	keyFile := getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	reloader := &tlsReloader{
+		logger:     logger{hook: log},
+		certFile:   certFile,
+		keyFile:    keyFile,
+		caFile:     getenv("TLS_CLIENT_CA_FILE"),
+		clientAuth: tls.VerifyClientCertIfGiven,
+		modTimes:   map[string]time.Time{},
+	}
+
+	switch mode := getenv("TLS_CLIENT_AUTH"); mode {
+	case "", "optional":
+	case "require":
+		reloader.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH must be optional or require, got %q", mode)
+	}
+	if reloader.caFile == "" && getenv("TLS_CLIENT_AUTH") != "" {
+		return nil, errors.New("TLS_CLIENT_AUTH requires TLS_CLIENT_CA_FILE")
+	}
+
+	// Load once up front so configuration errors stop startup
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// getCertificate returns the current certificate
+func (t *tlsReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cert, nil
+}
+
+// getConfigForClient returns a per-handshake config with the latest certificate and client CAs
+func (t *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.checkedAt) >= tlsReloadInterval {
+		t.checkedAt = time.Now()
+		if t.changed() {
+			// Keep serving the previous certificate if the new files are not usable yet
+			if err := t.loadLocked(); err != nil {
+				t.logError("Failed to reload TLS certificates: %v", err)
+			} else {
+				t.logSystem("Reloaded TLS certificates")
+			}
+		}
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*t.cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if t.clientCAs != nil {
+		config.ClientCAs = t.clientCAs
+		config.ClientAuth = t.clientAuth
+	}
+	return config, nil
+}
+
+// load reads the certificate, key and client CA files
+func (t *tlsReloader) load() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.checkedAt = time.Now()
+	return t.loadLocked()
+}
+
+// loadLocked reads the certificate, key and client CA files with the lock held
+func (t *tlsReloader) loadLocked() error {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if t.caFile != "" {
+		pem, err := os.ReadFile(t.caFile)
+		if err != nil {
+			return fmt.Errorf("reading client CA bundle: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("client CA bundle contains no certificates")
+		}
+	}
+
+	t.cert = &cert
+	t.clientCAs = pool
+	for _, file := range t.files() {
+		if info, err := os.Stat(file); err == nil {
+			t.modTimes[file] = info.ModTime()
+		}
+	}
+	return nil
+}
+
+// changed reports whether any of the files were modified since they were last loaded
+func (t *tlsReloader) changed() bool {
+	for _, file := range t.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(t.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// files returns the files watched for changes
+func (t *tlsReloader) files() []string {
+	files := []string{t.certFile, t.keyFile}
+	if t.caFile != "" {
+		files = append(files, t.caFile)
+	}
+	return files
+}
+
+// parseClientIdentities parses "common-name:identity" pairs from a comma-separated list
+func parseClientIdentities(spec string) (map[string]string, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	identities := map[string]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cn, identity, ok := strings.Cut(entry, ":")
+		if !ok || strings.TrimSpace(cn) == "" || strings.TrimSpace(identity) == "" {
+			return nil, fmt.Errorf("invalid TLS_CLIENT_IDENTITIES entry %q", entry)
+		}
+		identities[strings.TrimSpace(cn)] = strings.TrimSpace(identity)
+	}
+	return identities, nil
+}
+
+// clientCertIdentity returns the proxy identity for a verified client certificate, if any.
+// Identities maps common names to identities; nil means use the common name.
+func clientCertIdentity(r *http.Request, identities map[string]string) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if identities == nil {
+		return cn
+	}
+	return identities[cn]
+}
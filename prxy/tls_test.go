@@ -0,0 +1,255 @@
+package prxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and its key for the common name
+func writeTestCert(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestTLSConfigFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "proxy")
+	caFile, _ := writeTestCert(t, dir, "client-ca")
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		clientAuth tls.ClientAuthType
+		wantErr    string
+	}{
+		{name: "disabled"},
+		{name: "server only", env: map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile}},
+		{
+			name:       "optional client certs",
+			env:        map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_CLIENT_CA_FILE": caFile},
+			clientAuth: tls.VerifyClientCertIfGiven,
+		},
+		{
+			name:       "required client certs",
+			env:        map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_CLIENT_CA_FILE": caFile, "TLS_CLIENT_AUTH": "require"},
+			clientAuth: tls.RequireAndVerifyClientCert,
+		},
+		{name: "cert without key", env: map[string]string{"TLS_CERT_FILE": certFile}, wantErr: "must be set together"},
+		{name: "client auth without CA", env: map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_CLIENT_AUTH": "require"}, wantErr: "requires TLS_CLIENT_CA_FILE"},
+		{name: "bad client auth", env: map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_CLIENT_AUTH": "always"}, wantErr: "optional or require"},
+		{name: "missing cert", env: map[string]string{"TLS_CERT_FILE": filepath.Join(dir, "none.crt"), "TLS_KEY_FILE": keyFile}, wantErr: "loading certificate"},
+		{name: "empty CA bundle", env: map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_CLIENT_CA_FILE": keyFile}, wantErr: "no certificates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_CLIENT_CA_FILE", "TLS_CLIENT_AUTH"} {
+				t.Setenv(name, tt.env[name])
+			}
+			config, err := TLSConfigFromEnv(func(LogEntry) {})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.env == nil {
+				if config != nil {
+					t.Error("TLS config without certificate files")
+				}
+				return
+			}
+			handshake, err := config.GetConfigForClient(&tls.ClientHelloInfo{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(handshake.Certificates) != 1 || handshake.ClientAuth != tt.clientAuth {
+				t.Errorf("%d certificates and client auth %v, want 1 and %v", len(handshake.Certificates), handshake.ClientAuth, tt.clientAuth)
+			}
+		})
+	}
+}
+
+func TestTLSReloadFailureIsLogged(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "proxy")
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("TLS_CLIENT_CA_FILE", "")
+	t.Setenv("TLS_CLIENT_AUTH", "")
+
+	var entries []LogEntry
+	reloader, err := tlsReloaderFromEnv(os.Getenv, func(entry LogEntry) { entries = append(entries, entry) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := reloader.cert.Certificate[0]
+
+	// A half-written certificate is reported and the previous one is kept
+	os.WriteFile(certFile, []byte("not a certificate"), 0o600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	reloader.checkedAt = time.Time{}
+
+	handshake, err := reloader.getConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Level != LogError || !strings.Contains(entries[0].Message, "Failed to reload TLS certificates") {
+		t.Fatalf("log entries = %+v, want one reload error", entries)
+	}
+	if string(handshake.Certificates[0].Certificate[0]) != string(before) {
+		t.Error("the previous certificate was not kept")
+	}
+}
+
+func TestParseClientIdentities(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "billing-svc:billing, reports:reporting", want: map[string]string{"billing-svc": "billing", "reports": "reporting"}},
+		{spec: "billing-svc", wantErr: true},
+		{spec: ":billing", wantErr: true},
+		{spec: "billing-svc: ", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseClientIdentities(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseClientIdentities(%q) error = %v", tt.spec, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseClientIdentities(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+		for cn, identity := range tt.want {
+			if got[cn] != identity {
+				t.Errorf("parseClientIdentities(%q)[%s] = %q, want %q", tt.spec, cn, got[cn], identity)
+			}
+		}
+	}
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	verified := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	}
+	tests := []struct {
+		name       string
+		state      *tls.ConnectionState
+		identities map[string]string
+		want       string
+	}{
+		{name: "plain HTTP"},
+		{name: "no verified chain", state: &tls.ConnectionState{}},
+		{name: "common name", state: verified("billing-svc"), want: "billing-svc"},
+		{name: "mapped", state: verified("billing-svc"), identities: map[string]string{"billing-svc": "billing"}, want: "billing"},
+		{name: "not listed", state: verified("other"), identities: map[string]string{"billing-svc": "billing"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = tt.state
+		if got := clientCertIdentity(req, tt.identities); got != tt.want {
+			t.Errorf("%s: identity = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClientCertificateCallers(t *testing.T) {
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "billing-svc"}}}}}
+	request := `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name            string
+		cfg             Config
+		key             string
+		status          int
+		wantFingerprint string
+		wantUpstreamKey string
+	}{
+		{
+			name: "certificate alone", cfg: Config{AllowedAPIKeys: []string{"client-key"}, UpstreamAPIKey: "upstream-key"},
+			status: http.StatusOK, wantFingerprint: "mtls:billing-svc", wantUpstreamKey: "upstream-key",
+		},
+		{
+			name: "certificate with an allowed key", cfg: Config{AllowedAPIKeys: []string{"client-key"}, UpstreamAPIKey: "upstream-key"},
+			key: "client-key", status: http.StatusOK, wantFingerprint: "mtls:billing-svc", wantUpstreamKey: "upstream-key",
+		},
+		{
+			name: "certificate with a key that is not allowed", cfg: Config{AllowedAPIKeys: []string{"client-key"}, UpstreamAPIKey: "upstream-key"},
+			key: "other-key", status: http.StatusUnauthorized,
+		},
+		{
+			// The caller's own key is forwarded, under the certificate's identity
+			name: "certificate with a key and no upstream key", cfg: Config{},
+			key: "caller-key", status: http.StatusOK, wantFingerprint: "mtls:billing-svc", wantUpstreamKey: "caller-key",
+		},
+		{name: "certificate without any key to send", cfg: Config{}, status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotKey string
+			p := newTestProxy(t, tt.cfg, func(w http.ResponseWriter, r *http.Request) {
+				gotKey = r.Header.Get("x-api-key")
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{"type":"message","usage":{"input_tokens":1,"output_tokens":1}}`)
+			})
+			req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(request))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.key != "" {
+				req.Header.Set("x-api-key", tt.key)
+			}
+			req.TLS = verified
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get(headerKeyFingerprint); got != tt.wantFingerprint || gotKey != tt.wantUpstreamKey {
+				t.Errorf("caller %q with upstream key %q, want %q with %q", got, gotKey, tt.wantFingerprint, tt.wantUpstreamKey)
+			}
+		})
+	}
+}
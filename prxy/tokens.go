@@ -0,0 +1,236 @@
+package prxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Token lifetime limits and signing parameters
+const (
+	tokenIssuer           = "prxy"
+	defaultTokenTTL       = 15 * time.Minute
+	maxTokenTTL           = time.Hour
+	minTokenSigningKeyLen = 32
+)
+
+// tokenHeader is the fixed JOSE header for HS256 tokens
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// tokenClaims are the claims carried by a short-lived browser token
+type tokenClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	ID        string   `json:"jti"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	Models    []string `json:"models,omitempty"`
+	MaxTokens int      `json:"max_tokens,omitempty"`
+	Origin    string   `json:"origin,omitempty"`
+	// Owner is the file owner ID of the issuing key, so tokens share its files
+	Owner string `json:"own,omitempty"`
+	// KeyID identifies the issuing key, so tokens stop working when it is revoked and use its
+	// current headers and provider
+	KeyID string `json:"kid,omitempty"`
+}
+
+// tokenRequest is the body accepted by the token endpoint
+type tokenRequest struct {
+	Models    []string `json:"models"`
+	MaxTokens int      `json:"max_tokens"`
+	ExpiresIn int      `json:"expires_in"`
+	Origin    string   `json:"origin"`
+}
+
+// tokenResponse is returned by the token endpoint
+type tokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expires_at"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// isToken reports whether a credential looks like a signed token rather than an API key
+func isToken(credential string) bool {
+	return strings.HasPrefix(credential, "eyJ") && strings.Count(credential, ".") == 2
+}
+
+// signToken encodes and signs the claims as an HS256 JWT
+func signToken(claims tokenClaims, key []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// validateToken checks the token's signature, expiry and origin binding and returns its claims
+func validateToken(token, origin string, key []byte) (*tokenClaims, error) {
+	if key == nil {
+		return nil, errors.New("tokens are not enabled")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return nil, errors.New("malformed token")
+	}
+
+	// Check the signature before looking at any claims
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+
+	if claims.Issuer != tokenIssuer {
+		return nil, errors.New("invalid token issuer")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+	if claims.Origin != "" && claims.Origin != origin {
+		return nil, fmt.Errorf("token not valid for origin %q", origin)
+	}
+
+	return &claims, nil
+}
+
+// checkScope verifies that a Messages request stays within the token's model and max_tokens limits
+func (c *tokenClaims) checkScope(requestData map[string]interface{}) error {
+	if len(c.Models) > 0 {
+		model, _ := requestData["model"].(string)
+		allowed := false
+		for _, m := range c.Models {
+			if m == model {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("model %q is not allowed by this token", model)
+		}
+	}
+
+	if c.MaxTokens > 0 {
+		maxTokens, ok := requestData["max_tokens"].(float64)
+		if !ok || maxTokens > float64(c.MaxTokens) {
+			return fmt.Errorf("max_tokens must be at most %d for this token", c.MaxTokens)
+		}
+	}
+
+	return nil
+}
+
+// tokenHandler mints short-lived tokens for a trusted backend authenticated with its API key
+func (p *Proxy) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Context().Value(requestIDKey).(string)
+	p.logRequest(requestID, "Processing token request")
+
+	key := p.tokenKey
+	if key == nil {
+		p.logRequest(requestID, "Token endpoint is not enabled")
+		writeAPIError(w, http.StatusNotFound, errorTypeNotFound, "Token endpoint is not enabled")
+		return
+	}
+
+	// Only API keys may mint tokens, never other tokens
+	apiKey := extractAPIKey(r)
+	keyFingerprint := FingerprintAPIKey(apiKey)
+	hash, err := p.validateAPIKey(apiKey, r.Header.Get("Origin"))
+	if isToken(apiKey) || err != nil {
+		p.logRequest(requestID, "Unauthorized: Invalid API key %s", keyFingerprint)
+		writeAPIError(w, http.StatusUnauthorized, errorTypeAuthentication, "Invalid API key")
+		return
+	}
+
+	var req tokenRequest
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, p.maxBodyBytes)).Decode(&req)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		p.writeBodyTooLarge(w, requestID, maxBytesErr.Limit, false)
+		return
+	}
+	if err != nil {
+		p.write(LogError, requestID, "Invalid JSON in token request: %v", err)
+		writeAPIError(w, http.StatusBadRequest, errorTypeInvalidRequest, "Invalid JSON request body")
+		return
+	}
+
+	// expires_in is checked in seconds, since a large value would overflow the duration
+	if req.ExpiresIn > int(maxTokenTTL.Seconds()) || req.ExpiresIn < 0 || req.MaxTokens < 0 {
+		writeAPIError(w, http.StatusBadRequest, errorTypeInvalidRequest,
+			fmt.Sprintf("expires_in must be between 1 and %d seconds and max_tokens must not be negative", int(maxTokenTTL.Seconds())))
+		return
+	}
+	ttl := defaultTokenTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+
+	// Tokens from an origin-bound key are bound to one of its origins
+	if hash != nil && len(hash.origins) > 0 && (req.Origin == "" || !hash.allowsOrigin(req.Origin)) {
+		p.logRequest(requestID, "Token origin %q is not allowed for key %s", req.Origin, keyFingerprint)
+		writeAPIError(w, http.StatusBadRequest, errorTypeInvalidRequest, "origin must be one of the origins the API key is bound to")
+		return
+	}
+
+	jti, err := randomBytes(16)
+	if err != nil {
+		p.write(LogError, requestID, "Failed to generate token ID: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, errorTypeAPI, "Failed to create token")
+		return
+	}
+
+	now := time.Now()
+	claims := tokenClaims{
+		Issuer:    tokenIssuer,
+		Subject:   keyFingerprint,
+		ID:        hex.EncodeToString(jti),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		Models:    req.Models,
+		MaxTokens: req.MaxTokens,
+		Origin:    req.Origin,
+		Owner:     keyOwner(apiKey),
+	}
+	if hash != nil {
+		claims.KeyID = hash.id
+	}
+	token, err := signToken(claims, key)
+	if err != nil {
+		p.write(LogError, requestID, "Failed to sign token: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, errorTypeAPI, "Failed to create token")
+		return
+	}
+
+	p.logRequest(requestID, "Issued token %s for key %s (expires in %v)", claims.ID[:8], keyFingerprint, ttl)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokenResponse{
+		Token:     token,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339),
+		ExpiresIn: int(ttl.Seconds()),
+	})
+}
@@ -0,0 +1,222 @@
+package prxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSigningKey = "0123456789abcdef0123456789abcdef"
+
+func TestValidateToken(t *testing.T) {
+	key := []byte(testSigningKey)
+	now := time.Now()
+	valid := tokenClaims{Issuer: tokenIssuer, ID: "0123456789abcdef", ExpiresAt: now.Add(time.Minute).Unix()}
+	sign := func(claims tokenClaims, key []byte) string {
+		token, err := signToken(claims, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	withOrigin := valid
+	withOrigin.Origin = "https://app.example"
+	expired := valid
+	expired.ExpiresAt = now.Add(-time.Second).Unix()
+	otherIssuer := valid
+	otherIssuer.Issuer = "someone-else"
+
+	token := sign(valid, key)
+	parts := strings.Split(token, ".")
+	tampered := valid
+	tampered.MaxTokens = 100000
+	tamperedPayload, _ := json.Marshal(tampered)
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+
+	tests := []struct {
+		name    string
+		token   string
+		origin  string
+		key     []byte
+		wantErr string
+	}{
+		{name: "valid", token: token, key: key},
+		{name: "origin matches", token: sign(withOrigin, key), origin: "https://app.example", key: key},
+		{name: "origin differs", token: sign(withOrigin, key), origin: "https://evil.example", key: key, wantErr: "not valid for origin"},
+		{name: "no origin", token: sign(withOrigin, key), key: key, wantErr: "not valid for origin"},
+		{name: "expired", token: sign(expired, key), key: key, wantErr: "expired"},
+		{name: "wrong issuer", token: sign(otherIssuer, key), key: key, wantErr: "issuer"},
+		{name: "other signing key", token: sign(valid, []byte(strings.Repeat("x", 32))), key: key, wantErr: "invalid token signature"},
+		{name: "tampered payload", token: parts[0] + "." + base64.RawURLEncoding.EncodeToString(tamperedPayload) + "." + parts[2], key: key, wantErr: "invalid token signature"},
+		{name: "alg none", token: noneHeader + "." + parts[1] + ".", key: key, wantErr: "malformed token"},
+		{name: "bad signature encoding", token: parts[0] + "." + parts[1] + ".!!", key: key, wantErr: "malformed token signature"},
+		{name: "two parts", token: parts[0] + "." + parts[1], key: key, wantErr: "malformed token"},
+		{name: "tokens disabled", token: token, wantErr: "not enabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := validateToken(tt.token, tt.origin, tt.key)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.ID != valid.ID {
+				t.Errorf("claims ID = %q, want %q", claims.ID, valid.ID)
+			}
+		})
+	}
+}
+
+func TestCheckScope(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  tokenClaims
+		request string
+		wantErr string
+	}{
+		{name: "unscoped", request: `{"model":"any","max_tokens":100000}`},
+		{name: "allowed model", claims: tokenClaims{Models: []string{"a", "b"}}, request: `{"model":"b"}`},
+		{name: "other model", claims: tokenClaims{Models: []string{"a"}}, request: `{"model":"b"}`, wantErr: `model "b" is not allowed`},
+		{name: "missing model", claims: tokenClaims{Models: []string{"a"}}, request: `{}`, wantErr: "is not allowed"},
+		{name: "max tokens within limit", claims: tokenClaims{MaxTokens: 100}, request: `{"max_tokens":100}`},
+		{name: "max tokens over limit", claims: tokenClaims{MaxTokens: 100}, request: `{"max_tokens":101}`, wantErr: "at most 100"},
+		{name: "max tokens missing", claims: tokenClaims{MaxTokens: 100}, request: `{}`, wantErr: "at most 100"},
+		{name: "max tokens not a number", claims: tokenClaims{MaxTokens: 100}, request: `{"max_tokens":"50"}`, wantErr: "at most 100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var request map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.request), &request); err != nil {
+				t.Fatal(err)
+			}
+			err := tt.claims.checkScope(request)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("checkScope() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// mintToken asks the proxy's token endpoint for a token with the given API key
+func mintToken(t *testing.T, p *Proxy, apiKey, body string) string {
+	t.Helper()
+	w := serve(p, "POST", "/v1/tokens", body, map[string]string{"x-api-key": apiKey})
+	if w.Code != http.StatusOK {
+		t.Fatalf("token status = %d: %s", w.Code, w.Body)
+	}
+	var resp tokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Token
+}
+
+func TestTokensUseIssuingKeyHeaders(t *testing.T) {
+	var gotTeam string
+	p := newTestProxy(t, Config{
+		AllowedAPIKeys:  []string{"backend-key;headers=X-Team:web"},
+		UpstreamAPIKey:  "upstream-key",
+		TokenSigningKey: testSigningKey,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		gotTeam = r.Header.Get("X-Team")
+		w.Write([]byte(`{"type":"message"}`))
+	})
+
+	token := mintToken(t, p, "backend-key", `{"models":["claude-x"]}`)
+	w := serve(p, "POST", "/v1/messages", `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`,
+		map[string]string{"Authorization": "Bearer " + token})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if gotTeam != "web" {
+		t.Errorf("X-Team = %q, want the issuing key's static header", gotTeam)
+	}
+
+	// Tokens cannot mint other tokens
+	if w := serve(p, "POST", "/v1/tokens", `{}`, map[string]string{"Authorization": "Bearer " + token}); w.Code != http.StatusUnauthorized {
+		t.Errorf("minting with a token: status = %d, want 401", w.Code)
+	}
+}
+
+func TestTokensStopWorkingWhenKeyIsRevoked(t *testing.T) {
+	keyFile := KeyFile{Path: filepath.Join(t.TempDir(), "keys.json")}
+	apiKey, record, err := keyFile.Create("backend", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, Config{KeyStoreFile: keyFile.Path, UpstreamAPIKey: "upstream-key", TokenSigningKey: testSigningKey},
+		func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"type":"message"}`)) })
+
+	token := mintToken(t, p, apiKey, `{}`)
+	request := `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`
+	header := map[string]string{"Authorization": "Bearer " + token}
+	if w := serve(p, "POST", "/v1/messages", request, header); w.Code != http.StatusOK {
+		t.Fatalf("before revoking: status = %d: %s", w.Code, w.Body)
+	}
+
+	if _, err := keyFile.Revoke(record.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Make the watcher see the change without waiting for its reload interval
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(keyFile.Path, future, future)
+	p.keyFile.mu.Lock()
+	p.keyFile.checkedAt = time.Time{}
+	p.keyFile.mu.Unlock()
+
+	if w := serve(p, "POST", "/v1/messages", request, header); w.Code != http.StatusUnauthorized {
+		t.Errorf("after revoking: status = %d, want 401", w.Code)
+	}
+}
+
+func TestTokenRequestLimits(t *testing.T) {
+	p := newTestProxy(t, Config{
+		AllowedAPIKeys:  []string{"backend-key", "web-key;origins=https://app.example|https://admin.example"},
+		UpstreamAPIKey:  "upstream-key",
+		TokenSigningKey: testSigningKey,
+	}, nil)
+	tests := []struct {
+		name   string
+		key    string
+		origin string
+		body   string
+		status int
+	}{
+		{name: "defaults", key: "backend-key", body: `{}`, status: http.StatusOK},
+		{name: "longest lifetime", key: "backend-key", body: `{"expires_in":3600}`, status: http.StatusOK},
+		{name: "too long", key: "backend-key", body: `{"expires_in":3601}`, status: http.StatusBadRequest},
+		// Would overflow to a negative duration
+		{name: "overflowing lifetime", key: "backend-key", body: `{"expires_in":10000000000}`, status: http.StatusBadRequest},
+		{name: "negative lifetime", key: "backend-key", body: `{"expires_in":-1}`, status: http.StatusBadRequest},
+		{name: "negative max_tokens", key: "backend-key", body: `{"max_tokens":-1}`, status: http.StatusBadRequest},
+		{name: "any origin for an unbound key", key: "backend-key", body: `{"origin":"https://other.example"}`, status: http.StatusOK},
+		{name: "bound origin", key: "web-key", origin: "https://app.example", body: `{"origin":"https://admin.example"}`, status: http.StatusOK},
+		{name: "other origin", key: "web-key", origin: "https://app.example", body: `{"origin":"https://evil.example"}`, status: http.StatusBadRequest},
+		{name: "no origin", key: "web-key", origin: "https://app.example", body: `{}`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := map[string]string{"x-api-key": tt.key}
+			if tt.origin != "" {
+				header["Origin"] = tt.origin
+			}
+			w := serve(p, "POST", "/v1/tokens", tt.body, header)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				decodeAPIError(t, w.Body.String())
+			}
+		})
+	}
+}
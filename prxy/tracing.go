@@ -0,0 +1,374 @@
+package prxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span export batching parameters
+const (
+	spanBatchSize     = 256
+	spanQueueSize     = 2048
+	spanFlushInterval = 5 * time.Second
+	spanExportTimeout = 10 * time.Second
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+// Key for the current span in context
+const spanKey contextKey = "span"
+
+// span is a single timed operation in a trace
+type span struct {
+	name     string
+	kind     int
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	start    time.Time
+	// exporter exports the span when it finishes, or is nil when span export is disabled
+	exporter *spanExporter
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	status     int
+	statusMsg  string
+}
+
+// startSpan starts a span as a child of the span in the context, or as a new trace root
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	s := &span{
+		name:       name,
+		kind:       kind,
+		sampled:    true,
+		start:      time.Now(),
+		attributes: map[string]interface{}{},
+	}
+	if parent, ok := ctx.Value(spanKey).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+		s.exporter = parent.exporter
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// startServerSpan starts the span for an incoming request, continuing the caller's W3C traceparent if present.
+// The span and its children are sent to the exporter, if any.
+func startServerSpan(r *http.Request, name string, exporter *spanExporter) (context.Context, *span) {
+	ctx := r.Context()
+	if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		ctx = context.WithValue(ctx, spanKey, parent)
+	}
+	ctx, s := startSpan(ctx, name, spanKindServer)
+	s.exporter = exporter
+	return ctx, s
+}
+
+// spanFromContext returns the current span, if any
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey).(*span)
+	return s
+}
+
+// setAttribute records a string, bool or integer attribute on the span
+func (s *span) setAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// setError marks the span as failed
+func (s *span) setError(format string, v ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = spanStatusError
+	s.statusMsg = fmt.Sprintf(format, v...)
+}
+
+// finish ends the span and queues it for export
+func (s *span) finish() {
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.exporter != nil && s.sampled {
+		s.exporter.enqueue(s)
+	}
+}
+
+// traceIDString returns the hex trace ID
+func (s *span) traceIDString() string {
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// traceparent returns the W3C traceparent header value for this span
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// parseTraceparent parses a W3C traceparent header into a remote parent span
+func parseTraceparent(header string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+	// Version 00 has exactly four fields
+	if parts[0] == "00" && len(parts) != 4 {
+		return nil, false
+	}
+
+	parent := &span{}
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil || parent.traceID == [16]byte{} {
+		return nil, false
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil || parent.spanID == [8]byte{} {
+		return nil, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return nil, false
+	}
+	parent.sampled = flags[0]&0x01 == 1
+	return parent, true
+}
+
+// spanExporter batches finished spans and sends them to an OTLP/HTTP collector as JSON
+type spanExporter struct {
+	logger
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	version     string
+	client      *http.Client
+	queue       chan *span
+	done        chan struct{}
+}
+
+// newSpanExporter configures span export to the configured OTLP traces endpoint
+func newSpanExporter(cfg Config, log logger) *spanExporter {
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	return &spanExporter{
+		logger:      log,
+		endpoint:    cfg.TracesEndpoint,
+		headers:     cfg.TracesHeaders,
+		serviceName: serviceName,
+		version:     cfg.Version,
+		client:      &http.Client{Timeout: spanExportTimeout},
+		queue:       make(chan *span, spanQueueSize),
+		done:        make(chan struct{}),
+	}
+}
+
+// enqueue queues a finished span, dropping it if the queue is full
+func (e *spanExporter) enqueue(s *span) {
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+// run exports spans in batches until the context is canceled, then flushes what is left
+func (e *spanExporter) run(ctx context.Context) {
+	defer close(e.done)
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= spanBatchSize {
+				e.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.export(batch)
+				batch = nil
+			}
+		case <-ctx.Done():
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					if len(batch) > 0 {
+						e.export(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// wait blocks until the exporter has flushed its final batch or the context expires
+func (e *spanExporter) wait(ctx context.Context) {
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+	}
+}
+
+// export sends a batch of spans to the collector
+func (e *spanExporter) export(batch []*span) {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{
+					"service.name":    e.serviceName,
+					"service.version": e.version,
+				}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "prxy", "version": e.version},
+				"spans": spans,
+			}},
+		}},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		e.logError("Failed to encode spans: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		e.logError("Failed to create span export request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.logWarning("Failed to export %d spans: %v", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		e.logWarning("Span collector rejected %d spans with status %d", len(batch), resp.StatusCode)
+	}
+}
+
+// otlp encodes the span in the OTLP JSON format
+func (s *span) otlp() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	encoded := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+	}
+	if s.parentID != [8]byte{} {
+		encoded["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.status != 0 {
+		encoded["status"] = map[string]interface{}{"code": s.status, "message": s.statusMsg}
+	}
+	return encoded
+}
+
+// otlpAttributes encodes attributes as OTLP key/value pairs
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	encoded := make([]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": key, "value": v})
+	}
+	return encoded
+}
+
+// statusRecorder captures the response status and size for the request span and metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush passes flushes through so streaming keeps working
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, for deadlines and hijacking
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
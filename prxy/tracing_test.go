@@ -0,0 +1,252 @@
+package prxy
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{name: "sampled", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: true, sampled: true},
+		{name: "not sampled", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", ok: true},
+		{name: "surrounding space", header: " 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 ", ok: true, sampled: true},
+		{name: "future version with extra fields", header: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", ok: true, sampled: true},
+		{name: "empty"},
+		{name: "version ff", header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "version 00 with extra fields", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{name: "zero trace ID", header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "zero span ID", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "short trace ID", header: "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01"},
+		{name: "short span ID", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01"},
+		{name: "non-hex trace ID", header: "00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01"},
+		{name: "non-hex flags", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, ok := parseTraceparent(tt.header)
+			if ok != tt.ok {
+				t.Fatalf("parseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if parent.traceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" || parent.sampled != tt.sampled {
+				t.Errorf("parent = trace %s, sampled %v", parent.traceIDString(), parent.sampled)
+			}
+		})
+	}
+}
+
+func TestServerSpanContinuesTrace(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/messages", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx, server := startServerSpan(req, "POST /v1/messages", nil)
+	_, client := startSpan(ctx, "upstream", spanKindClient)
+
+	if server.traceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" || client.traceIDString() != server.traceIDString() {
+		t.Errorf("trace IDs = %s and %s, want the caller's", server.traceIDString(), client.traceIDString())
+	}
+	if server.parentID != [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7} || client.parentID != server.spanID {
+		t.Error("spans are not linked to their parents")
+	}
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + hex.EncodeToString(client.spanID[:]) + "-01"; client.traceparent() != want {
+		t.Errorf("traceparent = %s, want %s", client.traceparent(), want)
+	}
+
+	// Without a traceparent a new trace is started
+	_, root := startServerSpan(httptest.NewRequest("GET", "/", nil), "GET /", nil)
+	if root.traceID == server.traceID || root.parentID != [8]byte{} {
+		t.Error("a request without traceparent did not start a new trace")
+	}
+}
+
+func TestSpanExport(t *testing.T) {
+	received := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer collector" {
+			t.Errorf("export headers = %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+	}))
+	defer collector.Close()
+
+	exporter := newSpanExporter(Config{
+		TracesEndpoint: collector.URL,
+		TracesHeaders:  map[string]string{"Authorization": "Bearer collector"},
+		Version:        "1.2.3",
+	}, logger{hook: func(LogEntry) {}})
+
+	ctx, server := startServerSpan(httptest.NewRequest("POST", "/v1/messages", nil), "POST /v1/messages", exporter)
+	_, client := startSpan(ctx, "upstream", spanKindClient)
+	client.setAttribute("http.response.status_code", 502)
+	client.setAttribute("prxy.streaming", true)
+	client.setAttribute("prxy.bytes", int64(42))
+	client.setAttribute("url.path", "/v1/messages")
+	client.setError("HTTP %d", 502)
+	client.finish()
+	server.finish()
+	server.finish()
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	go exporter.run(runCtx)
+	cancel()
+	exporter.wait(context.Background())
+
+	var payload struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpKeyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Scope struct {
+					Name    string `json:"name"`
+					Version string `json:"version"`
+				} `json:"scope"`
+				Spans []struct {
+					TraceID           string         `json:"traceId"`
+					SpanID            string         `json:"spanId"`
+					ParentSpanID      string         `json:"parentSpanId"`
+					Name              string         `json:"name"`
+					Kind              int            `json:"kind"`
+					StartTimeUnixNano string         `json:"startTimeUnixNano"`
+					EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+					Attributes        []otlpKeyValue `json:"attributes"`
+					Status            *struct {
+						Code    int    `json:"code"`
+						Message string `json:"message"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	select {
+	case body := <-received:
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatalf("export body is not OTLP JSON: %v: %s", err, body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no spans were exported")
+	}
+
+	if len(payload.ResourceSpans) != 1 || len(payload.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("payload = %+v, want one resource and scope", payload)
+	}
+	resource := attributeMap(payload.ResourceSpans[0].Resource.Attributes)
+	if resource["service.name"] != `{"stringValue":"prxy"}` || resource["service.version"] != `{"stringValue":"1.2.3"}` {
+		t.Errorf("resource attributes = %v", resource)
+	}
+	scope := payload.ResourceSpans[0].ScopeSpans[0]
+	if scope.Scope.Name != "prxy" || scope.Scope.Version != "1.2.3" {
+		t.Errorf("scope = %+v", scope.Scope)
+	}
+
+	// Spans are exported in the order they finish, and only once
+	spans := scope.Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	upstream, request := spans[0], spans[1]
+	if upstream.TraceID != server.traceIDString() || request.TraceID != upstream.TraceID || upstream.ParentSpanID != request.SpanID || request.ParentSpanID != "" {
+		t.Errorf("span IDs: request %s/%s, upstream %s/%s parent %s", request.TraceID, request.SpanID, upstream.TraceID, upstream.SpanID, upstream.ParentSpanID)
+	}
+	if len(upstream.TraceID) != 32 || len(upstream.SpanID) != 16 {
+		t.Errorf("IDs are not hex: %s %s", upstream.TraceID, upstream.SpanID)
+	}
+	if request.Name != "POST /v1/messages" || request.Kind != spanKindServer || upstream.Kind != spanKindClient {
+		t.Errorf("names and kinds = %s/%d and %s/%d", request.Name, request.Kind, upstream.Name, upstream.Kind)
+	}
+	start, err := strconv.ParseInt(upstream.StartTimeUnixNano, 10, 64)
+	if err != nil {
+		t.Fatalf("start time %q is not a decimal string", upstream.StartTimeUnixNano)
+	}
+	end, err := strconv.ParseInt(upstream.EndTimeUnixNano, 10, 64)
+	if err != nil || end < start || start < time.Now().Add(-time.Minute).UnixNano() {
+		t.Errorf("times = %s to %s", upstream.StartTimeUnixNano, upstream.EndTimeUnixNano)
+	}
+	if request.Status != nil {
+		t.Errorf("request status = %+v, want unset", request.Status)
+	}
+	if upstream.Status == nil || upstream.Status.Code != spanStatusError || upstream.Status.Message != "HTTP 502" {
+		t.Errorf("upstream status = %+v", upstream.Status)
+	}
+
+	// Integers are strings, as the OTLP JSON encoding requires for 64-bit values
+	attributes := attributeMap(upstream.Attributes)
+	want := map[string]string{
+		"http.response.status_code": `{"intValue":"502"}`,
+		"prxy.streaming":            `{"boolValue":true}`,
+		"prxy.bytes":                `{"intValue":"42"}`,
+		"url.path":                  `{"stringValue":"/v1/messages"}`,
+	}
+	for key, value := range want {
+		if attributes[key] != value {
+			t.Errorf("attribute %s = %s, want %s", key, attributes[key], value)
+		}
+	}
+}
+
+func TestSpanExportNotSampled(t *testing.T) {
+	exporter := newSpanExporter(Config{TracesEndpoint: "http://127.0.0.1:0"}, logger{hook: func(LogEntry) {}})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	ctx, server := startServerSpan(req, "GET /", exporter)
+	_, child := startSpan(ctx, "child", spanKindInternal)
+	child.finish()
+	server.finish()
+	if len(exporter.queue) != 0 {
+		t.Errorf("%d unsampled spans were queued", len(exporter.queue))
+	}
+}
+
+// otlpKeyValue is an OTLP attribute with its value kept as raw JSON
+type otlpKeyValue struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+func attributeMap(attributes []otlpKeyValue) map[string]string {
+	m := map[string]string{}
+	for _, attribute := range attributes {
+		m[attribute.Key] = string(attribute.Value)
+	}
+	return m
+}
+
+func TestStatusRecorderUnwrap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		controller := http.NewResponseController(recorder)
+		if err := controller.SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+			t.Errorf("SetWriteDeadline through the recorder: %v", err)
+		}
+		recorder.WriteHeader(http.StatusAccepted)
+		recorder.Write([]byte("ok"))
+		if err := controller.Flush(); err != nil {
+			t.Errorf("Flush through the recorder: %v", err)
+		}
+		if recorder.status != http.StatusAccepted || recorder.bytes != 2 {
+			t.Errorf("recorded status %d and %d bytes", recorder.status, recorder.bytes)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
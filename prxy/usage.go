@@ -0,0 +1,173 @@
+package prxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// UsageRecord is a single proxied Messages request in a usage file
+type UsageRecord struct {
+	Time                     time.Time `json:"time"`
+	RequestID                string    `json:"request_id"`
+	Caller                   string    `json:"caller"`
+	KeyID                    string    `json:"key_id,omitempty"`
+	Model                    string    `json:"model"`
+	Stream                   bool      `json:"stream,omitempty"`
+	Status                   int       `json:"status"`
+	InputTokens              int       `json:"input_tokens"`
+	OutputTokens             int       `json:"output_tokens"`
+	CacheCreationInputTokens int       `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int       `json:"cache_read_input_tokens,omitempty"`
+}
+
+// ReadUsage reads the records in a usage file. A missing file has no records.
+func ReadUsage(path string) ([]UsageRecord, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []UsageRecord
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// usageLog appends a usage record for every proxied request to a JSON lines file
+type usageLog struct {
+	logger
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// record appends a record for the request, opening the file on first use
+func (u *usageLog) record(m RequestMetrics) {
+	line, err := json.Marshal(UsageRecord{
+		Time:                     time.Now().UTC(),
+		RequestID:                m.RequestID,
+		Caller:                   m.Caller,
+		KeyID:                    m.KeyID,
+		Model:                    m.Model,
+		Stream:                   m.Stream,
+		Status:                   m.UpstreamStatus,
+		InputTokens:              m.InputTokens,
+		OutputTokens:             m.OutputTokens,
+		CacheCreationInputTokens: m.CacheCreationInputTokens,
+		CacheReadInputTokens:     m.CacheReadInputTokens,
+	})
+	if err != nil {
+		u.logError("Failed to encode usage record: %v", err)
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.file == nil {
+		u.file, err = os.OpenFile(u.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			u.logError("Failed to open usage file %s: %v", u.path, err)
+			return
+		}
+	}
+	if _, err := u.file.Write(append(line, '\n')); err != nil {
+		u.logError("Failed to write usage record: %v", err)
+	}
+}
+
+// close closes the usage file if it was opened
+func (u *usageLog) close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.file != nil {
+		u.file.Close()
+		u.file = nil
+	}
+}
+
+// messageUsage is the token usage reported by Messages responses and stream events
+type messageUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// merge keeps the larger of each count, since stream events report running totals
+func (u *messageUsage) merge(other messageUsage) {
+	u.InputTokens = larger(u.InputTokens, other.InputTokens)
+	u.OutputTokens = larger(u.OutputTokens, other.OutputTokens)
+	u.CacheCreationInputTokens = larger(u.CacheCreationInputTokens, other.CacheCreationInputTokens)
+	u.CacheReadInputTokens = larger(u.CacheReadInputTokens, other.CacheReadInputTokens)
+}
+
+// larger returns the larger of two counts
+func larger(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// setMetrics copies the token counts to the request metrics
+func (u messageUsage) setMetrics(m *RequestMetrics) {
+	m.InputTokens = u.InputTokens
+	m.OutputTokens = u.OutputTokens
+	m.CacheCreationInputTokens = u.CacheCreationInputTokens
+	m.CacheReadInputTokens = u.CacheReadInputTokens
+}
+
+// streamUsage collects token usage from the events of a streamed Messages response as it is forwarded
+type streamUsage struct {
+	pending []byte
+	usage   messageUsage
+}
+
+// write scans streamed bytes for complete event lines carrying usage
+func (s *streamUsage) write(b []byte) {
+	s.pending = append(s.pending, b...)
+	for {
+		i := bytes.IndexByte(s.pending, '\n')
+		if i < 0 {
+			return
+		}
+		line := s.pending[:i]
+		s.pending = s.pending[i+1:]
+
+		// message_start carries the input usage and message_delta the output usage
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		if !ok || !bytes.Contains(data, []byte(`"usage"`)) {
+			continue
+		}
+		var event struct {
+			Message struct {
+				Usage messageUsage `json:"usage"`
+			} `json:"message"`
+			Usage messageUsage `json:"usage"`
+		}
+		if json.Unmarshal(data, &event) == nil {
+			s.usage.merge(event.Message.Usage)
+			s.usage.merge(event.Usage)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package prxy
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamUsage(t *testing.T) {
+	stream := "event: message_start\n" +
+		`data: {"type":"message_start","message":{"usage":{"input_tokens":12,"cache_read_input_tokens":4,"output_tokens":1}}}` + "\n\n" +
+		"event: content_block_delta\n" +
+		`data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"the \"usage\" of words"}}` + "\n\n" +
+		"event: message_delta\n" +
+		`data: {"type":"message_delta","usage":{"output_tokens":30}}` + "\n\n"
+
+	// Events split across writes at every possible point are still counted
+	for split := 0; split <= len(stream); split++ {
+		var usage streamUsage
+		usage.write([]byte(stream[:split]))
+		usage.write([]byte(stream[split:]))
+		want := messageUsage{InputTokens: 12, OutputTokens: 30, CacheReadInputTokens: 4}
+		if usage.usage != want {
+			t.Fatalf("split at %d: usage = %+v, want %+v", split, usage.usage, want)
+		}
+	}
+}
+
+func TestReadUsage(t *testing.T) {
+	dir := t.TempDir()
+	if records, err := ReadUsage(filepath.Join(dir, "missing.jsonl")); err != nil || records != nil {
+		t.Errorf("ReadUsage() of a missing file = %v, %v", records, err)
+	}
+
+	path := filepath.Join(dir, "usage.jsonl")
+	os.WriteFile(path, []byte(`{"caller":"a","key_id":"key_1","model":"m","input_tokens":1}`+"\n\n"+`{"caller":"b","model":"m"}`+"\n"), 0o600)
+	records, err := ReadUsage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].KeyID != "key_1" || records[0].InputTokens != 1 || records[1].Caller != "b" {
+		t.Errorf("records = %+v", records)
+	}
+
+	os.WriteFile(path, []byte(`{"caller":"a"}`+"\n{\n"), 0o600)
+	if _, err := ReadUsage(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("ReadUsage() of a broken file error = %v, want the line number", err)
+	}
+}
+
+func TestUsageRecordsKeyID(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := KeyFile{Path: filepath.Join(dir, "keys.json")}
+	stored, record, err := keyFile.Create("backend", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usageFile := filepath.Join(dir, "usage.jsonl")
+
+	// Both environment keys end in the same characters, so they share a fingerprint
+	p := newTestProxy(t, Config{
+		AllowedAPIKeys:  []string{"first-key-abcd", "second-key-abcd"},
+		KeyStoreFile:    keyFile.Path,
+		UpstreamAPIKey:  "upstream-key",
+		TokenSigningKey: testSigningKey,
+		UsageFile:       usageFile,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"type":"message","usage":{"input_tokens":3,"output_tokens":5}}`)
+	})
+	token := mintToken(t, p, stored, `{"models":["claude-x"]}`)
+
+	body := `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`
+	for _, credential := range []string{"first-key-abcd", "second-key-abcd", stored, token} {
+		if w := serve(p, "POST", "/v1/messages", body, map[string]string{"x-api-key": credential}); w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+	}
+	p.usage.close()
+
+	records, err := ReadUsage(usageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("%d usage records, want 4", len(records))
+	}
+	if records[0].Caller != records[1].Caller || records[0].KeyID == "" || records[0].KeyID == records[1].KeyID {
+		t.Errorf("environment keys recorded as %s/%s and %s/%s, want one fingerprint and two key IDs",
+			records[0].Caller, records[0].KeyID, records[1].Caller, records[1].KeyID)
+	}
+	if records[2].KeyID != record.ID || records[3].KeyID != record.ID {
+		t.Errorf("key store key and its token recorded key IDs %q and %q, want %q", records[2].KeyID, records[3].KeyID, record.ID)
+	}
+	if records[3].Caller == records[2].Caller || records[3].InputTokens != 3 || records[3].OutputTokens != 5 {
+		t.Errorf("token record = %+v", records[3])
+	}
+}
@@ -0,0 +1,180 @@
+package prxy
+
+import (
+	"fmt"
+	"math"
+)
+
+// Default maximum request body size if none is configured (matches the Messages API limit)
+const defaultMaxRequestBodyBytes = 32 << 20
+
+// Valid message roles
+var messageRoles = map[string]bool{
+	"user":      true,
+	"assistant": true,
+}
+
+// Known content block types and the fields each one requires. Other types, such as those of
+// newer server tools, are passed on for the Claude API to check.
+var contentBlockFields = map[string][]string{
+	"text":                   {"text"},
+	"image":                  {"source"},
+	"document":               {"source"},
+	"search_result":          {"source", "title", "content"},
+	"tool_use":               {"id", "name", "input"},
+	"tool_result":            {"tool_use_id"},
+	"server_tool_use":        {"id", "name", "input"},
+	"web_search_tool_result": {"tool_use_id", "content"},
+	"thinking":               {"thinking", "signature"},
+	"redacted_thinking":      {"data"},
+	"container_upload":       {"file_id"},
+}
+
+// validationError is a problem with a request body at a JSON path such as "messages.0.content"
+type validationError struct {
+	path    string
+	message string
+}
+
+func (e *validationError) Error() string {
+	if e.path == "" {
+		return e.message
+	}
+	return e.path + ": " + e.message
+}
+
+// validateMessagesRequest checks the structure of a Messages API request body
+func validateMessagesRequest(requestData map[string]interface{}) error {
+	model, exists := requestData["model"]
+	if !exists {
+		return &validationError{"model", "Field required"}
+	}
+	if s, ok := model.(string); !ok || s == "" {
+		return &validationError{"model", "Input should be a non-empty string"}
+	}
+
+	maxTokens, exists := requestData["max_tokens"]
+	if !exists {
+		return &validationError{"max_tokens", "Field required"}
+	}
+	if n, ok := maxTokens.(float64); !ok || n < 1 || n != math.Trunc(n) {
+		return &validationError{"max_tokens", "Input should be a positive integer"}
+	}
+
+	if stream, exists := requestData["stream"]; exists {
+		if _, ok := stream.(bool); !ok {
+			return &validationError{"stream", "Input should be a valid boolean"}
+		}
+	}
+
+	if system, exists := requestData["system"]; exists {
+		if err := validateSystem(system); err != nil {
+			return err
+		}
+	}
+
+	messages, exists := requestData["messages"]
+	if !exists {
+		return &validationError{"messages", "Field required"}
+	}
+	list, ok := messages.([]interface{})
+	if !ok {
+		return &validationError{"messages", "Input should be a valid list"}
+	}
+	if len(list) == 0 {
+		return &validationError{"messages", "List should have at least 1 item"}
+	}
+	for i, message := range list {
+		if err := validateMessage(fmt.Sprintf("messages.%d", i), message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateSystem checks a system prompt, which is a string or a list of text blocks
+func validateSystem(system interface{}) error {
+	switch v := system.(type) {
+	case string:
+		return nil
+	case []interface{}:
+		for i, block := range v {
+			path := fmt.Sprintf("system.%d", i)
+			if err := validateContentBlock(path, block); err != nil {
+				return err
+			}
+			if block.(map[string]interface{})["type"] != "text" {
+				return &validationError{path + ".type", "Input should be 'text'"}
+			}
+		}
+		return nil
+	default:
+		return &validationError{"system", "Input should be a valid string or list of text blocks"}
+	}
+}
+
+// validateMessage checks a single message's role and content
+func validateMessage(path string, message interface{}) error {
+	m, ok := message.(map[string]interface{})
+	if !ok {
+		return &validationError{path, "Input should be a valid object"}
+	}
+
+	role, exists := m["role"]
+	if !exists {
+		return &validationError{path + ".role", "Field required"}
+	}
+	if s, ok := role.(string); !ok || !messageRoles[s] {
+		return &validationError{path + ".role", "Input should be 'user' or 'assistant'"}
+	}
+
+	content, exists := m["content"]
+	if !exists {
+		return &validationError{path + ".content", "Field required"}
+	}
+	switch v := content.(type) {
+	case string:
+		return nil
+	case []interface{}:
+		for i, block := range v {
+			if err := validateContentBlock(fmt.Sprintf("%s.content.%d", path, i), block); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return &validationError{path + ".content", "Input should be a valid string or list of content blocks"}
+	}
+}
+
+// validateContentBlock checks that a content block has a type and, for known types, their
+// required fields
+func validateContentBlock(path string, block interface{}) error {
+	b, ok := block.(map[string]interface{})
+	if !ok {
+		return &validationError{path, "Input should be a valid object"}
+	}
+
+	blockType, exists := b["type"]
+	if !exists {
+		return &validationError{path + ".type", "Field required"}
+	}
+	typeName, _ := blockType.(string)
+	if typeName == "" {
+		return &validationError{path + ".type", "Input should be a non-empty string"}
+	}
+
+	for _, field := range contentBlockFields[typeName] {
+		if _, exists := b[field]; !exists {
+			return &validationError{path + "." + field, "Field required"}
+		}
+	}
+	if typeName == "text" {
+		if _, ok := b["text"].(string); !ok {
+			return &validationError{path + ".text", "Input should be a valid string"}
+		}
+	}
+
+	return nil
+}
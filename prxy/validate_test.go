@@ -0,0 +1,119 @@
+package prxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateMessagesRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "minimal", body: `{"model":"m","max_tokens":1,"messages":[{"role":"user","content":"hi"}]}`},
+		{name: "missing model", body: `{"max_tokens":1,"messages":[{"role":"user","content":"hi"}]}`, wantErr: "model: Field required"},
+		{name: "empty model", body: `{"model":"","max_tokens":1,"messages":[]}`, wantErr: "model: Input should be a non-empty string"},
+		{name: "missing max_tokens", body: `{"model":"m","messages":[]}`, wantErr: "max_tokens: Field required"},
+		{name: "zero max_tokens", body: `{"model":"m","max_tokens":0,"messages":[]}`, wantErr: "max_tokens: Input should be a positive integer"},
+		{name: "fractional max_tokens", body: `{"model":"m","max_tokens":1.5,"messages":[]}`, wantErr: "max_tokens: Input should be a positive integer"},
+		{name: "string stream", body: `{"model":"m","max_tokens":1,"stream":"yes","messages":[]}`, wantErr: "stream: Input should be a valid boolean"},
+		{name: "missing messages", body: `{"model":"m","max_tokens":1}`, wantErr: "messages: Field required"},
+		{name: "empty messages", body: `{"model":"m","max_tokens":1,"messages":[]}`, wantErr: "messages: List should have at least 1 item"},
+		{name: "bad role", body: `{"model":"m","max_tokens":1,"messages":[{"role":"system","content":"hi"}]}`, wantErr: "messages.0.role"},
+		{name: "missing content", body: `{"model":"m","max_tokens":1,"messages":[{"role":"user"}]}`, wantErr: "messages.0.content: Field required"},
+		{name: "numeric content", body: `{"model":"m","max_tokens":1,"messages":[{"role":"user","content":1}]}`, wantErr: "messages.0.content: Input should be"},
+		{name: "system string", body: `{"model":"m","max_tokens":1,"system":"be brief","messages":[{"role":"user","content":"hi"}]}`},
+		{name: "system blocks", body: `{"model":"m","max_tokens":1,"system":[{"type":"text","text":"be brief"}],"messages":[{"role":"user","content":"hi"}]}`},
+		{name: "system image", body: `{"model":"m","max_tokens":1,"system":[{"type":"image","source":{}}],"messages":[{"role":"user","content":"hi"}]}`, wantErr: "system.0.type: Input should be 'text'"},
+		{
+			name:    "block without type",
+			body:    `{"model":"m","max_tokens":1,"messages":[{"role":"user","content":[{"text":"hi"}]}]}`,
+			wantErr: "messages.0.content.0.type: Field required",
+		},
+		{
+			name:    "block with empty type",
+			body:    `{"model":"m","max_tokens":1,"messages":[{"role":"user","content":[{"type":""}]}]}`,
+			wantErr: "messages.0.content.0.type: Input should be a non-empty string",
+		},
+		{
+			name:    "tool_use without input",
+			body:    `{"model":"m","max_tokens":1,"messages":[{"role":"assistant","content":[{"type":"tool_use","id":"t","name":"n"}]}]}`,
+			wantErr: "messages.0.content.0.input: Field required",
+		},
+		{
+			name:    "text that is not a string",
+			body:    `{"model":"m","max_tokens":1,"messages":[{"role":"user","content":[{"type":"text","text":1}]}]}`,
+			wantErr: "messages.0.content.0.text: Input should be a valid string",
+		},
+		{
+			name: "tool round trip",
+			body: `{"model":"m","max_tokens":1,"messages":[{"role":"user","content":"hi"},` +
+				`{"role":"assistant","content":[{"type":"tool_use","id":"t","name":"n","input":{}}]},` +
+				`{"role":"user","content":[{"type":"tool_result","tool_use_id":"t","content":"ok"}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var request map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.body), &request); err != nil {
+				t.Fatal(err)
+			}
+			err := validateMessagesRequest(request)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateMessagesRequest() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateUnknownBlockTypesPassThrough(t *testing.T) {
+	// Server tool results that clients echo back, including types added after this proxy
+	for _, blockType := range []string{
+		"web_fetch_tool_result",
+		"code_execution_tool_result",
+		"bash_code_execution_tool_result",
+		"mcp_tool_use",
+		"mcp_tool_result",
+		"some_future_block",
+	} {
+		body := `{"model":"m","max_tokens":1,"messages":[{"role":"assistant","content":[{"type":"` + blockType + `","tool_use_id":"t"}]}]}`
+		var request map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &request); err != nil {
+			t.Fatal(err)
+		}
+		if err := validateMessagesRequest(request); err != nil {
+			t.Errorf("%s: %v", blockType, err)
+		}
+	}
+}
+
+func TestBodySizeLimits(t *testing.T) {
+	p := newTestProxy(t, Config{
+		AllowedAPIKeys:      []string{"client-key"},
+		UpstreamAPIKey:      "upstream-key",
+		TokenSigningKey:     testSigningKey,
+		MaxRequestBodyBytes: 1024,
+	}, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"type":"message"}`)) })
+	header := map[string]string{"x-api-key": "client-key"}
+	padding := strings.Repeat("x", 2048)
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"message within limit", "/v1/messages", `{"model":"m","max_tokens":1,"messages":[{"role":"user","content":"hi"}]}`, http.StatusOK},
+		{"message over limit", "/v1/messages", `{"model":"m","max_tokens":1,"messages":[{"role":"user","content":"` + padding + `"}]}`, http.StatusRequestEntityTooLarge},
+		{"token request within limit", "/v1/tokens", `{"models":["m"]}`, http.StatusOK},
+		{"token request over limit", "/v1/tokens", `{"models":["` + padding + `"]}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		if w := serve(p, "POST", tt.path, tt.body, header); w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+}
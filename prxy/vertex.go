@@ -0,0 +1,195 @@
+package prxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Vertex AI request constants
+const (
+	vertexAnthropicVersion = "vertex-2023-10-16"
+	// Largest Vertex AI error body that is read
+	maxVertexErrorBytes = 1 << 20
+)
+
+// vertexProvider sends Messages requests to the Anthropic publisher models on Vertex AI,
+// authenticated with access tokens for a service account
+type vertexProvider struct {
+	logger
+	endpoint string
+	project  string
+	region   string
+	tokens   *serviceAccountTokens
+	models   map[string]string
+}
+
+// newVertexProvider checks the Vertex AI configuration, loads the service account key and
+// fills in the defaults
+func newVertexProvider(cfg VertexConfig, l logger) (*vertexProvider, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	tokens, err := loadServiceAccount(cfg.CredentialsFile, cfg.TokenURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Vertex AI credentials: %w", err)
+	}
+	endpoint := strings.TrimSuffix(cfg.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = "https://" + cfg.Region + "-aiplatform.googleapis.com"
+		if cfg.Region == "global" {
+			endpoint = "https://aiplatform.googleapis.com"
+		}
+	}
+	return &vertexProvider{
+		logger:   l,
+		endpoint: endpoint,
+		project:  cfg.ProjectID,
+		region:   cfg.Region,
+		tokens:   tokens,
+		models:   cfg.Models,
+	}, nil
+}
+
+// validate checks that the Vertex AI settings are complete, without reading the key file
+func (cfg VertexConfig) validate() error {
+	if cfg.Region == "" || cfg.ProjectID == "" {
+		return fmt.Errorf("Vertex AI needs a region and a project ID")
+	}
+	if cfg.CredentialsFile == "" {
+		return fmt.Errorf("Vertex AI needs a service account key file")
+	}
+	return nil
+}
+
+func (v *vertexProvider) baseURL() string {
+	return v.endpoint
+}
+
+// modelID returns the Vertex AI model ID for a Claude API model name, which is the name itself
+// unless a mapping is configured
+func (v *vertexProvider) modelID(model string) string {
+	if id, ok := v.models[model]; ok {
+		return id
+	}
+	return model
+}
+
+// send rewrites a Messages request for Vertex AI, which takes the model in the URL and the API
+// version in the body. Responses are already in the Claude API format, apart from errors
+// reported by Google Cloud itself.
+func (v *vertexProvider) send(client *http.Client, req *http.Request) (*http.Response, error) {
+	requestID := RequestIDFromContext(req.Context())
+	request, errResp, err := readProviderRequest(req)
+	if request == nil {
+		return errResp, err
+	}
+	modelID := v.modelID(request.model)
+	delete(request.fields, "model")
+	request.setDefault("anthropic_version", vertexAnthropicVersion)
+	vertexBody, err := json.Marshal(request.fields)
+	if err != nil {
+		return nil, err
+	}
+
+	method := "rawPredict"
+	if request.stream {
+		method = "streamRawPredict"
+	}
+	vertexURL := fmt.Sprintf("%s/v1/projects/%s/locations/%s/publishers/anthropic/models/%s:%s",
+		v.endpoint, url.PathEscape(v.project), url.PathEscape(v.region), url.PathEscape(modelID), method)
+	v.logRequest(requestID, "Forwarding request to Vertex AI model %s at %s", modelID, vertexURL)
+
+	token, err := v.tokens.accessToken(req.Context(), client)
+	if err != nil {
+		v.write(LogError, requestID, "Failed to get a Vertex AI access token: %v", err)
+		return errorResponse(req, http.StatusInternalServerError, errorTypeAPI, "Failed to authenticate with Vertex AI"), nil
+	}
+
+	vertexReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, vertexURL, bytes.NewReader(vertexBody))
+	if err != nil {
+		return nil, err
+	}
+	// Client credentials are never sent to Vertex AI, but the betas and trace context are
+	vertexReq.Header.Set("Content-Type", "application/json")
+	vertexReq.Header.Set("Authorization", "Bearer "+token)
+	for _, name := range []string{"anthropic-beta", "traceparent"} {
+		if values := req.Header.Values(name); len(values) > 0 {
+			vertexReq.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	resp, err := client.Do(vertexReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+
+	// Errors from the model are in the Claude API format, and errors from Google Cloud are
+	// converted to it
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxVertexErrorBytes))
+	var anthropicErr apiErrorResponse
+	if json.Unmarshal(data, &anthropicErr) == nil && anthropicErr.Type == "error" {
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		return resp, nil
+	}
+	status, message := googleError(data)
+	errorType, code := vertexErrorType(status, resp.StatusCode)
+	if resp.StatusCode == http.StatusUnauthorized || status == "PERMISSION_DENIED" || status == "UNAUTHENTICATED" {
+		v.tokens.invalidate(token)
+		v.write(LogError, requestID, "Vertex AI rejected the service account: %s", message)
+		message = "Vertex AI rejected the proxy's credentials"
+	}
+	if message == "" {
+		message = http.StatusText(resp.StatusCode)
+	}
+	return errorResponse(req, code, errorType, message), nil
+}
+
+// googleError reads the status and message of a Google Cloud error body, which may be wrapped
+// in an array
+func googleError(data []byte) (string, string) {
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &body) != nil {
+		var bodies []json.RawMessage
+		if json.Unmarshal(data, &bodies) == nil && len(bodies) > 0 {
+			json.Unmarshal(bodies[0], &body)
+		}
+	}
+	return body.Error.Status, body.Error.Message
+}
+
+// vertexErrorType returns the Claude API error type and status for a Google Cloud error
+// status, falling back to the HTTP status. Rejected credentials are the proxy's fault.
+func vertexErrorType(status string, code int) (string, int) {
+	switch status {
+	case "INVALID_ARGUMENT", "FAILED_PRECONDITION", "OUT_OF_RANGE":
+		return errorTypeInvalidRequest, http.StatusBadRequest
+	case "NOT_FOUND":
+		return errorTypeNotFound, http.StatusNotFound
+	case "RESOURCE_EXHAUSTED":
+		return errorTypeRateLimit, http.StatusTooManyRequests
+	case "UNAVAILABLE":
+		return errorTypeOverloaded, statusForErrorType(errorTypeOverloaded)
+	case "DEADLINE_EXCEEDED":
+		return errorTypeAPI, http.StatusGatewayTimeout
+	case "PERMISSION_DENIED", "UNAUTHENTICATED":
+		return errorTypeAPI, http.StatusInternalServerError
+	}
+	if code == http.StatusUnauthorized {
+		return errorTypeAPI, http.StatusInternalServerError
+	}
+	return errorTypeForStatus(code)
+}
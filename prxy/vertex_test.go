@@ -0,0 +1,230 @@
+package prxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newVertexTestProxy returns a proxy that sends Messages requests to a stand-in for Vertex AI,
+// with access tokens from a stand-in token endpoint
+func newVertexTestProxy(t *testing.T, vertex http.HandlerFunc) (*Proxy, *testTokenEndpoint) {
+	t.Helper()
+	path, key := writeServiceAccountKey(t, "", false)
+	endpoint := &testTokenEndpoint{key: &key.PublicKey, expiresIn: 3600}
+	tokenServer := httptest.NewServer(endpoint)
+	t.Cleanup(tokenServer.Close)
+	server := httptest.NewServer(vertex)
+	t.Cleanup(server.Close)
+	p := newTestProxy(t, Config{
+		AllowedAPIKeys:   []string{"client-key"},
+		UpstreamProvider: ProviderVertex,
+		Vertex: &VertexConfig{
+			Region:          "us-east5",
+			ProjectID:       "my-project",
+			Endpoint:        server.URL,
+			CredentialsFile: path,
+			TokenURL:        tokenServer.URL + "/token",
+			Models:          map[string]string{"claude-mapped": "claude-mapped@20250929"},
+		},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Messages request sent to the Claude API: %s", r.URL)
+	})
+	return p, endpoint
+}
+
+func TestVertexProvider(t *testing.T) {
+	path, _ := writeServiceAccountKey(t, "", false)
+	tests := []struct {
+		region string
+		want   string
+	}{
+		{"us-east5", "https://us-east5-aiplatform.googleapis.com"},
+		{"global", "https://aiplatform.googleapis.com"},
+	}
+	for _, tt := range tests {
+		v, err := newVertexProvider(VertexConfig{Region: tt.region, ProjectID: "p", CredentialsFile: path}, logger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.baseURL() != tt.want {
+			t.Errorf("baseURL() in %s = %s, want %s", tt.region, v.baseURL(), tt.want)
+		}
+	}
+
+	for _, cfg := range []VertexConfig{
+		{ProjectID: "p", CredentialsFile: path},
+		{Region: "us-east5", CredentialsFile: path},
+		{Region: "us-east5", ProjectID: "p"},
+	} {
+		if _, err := newVertexProvider(cfg, logger{}); err == nil {
+			t.Errorf("newVertexProvider(%+v) succeeded", cfg)
+		}
+	}
+	if _, err := newVertexProvider(VertexConfig{Region: "us-east5", ProjectID: "p", CredentialsFile: path + ".missing"}, logger{}); err == nil ||
+		!strings.Contains(err.Error(), "invalid Vertex AI credentials") {
+		t.Errorf("newVertexProvider() with a missing key file error = %v", err)
+	}
+}
+
+func TestVertexRawPredict(t *testing.T) {
+	var got *http.Request
+	var gotBody map[string]interface{}
+	p, endpoint := newVertexTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"msg_1","type":"message","usage":{"input_tokens":1,"output_tokens":1}}`)
+	})
+
+	header := map[string]string{
+		"x-api-key":         "client-key",
+		"anthropic-version": "2023-06-01",
+		"anthropic-beta":    "beta-1",
+		"traceparent":       "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	}
+	for i := 0; i < 2; i++ {
+		w := serve(p, "POST", "/v1/messages", `{"model":"claude-mapped","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`, header)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+	}
+	if n := atomic.LoadInt32(&endpoint.exchanges); n != 1 {
+		t.Errorf("%d token exchanges for two requests, want 1", n)
+	}
+
+	if got.URL.EscapedPath() != "/v1/projects/my-project/locations/us-east5/publishers/anthropic/models/claude-mapped@20250929:rawPredict" {
+		t.Errorf("path = %s", got.URL.EscapedPath())
+	}
+	if got.Header.Get("Authorization") != "Bearer token-1" || got.Header.Get("x-api-key") != "" || got.Header.Get("anthropic-version") != "" {
+		t.Errorf("credentials = %q, x-api-key %q, anthropic-version %q",
+			got.Header.Get("Authorization"), got.Header.Get("x-api-key"), got.Header.Get("anthropic-version"))
+	}
+	if got.Header.Get("anthropic-beta") != "beta-1" || got.Header.Get("traceparent") == "" {
+		t.Errorf("headers = %v", got.Header)
+	}
+	body, _ := json.Marshal(gotBody)
+	if want := `{"anthropic_version":"vertex-2023-10-16","max_tokens":10,"messages":[{"content":"hi","role":"user"}]}`; string(body) != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+}
+
+func TestVertexStreamRawPredict(t *testing.T) {
+	stream := sseEvents(`{"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":1,"output_tokens":1}}}`, `{"type":"message_stop"}`)
+	var gotPath string
+	var gotBody map[string]interface{}
+	p, _ := newVertexTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, stream)
+	})
+
+	w := serve(p, "POST", "/v1/messages", `{"model":"claude-x","max_tokens":10,"stream":true,"anthropic_version":"vertex-2099-01-01","messages":[{"role":"user","content":"hi"}]}`,
+		map[string]string{"x-api-key": "client-key"})
+	if w.Code != http.StatusOK || w.Body.String() != stream {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if gotPath != "/v1/projects/my-project/locations/us-east5/publishers/anthropic/models/claude-x:streamRawPredict" {
+		t.Errorf("path = %s", gotPath)
+	}
+	// Streaming stays in the body, and a version the client chose is kept
+	if gotBody["stream"] != true || gotBody["anthropic_version"] != "vertex-2099-01-01" || gotBody["model"] != nil {
+		t.Errorf("body = %v", gotBody)
+	}
+}
+
+func TestVertexErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		wantStatus  int
+		wantType    string
+		wantMessage string
+		wantRefresh bool
+	}{
+		{
+			// Errors from the model are passed through as they are
+			name: "model error", status: http.StatusBadRequest,
+			body:       `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: Field required"}}`,
+			wantStatus: http.StatusBadRequest, wantType: errorTypeInvalidRequest, wantMessage: "max_tokens: Field required",
+		},
+		{
+			name: "quota", status: http.StatusTooManyRequests,
+			body:       `{"error":{"code":429,"message":"Quota exceeded","status":"RESOURCE_EXHAUSTED"}}`,
+			wantStatus: http.StatusTooManyRequests, wantType: errorTypeRateLimit, wantMessage: "Quota exceeded",
+		},
+		{
+			name: "wrapped in an array", status: http.StatusNotFound,
+			body:       `[{"error":{"code":404,"message":"Publisher model not found","status":"NOT_FOUND"}}]`,
+			wantStatus: http.StatusNotFound, wantType: errorTypeNotFound, wantMessage: "Publisher model not found",
+		},
+		{
+			name: "unavailable", status: http.StatusServiceUnavailable,
+			body:       `{"error":{"code":503,"message":"The service is currently unavailable","status":"UNAVAILABLE"}}`,
+			wantStatus: statusForErrorType(errorTypeOverloaded), wantType: errorTypeOverloaded, wantMessage: "The service is currently unavailable",
+		},
+		{
+			// The proxy's own credentials are not the client's problem, and the token is replaced
+			name: "permission denied", status: http.StatusForbidden,
+			body:       `{"error":{"code":403,"message":"Permission denied on resource project my-project","status":"PERMISSION_DENIED"}}`,
+			wantStatus: http.StatusInternalServerError, wantType: errorTypeAPI, wantMessage: "Vertex AI rejected the proxy's credentials", wantRefresh: true,
+		},
+		{
+			name: "unauthorized", status: http.StatusUnauthorized, body: "Unauthorized",
+			wantStatus: http.StatusInternalServerError, wantType: errorTypeAPI, wantMessage: "Vertex AI rejected the proxy's credentials", wantRefresh: true,
+		},
+		{
+			name: "not JSON", status: http.StatusBadGateway, body: "<html>",
+			wantStatus: http.StatusInternalServerError, wantType: errorTypeAPI, wantMessage: "Bad Gateway",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, endpoint := newVertexTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			})
+			for i := 0; i < 2; i++ {
+				w := serve(p, "POST", "/v1/messages", `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`,
+					map[string]string{"x-api-key": "client-key"})
+				if w.Code != tt.wantStatus {
+					t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+				}
+				resp := decodeAPIError(t, w.Body.String())
+				if resp.Error.Type != tt.wantType || resp.Error.Message != tt.wantMessage {
+					t.Errorf("error = %+v, want %s %q", resp.Error, tt.wantType, tt.wantMessage)
+				}
+			}
+			want := int32(1)
+			if tt.wantRefresh {
+				want = 2
+			}
+			if n := atomic.LoadInt32(&endpoint.exchanges); n != want {
+				t.Errorf("%d token exchanges, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestVertexTokenFailure(t *testing.T) {
+	var requests int32
+	p, endpoint := newVertexTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	})
+	endpoint.reject = true
+
+	w := serve(p, "POST", "/v1/messages", `{"model":"claude-x","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`, map[string]string{"x-api-key": "client-key"})
+	if w.Code != http.StatusInternalServerError || atomic.LoadInt32(&requests) != 0 {
+		t.Fatalf("status = %d after %d requests to Vertex AI", w.Code, atomic.LoadInt32(&requests))
+	}
+	if resp := decodeAPIError(t, w.Body.String()); resp.Error.Message != "Failed to authenticate with Vertex AI" {
+		t.Errorf("error = %+v", resp.Error)
+	}
+}